@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	store "kvstore/internal/kv"
+	"kvstore/internal/wal"
+	"kvstore/utils"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+// Counter routes under /api/v1/keys/{key}/incr, /decr and /incrby.
+// Counters are decimal values, a missing key starts at 0.
+
+type CounterBody struct {
+	// Delta is only read by INCRBY
+	Delta int64 `json:"delta"`
+	// TTL in seconds for a counter that does not exist yet, existing counters keep their expiry
+	TTL int64 `json:"ttl"`
+}
+
+type CounterResponse struct {
+	Key     string `json:"key"`
+	Value   int64  `json:"value"`
+	Version int    `json:"version"`
+}
+
+func (app *App) Incr(rw http.ResponseWriter, r *http.Request) {
+	app.counterRecord(rw, r, "INCR")
+}
+
+func (app *App) Decr(rw http.ResponseWriter, r *http.Request) {
+	app.counterRecord(rw, r, "DECR")
+}
+
+func (app *App) IncrBy(rw http.ResponseWriter, r *http.Request) {
+	app.counterRecord(rw, r, "INCRBY")
+}
+
+func (app *App) counterRecord(rw http.ResponseWriter, r *http.Request, op string) {
+	var body CounterBody
+	// The body is optional for INCR and DECR
+	if r.ContentLength != 0 {
+		if err := utils.ExtractBody(r, &body); err != nil {
+			http.Error(rw, "Failed to extract body", http.StatusBadRequest)
+			return
+		}
+	}
+	if body.TTL < 0 {
+		http.Error(rw, "TTL cannot be negative", http.StatusBadRequest)
+		return
+	}
+
+	ns := namespaceFromRequest(r)
+	if body.TTL == 0 {
+		body.TTL = ns.DefaultTTL
+	}
+	key := chi.URLParam(r, "key")
+	entry := wal.WAL{
+		Type:      op,
+		Namespace: ns.Name,
+		Key:       store.NamespacedKey(ns.Name, key),
+		Delta:     body.Delta,
+		TTL:       body.TTL,
+		Timestamp: time.Now().UnixNano(),
+	}
+	if op != "INCRBY" {
+		entry.Delta = 0
+	}
+
+	if app.ElectionManager.IsLeader {
+		unlock := app.StoreManager.LockKeys(entry.Key)
+		defer unlock()
+
+		// The increment is checked before the prepare phase, followers then apply it without surprises
+		if !app.checkCounter(rw, entry) {
+			return
+		}
+
+		committed, ok := app.commitWrite(rw, entry)
+		if !ok {
+			return
+		}
+
+		value, err := app.StoreManager.Store.Get(committed.Key)
+		if err != nil {
+			http.Error(rw, "Failed to get value", http.StatusInternalServerError)
+			return
+		}
+		counter, err := strconv.ParseInt(string(value), 10, 64)
+		if err != nil {
+			http.Error(rw, "Failed to read counter", http.StatusInternalServerError)
+			return
+		}
+
+		rw.Header().Set("ETag", formatETag(committed.Version))
+		if err := utils.WriteJSON(rw, CounterResponse{Key: key, Value: counter, Version: committed.Version}); err != nil {
+			http.Error(rw, "Failed to write JSON response", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	http.Error(rw, "UnAuthorized action(POST) for a follower ... ", http.StatusForbidden)
+}
+
+// checkCounter answers with 409 when the key does not hold an integer or the increment would overflow
+func (app *App) checkCounter(rw http.ResponseWriter, entry wal.WAL) bool {
+	_, err := app.StoreManager.NextCounterValue(entry.Key, store.CounterDelta(entry))
+	if errors.Is(err, store.ErrNotInteger) || errors.Is(err, store.ErrCounterOverflow) {
+		http.Error(rw, err.Error(), http.StatusConflict)
+		return false
+	}
+	if err != nil {
+		http.Error(rw, "Failed to read counter", http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	store "kvstore/internal/kv"
+	"kvstore/internal/wal"
+	"kvstore/utils"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+// Document routes under /api/v1/docs/{key}.
+// PUT stores a validated JSON document, PATCH changes part of it and GET can return a sub-path.
+// Only the patch goes through 2PC, every replica applies it to its own copy of the document.
+
+const contentTypeJSONPatch = "application/json-patch+json"
+
+// PathSetBody is the simple alternative to JSON Patch: values to set and paths to remove.
+// Paths are JSON Pointers, missing parent objects are created by set.
+type PathSetBody struct {
+	Set    map[string]json.RawMessage `json:"set"`
+	Remove []string                   `json:"remove"`
+}
+
+type PatchResponse struct {
+	Version int `json:"version"`
+}
+
+// PutDocument stores the request body as a document, the optional ttl query parameter is in seconds
+func (app *App) PutDocument(rw http.ResponseWriter, r *http.Request) {
+	value, err := io.ReadAll(http.MaxBytesReader(rw, r.Body, maxRawValueSize))
+	if err != nil {
+		http.Error(rw, "Failed to read body", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err := store.ValidateDocument(value); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var ttl int64
+	if rawTTL := r.URL.Query().Get("ttl"); rawTTL != "" {
+		ttl, err = strconv.ParseInt(rawTTL, 10, 64)
+		if err != nil {
+			http.Error(rw, "Invalid ttl", http.StatusBadRequest)
+			return
+		}
+	}
+
+	cond, err := conditionFromHeaders(r)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	app.putRecord(rw, namespaceFromRequest(r), chi.URLParam(r, "key"), value, store.ContentTypeJSON, ttl, cond)
+}
+
+// GetDocument returns the document, or the part of it at the JSON Pointer given in the path query parameter
+func (app *App) GetDocument(rw http.ResponseWriter, r *http.Request) {
+	if app.ElectionManager.IsLeader {
+		http.Error(rw, "UnAuthorized action(GET) for a leader ... ", http.StatusForbidden)
+		return
+	}
+
+	ns := namespaceFromRequest(r)
+	key := store.NamespacedKey(ns.Name, chi.URLParam(r, "key"))
+	part, current, err := app.StoreManager.Document(key, r.URL.Query().Get("path"))
+	if !checkDocumentErr(rw, err) {
+		return
+	}
+
+	rw.Header().Set("ETag", formatETag(current.Version))
+	rw.Header().Set("Content-Type", store.ContentTypeJSON)
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(part)
+}
+
+// PatchDocument applies a JSON Patch (Content-Type application/json-patch+json) or a PathSetBody.
+// If-Match makes the patch conditional on the version of the document.
+func (app *App) PatchDocument(rw http.ResponseWriter, r *http.Request) {
+	var ops []store.PatchOp
+	if strings.HasPrefix(r.Header.Get("Content-Type"), contentTypeJSONPatch) {
+		if err := utils.ExtractBody(r, &ops); err != nil {
+			http.Error(rw, "Failed to extract body", http.StatusBadRequest)
+			return
+		}
+	} else {
+		var body PathSetBody
+		if err := utils.ExtractBody(r, &body); err != nil {
+			http.Error(rw, "Failed to extract body", http.StatusBadRequest)
+			return
+		}
+		ops = pathSetOps(body)
+	}
+	if len(ops) == 0 {
+		http.Error(rw, "Patch has no operations", http.StatusBadRequest)
+		return
+	}
+	patch, err := json.Marshal(ops)
+	if err != nil {
+		http.Error(rw, "Failed to encode patch", http.StatusInternalServerError)
+		return
+	}
+
+	cond, err := conditionFromHeaders(r)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ns := namespaceFromRequest(r)
+	entry := wal.WAL{
+		Type:        "PATCH",
+		Namespace:   ns.Name,
+		Key:         store.NamespacedKey(ns.Name, chi.URLParam(r, "key")),
+		Value:       patch,
+		ContentType: contentTypeJSONPatch,
+		Timestamp:   time.Now().UnixNano(),
+	}
+
+	if app.ElectionManager.IsLeader {
+		unlock := app.StoreManager.LockKeys(entry.Key)
+		defer unlock()
+
+		if cond != nil && !app.checkCondition(rw, ns, entry.Key, *cond) {
+			return
+		}
+		// The patch is tried on the leader first so that a failing patch never reaches the WAL
+		if !checkDocumentErr(rw, app.StoreManager.CheckPatch(entry)) {
+			return
+		}
+
+		committed, ok := app.commitWrite(rw, entry)
+		if !ok {
+			return
+		}
+		rw.Header().Set("ETag", formatETag(committed.Version))
+		if err := utils.WriteJSON(rw, PatchResponse{Version: committed.Version}); err != nil {
+			http.Error(rw, "Failed to write JSON response", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	http.Error(rw, "UnAuthorized action(PATCH) for a follower ... ", http.StatusForbidden)
+}
+
+// pathSetOps turns a PathSetBody into patch operations, sets are sorted by path so the order is stable
+func pathSetOps(body PathSetBody) []store.PatchOp {
+	paths := make([]string, 0, len(body.Set))
+	for path := range body.Set {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	ops := make([]store.PatchOp, 0, len(paths)+len(body.Remove))
+	for _, path := range paths {
+		ops = append(ops, store.PatchOp{Op: "set", Path: path, Value: body.Set[path]})
+	}
+	for _, path := range body.Remove {
+		ops = append(ops, store.PatchOp{Op: "remove", Path: path})
+	}
+	return ops
+}
+
+// checkDocumentErr maps document and patch errors to a response, it returns false once the response is written
+func checkDocumentErr(rw http.ResponseWriter, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, store.ErrDocumentNotFound):
+		http.Error(rw, "Key not found", http.StatusNotFound)
+	case errors.Is(err, store.ErrWrongType):
+		http.Error(rw, "Key does not hold a JSON document", http.StatusConflict)
+	case errors.Is(err, store.ErrPatchTestFailed):
+		http.Error(rw, err.Error(), http.StatusConflict)
+	case errors.Is(err, store.ErrPathNotFound), errors.Is(err, store.ErrInvalidPatch), errors.Is(err, store.ErrInvalidDocument):
+		http.Error(rw, err.Error(), http.StatusUnprocessableEntity)
+	default:
+		http.Error(rw, "Failed to read document", http.StatusInternalServerError)
+	}
+	return false
+}
@@ -4,10 +4,109 @@ import "github.com/go-chi/chi"
 
 func (app *App) InitializeHandler() *chi.Mux {
 	R := app.Handler
+	// Nothing but the readiness probe is served until the WAL is replayed
+	R.Use(app.readinessGate)
 
-	// Add your routes here
-	R.Get("/api/v1/", app.ReadRecords)
-	R.Post("/api/v1/", app.WriteRecord)
+	R.Route("/api/v1", func(R chi.Router) {
+		R.Get("/ready", app.Ready)
+		// Replication routes used by the leader during 2PC
+		R.Post("/replicate/", app.WALWriter)
+		// Used by followers to reach the read quorum of a namespace
+		R.Post("/internal/read", app.PeerRead)
+		// Memory budget and eviction counters of this node
+		R.Get("/memory", app.GetMemoryStats)
+		// Snapshots of this replica, exports are served per namespace
+		R.Get("/snapshots", app.ListSnapshots)
+		R.Post("/snapshots", app.CreateSnapshot)
+		R.Delete("/snapshots/{id}", app.ReleaseSnapshot)
+
+		// Routes without a namespace work on the default namespace
+		R.Group(func(R chi.Router) {
+			R.Use(app.WithNamespace)
+			app.recordRoutes(R)
+		})
+
+		R.Route("/ns/{ns}", func(R chi.Router) {
+			R.Get("/config", app.GetNamespaceConfig)
+			R.Put("/config", app.PutNamespaceConfig)
+
+			R.Group(func(R chi.Router) {
+				R.Use(app.WithNamespace)
+				app.recordRoutes(R)
+			})
+		})
+	})
+	R.Post("/commit/", app.CommitTxn)
+	R.Post("/abort/", app.AbortTxn)
+	R.Get("/outcome/{version}", app.Outcome)
 
 	return R
 }
+
+// recordRoutes registers the data routes, both at the top level and under /ns/{ns}
+func (app *App) recordRoutes(R chi.Router) {
+	// Add your routes here
+	R.Get("/", app.ReadRecords)
+	R.Post("/", app.WriteRecord)
+	R.Delete("/", app.DeleteRecord)
+	R.Get("/scan", app.ScanRecords)
+
+	// Single key routes, conditional writes use If-Match / If-None-Match with the WAL version as ETag
+	R.Get("/keys/{key}", app.GetKey)
+	R.Put("/keys/{key}", app.PutKey)
+	R.Delete("/keys/{key}", app.DeleteKey)
+
+	// JSON documents, PATCH replicates only the patch
+	R.Get("/docs/{key}", app.GetDocument)
+	R.Put("/docs/{key}", app.PutDocument)
+	R.Patch("/docs/{key}", app.PatchDocument)
+	R.Delete("/docs/{key}", app.DeleteKey)
+
+	// Atomic counters, each one is its own WAL entry type
+	R.Post("/keys/{key}/incr", app.Incr)
+	R.Post("/keys/{key}/decr", app.Decr)
+	R.Post("/keys/{key}/incrby", app.IncrBy)
+
+	// Raw values, the body is the value and its Content-Type is stored with it
+	R.Get("/raw/{key}", app.GetRawKey)
+	R.Put("/raw/{key}", app.PutRawKey)
+	R.Delete("/raw/{key}", app.DeleteKey)
+
+	// Hashes, lists, sets and sorted sets, every operation is its own WAL entry type
+	R.Get("/hashes/{key}", app.GetHash)
+	R.Get("/hashes/{key}/fields/{field}", app.GetHashField)
+	R.Post("/hashes/{key}/hset", app.DataTypeWrite("HSET"))
+	R.Post("/hashes/{key}/hdel", app.DataTypeWrite("HDEL"))
+	R.Get("/lists/{key}", app.GetList)
+	R.Post("/lists/{key}/lpush", app.DataTypeWrite("LPUSH"))
+	R.Post("/lists/{key}/rpush", app.DataTypeWrite("RPUSH"))
+	R.Post("/lists/{key}/lpop", app.DataTypeWrite("LPOP"))
+	R.Post("/lists/{key}/rpop", app.DataTypeWrite("RPOP"))
+	R.Get("/sets/{key}", app.GetSet)
+	R.Get("/sets/{key}/members/{member}", app.GetSetMember)
+	R.Post("/sets/{key}/sadd", app.DataTypeWrite("SADD"))
+	R.Post("/sets/{key}/srem", app.DataTypeWrite("SREM"))
+	R.Get("/zsets/{key}", app.GetSortedSet)
+	R.Get("/zsets/{key}/rank/{member}", app.GetSortedSetRank)
+	R.Post("/zsets/{key}/zadd", app.DataTypeWrite("ZADD"))
+	R.Post("/zsets/{key}/zrem", app.DataTypeWrite("ZREM"))
+
+	// Secondary index lookups on the JSON values of the namespace
+	R.Get("/indexes/{index}", app.QueryIndex)
+
+	// Distributed locks with leases and fencing tokens
+	R.Get("/locks/{key}", app.GetLock)
+	R.Post("/locks/{key}/acquire", app.AcquireLock)
+	R.Post("/locks/{key}/renew", app.RenewLock)
+	R.Post("/locks/{key}/release", app.ReleaseLock)
+
+	// Change feed of committed mutations, as Server-Sent Events or over a WebSocket
+	R.Get("/watch", app.WatchSSE)
+	R.Get("/watch/ws", app.WatchWebSocket)
+
+	// Streams the keys of the namespace as seen by a snapshot
+	R.Get("/snapshots/{id}/export", app.ExportSnapshot)
+
+	// Multi-key transactions with read conditions
+	R.Post("/txn", app.Txn)
+}
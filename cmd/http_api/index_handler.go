@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	store "kvstore/internal/kv"
+	"kvstore/utils"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi"
+)
+
+type IndexQueryResponse struct {
+	Items []ScanItem `json:"items"`
+}
+
+// QueryIndex returns the keys and values whose indexed field equals eq, or lies between min and max (both included).
+// Results come in index order and are served from the local replica, like scans.
+func (app *App) QueryIndex(rw http.ResponseWriter, r *http.Request) {
+	ns := namespaceFromRequest(r)
+	query := r.URL.Query()
+
+	indexQuery := store.IndexQuery{
+		Eq:    query.Get("eq"),
+		Min:   query.Get("min"),
+		Max:   query.Get("max"),
+		Limit: defaultScanLimit,
+	}
+	if rawLimit := query.Get("limit"); rawLimit != "" {
+		parsed, err := strconv.Atoi(rawLimit)
+		if err != nil || parsed <= 0 {
+			http.Error(rw, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		indexQuery.Limit = min(parsed, maxScanLimit)
+	}
+
+	if !app.ElectionManager.IsLeader {
+		pairs, err := app.StoreManager.QueryIndex(ns.Name, chi.URLParam(r, "index"), indexQuery)
+		if errors.Is(err, store.ErrIndexNotFound) {
+			http.Error(rw, "Index not found", http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, store.ErrInvalidIndexQuery) {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(rw, "Failed to query index", http.StatusInternalServerError)
+			return
+		}
+
+		items := make([]ScanItem, len(pairs))
+		for i, pair := range pairs {
+			items[i] = ScanItem{
+				Key:         store.StripNamespace(ns.Name, pair.Key),
+				Value:       string(pair.Value),
+				ContentType: pair.ContentType,
+			}
+		}
+		if err := utils.WriteJSON(rw, IndexQueryResponse{Items: items}); err != nil {
+			http.Error(rw, "Failed to write JSON response", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	http.Error(rw, "UnAuthorized action(GET) for a leader ... ", http.StatusForbidden)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	store "kvstore/internal/kv"
+	"kvstore/utils"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi"
+)
+
+// Single key routes under /api/v1/keys/{key}.
+// The WAL version of a value is its ETag, If-Match and If-None-Match turn writes into conditional writes.
+
+type KeyRecordBody struct {
+	Value string `json:"value"`
+	// TTL in seconds, 0 means the key never expires
+	TTL         int64  `json:"ttl"`
+	ContentType string `json:"content_type,omitempty"`
+}
+
+type KeyRecordResponse struct {
+	Key         string `json:"key"`
+	Value       string `json:"value"`
+	ContentType string `json:"content_type,omitempty"`
+	Version     int    `json:"version"`
+}
+
+func formatETag(version int) string {
+	return `"` + strconv.Itoa(version) + `"`
+}
+
+func parseETag(etag string) (int, error) {
+	etag = strings.TrimPrefix(strings.TrimSpace(etag), "W/")
+	return strconv.Atoi(strings.Trim(etag, `"`))
+}
+
+// conditionFromHeaders builds a write condition out of If-Match and If-None-Match
+func conditionFromHeaders(r *http.Request) (*store.Condition, error) {
+	ifMatch := strings.TrimSpace(r.Header.Get("If-Match"))
+	ifNoneMatch := strings.TrimSpace(r.Header.Get("If-None-Match"))
+	if ifMatch == "" && ifNoneMatch == "" {
+		return nil, nil
+	}
+
+	cond := &store.Condition{}
+	if ifMatch == "*" {
+		cond.Exists = true
+	} else if ifMatch != "" {
+		version, err := parseETag(ifMatch)
+		if err != nil {
+			return nil, errors.New("If-Match must be * or a single version ETag")
+		}
+		cond.Version = &version
+	}
+
+	if ifNoneMatch == "*" {
+		cond.Absent = true
+	} else if ifNoneMatch != "" {
+		return nil, errors.New("If-None-Match only supports * on writes")
+	}
+	return cond, nil
+}
+
+func (app *App) GetKey(rw http.ResponseWriter, r *http.Request) {
+	ns := namespaceFromRequest(r)
+	key := chi.URLParam(r, "key")
+
+	if !app.ElectionManager.IsLeader {
+		results, err := app.readVersioned(ns, []string{store.NamespacedKey(ns.Name, key)})
+		if err != nil {
+			http.Error(rw, "Failed to get value", http.StatusInternalServerError)
+			return
+		}
+		current := results[0]
+		if !current.Found {
+			http.Error(rw, "Key not found", http.StatusNotFound)
+			return
+		}
+
+		etag := formatETag(current.Version)
+		rw.Header().Set("ETag", etag)
+		if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+			if version, err := parseETag(ifNoneMatch); err == nil && version == current.Version {
+				rw.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+
+		response := KeyRecordResponse{
+			Key:         key,
+			Value:       string(current.Value),
+			ContentType: current.ContentType,
+			Version:     current.Version,
+		}
+		if err := utils.WriteJSON(rw, response); err != nil {
+			http.Error(rw, "Failed to write JSON response", http.StatusInternalServerError)
+			return
+		}
+		return
+	}
+
+	http.Error(rw, "UnAuthorized action(GET) for a leader ... ", http.StatusForbidden)
+}
+
+func (app *App) PutKey(rw http.ResponseWriter, r *http.Request) {
+	var body KeyRecordBody
+	err := utils.ExtractBody(r, &body)
+	if err != nil {
+		http.Error(rw, "Failed to extract body", http.StatusBadRequest)
+		return
+	}
+
+	cond, err := conditionFromHeaders(r)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if body.ContentType == "" {
+		body.ContentType = defaultTextContentType
+	}
+	app.putRecord(rw, namespaceFromRequest(r), chi.URLParam(r, "key"), []byte(body.Value), body.ContentType, body.TTL, cond)
+}
+
+func (app *App) DeleteKey(rw http.ResponseWriter, r *http.Request) {
+	cond, err := conditionFromHeaders(r)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	app.deleteRecord(rw, namespaceFromRequest(r), DeleteRecordBody{
+		Key:       chi.URLParam(r, "key"),
+		Condition: cond,
+	})
+}
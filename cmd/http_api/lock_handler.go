@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	store "kvstore/internal/kv"
+	"kvstore/internal/wal"
+	"kvstore/utils"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+// Lock routes under /api/v1/locks/{key}. Acquire, renew and release go through 2PC on the leader,
+// the fencing token returned by acquire is the WAL version of the acquisition.
+
+type LockBody struct {
+	Owner string `json:"owner"`
+	// Token is required by renew and release, it is the token acquire returned
+	Token int `json:"token"`
+	// TTL is the lease in seconds, required by acquire and renew
+	TTL int64 `json:"ttl"`
+}
+
+type LeaseResponse struct {
+	Key   string `json:"key"`
+	Owner string `json:"owner"`
+	Token int    `json:"token"`
+	// ExpiresAt is when the lease runs out unless it is renewed
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func (app *App) AcquireLock(rw http.ResponseWriter, r *http.Request) {
+	app.lockRecord(rw, r, "LOCK")
+}
+
+func (app *App) RenewLock(rw http.ResponseWriter, r *http.Request) {
+	app.lockRecord(rw, r, "RENEW")
+}
+
+func (app *App) ReleaseLock(rw http.ResponseWriter, r *http.Request) {
+	app.lockRecord(rw, r, "UNLOCK")
+}
+
+func (app *App) lockRecord(rw http.ResponseWriter, r *http.Request, op string) {
+	var body LockBody
+	if err := utils.ExtractBody(r, &body); err != nil {
+		http.Error(rw, "Failed to extract body", http.StatusBadRequest)
+		return
+	}
+	if body.Owner == "" {
+		http.Error(rw, "Owner cannot be empty", http.StatusBadRequest)
+		return
+	}
+	if op != "UNLOCK" && body.TTL <= 0 {
+		http.Error(rw, "TTL must be positive", http.StatusBadRequest)
+		return
+	}
+	if op == "LOCK" {
+		body.Token = 0
+	}
+	value, err := json.Marshal(store.Lock{Owner: body.Owner, Token: body.Token})
+	if err != nil {
+		http.Error(rw, "Failed to encode lock", http.StatusInternalServerError)
+		return
+	}
+
+	ns := namespaceFromRequest(r)
+	key := chi.URLParam(r, "key")
+	entry := wal.WAL{
+		Type:        op,
+		Namespace:   ns.Name,
+		Key:         store.NamespacedKey(ns.Name, key),
+		Value:       value,
+		ContentType: store.ContentTypeLock,
+		TTL:         body.TTL,
+		Timestamp:   time.Now().UnixNano(),
+	}
+	if op == "UNLOCK" {
+		entry.TTL = 0
+	}
+
+	if app.ElectionManager.IsLeader {
+		unlock := app.StoreManager.LockKeys(entry.Key)
+		defer unlock()
+
+		err := app.StoreManager.CheckLockEntry(entry)
+		if errors.Is(err, store.ErrLockHeld) || errors.Is(err, store.ErrLockNotHeld) || errors.Is(err, store.ErrWrongType) {
+			http.Error(rw, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(rw, "Failed to read lock", http.StatusInternalServerError)
+			return
+		}
+
+		committed, ok := app.commitWrite(rw, entry)
+		if !ok {
+			return
+		}
+		if op == "UNLOCK" {
+			rw.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		token := body.Token
+		if op == "LOCK" {
+			token = committed.Version
+		}
+		lease := LeaseResponse{Key: key, Owner: body.Owner, Token: token, ExpiresAt: committed.ExpiresAt()}
+		if err := utils.WriteJSON(rw, lease); err != nil {
+			http.Error(rw, "Failed to write JSON response", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	http.Error(rw, "UnAuthorized action(POST) for a follower ... ", http.StatusForbidden)
+}
+
+// GetLock returns the current holder of the lock, 404 when it is free
+func (app *App) GetLock(rw http.ResponseWriter, r *http.Request) {
+	if app.ElectionManager.IsLeader {
+		http.Error(rw, "UnAuthorized action(GET) for a leader ... ", http.StatusForbidden)
+		return
+	}
+
+	ns := namespaceFromRequest(r)
+	key := chi.URLParam(r, "key")
+	lock, current, exists, err := app.StoreManager.GetLock(store.NamespacedKey(ns.Name, key))
+	if errors.Is(err, store.ErrWrongType) {
+		http.Error(rw, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(rw, "Failed to read lock", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(rw, "Lock is not held", http.StatusNotFound)
+		return
+	}
+
+	lease := LeaseResponse{Key: key, Owner: lock.Owner, Token: lock.Token}
+	if current.ExpiresAt != 0 {
+		lease.ExpiresAt = time.Unix(0, current.ExpiresAt)
+	}
+	if err := utils.WriteJSON(rw, lease); err != nil {
+		http.Error(rw, "Failed to write JSON response", http.StatusInternalServerError)
+	}
+}
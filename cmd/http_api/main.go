@@ -8,8 +8,10 @@ import (
 	store "kvstore/internal/kv"
 	"kvstore/internal/replication"
 	"kvstore/internal/wal"
+	"kvstore/internal/watch"
 
 	"net/http"
+	"sync/atomic"
 	"time"
 
 	"github.com/apex/log"
@@ -24,15 +26,44 @@ type App struct {
 	ReplicationManager *replication.ReplicationManager `json:"replication_manager"`
 	WALManager         *wal.WALManager                 `json:"wal_manager"`
 	StoreManager       *store.StoreManager             `json:"store_manager"`
+	WatchManager       *watch.WatchManager             `json:"watch_manager"`
+	// ready is set once the WAL has been replayed into the store
+	ready atomic.Bool
 }
 
 func main() {
 
 	// The port variable is a pointer to an int that will hold the value of the port flag after parsing.
 	port := flag.Int("port", 8081, "Port for the KV store")
+	// Storage engine backing the node, data is lost on restart with the memory engine
+	engine := flag.String("engine", store.EngineMemory, "Storage engine: memory or lsm")
+	// Number of lock-striped shards the in-memory store is split into
+	shards := flag.Int("shards", store.DefaultShardCount, "Number of shards in the in-memory store")
+	// Directory holding the SSTables of the lsm engine
+	dataDir := flag.String("data-dir", "", "Data directory for the lsm engine (default data_<port>)")
+	// How many WAL versions of history are kept for reads as of a past version
+	versionRetention := flag.Int("version-retention", 1000, "Number of WAL versions kept for as-of reads")
+	// How often expired keys are removed from the store
+	sweepInterval := flag.Duration("sweep-interval", time.Second, "Interval between expired key sweeps")
+	// Approximate memory budget of the store, writes evict keys or are refused once it is used up
+	maxMemory := flag.Int64("max-memory", 0, "Memory budget of the store in bytes, 0 means unbounded")
+	// Which keys go first when the memory budget is hit
+	evictionPolicy := flag.String("eviction-policy", store.EvictionNone, "Eviction policy: noeviction, lru, lfu or random")
+	// Directory holding the WAL segments
+	walDir := flag.String("wal-dir", "", "Directory for the WAL segments (default wal_<port>)")
+	// Size a WAL segment is rotated at
+	walSegmentSize := flag.Int64("wal-segment-size", wal.DefaultSegmentSize, "Size in bytes a WAL segment is rotated at")
+	// When WAL entries are fsynced, namespaces may override it
+	walDurability := flag.String("wal-durability", wal.DurabilityGroup, "WAL durability: fsync, group or interval")
+	// How often the interval durability fsyncs the WAL
+	walSyncInterval := flag.Duration("wal-sync-interval", 100*time.Millisecond, "Interval between WAL fsyncs with the interval durability")
 	// here the value will be loaded into the port variable..
 	flag.Parse()
 
+	if !wal.ValidDurability(*walDurability) {
+		panic(fmt.Sprintf("unknown WAL durability: %s", *walDurability))
+	}
+
 	// Connect to Zookeeper
 	conn, _, err := zk.Connect([]string{"localhost:2181"}, 5*time.Second)
 
@@ -41,33 +72,67 @@ func main() {
 	}
 	defer conn.Close()
 
+	if *dataDir == "" {
+		*dataDir = fmt.Sprintf("data_%d", *port)
+	}
+	storeManager, err := store.NewStoreManager(store.Config{
+		Engine:           *engine,
+		ShardCount:       *shards,
+		DataDir:          *dataDir,
+		VersionRetention: *versionRetention,
+		MaxMemory:        *maxMemory,
+		EvictionPolicy:   *evictionPolicy,
+	})
+	if err != nil {
+		panic(err)
+	}
+	defer storeManager.Store.Close()
+
 	// Initialize the application
 	app := App{
 		Handler:        chi.NewRouter(),
 		ClusterManager: cluster.NewClusterManager(*port, conn),
-		StoreManager:   store.NewStoreManager(),
+		StoreManager:   storeManager,
 	}
 
+	app.StoreManager.StartExpirySweeper(*sweepInterval)
+	app.StoreManager.StartVersionGC(*sweepInterval)
+
 	app.ElectionManager = elections.NewElectionManager(*port, conn)
 	fmt.Println("Election Manager initialized")
 	app.ElectionManager.Election()
 
 	// Intialize WAL manager
-	app.WALManager = wal.NewWALManager(*port, conn)
+	app.WALManager = wal.NewWALManager(*port, conn, *walDir, *walSegmentSize, *walDurability)
+	app.WALManager.NamespaceDurability = app.namespaceDurability
+	app.WALManager.StartIntervalSync(*walSyncInterval)
+	defer app.WALManager.Close()
+	// Prepared entries hold back the version the store reports as applied
+	app.StoreManager.TrackUndecided(app.WALManager)
 	fmt.Println("WAL Manager initialized")
 
+	// Initialize Watch Manager, it replays the WAL for watchers that start behind
+	app.WatchManager = watch.NewWatchManager(app.WALManager, app.StoreManager.LatestVersion)
+	fmt.Println("Watch Manager initialized")
+
 	// Initialize Replication Manager
 	app.ReplicationManager = replication.NewReplicationManager(*port, conn, app.WALManager, app.ClusterManager)
 	fmt.Println("Replication Manager initialized")
 
+	// Old segments are deleted once the store persisted them and every follower acknowledged them
+	app.WALManager.StartRetention(*sweepInterval, app.walRetentionHorizon)
+
 	// Initialize Cluster Metadata
 	app.ClusterManager.InitializeClusterMetadata()
 
 	// Initialize Handler
 	app.InitializeHandler()
 
+	// The store is rebuilt from the WAL while the server already answers the readiness probe
+	go app.replayWAL()
+
 	fmt.Println("KV Store is running on port:", *port)
-	
+
 	err = http.ListenAndServe(fmt.Sprintf(":%d", *port), app.Handler)
 
 	if err != nil {
@@ -0,0 +1,14 @@
+package main
+
+import (
+	"kvstore/utils"
+	"net/http"
+)
+
+// GetMemoryStats reports the memory budget, the bytes in use and the eviction counters of this node.
+// Evictions are replicated, so the counter matches across replicas once they have caught up.
+func (app *App) GetMemoryStats(rw http.ResponseWriter, r *http.Request) {
+	if err := utils.WriteJSON(rw, app.StoreManager.MemoryStats()); err != nil {
+		http.Error(rw, "Failed to write JSON response", http.StatusInternalServerError)
+	}
+}
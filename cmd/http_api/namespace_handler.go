@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"kvstore/internal/cluster"
+	"kvstore/utils"
+	"log"
+	"net/http"
+
+	"github.com/go-chi/chi"
+)
+
+type namespaceContextKey struct{}
+
+// WithNamespace loads the config of the {ns} route parameter into the request context.
+// Routes without the parameter work on the default namespace.
+func (app *App) WithNamespace(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		name := chi.URLParam(r, "ns")
+		if name == "" {
+			name = cluster.DefaultNamespace
+		}
+
+		cfg, err := app.ClusterManager.GetNamespace(name)
+		if errors.Is(err, cluster.ErrNamespaceNotFound) {
+			http.Error(rw, "Namespace not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(rw, "Failed to get namespace config", http.StatusInternalServerError)
+			return
+		}
+
+		// The namespace may declare indexes this node has not built yet
+		if err := app.StoreManager.EnsureIndexes(cfg.Name, cfg.Indexes); err != nil {
+			http.Error(rw, "Failed to build namespace indexes", http.StatusInternalServerError)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), namespaceContextKey{}, cfg)
+		next.ServeHTTP(rw, r.WithContext(ctx))
+	})
+}
+
+// ensureIndexes builds the indexes a namespace declares before one of its entries is applied
+func (app *App) ensureIndexes(name string) {
+	if name == "" {
+		name = cluster.DefaultNamespace
+	}
+	cfg, err := app.ClusterManager.GetNamespace(name)
+	if err != nil {
+		log.Println("Failed to get namespace config:", err)
+		return
+	}
+	if err := app.StoreManager.EnsureIndexes(cfg.Name, cfg.Indexes); err != nil {
+		log.Println("Failed to build namespace indexes:", err)
+	}
+}
+
+func namespaceFromRequest(r *http.Request) cluster.NamespaceConfig {
+	cfg, ok := r.Context().Value(namespaceContextKey{}).(cluster.NamespaceConfig)
+	if !ok {
+		return cluster.NamespaceConfig{Name: cluster.DefaultNamespace, ReplicationMode: cluster.ReplicationSync}
+	}
+	return cfg
+}
+
+func (app *App) GetNamespaceConfig(rw http.ResponseWriter, r *http.Request) {
+	cfg, err := app.ClusterManager.GetNamespace(chi.URLParam(r, "ns"))
+	if errors.Is(err, cluster.ErrNamespaceNotFound) {
+		http.Error(rw, "Namespace not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(rw, "Failed to get namespace config", http.StatusInternalServerError)
+		return
+	}
+
+	if err := utils.WriteJSON(rw, cfg); err != nil {
+		http.Error(rw, "Failed to write JSON response", http.StatusInternalServerError)
+	}
+}
+
+// PutNamespaceConfig creates the namespace or replaces its config.
+// The config lives in Zookeeper, so any node can serve this.
+func (app *App) PutNamespaceConfig(rw http.ResponseWriter, r *http.Request) {
+	var cfg cluster.NamespaceConfig
+	err := utils.ExtractBody(r, &cfg)
+	if err != nil {
+		http.Error(rw, "Failed to extract body", http.StatusBadRequest)
+		return
+	}
+	cfg.Name = chi.URLParam(r, "ns")
+	if cfg.ReplicationMode == "" {
+		cfg.ReplicationMode = cluster.ReplicationSync
+	}
+	if err := cfg.Validate(); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := app.ClusterManager.PutNamespace(cfg); err != nil {
+		http.Error(rw, "Failed to store namespace config", http.StatusInternalServerError)
+		return
+	}
+	// Other nodes pick up new indexes on their next request or commit in the namespace
+	if err := app.StoreManager.EnsureIndexes(cfg.Name, cfg.Indexes); err != nil {
+		http.Error(rw, "Failed to build namespace indexes", http.StatusInternalServerError)
+		return
+	}
+	if err := utils.WriteJSON(rw, cfg); err != nil {
+		http.Error(rw, "Failed to write JSON response", http.StatusInternalServerError)
+	}
+}
+
+// namespaceDurability returns the WAL durability of a namespace, empty when it uses the node's durability
+func (app *App) namespaceDurability(namespace string) string {
+	if namespace == "" {
+		namespace = cluster.DefaultNamespace
+	}
+	cfg, err := app.ClusterManager.GetNamespace(namespace)
+	if err != nil {
+		return ""
+	}
+	return cfg.Durability
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io"
+	store "kvstore/internal/kv"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi"
+)
+
+// Raw value routes under /api/v1/raw/{key}.
+// The request and response bodies are the value itself, so binary values need no encoding.
+// The Content-Type of the PUT is stored with the value and sent back on GET.
+
+// maxRawValueSize caps the body of a raw PUT
+const maxRawValueSize = 16 << 20
+
+func (app *App) GetRawKey(rw http.ResponseWriter, r *http.Request) {
+	ns := namespaceFromRequest(r)
+	key := chi.URLParam(r, "key")
+
+	if !app.ElectionManager.IsLeader {
+		results, err := app.readVersioned(ns, []string{store.NamespacedKey(ns.Name, key)})
+		if err != nil {
+			http.Error(rw, "Failed to get value", http.StatusInternalServerError)
+			return
+		}
+		current := results[0]
+		if !current.Found {
+			http.Error(rw, "Key not found", http.StatusNotFound)
+			return
+		}
+
+		rw.Header().Set("ETag", formatETag(current.Version))
+		if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+			if version, err := parseETag(ifNoneMatch); err == nil && version == current.Version {
+				rw.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+
+		contentType := current.ContentType
+		if contentType == "" {
+			contentType = defaultBinaryContentType
+		}
+		rw.Header().Set("Content-Type", contentType)
+		rw.Header().Set("Content-Length", strconv.Itoa(len(current.Value)))
+		rw.WriteHeader(http.StatusOK)
+		rw.Write(current.Value)
+		return
+	}
+
+	http.Error(rw, "UnAuthorized action(GET) for a leader ... ", http.StatusForbidden)
+}
+
+// PutRawKey stores the request body as the value, the optional ttl query parameter is in seconds
+func (app *App) PutRawKey(rw http.ResponseWriter, r *http.Request) {
+	value, err := io.ReadAll(http.MaxBytesReader(rw, r.Body, maxRawValueSize))
+	if err != nil {
+		http.Error(rw, "Failed to read body", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var ttl int64
+	if rawTTL := r.URL.Query().Get("ttl"); rawTTL != "" {
+		ttl, err = strconv.ParseInt(rawTTL, 10, 64)
+		if err != nil {
+			http.Error(rw, "Invalid ttl", http.StatusBadRequest)
+			return
+		}
+	}
+
+	cond, err := conditionFromHeaders(r)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = defaultBinaryContentType
+	}
+	app.putRecord(rw, namespaceFromRequest(r), chi.URLParam(r, "key"), value, contentType, ttl, cond)
+}
@@ -1,14 +1,33 @@
 package main
 
 import (
+	"encoding/base64"
+	"errors"
+	"kvstore/internal/cluster"
+	store "kvstore/internal/kv"
+	"kvstore/internal/replication"
 	"kvstore/utils"
 	"net/http"
+	"strconv"
 )
 
 type ReadRecordsBody struct {
 	Keys []string `json:"keys"`
 }
 
+// ReadRecordItem is the answer for one of the requested keys, in the order they were asked for.
+// Found tells a missing key apart from an empty value.
+type ReadRecordItem struct {
+	Key         string `json:"key"`
+	Found       bool   `json:"found"`
+	Value       string `json:"value"`
+	ContentType string `json:"content_type,omitempty"`
+	// Version is always sent, 0 is the version of the first write of an empty WAL
+	Version int `json:"version"`
+}
+
+// ReadRecords returns the values of the requested keys.
+// The optional as_of query parameter reads the values as of a past WAL version.
 func (app *App) ReadRecords(rw http.ResponseWriter, r *http.Request) {
 	// Implement the logic to get records from the KV store
 	var body ReadRecordsBody
@@ -19,20 +38,232 @@ func (app *App) ReadRecords(rw http.ResponseWriter, r *http.Request) {
 		http.Error(rw, "Failed to extract body", http.StatusBadRequest)
 		return
 	}
+
+	asOf := -1
+	if rawAsOf := r.URL.Query().Get("as_of"); rawAsOf != "" {
+		asOf, err = strconv.Atoi(rawAsOf)
+		if err != nil || asOf < 0 {
+			http.Error(rw, "Invalid as_of version", http.StatusBadRequest)
+			return
+		}
+	}
+
+	ns := namespaceFromRequest(r)
+	keys := make([]string, len(body.Keys))
+	for i, key := range body.Keys {
+		keys[i] = store.NamespacedKey(ns.Name, key)
+	}
+
 	if !app.ElectionManager.IsLeader {
 		// Retreive values from the KV store
-		outValues := make([]string, len(body.Keys))
-		for i, key := range body.Keys {
-			value, err := app.StoreManager.Store.Get(key)
+		items := make([]ReadRecordItem, len(keys))
+		if asOf >= 0 {
+			// Reads as of a past version are served from the local version chains
+			for i, key := range keys {
+				items[i].Key = body.Keys[i]
+				current, err := app.StoreManager.GetAt(key, asOf)
+				if errors.Is(err, store.ErrKeyNotFound) {
+					continue
+				}
+				if errors.Is(err, store.ErrVersionNotRetained) {
+					http.Error(rw, "Requested version is no longer retained", http.StatusGone)
+					return
+				}
+				if err != nil {
+					http.Error(rw, "Failed to get value", http.StatusInternalServerError)
+					return
+				}
+				items[i] = ReadRecordItem{
+					Key:         body.Keys[i],
+					Found:       true,
+					Value:       string(current.Value),
+					ContentType: current.ContentType,
+					Version:     current.Version,
+				}
+			}
+		} else {
+			results, err := app.readVersioned(ns, keys)
 			if err != nil {
 				http.Error(rw, "Failed to get value", http.StatusInternalServerError)
 				return
 			}
-			outValues[i] = value
+			for i, result := range results {
+				items[i] = ReadRecordItem{
+					Key:         body.Keys[i],
+					Found:       result.Found,
+					Value:       string(result.Value),
+					ContentType: result.ContentType,
+					Version:     result.Version,
+				}
+			}
 		}
 
 		// Send the values back to the client
-		if err := utils.WriteJSON(rw, outValues); err != nil {
+		if err := utils.WriteJSON(rw, items); err != nil {
+			http.Error(rw, "Failed to write JSON response", http.StatusInternalServerError)
+			return
+		}
+		return
+	}
+
+	http.Error(rw, "UnAuthorized action(GET) for a leader ... ", http.StatusForbidden)
+}
+
+const (
+	defaultScanLimit = 100
+	maxScanLimit     = 1000
+)
+
+// ScanItem is a key of a scan page, values are returned as text like in ReadRecords
+type ScanItem struct {
+	Key         string `json:"key"`
+	Value       string `json:"value"`
+	ContentType string `json:"content_type,omitempty"`
+}
+
+type ScanRecordsResponse struct {
+	Items []ScanItem `json:"items"`
+	// NextCursor is empty once the range has been fully read
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// encodeCursor turns the last key of a page into a continuation token.
+// The token points just past that key, so the next page starts at the following key.
+func encodeCursor(lastKey string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(lastKey + "\x00"))
+}
+
+func decodeCursor(cursor string) (string, error) {
+	key, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", err
+	}
+	return string(key), nil
+}
+
+// readVersioned reads the keys locally and, when the namespace asks for a read quorum above 1,
+// from enough other replicas to reach it. The copy with the highest version wins.
+func (app *App) readVersioned(ns cluster.NamespaceConfig, keys []string) ([]replication.ReadResult, error) {
+	results, err := app.readLocal(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	needed := app.ClusterManager.EffectiveReadQuorum(ns) - 1
+	if needed <= 0 {
+		return results, nil
+	}
+	peers, err := app.ReplicationManager.ReadFromWorkers(keys, needed)
+	if err != nil {
+		return nil, err
+	}
+	for _, peer := range peers {
+		for i, result := range peer {
+			if result.Found && (!results[i].Found || result.Version > results[i].Version) {
+				results[i] = result
+			}
+		}
+	}
+	return results, nil
+}
+
+func (app *App) readLocal(keys []string) ([]replication.ReadResult, error) {
+	results := make([]replication.ReadResult, len(keys))
+	for i, key := range keys {
+		current, exists, err := app.StoreManager.Store.GetVersioned(key)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			app.StoreManager.Touch(key)
+		}
+		results[i] = replication.ReadResult{
+			Key:         key,
+			Found:       exists,
+			Value:       current.Value,
+			ContentType: current.ContentType,
+			Version:     current.Version,
+		}
+	}
+	return results, nil
+}
+
+// PeerRead answers another replica's quorum read with the local copies of the keys
+func (app *App) PeerRead(rw http.ResponseWriter, r *http.Request) {
+	var body replication.PeerReadBody
+	err := utils.ExtractBody(r, &body)
+	if err != nil {
+		http.Error(rw, "Failed to extract body", http.StatusBadRequest)
+		return
+	}
+
+	results, err := app.readLocal(body.Keys)
+	if err != nil {
+		http.Error(rw, "Failed to get value", http.StatusInternalServerError)
+		return
+	}
+	if err := utils.WriteJSON(rw, results); err != nil {
+		http.Error(rw, "Failed to write JSON response", http.StatusInternalServerError)
+	}
+}
+
+// ScanRecords serves ordered range and prefix scans, one page at a time.
+// Query parameters: start, end, prefix, limit and cursor (from a previous page).
+// Scans are always served from the local replica.
+func (app *App) ScanRecords(rw http.ResponseWriter, r *http.Request) {
+	ns := namespaceFromRequest(r)
+	query := r.URL.Query()
+
+	start := query.Get("start")
+	end := query.Get("end")
+	if prefix := query.Get("prefix"); prefix != "" {
+		start = prefix
+		end = store.PrefixEnd(prefix)
+	}
+
+	limit := defaultScanLimit
+	if rawLimit := query.Get("limit"); rawLimit != "" {
+		parsed, err := strconv.Atoi(rawLimit)
+		if err != nil || parsed <= 0 {
+			http.Error(rw, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(parsed, maxScanLimit)
+	}
+
+	if cursor := query.Get("cursor"); cursor != "" {
+		key, err := decodeCursor(cursor)
+		if err != nil {
+			http.Error(rw, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+		start = key
+	}
+
+	if !app.ElectionManager.IsLeader {
+		// Fetch one extra key to find out whether there is another page
+		storedStart, storedEnd := store.NamespaceRange(ns.Name, start, end)
+		pairs, err := app.StoreManager.Store.Scan(storedStart, storedEnd, limit+1)
+		if err != nil {
+			http.Error(rw, "Failed to scan keys", http.StatusInternalServerError)
+			return
+		}
+		items := make([]ScanItem, len(pairs))
+		for i, pair := range pairs {
+			items[i] = ScanItem{
+				Key:         store.StripNamespace(ns.Name, pair.Key),
+				Value:       string(pair.Value),
+				ContentType: pair.ContentType,
+			}
+		}
+
+		response := ScanRecordsResponse{Items: items}
+		if len(items) > limit {
+			response.Items = items[:limit]
+			response.NextCursor = encodeCursor(items[limit-1].Key)
+		}
+
+		if err := utils.WriteJSON(rw, response); err != nil {
 			http.Error(rw, "Failed to write JSON response", http.StatusInternalServerError)
 			return
 		}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	store "kvstore/internal/kv"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReadRecordsReportsVersionZero(t *testing.T) {
+	app := newTestApp(t, store.Config{Engine: store.EngineMemory})
+	if rw := writeRecord(app, "first", "v"); rw.Code != http.StatusOK {
+		t.Fatalf("write = %d %s", rw.Code, rw.Body)
+	}
+
+	// Reads are served by followers
+	app.ElectionManager.IsLeader = false
+	body, _ := json.Marshal(ReadRecordsBody{Keys: []string{"first"}})
+	rw := httptest.NewRecorder()
+	app.Handler.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/api/v1/", bytes.NewReader(body)))
+	if rw.Code != http.StatusOK {
+		t.Fatalf("read = %d %s", rw.Code, rw.Body)
+	}
+
+	var items []map[string]any
+	if err := json.Unmarshal(rw.Body.Bytes(), &items); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if len(items) != 1 || items[0]["found"] != true || items[0]["version"] != float64(0) {
+		t.Fatalf("items = %v; want first found at version 0", items)
+	}
+}
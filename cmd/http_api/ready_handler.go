@@ -0,0 +1,161 @@
+package main
+
+import (
+	"kvstore/internal/wal"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// readinessPath and the outcome queries are the only routes answered while the WAL is replayed,
+// replicas restarting together ask each other for the outcome of their in-doubt entries
+const (
+	readinessPath = "/api/v1/ready"
+	outcomePrefix = "/outcome/"
+)
+
+// Ready answers 200 once the node has replayed its WAL and serves traffic, 503 until then
+func (app *App) Ready(rw http.ResponseWriter, r *http.Request) {
+	if !app.ready.Load() {
+		http.Error(rw, "Replaying the WAL", http.StatusServiceUnavailable)
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+}
+
+// readinessGate answers 503 to every request but the readiness probe and outcome queries until the WAL replay is done.
+// Replication requests are refused as well, so the leader cannot commit entries in between replayed ones.
+func (app *App) readinessGate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if !app.ready.Load() && r.URL.Path != readinessPath && !strings.HasPrefix(r.URL.Path, outcomePrefix) {
+			rw.Header().Set("Retry-After", "1")
+			http.Error(rw, "Replaying the WAL, not ready yet", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// resolveInDoubt settles the entries that were prepared but have neither a COMMIT nor an ABORT record,
+// the node crashed between the two phases. A follower asks the leader, the leader asks the followers:
+// a leader sends the commit phase only after logging it, so only a previous leader may have committed the entry.
+// Entries whose outcome cannot be learned stay in doubt and are not replayed.
+// It returns the entries it committed, they were never applied whatever their version.
+func (app *App) resolveInDoubt() []wal.WAL {
+	entries, err := app.WALManager.InDoubtEntries(app.WALManager.OldestVersion())
+	if err != nil {
+		log.Println("Failed to read the WAL:", err)
+		return nil
+	}
+
+	var committed []wal.WAL
+	for _, entry := range entries {
+		var outcome string
+		if app.ElectionManager.IsLeader {
+			outcome, err = app.outcomeFromWorkers(entry.Version)
+		} else {
+			outcome, err = app.outcomeFromLeader(entry.Version)
+		}
+		if err != nil {
+			log.Println("Failed to resolve in-doubt WAL entry:", entry.Version, err)
+			continue
+		}
+
+		switch outcome {
+		case wal.OutcomeCommitted:
+			if err = app.WALManager.MarkCommitted(entry); err == nil {
+				committed = append(committed, entry)
+			}
+		case wal.OutcomeAborted, wal.OutcomeUnknown:
+			err = app.WALManager.MarkAborted(entry)
+			if app.ElectionManager.IsLeader {
+				app.ReplicationManager.AbortTxnToWorkers(entry)
+			}
+		default:
+			log.Println("WAL entry is still in doubt:", entry.Version)
+			continue
+		}
+		if err != nil {
+			log.Println("Failed to write to WAL:", err)
+		}
+	}
+	if len(entries) > 0 {
+		log.Println("Resolved in-doubt WAL entries:", len(entries))
+	}
+	return committed
+}
+
+// outcomeFromLeader asks the current leader what happened to the entry of a version
+func (app *App) outcomeFromLeader(version int) (string, error) {
+	leader, err := app.ReplicationManager.LeaderAddress()
+	if err != nil {
+		return "", err
+	}
+	return app.ReplicationManager.QueryOutcome(leader, version)
+}
+
+// outcomeFromWorkers returns committed as soon as a follower committed the entry of a version, aborted otherwise.
+// A follower that cannot be reached may hold the only commit, so the entry then stays in doubt.
+func (app *App) outcomeFromWorkers(version int) (string, error) {
+	workers, err := app.ReplicationManager.WorkerAddresses()
+	if err != nil {
+		return "", err
+	}
+	for _, worker := range workers {
+		outcome, err := app.ReplicationManager.QueryOutcome(worker, version)
+		if err != nil {
+			return "", err
+		}
+		if outcome == wal.OutcomeCommitted {
+			return wal.OutcomeCommitted, nil
+		}
+	}
+	return wal.OutcomeAborted, nil
+}
+
+// replayWAL applies the committed WAL entries the store does not hold yet, in version order, then opens the readiness gate.
+// The memory engine starts empty and replays the whole WAL, the lsm engine the entries above its applied low-water mark.
+// The gate stays closed when the retention deleted entries the store does not hold.
+func (app *App) replayWAL() {
+	recovered, err := app.StoreManager.RecoverVersion()
+	if err != nil {
+		log.Println("Failed to recover the store version:", err)
+		return
+	}
+	from := recovered + 1
+	if oldest := app.WALManager.OldestVersion(); from < oldest {
+		log.Printf("The store holds versions up to %d but the WAL starts at %d, the entries in between are lost; not serving traffic", recovered, oldest)
+		return
+	}
+	resolved := app.resolveInDoubt()
+
+	entries, err := app.WALManager.CommittedEntries(from)
+	if err != nil {
+		log.Println("Failed to read the WAL:", err)
+		return
+	}
+	// An entry resolved now was not applied before the restart, even below the low-water mark
+	for _, entry := range resolved {
+		if entry.Version < from {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Version < entries[j].Version
+	})
+
+	namespaces := make(map[string]bool)
+	for _, entry := range entries {
+		if !namespaces[entry.Namespace] {
+			app.ensureIndexes(entry.Namespace)
+			namespaces[entry.Namespace] = true
+		}
+		if err := app.StoreManager.Replay(entry); err != nil {
+			// The entry failed the same way when it was first applied
+			log.Println("Failed to replay WAL entry:", entry.Version, err)
+		}
+	}
+	log.Println("Replayed WAL entries:", len(entries))
+	app.ready.Store(true)
+}
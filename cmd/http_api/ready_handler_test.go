@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	store "kvstore/internal/kv"
+	"kvstore/internal/wal"
+	"testing"
+)
+
+// logEntries replaces the WAL of app with one of small segments holding n committed PUT entries
+func logEntries(t *testing.T, app *App, n int) {
+	t.Helper()
+	zkClient := &fakeZk{}
+	walManager := wal.NewWALManager(0, zkClient, t.TempDir(), 64, wal.DurabilityGroup)
+	zkClient.wal = walManager
+	t.Cleanup(func() { walManager.Close() })
+
+	for i := 0; i < n; i++ {
+		entry := wal.WAL{Type: "PUT", Key: fmt.Sprintf("k%d", i), Value: []byte("v")}
+		version, err := walManager.WALWriter(entry)
+		if err != nil {
+			t.Fatalf("WALWriter failed: %v", err)
+		}
+		entry.Version = version
+		if err := walManager.MarkCommitted(entry); err != nil {
+			t.Fatalf("MarkCommitted failed: %v", err)
+		}
+	}
+	app.WALManager = walManager
+	app.StoreManager.TrackUndecided(walManager)
+	app.ready.Store(false)
+}
+
+func TestReplayWALAppliesCommittedEntries(t *testing.T) {
+	app := newTestApp(t, store.Config{Engine: store.EngineMemory})
+	logEntries(t, app, 4)
+
+	app.replayWAL()
+	if !app.ready.Load() {
+		t.Fatalf("ready = false; want true after the replay")
+	}
+	if latest := app.StoreManager.LatestVersion(); latest != 3 {
+		t.Fatalf("LatestVersion = %d; want 3", latest)
+	}
+}
+
+func TestReplayWALKeepsGateClosedOnGap(t *testing.T) {
+	app := newTestApp(t, store.Config{Engine: store.EngineMemory})
+	logEntries(t, app, 4)
+	if removed, err := app.WALManager.Retain(3); err != nil || removed == 0 {
+		t.Fatalf("Retain = %d, %v; want segments removed", removed, err)
+	}
+
+	// The memory engine starts empty, the removed entries cannot be replayed
+	app.replayWAL()
+	if app.ready.Load() {
+		t.Fatalf("ready = true; want the gate closed while the WAL misses versions below %d", app.WALManager.OldestVersion())
+	}
+}
+
+func TestReplayWALAppliesEntriesSkippedByOutOfOrderApplies(t *testing.T) {
+	dir := t.TempDir()
+	config := store.Config{Engine: store.EngineLSM, DataDir: dir}
+	app := newTestApp(t, config)
+	logEntries(t, app, 0)
+	entries := []wal.WAL{
+		{Type: "INCR", Key: "hits"},
+		{Type: "PUT", Key: "a", Value: []byte("1")},
+		{Type: "INCR", Key: "hits"},
+		{Type: "PUT", Key: "b", Value: []byte("2")},
+	}
+	for i := range entries {
+		version, err := app.WALManager.WALWriter(entries[i])
+		if err != nil {
+			t.Fatalf("WALWriter failed: %v", err)
+		}
+		entries[i].Version = version
+		if err := app.WALManager.MarkCommitted(entries[i]); err != nil {
+			t.Fatalf("MarkCommitted failed: %v", err)
+		}
+	}
+	// The node crashed after applying 0 and 2, the PUT of 1 was still on its way
+	app.StoreManager.Apply(entries[0])
+	app.StoreManager.Apply(entries[2])
+	app.StoreManager.Store.Close()
+
+	reopened, err := store.NewStoreManager(config)
+	if err != nil {
+		t.Fatalf("NewStoreManager failed: %v", err)
+	}
+	t.Cleanup(func() { reopened.Store.Close() })
+	reopened.TrackUndecided(app.WALManager)
+	app.StoreManager = reopened
+
+	app.replayWAL()
+	if !app.ready.Load() {
+		t.Fatalf("ready = false; want true after the replay")
+	}
+	for key, want := range map[string]string{"hits": "2", "a": "1", "b": "2"} {
+		if value, err := reopened.Store.Get(key); err != nil || string(value) != want {
+			t.Fatalf("Get(%s) = %q, %v; want %q", key, value, err, want)
+		}
+	}
+}
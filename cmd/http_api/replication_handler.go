@@ -1,10 +1,15 @@
 package main
 
 import (
+	"encoding/json"
+	"kvstore/internal/replication"
 	"kvstore/internal/wal"
 	"kvstore/utils"
 	"log"
 	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi"
 )
 
 func (app *App) WALWriter(rw http.ResponseWriter, r *http.Request) {
@@ -25,11 +30,19 @@ func (app *App) WALWriter(rw http.ResponseWriter, r *http.Request) {
 
 	log.Println("Replicating WAL entry")
 
-	_, err = app.WALManager.WALWriter(wal.WAL{
-		Type:          body.Type,
-		Key:           body.Key,
-		Value:         body.Value,
-		SuccessMarker: false,
+	_, err = app.WALManager.ReplicaWALWriter(wal.WAL{
+		Version:     body.Version,
+		Type:        body.Type,
+		Namespace:   body.Namespace,
+		Key:         body.Key,
+		Value:       body.Value,
+		ContentType: body.ContentType,
+		TTL:         body.TTL,
+		Delta:       body.Delta,
+		Items:       body.Items,
+		Count:       body.Count,
+		Timestamp:   body.Timestamp,
+		Ops:         body.Ops,
 	})
 
 	if err != nil {
@@ -49,13 +62,85 @@ func (app *App) CommitTxn(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	//TODO: Mark the WAL entry as successful
+	// A retried commit waits for the first one to be done with the entry, the entry is applied once
+	unlock := app.WALManager.LockVersion(body.Version)
+	defer unlock()
+
+	outcome, err := app.WALManager.Outcome(body.Version)
+	if err != nil {
+		http.Error(rw, "Failed to read WAL", http.StatusInternalServerError)
+		return
+	}
+	switch outcome {
+	case wal.OutcomeCommitted:
+		// A retried commit phase, the entry is already applied
+		rw.WriteHeader(http.StatusOK)
+		return
+	case wal.OutcomeAborted:
+		http.Error(rw, "WAL entry was aborted", http.StatusConflict)
+		return
+	case wal.OutcomeUnknown:
+		// The prepare phase never reached this node, the commit carries the whole entry so it is logged first.
+		// Otherwise the COMMIT record has no entry to replay after a restart.
+		_, err = app.WALManager.ReplicaWALWriter(body)
+		if err != nil {
+			http.Error(rw, "Failed to write to WAL", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	app.StoreManager.BeginApply(body.Version)
+	err = app.WALManager.MarkCommitted(body)
+	if err != nil {
+		app.StoreManager.CancelApply(body.Version)
+		http.Error(rw, "Failed to write to WAL", http.StatusInternalServerError)
+		return
+	}
 
-	err = app.StoreManager.Store.Put(body.Key, body.Value)
+	app.ensureIndexes(body.Namespace)
+	err = app.StoreManager.Apply(body)
 	if err != nil {
 		http.Error(rw, "Failed to put value", http.StatusInternalServerError)
 		return
 	}
+	app.WatchManager.Publish(body)
 	rw.WriteHeader(http.StatusOK)
 
 }
+
+// AbortTxn logs the abort of an entry the leader could not commit, it is never applied
+func (app *App) AbortTxn(rw http.ResponseWriter, r *http.Request) {
+	var body wal.WAL
+	err := utils.ExtractBody(r, &body)
+	if err != nil {
+		http.Error(rw, "Failed to extract body", http.StatusBadRequest)
+		return
+	}
+
+	unlock := app.WALManager.LockVersion(body.Version)
+	defer unlock()
+
+	err = app.WALManager.MarkAborted(body)
+	if err != nil {
+		http.Error(rw, "Failed to write to WAL", http.StatusInternalServerError)
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+}
+
+// Outcome answers what the local WAL says about the entry of a version, replicas ask it for the entries they are in doubt about
+func (app *App) Outcome(rw http.ResponseWriter, r *http.Request) {
+	version, err := strconv.Atoi(chi.URLParam(r, "version"))
+	if err != nil {
+		http.Error(rw, "Invalid version", http.StatusBadRequest)
+		return
+	}
+
+	outcome, err := app.WALManager.Outcome(version)
+	if err != nil {
+		http.Error(rw, "Failed to read WAL", http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(replication.OutcomeResponse{Version: version, Outcome: outcome})
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	store "kvstore/internal/kv"
+	"kvstore/internal/wal"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func postEntry(app *App, path string, entry wal.WAL) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(entry)
+	rw := httptest.NewRecorder()
+	app.Handler.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body)))
+	return rw
+}
+
+func TestCommitLogsEntryMissedInPrepare(t *testing.T) {
+	app := newTestApp(t, store.Config{Engine: store.EngineMemory})
+	app.ElectionManager.IsLeader = false
+
+	entry := wal.WAL{Version: 0, Type: "PUT", Key: "k", Value: []byte("v")}
+	for i := 0; i < 2; i++ {
+		if rw := postEntry(app, "/commit/", entry); rw.Code != http.StatusOK {
+			t.Fatalf("commit = %d %s", rw.Code, rw.Body)
+		}
+	}
+
+	// A restart replays the committed entries of the log
+	entries, err := app.WALManager.CommittedEntries(0)
+	if err != nil {
+		t.Fatalf("CommittedEntries failed: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Key != "k" {
+		t.Fatalf("CommittedEntries = %+v; want the entry of k once", entries)
+	}
+}
+
+func TestCommitRejectsAbortedEntry(t *testing.T) {
+	app := newTestApp(t, store.Config{Engine: store.EngineMemory})
+	app.ElectionManager.IsLeader = false
+
+	entry := wal.WAL{Version: 0, Type: "PUT", Key: "k", Value: []byte("v")}
+	if rw := postEntry(app, "/api/v1/replicate/", entry); rw.Code != http.StatusOK {
+		t.Fatalf("replicate = %d %s", rw.Code, rw.Body)
+	}
+	if rw := postEntry(app, "/abort/", entry); rw.Code != http.StatusOK {
+		t.Fatalf("abort = %d %s", rw.Code, rw.Body)
+	}
+	if rw := postEntry(app, "/commit/", entry); rw.Code != http.StatusConflict {
+		t.Fatalf("commit = %d %s; want %d", rw.Code, rw.Body, http.StatusConflict)
+	}
+	if _, found, _ := app.StoreManager.Store.GetVersioned("k"); found {
+		t.Fatalf("k found; want the aborted entry not applied")
+	}
+}
+
+func TestRetriedCommitsApplyOnce(t *testing.T) {
+	app := newTestApp(t, store.Config{Engine: store.EngineMemory})
+	app.ElectionManager.IsLeader = false
+
+	entry := wal.WAL{Version: 0, Type: "INCR", Key: "hits"}
+	if rw := postEntry(app, "/api/v1/replicate/", entry); rw.Code != http.StatusOK {
+		t.Fatalf("replicate = %d %s", rw.Code, rw.Body)
+	}
+	// The leader retries a commit it did not hear back from while the first one is still being handled
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if rw := postEntry(app, "/commit/", entry); rw.Code != http.StatusOK {
+				t.Errorf("commit = %d %s", rw.Code, rw.Body)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if value, err := app.StoreManager.Store.Get("hits"); err != nil || string(value) != "1" {
+		t.Fatalf("hits = %q, %v; want 1", value, err)
+	}
+}
+
+func TestWriteIsPendingWithoutCommitQuorum(t *testing.T) {
+	app := newTestApp(t, store.Config{Engine: store.EngineMemory})
+
+	// The worker accepts the prepare phase but never confirms the commit
+	worker := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/commit/" {
+			http.Error(rw, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer worker.Close()
+	app.ReplicationManager.ZkClient.(*fakeZk).workers = map[string]string{
+		"worker-1": strings.TrimPrefix(worker.URL, "http://"),
+	}
+	app.ClusterManager.WriteQuorum = 1
+
+	// The leader applied the write, the client is told so and must not retry it
+	rw := writeRecord(app, "k", "v")
+	if rw.Code != http.StatusAccepted {
+		t.Fatalf("write = %d %s; want %d", rw.Code, rw.Body, http.StatusAccepted)
+	}
+	var pending PendingWriteResponse
+	if err := json.Unmarshal(rw.Body.Bytes(), &pending); err != nil {
+		t.Fatalf("Failed to decode response %s: %v", rw.Body, err)
+	}
+	current, found, _ := app.StoreManager.Store.GetVersioned(store.NamespacedKey("default", "k"))
+	if !found || current.Version != pending.Version || rw.Header().Get("ETag") != formatETag(pending.Version) {
+		t.Fatalf("response = %s ETag %s, k = %+v; want the version k was applied at", rw.Body, rw.Header().Get("ETag"), current)
+	}
+}
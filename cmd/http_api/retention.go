@@ -0,0 +1,27 @@
+package main
+
+import "log"
+
+// walRetentionHorizon is the version below which WAL segments may be deleted:
+// the store has flushed the older entries to its files and every follower has acknowledged them.
+// Both are contiguous prefixes, an entry applied or acknowledged out of order does not move them past an older one.
+// It is -1 while nothing may be deleted.
+func (app *App) walRetentionHorizon() int {
+	persisted := app.StoreManager.PersistedVersion()
+	if persisted < 0 {
+		return -1
+	}
+	horizon := persisted + 1
+	if app.ElectionManager.IsLeader {
+		acked, err := app.ReplicationManager.AckedVersion()
+		if err != nil {
+			log.Println("Failed to get the acknowledged version:", err)
+			return -1
+		}
+		if acked < 0 {
+			return -1
+		}
+		horizon = min(horizon, acked+1)
+	}
+	return horizon
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	store "kvstore/internal/kv"
+	"kvstore/utils"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+// Snapshot routes. A snapshot belongs to the replica it was created on, like the reads it serves,
+// so create it on the follower the export will be read from.
+
+// exportFlushEvery is how many exported keys are buffered before the response is flushed
+const exportFlushEvery = 100
+
+// CreateSnapshot opens a snapshot at the latest applied version, the optional ttl query parameter is in seconds
+func (app *App) CreateSnapshot(rw http.ResponseWriter, r *http.Request) {
+	if app.ElectionManager.IsLeader {
+		http.Error(rw, "UnAuthorized action(POST) for a leader ... ", http.StatusForbidden)
+		return
+	}
+
+	var ttl time.Duration
+	if rawTTL := r.URL.Query().Get("ttl"); rawTTL != "" {
+		seconds, err := strconv.ParseInt(rawTTL, 10, 64)
+		if err != nil || seconds <= 0 {
+			http.Error(rw, "Invalid ttl", http.StatusBadRequest)
+			return
+		}
+		ttl = time.Duration(seconds) * time.Second
+	}
+
+	snapshot := app.StoreManager.CreateSnapshot(ttl)
+	if err := utils.WriteJSONWithStatus(rw, http.StatusCreated, snapshot); err != nil {
+		http.Error(rw, "Failed to write JSON response", http.StatusInternalServerError)
+	}
+}
+
+func (app *App) ListSnapshots(rw http.ResponseWriter, r *http.Request) {
+	if err := utils.WriteJSON(rw, app.StoreManager.Snapshots()); err != nil {
+		http.Error(rw, "Failed to write JSON response", http.StatusInternalServerError)
+	}
+}
+
+func (app *App) ReleaseSnapshot(rw http.ResponseWriter, r *http.Request) {
+	err := app.StoreManager.ReleaseSnapshot(chi.URLParam(r, "id"))
+	if errors.Is(err, store.ErrSnapshotNotFound) {
+		http.Error(rw, "Snapshot not found", http.StatusNotFound)
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// ExportItem is a line of a snapshot export, the value is base64 encoded so that binary values survive
+type ExportItem struct {
+	Key         string `json:"key"`
+	Value       []byte `json:"value"`
+	ContentType string `json:"content_type,omitempty"`
+}
+
+// ExportSnapshot streams the keys of the namespace as seen by the snapshot, one JSON object per line.
+// The optional prefix query parameter narrows the export. X-Snapshot-Version carries the version exported.
+func (app *App) ExportSnapshot(rw http.ResponseWriter, r *http.Request) {
+	if app.ElectionManager.IsLeader {
+		http.Error(rw, "UnAuthorized action(GET) for a leader ... ", http.StatusForbidden)
+		return
+	}
+
+	ns := namespaceFromRequest(r)
+	prefix := store.NamespacedKey(ns.Name, r.URL.Query().Get("prefix"))
+	it, err := app.StoreManager.NewSnapshotIterator(chi.URLParam(r, "id"), prefix, store.PrefixEnd(prefix))
+	if errors.Is(err, store.ErrSnapshotNotFound) {
+		http.Error(rw, "Snapshot not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(rw, "Failed to read snapshot", http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/x-ndjson")
+	rw.Header().Set("X-Snapshot-Version", strconv.Itoa(it.Snapshot().Version))
+	rw.WriteHeader(http.StatusOK)
+	flusher, _ := rw.(http.Flusher)
+
+	encoder := json.NewEncoder(rw)
+	count := 0
+	for it.Next() {
+		pair := it.Pair()
+		item := ExportItem{
+			Key:         store.StripNamespace(ns.Name, pair.Key),
+			Value:       pair.Value,
+			ContentType: pair.ContentType,
+		}
+		if err := encoder.Encode(item); err != nil {
+			// The client went away
+			return
+		}
+		count++
+		if flusher != nil && count%exportFlushEvery == 0 {
+			flusher.Flush()
+		}
+	}
+	if err := it.Err(); err != nil {
+		// The status is already sent, the truncated stream is all the client can be told
+		log.Println("Snapshot export failed:", err)
+	}
+}
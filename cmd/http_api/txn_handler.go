@@ -0,0 +1,114 @@
+package main
+
+import (
+	store "kvstore/internal/kv"
+	"kvstore/internal/wal"
+	"kvstore/utils"
+	"net/http"
+	"time"
+)
+
+// TxnCondition is a read condition on a key that has to hold for the transaction to commit
+type TxnCondition struct {
+	Key string `json:"key"`
+	store.Condition
+}
+
+// TxnOp is a mutation of a transaction, values are sent as text like in WriteRecord
+type TxnOp struct {
+	Type        string `json:"type"`
+	Key         string `json:"key"`
+	Value       string `json:"value,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	// TTL in seconds, 0 means the key never expires
+	TTL int64 `json:"ttl,omitempty"`
+}
+
+type TxnBody struct {
+	Conditions []TxnCondition `json:"conditions"`
+	Ops        []TxnOp        `json:"ops"`
+}
+
+type TxnResponse struct {
+	Version int `json:"version"`
+}
+
+// Txn atomically applies a set of puts and deletes once all of its read conditions hold.
+// The whole transaction is a single TXN WAL entry, so it goes through 2PC with one version.
+func (app *App) Txn(rw http.ResponseWriter, r *http.Request) {
+	var body TxnBody
+	// Extract the body from the request
+	// and unmarshal it into the TxnBody struct
+	err := utils.ExtractBody(r, &body)
+	if err != nil {
+		http.Error(rw, "Failed to extract body", http.StatusBadRequest)
+		return
+	}
+
+	ops := make([]wal.Op, len(body.Ops))
+	for i, op := range body.Ops {
+		ops[i] = wal.Op{Type: op.Type, Key: op.Key, TTL: op.TTL}
+		if op.Type == "PUT" {
+			ops[i].Value = []byte(op.Value)
+			ops[i].ContentType = op.ContentType
+			if ops[i].ContentType == "" {
+				ops[i].ContentType = defaultTextContentType
+			}
+		}
+	}
+	if err := store.ValidateOps(ops); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Scope every key to the namespace before anything is locked or logged
+	ns := namespaceFromRequest(r)
+	for i := range body.Conditions {
+		body.Conditions[i].Key = store.NamespacedKey(ns.Name, body.Conditions[i].Key)
+	}
+	for i := range ops {
+		ops[i].Key = store.NamespacedKey(ns.Name, ops[i].Key)
+		if ops[i].Type == "PUT" && ops[i].TTL == 0 {
+			ops[i].TTL = ns.DefaultTTL
+		}
+	}
+
+	if app.ElectionManager.IsLeader {
+		// Every key that is read or written stays locked until the transaction is applied
+		keys := make([]string, 0, len(body.Conditions)+len(body.Ops))
+		for _, cond := range body.Conditions {
+			keys = append(keys, cond.Key)
+		}
+		for _, op := range ops {
+			keys = append(keys, op.Key)
+		}
+		unlock := app.StoreManager.LockKeys(keys...)
+		defer unlock()
+
+		for _, cond := range body.Conditions {
+			if !app.checkCondition(rw, ns, cond.Key, cond.Condition) {
+				return
+			}
+		}
+		if !app.checkPlainWrite(rw, keys[len(body.Conditions):]...) {
+			return
+		}
+
+		entry, ok := app.commitWrite(rw, wal.WAL{
+			Type:      "TXN",
+			Namespace: ns.Name,
+			Ops:       ops,
+			Timestamp: time.Now().UnixNano(),
+		})
+		if !ok {
+			return
+		}
+
+		if err := utils.WriteJSON(rw, TxnResponse{Version: entry.Version}); err != nil {
+			http.Error(rw, "Failed to write JSON response", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	http.Error(rw, "UnAuthorized action(POST) for a follower ... ", http.StatusForbidden)
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"errors"
+	store "kvstore/internal/kv"
+	"kvstore/internal/wal"
+	"kvstore/utils"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+// Hash, list, set and sorted set routes under /api/v1/hashes, /lists, /sets and /zsets.
+// Writes go through 2PC as one WAL entry per operation, reads are served from the local replica.
+
+type DataTypeBody struct {
+	// Items are the hash fields, list elements or set members the operation works on
+	Items []wal.Item `json:"items"`
+	// Count is how many elements LPOP and RPOP remove, 1 by default
+	Count int `json:"count"`
+	// TTL in seconds for a key that does not exist yet, existing keys keep their expiry
+	TTL int64 `json:"ttl"`
+}
+
+type DataTypeResponse struct {
+	Version int `json:"version"`
+	// Popped holds the elements removed by LPOP and RPOP
+	Popped []string `json:"popped,omitempty"`
+}
+
+// DataTypeWrite returns the handler of a hash, list, set or sorted set operation
+func (app *App) DataTypeWrite(entryType string) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		var body DataTypeBody
+		err := utils.ExtractBody(r, &body)
+		if err != nil {
+			http.Error(rw, "Failed to extract body", http.StatusBadRequest)
+			return
+		}
+		if body.TTL < 0 {
+			http.Error(rw, "TTL cannot be negative", http.StatusBadRequest)
+			return
+		}
+		pop := entryType == "LPOP" || entryType == "RPOP"
+		if pop {
+			if body.Count == 0 {
+				body.Count = 1
+			}
+			if body.Count < 0 {
+				http.Error(rw, "Count cannot be negative", http.StatusBadRequest)
+				return
+			}
+		} else if len(body.Items) == 0 {
+			http.Error(rw, "No items given", http.StatusBadRequest)
+			return
+		}
+
+		ns := namespaceFromRequest(r)
+		if body.TTL == 0 {
+			body.TTL = ns.DefaultTTL
+		}
+		entry := wal.WAL{
+			Type:      entryType,
+			Namespace: ns.Name,
+			Key:       store.NamespacedKey(ns.Name, chi.URLParam(r, "key")),
+			Items:     body.Items,
+			TTL:       body.TTL,
+			Timestamp: time.Now().UnixNano(),
+		}
+		if pop {
+			entry.Items = nil
+			entry.Count = body.Count
+		}
+
+		if app.ElectionManager.IsLeader {
+			unlock := app.StoreManager.LockKeys(entry.Key)
+			defer unlock()
+
+			err := app.StoreManager.CheckTypedEntry(entry)
+			if errors.Is(err, store.ErrWrongType) {
+				http.Error(rw, err.Error(), http.StatusConflict)
+				return
+			}
+			if err != nil {
+				http.Error(rw, "Failed to read key", http.StatusInternalServerError)
+				return
+			}
+
+			// The key stays locked until the pop is applied, so these are exactly the elements it removes
+			var popped []string
+			if pop {
+				list, err := app.StoreManager.List(entry.Key)
+				if err != nil && !errors.Is(err, store.ErrKeyNotFound) {
+					http.Error(rw, "Failed to read key", http.StatusInternalServerError)
+					return
+				}
+				count := min(entry.Count, len(list))
+				if entryType == "LPOP" {
+					popped = list[:count]
+				} else {
+					popped = list[len(list)-count:]
+				}
+			}
+
+			committed, ok := app.commitWrite(rw, entry)
+			if !ok {
+				return
+			}
+			if err := utils.WriteJSON(rw, DataTypeResponse{Version: committed.Version, Popped: popped}); err != nil {
+				http.Error(rw, "Failed to write JSON response", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		http.Error(rw, "UnAuthorized action(POST) for a follower ... ", http.StatusForbidden)
+	}
+}
+
+// checkDataTypeRead answers with 404 when the key is missing and 409 when it holds another type,
+// it returns false once the response is written
+func checkDataTypeRead(rw http.ResponseWriter, err error) bool {
+	if errors.Is(err, store.ErrKeyNotFound) {
+		http.Error(rw, "Key not found", http.StatusNotFound)
+		return false
+	}
+	if errors.Is(err, store.ErrWrongType) {
+		http.Error(rw, err.Error(), http.StatusConflict)
+		return false
+	}
+	if err != nil {
+		http.Error(rw, "Failed to get value", http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+func writeDataType(rw http.ResponseWriter, v interface{}) {
+	if err := utils.WriteJSON(rw, v); err != nil {
+		http.Error(rw, "Failed to write JSON response", http.StatusInternalServerError)
+	}
+}
+
+func (app *App) GetHash(rw http.ResponseWriter, r *http.Request) {
+	if app.ElectionManager.IsLeader {
+		http.Error(rw, "UnAuthorized action(GET) for a leader ... ", http.StatusForbidden)
+		return
+	}
+	ns := namespaceFromRequest(r)
+	hash, err := app.StoreManager.Hash(store.NamespacedKey(ns.Name, chi.URLParam(r, "key")))
+	if !checkDataTypeRead(rw, err) {
+		return
+	}
+	writeDataType(rw, hash)
+}
+
+type HashFieldResponse struct {
+	Field string `json:"field"`
+	Value string `json:"value"`
+}
+
+func (app *App) GetHashField(rw http.ResponseWriter, r *http.Request) {
+	if app.ElectionManager.IsLeader {
+		http.Error(rw, "UnAuthorized action(GET) for a leader ... ", http.StatusForbidden)
+		return
+	}
+	ns := namespaceFromRequest(r)
+	hash, err := app.StoreManager.Hash(store.NamespacedKey(ns.Name, chi.URLParam(r, "key")))
+	if !checkDataTypeRead(rw, err) {
+		return
+	}
+	field := chi.URLParam(r, "field")
+	value, ok := hash[field]
+	if !ok {
+		http.Error(rw, "Field not found", http.StatusNotFound)
+		return
+	}
+	writeDataType(rw, HashFieldResponse{Field: field, Value: value})
+}
+
+// GetList returns the elements between start and stop, both included.
+// Negative indexes count from the end of the list, like LRANGE.
+func (app *App) GetList(rw http.ResponseWriter, r *http.Request) {
+	if app.ElectionManager.IsLeader {
+		http.Error(rw, "UnAuthorized action(GET) for a leader ... ", http.StatusForbidden)
+		return
+	}
+	start, stop := 0, -1
+	var err error
+	if raw := r.URL.Query().Get("start"); raw != "" {
+		if start, err = strconv.Atoi(raw); err != nil {
+			http.Error(rw, "Invalid start", http.StatusBadRequest)
+			return
+		}
+	}
+	if raw := r.URL.Query().Get("stop"); raw != "" {
+		if stop, err = strconv.Atoi(raw); err != nil {
+			http.Error(rw, "Invalid stop", http.StatusBadRequest)
+			return
+		}
+	}
+
+	ns := namespaceFromRequest(r)
+	list, err := app.StoreManager.List(store.NamespacedKey(ns.Name, chi.URLParam(r, "key")))
+	if !checkDataTypeRead(rw, err) {
+		return
+	}
+	if start < 0 {
+		start = max(len(list)+start, 0)
+	}
+	if stop < 0 {
+		stop = len(list) + stop
+	}
+	stop = min(stop, len(list)-1)
+	if start > stop {
+		writeDataType(rw, []string{})
+		return
+	}
+	writeDataType(rw, list[start:stop+1])
+}
+
+func (app *App) GetSet(rw http.ResponseWriter, r *http.Request) {
+	if app.ElectionManager.IsLeader {
+		http.Error(rw, "UnAuthorized action(GET) for a leader ... ", http.StatusForbidden)
+		return
+	}
+	ns := namespaceFromRequest(r)
+	set, err := app.StoreManager.Set(store.NamespacedKey(ns.Name, chi.URLParam(r, "key")))
+	if !checkDataTypeRead(rw, err) {
+		return
+	}
+	writeDataType(rw, set)
+}
+
+type SetMemberResponse struct {
+	Member   string `json:"member"`
+	IsMember bool   `json:"is_member"`
+}
+
+func (app *App) GetSetMember(rw http.ResponseWriter, r *http.Request) {
+	if app.ElectionManager.IsLeader {
+		http.Error(rw, "UnAuthorized action(GET) for a leader ... ", http.StatusForbidden)
+		return
+	}
+	ns := namespaceFromRequest(r)
+	set, err := app.StoreManager.Set(store.NamespacedKey(ns.Name, chi.URLParam(r, "key")))
+	// A missing set has no members
+	if !errors.Is(err, store.ErrKeyNotFound) && !checkDataTypeRead(rw, err) {
+		return
+	}
+	member := chi.URLParam(r, "member")
+	// Members are kept sorted
+	i := sort.SearchStrings(set, member)
+	writeDataType(rw, SetMemberResponse{Member: member, IsMember: i < len(set) && set[i] == member})
+}
+
+// GetSortedSet returns the members with a score between min and max, both included.
+// min and max default to -inf and +inf.
+func (app *App) GetSortedSet(rw http.ResponseWriter, r *http.Request) {
+	if app.ElectionManager.IsLeader {
+		http.Error(rw, "UnAuthorized action(GET) for a leader ... ", http.StatusForbidden)
+		return
+	}
+	minScore, maxScore := "-inf", "+inf"
+	if raw := r.URL.Query().Get("min"); raw != "" {
+		minScore = raw
+	}
+	if raw := r.URL.Query().Get("max"); raw != "" {
+		maxScore = raw
+	}
+	low, err := strconv.ParseFloat(minScore, 64)
+	if err != nil {
+		http.Error(rw, "Invalid min score", http.StatusBadRequest)
+		return
+	}
+	high, err := strconv.ParseFloat(maxScore, 64)
+	if err != nil {
+		http.Error(rw, "Invalid max score", http.StatusBadRequest)
+		return
+	}
+
+	ns := namespaceFromRequest(r)
+	zset, err := app.StoreManager.SortedSet(store.NamespacedKey(ns.Name, chi.URLParam(r, "key")))
+	if !checkDataTypeRead(rw, err) {
+		return
+	}
+	// Members are ordered by score, so the range is a contiguous slice
+	from := sort.Search(len(zset), func(i int) bool { return zset[i].Score >= low })
+	to := sort.Search(len(zset), func(i int) bool { return zset[i].Score > high })
+	if from > to {
+		to = from
+	}
+	writeDataType(rw, zset[from:to])
+}
+
+type RankResponse struct {
+	Member string  `json:"member"`
+	Rank   int     `json:"rank"`
+	Score  float64 `json:"score"`
+}
+
+// GetSortedSetRank returns the 0-based rank of a member, ordered from the lowest score
+func (app *App) GetSortedSetRank(rw http.ResponseWriter, r *http.Request) {
+	if app.ElectionManager.IsLeader {
+		http.Error(rw, "UnAuthorized action(GET) for a leader ... ", http.StatusForbidden)
+		return
+	}
+	ns := namespaceFromRequest(r)
+	zset, err := app.StoreManager.SortedSet(store.NamespacedKey(ns.Name, chi.URLParam(r, "key")))
+	if !checkDataTypeRead(rw, err) {
+		return
+	}
+	member := chi.URLParam(r, "member")
+	for rank, m := range zset {
+		if m.Member == member {
+			writeDataType(rw, RankResponse{Member: member, Rank: rank, Score: m.Score})
+			return
+		}
+	}
+	http.Error(rw, "Member not found", http.StatusNotFound)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	store "kvstore/internal/kv"
+	"kvstore/internal/wal"
+	"kvstore/internal/watch"
+	"kvstore/utils"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// Change feed routes under /api/v1/watch. A watch follows a key (?key=) or a key prefix (?prefix=),
+// the whole namespace when neither is given. ?from= replays the WAL from that version before the live feed.
+
+// watchRequest reads the filter and the version a watch starts from.
+// SSE clients that reconnect send the last id they saw in Last-Event-ID, it is used when from is not given.
+func watchRequest(r *http.Request) (watch.Filter, int, error) {
+	ns := namespaceFromRequest(r)
+	query := r.URL.Query()
+	if query.Has("key") && query.Has("prefix") {
+		return watch.Filter{}, 0, errors.New("Only one of key and prefix can be given")
+	}
+	filter := watch.Filter{Key: store.NamespacedKey(ns.Name, query.Get("prefix")), Prefix: true}
+	if query.Has("key") {
+		filter = watch.Filter{Key: store.NamespacedKey(ns.Name, query.Get("key"))}
+	}
+
+	from := watch.FromNow
+	rawFrom := query.Get("from")
+	if rawFrom == "" {
+		rawFrom = r.Header.Get("Last-Event-ID")
+	}
+	if rawFrom != "" {
+		parsed, err := strconv.Atoi(rawFrom)
+		if err != nil || parsed < 0 {
+			return watch.Filter{}, 0, errors.New("Invalid from version")
+		}
+		from = parsed
+	}
+	return filter, from, nil
+}
+
+// WatchSSE streams the change feed as Server-Sent Events, the id of every event is its version
+func (app *App) WatchSSE(rw http.ResponseWriter, r *http.Request) {
+	if app.ElectionManager.IsLeader {
+		http.Error(rw, "UnAuthorized action(GET) for a leader ... ", http.StatusForbidden)
+		return
+	}
+	filter, from, err := watchRequest(r)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		http.Error(rw, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ns := namespaceFromRequest(r)
+	err = app.WatchManager.Watch(r.Context(), filter, from, func(event watch.Event) error {
+		event.Key = store.StripNamespace(ns.Name, event.Key)
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(rw, "id: %d\ndata: %s\n\n", event.Version, data); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	})
+	if errors.Is(err, watch.ErrWatcherTooSlow) || errors.Is(err, wal.ErrCompacted) {
+		// A slow client reconnects with Last-Event-ID and catches up from the WAL,
+		// one too far behind for the WAL starts over from a snapshot export
+		fmt.Fprintf(rw, "event: error\ndata: %s\n\n", err.Error())
+		flusher.Flush()
+		return
+	}
+	if err != nil && !errors.Is(err, context.Canceled) {
+		log.Println("Watch ended:", err)
+	}
+}
+
+// WatchWebSocket streams the change feed over a WebSocket, one JSON event per text message
+func (app *App) WatchWebSocket(rw http.ResponseWriter, r *http.Request) {
+	if app.ElectionManager.IsLeader {
+		http.Error(rw, "UnAuthorized action(GET) for a leader ... ", http.StatusForbidden)
+		return
+	}
+	filter, from, err := watchRequest(r)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ws, err := utils.UpgradeWebSocket(rw, r)
+	if errors.Is(err, utils.ErrBadWebSocketHandshake) {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Println("Failed to upgrade to a websocket:", err)
+		return
+	}
+	defer ws.Close()
+
+	// The connection is taken over from the HTTP server, the watch ends when the client goes away
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		defer cancel()
+		for {
+			if _, err := ws.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ns := namespaceFromRequest(r)
+	err = app.WatchManager.Watch(ctx, filter, from, func(event watch.Event) error {
+		event.Key = store.StripNamespace(ns.Name, event.Key)
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		return ws.WriteText(data)
+	})
+	if err != nil && !errors.Is(err, context.Canceled) {
+		log.Println("Watch ended:", err)
+	}
+}
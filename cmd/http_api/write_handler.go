@@ -1,14 +1,37 @@
 package main
 
 import (
+	"errors"
+	"kvstore/internal/cluster"
+	store "kvstore/internal/kv"
 	"kvstore/internal/wal"
 	"kvstore/utils"
+	"log"
 	"net/http"
+	"time"
+)
+
+const (
+	defaultTextContentType   = "text/plain"
+	defaultBinaryContentType = "application/octet-stream"
 )
 
 type WriteRecordBody struct {
 	Key   string `json:"key"`
 	Value string `json:"value"`
+	// TTL in seconds, 0 means the key never expires
+	TTL int64 `json:"ttl"`
+	// ContentType is stored with the value, JSON writes default to text/plain
+	ContentType string `json:"content_type,omitempty"`
+	// Condition makes the write depend on the current state of the key
+	Condition *store.Condition `json:"condition,omitempty"`
+}
+
+// PendingWriteResponse answers a write that is committed and applied on the leader but that too few followers
+// have committed yet. The leader keeps sending them the commit, the client must not retry the write.
+type PendingWriteResponse struct {
+	Version int    `json:"version"`
+	Status  string `json:"status"`
 }
 
 func (app *App) WriteRecord(rw http.ResponseWriter, r *http.Request) {
@@ -20,42 +43,56 @@ func (app *App) WriteRecord(rw http.ResponseWriter, r *http.Request) {
 		http.Error(rw, "Failed to extract body", http.StatusBadRequest)
 		return
 	}
+	if body.ContentType == "" {
+		body.ContentType = defaultTextContentType
+	}
+	app.putRecord(rw, namespaceFromRequest(r), body.Key, []byte(body.Value), body.ContentType, body.TTL, body.Condition)
+}
+
+// putRecord replicates a single PUT, the value is stored as raw bytes whatever route it came from
+func (app *App) putRecord(rw http.ResponseWriter, ns cluster.NamespaceConfig, key string, value []byte, contentType string, ttl int64, cond *store.Condition) {
+	if ttl < 0 {
+		http.Error(rw, "TTL cannot be negative", http.StatusBadRequest)
+		return
+	}
+	// Locks are only written by LOCK entries, which give them their fencing token
+	if contentType == store.ContentTypeLock {
+		http.Error(rw, "Locks are taken through the lock API", http.StatusBadRequest)
+		return
+	}
+	if ttl == 0 {
+		ttl = ns.DefaultTTL
+	}
+	key = store.NamespacedKey(ns.Name, key)
+
 	if app.ElectionManager.IsLeader {
-		
-		// 2PC Prepare Phase
-		version, err := app.WALManager.WALWriter(wal.WAL{
-			Type:          "PUT",
-			Key:           body.Key,
-			Value:         body.Value,
-			SuccessMarker: false,
-		})
-		if err != nil {
-			http.Error(rw, "Failed to write to WAL", http.StatusInternalServerError)
-			return
-		}
+		// Hold the key until the write is applied so that the condition cannot go stale
+		unlock := app.StoreManager.LockKeys(key)
+		defer unlock()
 
-		// Replicate WAL to followers
-		err = app.ReplicationManager.WALReplicationToWorkers("PUT", body.Key, body.Value, version)
-		if err != nil {
-			// These false WAL entries will be cleaned up during compaction
-			http.Error(rw, "Failed to replicate WAL to workers", http.StatusInternalServerError)
+		// Conditions are checked before the prepare phase so that failed writes never reach the WAL
+		if cond != nil && !app.checkCondition(rw, ns, key, *cond) {
 			return
 		}
-
-		// 2PC Commit Phase
-		
-		err = app.ReplicationManager.CommitTxnToWorkers("PUT", body.Key, body.Value, version)
-		if err != nil {
-			http.Error(rw, "Failed to commit transaction to workers", http.StatusInternalServerError)
+		if !app.checkPlainWrite(rw, key) {
 			return
 		}
 
-		err = app.StoreManager.Store.Put(body.Key, body.Value)
-		if err != nil {
-			http.Error(rw, "Failed to put value", http.StatusInternalServerError)
+		// The leader's timestamp is replicated so that every node computes the same expiry
+		entry, ok := app.commitWrite(rw, wal.WAL{
+			Type:        "PUT",
+			Namespace:   ns.Name,
+			Key:         key,
+			Value:       value,
+			ContentType: contentType,
+			TTL:         ttl,
+			Timestamp:   time.Now().UnixNano(),
+		})
+		if !ok {
 			return
 		}
 
+		rw.Header().Set("ETag", formatETag(entry.Version))
 		rw.WriteHeader(http.StatusOK)
 		return
 	}
@@ -63,8 +100,164 @@ func (app *App) WriteRecord(rw http.ResponseWriter, r *http.Request) {
 	http.Error(rw, "UnAuthorized action(POST) for a follower ... ", http.StatusForbidden)
 }
 
+// commitWrite makes room for a WAL entry in the memory budget and commits it.
+// On failure, and for a write that is only pending on the followers, the response has already been written.
+func (app *App) commitWrite(rw http.ResponseWriter, entry wal.WAL) (wal.WAL, bool) {
+	// The room is reserved until the entry is applied, so that two writers cannot both take it
+	release, ok := app.makeRoom(rw, entry)
+	if !ok {
+		return entry, false
+	}
+	defer release()
+
+	entry, ok, pending := app.commitEntry(rw, entry)
+	if pending {
+		// The write cannot be taken back, a client retrying it would apply it twice
+		rw.Header().Set("ETag", formatETag(entry.Version))
+		if err := utils.WriteJSONWithStatus(rw, http.StatusAccepted, PendingWriteResponse{Version: entry.Version, Status: "replication pending"}); err != nil {
+			http.Error(rw, "Failed to write JSON response", http.StatusInternalServerError)
+		}
+		return entry, false
+	}
+	return entry, ok
+}
+
+// commitEntry runs a WAL entry through the 2PC prepare and commit phases and applies it locally.
+// An entry that does not reach its quorum is aborted. One that too few followers commit is applied and reported as pending,
+// the commit phase is retried in the background. On failure the error response has already been written.
+func (app *App) commitEntry(rw http.ResponseWriter, entry wal.WAL) (committed wal.WAL, ok bool, pending bool) {
+	// 2PC Prepare Phase
+	version, err := app.WALManager.WALWriter(entry)
+	if err != nil {
+		http.Error(rw, "Failed to write to WAL", http.StatusInternalServerError)
+		return entry, false, false
+	}
+	entry.Version = version
+
+	// Replicate WAL to followers
+	err = app.ReplicationManager.WALReplicationToWorkers(entry)
+	if err != nil {
+		// No quorum, the entry is aborted everywhere it was prepared
+		app.abortWrite(entry)
+		http.Error(rw, "Failed to replicate WAL to workers", http.StatusInternalServerError)
+		return entry, false, false
+	}
+
+	// The commit decision is logged before it is sent, a restart replays exactly the logged commits
+	app.StoreManager.BeginApply(entry.Version)
+	err = app.WALManager.MarkCommitted(entry)
+	if err != nil {
+		app.StoreManager.CancelApply(entry.Version)
+		app.abortWrite(entry)
+		http.Error(rw, "Failed to write to WAL", http.StatusInternalServerError)
+		return entry, false, false
+	}
+
+	// 2PC Commit Phase
+	commitErr := app.ReplicationManager.CommitTxnToWorkers(entry)
+
+	// The decision is logged, the leader applies the entry even when the commit phase falls short
+	err = app.StoreManager.Apply(entry)
+	if err != nil {
+		http.Error(rw, "Failed to put value", http.StatusInternalServerError)
+		return entry, false, false
+	}
+	app.WatchManager.Publish(entry)
+
+	if commitErr != nil {
+		// Too few followers hold the commit yet for the write to be acknowledged.
+		// A follower that still misses it after the retries asks the leader for it when it restarts.
+		log.Println("Failed to commit transaction to workers:", entry.Version, commitErr)
+		return entry, true, true
+	}
+	return entry, true, false
+}
+
+// abortWrite logs an ABORT record for an entry that was prepared but not committed and sends the abort phase to followers
+func (app *App) abortWrite(entry wal.WAL) {
+	if err := app.WALManager.MarkAborted(entry); err != nil {
+		log.Println("Failed to write to WAL:", err)
+	}
+	if err := app.ReplicationManager.AbortTxnToWorkers(entry); err != nil {
+		log.Println("Failed to abort transaction on workers:", entry.Version, err)
+	}
+}
+
+// makeRoom reserves the room entry needs in the memory budget and evicts keys first when it would not fit.
+// The eviction is its own EVICT entry so that every replica drops the same keys.
+// The reservation and the locks of the victims are held until release is called, once entry is applied.
+func (app *App) makeRoom(rw http.ResponseWriter, entry wal.WAL) (release func(), ok bool) {
+	victims, release, err := app.StoreManager.EvictionVictims(entry)
+	if errors.Is(err, store.ErrMemoryBudgetExceeded) {
+		http.Error(rw, "Memory budget exceeded", http.StatusInsufficientStorage)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(rw, "Failed to evict keys", http.StatusInternalServerError)
+		return nil, false
+	}
+	if len(victims) == 0 {
+		return release, true
+	}
+
+	ops := make([]wal.Op, len(victims))
+	for i, key := range victims {
+		ops[i] = wal.Op{Type: "DELETE", Key: key}
+	}
+	// The EVICT entry itself only frees memory, it does not go through makeRoom again
+	// An EVICT entry pending on the followers has freed the room all the same
+	if _, ok, _ := app.commitEntry(rw, wal.WAL{
+		Type:      "EVICT",
+		Ops:       ops,
+		Timestamp: time.Now().UnixNano(),
+	}); !ok {
+		release()
+		return nil, false
+	}
+	return release, true
+}
+
+// checkCondition answers with 409 and the key's current version when the condition does not hold
+func (app *App) checkCondition(rw http.ResponseWriter, ns cluster.NamespaceConfig, key string, cond store.Condition) bool {
+	err := app.StoreManager.CheckCondition(key, cond)
+	if err == nil {
+		return true
+	}
+
+	var failed *store.ConditionFailedError
+	if errors.As(err, &failed) {
+		failed.Key = store.StripNamespace(ns.Name, failed.Key)
+		if failed.Exists {
+			rw.Header().Set("ETag", formatETag(failed.CurrentVersion))
+		}
+		if err := utils.WriteJSONWithStatus(rw, http.StatusConflict, failed); err != nil {
+			http.Error(rw, "Failed to write JSON response", http.StatusInternalServerError)
+		}
+		return false
+	}
+
+	http.Error(rw, "Failed to check condition", http.StatusInternalServerError)
+	return false
+}
+
+// checkPlainWrite answers with 409 when one of the keys holds a lock, only the lock API may change it
+func (app *App) checkPlainWrite(rw http.ResponseWriter, keys ...string) bool {
+	err := app.StoreManager.CheckPlainWrite(keys...)
+	if errors.Is(err, store.ErrLockKey) {
+		http.Error(rw, err.Error(), http.StatusConflict)
+		return false
+	}
+	if err != nil {
+		http.Error(rw, "Failed to read key", http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
 type DeleteRecordBody struct {
 	Key string `json:"key"`
+	// Condition makes the delete depend on the current state of the key
+	Condition *store.Condition `json:"condition,omitempty"`
 }
 
 func (app *App) DeleteRecord(rw http.ResponseWriter, r *http.Request) {
@@ -73,12 +266,49 @@ func (app *App) DeleteRecord(rw http.ResponseWriter, r *http.Request) {
 	// and unmarshal it into the DeleteRecordBody struct
 	err := utils.ExtractBody(r, &body)
 	if err != nil {
-		http.Error(rw, "Failed to extr body", http.StatusBadRequest)
+		http.Error(rw, "Failed to extract body", http.StatusBadRequest)
 		return
 	}
+	app.deleteRecord(rw, namespaceFromRequest(r), body)
+}
+
+func (app *App) deleteRecord(rw http.ResponseWriter, ns cluster.NamespaceConfig, body DeleteRecordBody) {
+	key := store.NamespacedKey(ns.Name, body.Key)
+
 	if app.ElectionManager.IsLeader {
-		// Delete the value from the KV store
-		app.StoreManager.Store.Delete(body.Key)
+		unlock := app.StoreManager.LockKeys(key)
+		defer unlock()
+
+		if body.Condition != nil && !app.checkCondition(rw, ns, key, *body.Condition) {
+			return
+		}
+		if !app.checkPlainWrite(rw, key) {
+			return
+		}
+
+		// Deleting a missing key is a no-op, it never reaches the WAL
+		_, exists, err := app.StoreManager.Store.GetVersioned(key)
+		if err != nil {
+			http.Error(rw, "Failed to read key", http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			rw.WriteHeader(http.StatusOK)
+			return
+		}
+
+		// The delete is replicated like any other write so that followers store the same tombstone
+		entry, ok := app.commitWrite(rw, wal.WAL{
+			Type:      "DELETE",
+			Namespace: ns.Name,
+			Key:       key,
+			Timestamp: time.Now().UnixNano(),
+		})
+		if !ok {
+			return
+		}
+
+		rw.Header().Set("ETag", formatETag(entry.Version))
 		rw.WriteHeader(http.StatusOK)
 		return
 	}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"kvstore/internal/cluster"
+	"kvstore/internal/elections"
+	store "kvstore/internal/kv"
+	"kvstore/internal/replication"
+	"kvstore/internal/wal"
+	"kvstore/internal/watch"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-zookeeper/zk"
+)
+
+// fakeZk is the Zookeeper of a cluster without namespaces configured, it has no workers unless a test registers them
+type fakeZk struct {
+	wal *wal.WALManager
+	// workers are the addresses of the registered workers, by worker name
+	workers map[string]string
+}
+
+func (z *fakeZk) Children(path string) ([]string, *zk.Stat, error) {
+	var children []string
+	if path == "/workers" {
+		for worker := range z.workers {
+			children = append(children, worker)
+		}
+	}
+	return children, &zk.Stat{}, nil
+}
+
+func (z *fakeZk) ChildrenW(path string) ([]string, *zk.Stat, <-chan zk.Event, error) {
+	children, stat, err := z.Children(path)
+	return children, stat, nil, err
+}
+
+func (z *fakeZk) Get(path string) ([]byte, *zk.Stat, error) {
+	if worker, ok := strings.CutPrefix(path, "/workers/"); ok {
+		if address, ok := z.workers[worker]; ok {
+			return []byte(address), &zk.Stat{}, nil
+		}
+	}
+	if path != "/version" {
+		return nil, nil, zk.ErrNoNode
+	}
+	// The WAL only appends while /version matches its latest version
+	latest := 0
+	entries, err := z.wal.ReadEntries(z.wal.OldestVersion())
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, entry := range entries {
+		latest = max(latest, entry.Version)
+	}
+	data, err := json.Marshal(latest)
+	return data, &zk.Stat{}, err
+}
+
+func (z *fakeZk) GetW(path string) ([]byte, *zk.Stat, <-chan zk.Event, error) {
+	return nil, nil, nil, zk.ErrNoNode
+}
+
+func (z *fakeZk) Create(path string, data []byte, flags int32, acl []zk.ACL) (string, error) {
+	return path, nil
+}
+
+func (z *fakeZk) Set(path string, data []byte, version int32) (*zk.Stat, error) {
+	return &zk.Stat{}, nil
+}
+
+// newTestApp starts a leader without followers, its writes commit locally
+func newTestApp(t *testing.T, config store.Config) *App {
+	t.Helper()
+	storeManager, err := store.NewStoreManager(config)
+	if err != nil {
+		t.Fatalf("NewStoreManager failed: %v", err)
+	}
+	zkClient := &fakeZk{}
+	walManager := wal.NewWALManager(0, zkClient, t.TempDir(), 0, wal.DurabilityGroup)
+	zkClient.wal = walManager
+	t.Cleanup(func() { walManager.Close() })
+	storeManager.TrackUndecided(walManager)
+
+	clusterManager := cluster.NewClusterManager(0, zkClient)
+	app := &App{
+		Handler:            chi.NewRouter(),
+		ClusterManager:     clusterManager,
+		ElectionManager:    &elections.ElectionManager{IsLeader: true},
+		ReplicationManager: replication.NewReplicationManager(0, zkClient, walManager, clusterManager),
+		WALManager:         walManager,
+		StoreManager:       storeManager,
+		WatchManager:       watch.NewWatchManager(walManager, storeManager.LatestVersion),
+	}
+	app.InitializeHandler()
+	app.ready.Store(true)
+	return app
+}
+
+func writeRecord(app *App, key string, value string) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(WriteRecordBody{Key: key, Value: value})
+	rw := httptest.NewRecorder()
+	app.Handler.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/api/v1/", bytes.NewReader(body)))
+	return rw
+}
+
+func TestWriteOverBudgetEvicts(t *testing.T) {
+	app := newTestApp(t, store.Config{Engine: store.EngineMemory, MaxMemory: 400, EvictionPolicy: store.EvictionLRU})
+	for i := 0; i < 4; i++ {
+		if rw := writeRecord(app, fmt.Sprintf("k%d", i), "v"); rw.Code != http.StatusOK {
+			t.Fatalf("write k%d = %d %s", i, rw.Code, rw.Body)
+		}
+	}
+
+	// The write only fits once some of the keys are evicted
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- writeRecord(app, "large", strings.Repeat("x", 200))
+	}()
+	select {
+	case rw := <-done:
+		if rw.Code != http.StatusOK {
+			t.Fatalf("write over budget = %d %s", rw.Code, rw.Body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("write over budget did not return")
+	}
+
+	stats := app.StoreManager.MemoryStats()
+	if stats.Evictions == 0 || stats.UsedBytes > stats.BudgetBytes {
+		t.Fatalf("MemoryStats = %+v; want evictions and usage within budget", stats)
+	}
+}
+
+func TestConcurrentWritesStayWithinBudget(t *testing.T) {
+	app := newTestApp(t, store.Config{Engine: store.EngineMemory, MaxMemory: 1000, EvictionPolicy: store.EvictionLRU})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rw := writeRecord(app, fmt.Sprintf("k%d", i), strings.Repeat("x", 100))
+			// fakeZk reads /version off the WAL, an append in between makes the WAL report a conflict
+			for attempt := 0; attempt < 10 && strings.Contains(rw.Body.String(), "Failed to write to WAL"); attempt++ {
+				rw = writeRecord(app, fmt.Sprintf("k%d", i), strings.Repeat("x", 100))
+			}
+			if rw.Code != http.StatusOK {
+				t.Errorf("write k%d = %d %s", i, rw.Code, rw.Body)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if stats := app.StoreManager.MemoryStats(); stats.UsedBytes > stats.BudgetBytes {
+		t.Fatalf("MemoryStats = %+v; want usage within budget", stats)
+	}
+}
+
+func TestBudgetedWritesDoNotWaitForEachOther(t *testing.T) {
+	app := newTestApp(t, store.Config{Engine: store.EngineMemory, MaxMemory: 1 << 20, EvictionPolicy: store.EvictionLRU})
+
+	// The worker holds the prepare phase of the first write until the test lets it go
+	blocked := make(chan struct{})
+	var once sync.Once
+	worker := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/replicate/" {
+			first := false
+			once.Do(func() { first = true })
+			if first {
+				<-blocked
+			}
+		}
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer worker.Close()
+	defer close(blocked)
+	app.ReplicationManager.ZkClient.(*fakeZk).workers = map[string]string{
+		"worker-1": strings.TrimPrefix(worker.URL, "http://"),
+	}
+	app.ClusterManager.WriteQuorum = 1
+
+	go writeRecord(app, "slow", "v")
+	time.Sleep(50 * time.Millisecond)
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- writeRecord(app, "fast", "v")
+	}()
+	select {
+	case rw := <-done:
+		if rw.Code != http.StatusOK {
+			t.Fatalf("write = %d %s", rw.Code, rw.Body)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("write waited for another key's write to replicate")
+	}
+}
+
+func TestPlainWritesCannotReleaseLocks(t *testing.T) {
+	app := newTestApp(t, store.Config{Engine: store.EngineMemory})
+	body, _ := json.Marshal(LockBody{Owner: "a", TTL: 60})
+	rw := httptest.NewRecorder()
+	app.Handler.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/api/v1/locks/mutex/acquire", bytes.NewReader(body)))
+	if rw.Code != http.StatusOK {
+		t.Fatalf("acquire = %d %s", rw.Code, rw.Body)
+	}
+
+	if rw := writeRecord(app, "mutex", "stolen"); rw.Code != http.StatusConflict {
+		t.Fatalf("PUT on a held lock = %d %s; want 409", rw.Code, rw.Body)
+	}
+	rw = httptest.NewRecorder()
+	app.Handler.ServeHTTP(rw, httptest.NewRequest(http.MethodDelete, "/api/v1/keys/mutex", nil))
+	if rw.Code != http.StatusConflict {
+		t.Fatalf("DELETE of a held lock = %d %s; want 409", rw.Code, rw.Body)
+	}
+	txn, _ := json.Marshal(TxnBody{Ops: []TxnOp{{Type: "PUT", Key: "other", Value: "v"}, {Type: "DELETE", Key: "mutex"}}})
+	rw = httptest.NewRecorder()
+	app.Handler.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/api/v1/txn", bytes.NewReader(txn)))
+	if rw.Code != http.StatusConflict {
+		t.Fatalf("TXN deleting a held lock = %d %s; want 409", rw.Code, rw.Body)
+	}
+
+	if lock, _, held, _ := app.StoreManager.GetLock(store.NamespacedKey("default", "mutex")); !held || lock.Owner != "a" {
+		t.Fatalf("GetLock = %+v, %v; want still held by a", lock, held)
+	}
+}
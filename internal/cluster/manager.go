@@ -2,34 +2,39 @@ package cluster
 
 import (
 	"fmt"
+	"log"
+	"time"
 
 	"github.com/go-zookeeper/zk"
 )
 
+// zkClient is the part of the Zookeeper client the cluster metadata uses, *zk.Conn implements it
+type zkClient interface {
+	ChildrenW(path string) ([]string, *zk.Stat, <-chan zk.Event, error)
+	GetW(path string) ([]byte, *zk.Stat, <-chan zk.Event, error)
+	Create(path string, data []byte, flags int32, acl []zk.ACL) (string, error)
+	Set(path string, data []byte, version int32) (*zk.Stat, error)
+}
+
 type ClusterManager struct {
 	KvPort      int      `json:"kv_port"`
-	ZkClient    *zk.Conn `json:"zk_client"`
+	ZkClient    zkClient `json:"zk_client"`
 	ClusterSize int32    `json:"cluster_size"`
 	WriteQuorum int32    `json:"write_quorum"`
 	ReadQuorum  int32    `json:"read_quorum"`
+	// namespaces caches the per-namespace configs stored in Zookeeper
+	namespaces namespaceCache
 }
 
-func NewClusterManager(kv_port int, zkClient *zk.Conn) *ClusterManager {
+func NewClusterManager(kv_port int, zkClient zkClient) *ClusterManager {
 	return &ClusterManager{
 		KvPort:   kv_port,
 		ZkClient: zkClient,
 	}
 }
 
-func (cm *ClusterManager) getClusterSize() int32 {
-	// Get the cluster size from Zookeepr
-	path := "/workers" // Zookeeper path for leader election
-	// Get the list of children nodes
-	children, _, err := cm.ZkClient.Get(path)
-	if err != nil {
-		panic(err)
-	}
-
+func (cm *ClusterManager) getClusterSize(children []string) int32 {
+	// Every worker registers a child of /workers
 	return int32(len(children))
 }
 
@@ -43,29 +48,41 @@ func (cm *ClusterManager) getReadQuorum() int32 {
 	return (cm.ClusterSize / 2) + 1
 }
 
+// InitializeClusterMetadata computes the cluster size and quorums from the registered workers,
+// then keeps them up to date in the background as workers join and leave.
 func (cm *ClusterManager) InitializeClusterMetadata() {
 	path := "/workers" // Zookeeper path for leader election
 
-	updateClusterDetails := func() {
-		cm.ClusterSize = cm.getClusterSize()
+	updateClusterDetails := func(children []string) {
+		cm.ClusterSize = cm.getClusterSize(children)
 		cm.WriteQuorum = cm.getWriteQuorum()
 		cm.ReadQuorum = cm.getReadQuorum()
 	}
 
-	updateClusterDetails()
-
 	// Get the list of children nodes
 	// here we are watching for changes in cluster size like if some replicas are added or removed/crashed
-
-	_, _, ch, err := cm.ZkClient.GetW(path)
+	children, _, ch, err := cm.ZkClient.ChildrenW(path)
 	if err != nil {
 		panic(err)
 	}
+	updateClusterDetails(children)
 
-	for ev := range ch {
-		if ev.Type == zk.EventNodeChildrenChanged {
-			fmt.Println("Cluster size changed, resetting cluster details")
-			updateClusterDetails()
+	go func() {
+		for {
+			// A watch fires once, it is set again along with reading the new children
+			ev := <-ch
+			if ev.Type == zk.EventNodeChildrenChanged {
+				fmt.Println("Cluster size changed, resetting cluster details")
+			}
+			for {
+				children, _, ch, err = cm.ZkClient.ChildrenW(path)
+				if err == nil {
+					break
+				}
+				log.Println("Failed to watch the workers:", err)
+				time.Sleep(time.Second)
+			}
+			updateClusterDetails(children)
 		}
-	}
+	}()
 }
@@ -0,0 +1,183 @@
+package cluster
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-zookeeper/zk"
+)
+
+// fakeZk keeps znodes in memory and fires watches the way Zookeeper does, once per watch
+type fakeZk struct {
+	mu      sync.Mutex
+	nodes   map[string][]byte
+	watches map[string][]chan zk.Event
+}
+
+func newFakeZk() *fakeZk {
+	return &fakeZk{nodes: make(map[string][]byte), watches: make(map[string][]chan zk.Event)}
+}
+
+func (z *fakeZk) watch(path string) <-chan zk.Event {
+	ch := make(chan zk.Event, 1)
+	z.watches[path] = append(z.watches[path], ch)
+	return ch
+}
+
+// fire must be called with mu held
+func (z *fakeZk) fire(path string, eventType zk.EventType) {
+	for _, ch := range z.watches[path] {
+		ch <- zk.Event{Type: eventType, Path: path}
+		close(ch)
+	}
+	delete(z.watches, path)
+}
+
+func (z *fakeZk) ChildrenW(path string) ([]string, *zk.Stat, <-chan zk.Event, error) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	var children []string
+	for node := range z.nodes {
+		if child, ok := strings.CutPrefix(node, path+"/"); ok && !strings.Contains(child, "/") {
+			children = append(children, child)
+		}
+	}
+	return children, &zk.Stat{}, z.watch(path + "/"), nil
+}
+
+func (z *fakeZk) GetW(path string) ([]byte, *zk.Stat, <-chan zk.Event, error) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	data, ok := z.nodes[path]
+	if !ok {
+		return nil, nil, nil, zk.ErrNoNode
+	}
+	return data, &zk.Stat{}, z.watch(path), nil
+}
+
+func (z *fakeZk) Create(path string, data []byte, flags int32, acl []zk.ACL) (string, error) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if _, ok := z.nodes[path]; ok {
+		return "", zk.ErrNodeExists
+	}
+	z.nodes[path] = data
+	z.fire(path[:strings.LastIndex(path, "/")+1], zk.EventNodeChildrenChanged)
+	return path, nil
+}
+
+func (z *fakeZk) Set(path string, data []byte, version int32) (*zk.Stat, error) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if _, ok := z.nodes[path]; !ok {
+		return nil, zk.ErrNoNode
+	}
+	z.nodes[path] = data
+	z.fire(path, zk.EventNodeDataChanged)
+	return &zk.Stat{}, nil
+}
+
+func (z *fakeZk) remove(path string) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	delete(z.nodes, path)
+	z.fire(path, zk.EventNodeDeleted)
+	z.fire(path[:strings.LastIndex(path, "/")+1], zk.EventNodeChildrenChanged)
+}
+
+// waitFor polls cond until it holds, the watches are handled in the background
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestClusterMembership(t *testing.T) {
+	zkClient := newFakeZk()
+	for _, worker := range []string{"1", "2"} {
+		zkClient.Create("/workers/"+worker, []byte("localhost:808"+worker), 0, nil)
+	}
+
+	cm := NewClusterManager(8080, zkClient)
+	cm.InitializeClusterMetadata()
+	if cm.ClusterSize != 2 || cm.WriteQuorum != 2 || cm.ReadQuorum != 2 {
+		t.Fatalf("cluster = %d workers, quorums %d/%d; want 2 workers, quorums 2/2", cm.ClusterSize, cm.WriteQuorum, cm.ReadQuorum)
+	}
+
+	// Workers joining and leaving are picked up by the watch, which is set again every time it fires
+	for _, worker := range []string{"3", "4"} {
+		zkClient.Create("/workers/"+worker, []byte("localhost:808"+worker), 0, nil)
+	}
+	waitFor(t, "4 workers", func() bool { return cm.ClusterSize == 4 && cm.WriteQuorum == 3 })
+
+	zkClient.remove("/workers/4")
+	waitFor(t, "3 workers", func() bool { return cm.ClusterSize == 3 && cm.WriteQuorum == 2 })
+}
+
+func TestNamespaceRegistration(t *testing.T) {
+	zkClient := newFakeZk()
+	cm := NewClusterManager(8080, zkClient)
+
+	cfg, err := cm.GetNamespace(DefaultNamespace)
+	if err != nil || cfg.ReplicationMode != ReplicationSync {
+		t.Fatalf("GetNamespace(default) = %+v, %v; want the sync default", cfg, err)
+	}
+	if _, err := cm.GetNamespace("orders"); !errors.Is(err, ErrNamespaceNotFound) {
+		t.Fatalf("GetNamespace(orders) = %v; want ErrNamespaceNotFound", err)
+	}
+
+	if err := cm.PutNamespace(NamespaceConfig{Name: "orders", WriteQuorum: 1, ReplicationMode: ReplicationAsync}); err != nil {
+		t.Fatalf("PutNamespace failed: %v", err)
+	}
+	cfg, err = cm.GetNamespace("orders")
+	if err != nil || cfg.WriteQuorum != 1 || cfg.ReplicationMode != ReplicationAsync {
+		t.Fatalf("GetNamespace(orders) = %+v, %v; want write quorum 1, async", cfg, err)
+	}
+
+	// Replacing the config drops the cached one
+	if err := cm.PutNamespace(NamespaceConfig{Name: "orders", WriteQuorum: 2, ReplicationMode: ReplicationSync}); err != nil {
+		t.Fatalf("PutNamespace failed: %v", err)
+	}
+	waitFor(t, "the new config", func() bool {
+		cfg, err := cm.GetNamespace("orders")
+		return err == nil && cfg.WriteQuorum == 2 && cfg.ReplicationMode == ReplicationSync
+	})
+}
+
+func TestNamespaceRegistrationRejectsInvalidConfigs(t *testing.T) {
+	cm := NewClusterManager(8080, newFakeZk())
+	for _, cfg := range []NamespaceConfig{
+		{Name: "bad/name", ReplicationMode: ReplicationSync},
+		{Name: "orders", ReplicationMode: "eventual"},
+		{Name: "orders", WriteQuorum: -1, ReplicationMode: ReplicationSync},
+		{Name: "orders", ReplicationMode: ReplicationSync, Durability: "never"},
+	} {
+		if err := cm.PutNamespace(cfg); err == nil {
+			t.Errorf("PutNamespace(%+v) succeeded; want an error", cfg)
+		}
+	}
+	if _, err := cm.GetNamespace("orders"); !errors.Is(err, ErrNamespaceNotFound) {
+		t.Fatalf("GetNamespace(orders) = %v; want ErrNamespaceNotFound", err)
+	}
+}
+
+func TestEffectiveQuorums(t *testing.T) {
+	cm := &ClusterManager{WriteQuorum: 2}
+	if q := cm.EffectiveWriteQuorum(NamespaceConfig{}); q != 2 {
+		t.Fatalf("EffectiveWriteQuorum without a namespace quorum = %d; want the cluster's 2", q)
+	}
+	if q := cm.EffectiveWriteQuorum(NamespaceConfig{WriteQuorum: 1}); q != 1 {
+		t.Fatalf("EffectiveWriteQuorum = %d; want the namespace's 1", q)
+	}
+	if q := cm.EffectiveReadQuorum(NamespaceConfig{}); q != 1 {
+		t.Fatalf("EffectiveReadQuorum without a namespace quorum = %d; want 1", q)
+	}
+}
@@ -0,0 +1,186 @@
+package cluster
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	store "kvstore/internal/kv"
+	"kvstore/internal/wal"
+	"log"
+	"regexp"
+	"sync"
+
+	"github.com/go-zookeeper/zk"
+)
+
+const (
+	DefaultNamespace = "default"
+
+	// Writes wait for the write quorum before they are acknowledged
+	ReplicationSync = "sync"
+	// Writes are acknowledged once they are on the leader, followers catch up in the background
+	ReplicationAsync = "async"
+
+	namespacesPath = "/namespaces"
+)
+
+var ErrNamespaceNotFound = errors.New("namespace not found")
+
+var namespaceNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// NamespaceConfig holds the consistency and availability settings of a namespace.
+// A write quorum of 0 falls back to the cluster majority, a read quorum of 0 reads from a single replica.
+type NamespaceConfig struct {
+	Name            string `json:"name"`
+	WriteQuorum     int32  `json:"write_quorum"`
+	ReadQuorum      int32  `json:"read_quorum"`
+	ReplicationMode string `json:"replication_mode"`
+	// DefaultTTL in seconds is applied to writes that do not set their own TTL, 0 means no expiry
+	DefaultTTL int64 `json:"default_ttl"`
+	// Indexes are the secondary indexes every replica keeps on the JSON values of the namespace
+	Indexes []store.IndexSpec `json:"indexes,omitempty"`
+	// Durability decides when the WAL entries of the namespace are fsynced, empty uses the node's durability
+	Durability string `json:"durability,omitempty"`
+}
+
+// namespaceCache keeps the configs read from Zookeeper, entries are dropped when their znode changes
+type namespaceCache struct {
+	mu      sync.RWMutex
+	configs map[string]NamespaceConfig
+}
+
+func defaultNamespaceConfig() NamespaceConfig {
+	return NamespaceConfig{
+		Name:            DefaultNamespace,
+		ReplicationMode: ReplicationSync,
+	}
+}
+
+func ValidNamespaceName(name string) bool {
+	return namespaceNamePattern.MatchString(name)
+}
+
+func (cfg NamespaceConfig) Validate() error {
+	if !ValidNamespaceName(cfg.Name) {
+		return fmt.Errorf("invalid namespace name: %q", cfg.Name)
+	}
+	if cfg.WriteQuorum < 0 || cfg.ReadQuorum < 0 {
+		return errors.New("quorums cannot be negative")
+	}
+	if cfg.ReplicationMode != ReplicationSync && cfg.ReplicationMode != ReplicationAsync {
+		return fmt.Errorf("unknown replication mode: %q", cfg.ReplicationMode)
+	}
+	if cfg.DefaultTTL < 0 {
+		return errors.New("default TTL cannot be negative")
+	}
+	if cfg.Durability != "" && !wal.ValidDurability(cfg.Durability) {
+		return fmt.Errorf("unknown durability: %q", cfg.Durability)
+	}
+	names := make(map[string]bool, len(cfg.Indexes))
+	for _, spec := range cfg.Indexes {
+		if err := spec.Validate(); err != nil {
+			return err
+		}
+		if names[spec.Name] {
+			return fmt.Errorf("duplicate index name: %q", spec.Name)
+		}
+		names[spec.Name] = true
+	}
+	return nil
+}
+
+// EffectiveWriteQuorum is the number of follower acks a write in the namespace needs
+func (cm *ClusterManager) EffectiveWriteQuorum(cfg NamespaceConfig) int32 {
+	if cfg.WriteQuorum > 0 {
+		return cfg.WriteQuorum
+	}
+	return cm.WriteQuorum
+}
+
+// EffectiveReadQuorum is the number of replicas a read in the namespace has to consult
+func (cm *ClusterManager) EffectiveReadQuorum(cfg NamespaceConfig) int32 {
+	if cfg.ReadQuorum > 0 {
+		return cfg.ReadQuorum
+	}
+	return 1
+}
+
+// GetNamespace returns the config of a namespace.
+// The default namespace always exists, with sync replication unless it was configured otherwise.
+func (cm *ClusterManager) GetNamespace(name string) (NamespaceConfig, error) {
+	cm.namespaces.mu.RLock()
+	cfg, ok := cm.namespaces.configs[name]
+	cm.namespaces.mu.RUnlock()
+	if ok {
+		return cfg, nil
+	}
+
+	if !ValidNamespaceName(name) {
+		return NamespaceConfig{}, ErrNamespaceNotFound
+	}
+
+	data, _, ch, err := cm.ZkClient.GetW(namespacesPath + "/" + name)
+	if errors.Is(err, zk.ErrNoNode) {
+		if name == DefaultNamespace {
+			return defaultNamespaceConfig(), nil
+		}
+		return NamespaceConfig{}, ErrNamespaceNotFound
+	}
+	if err != nil {
+		log.Println("Failed to get namespace config from Zookeeper:", err)
+		return NamespaceConfig{}, err
+	}
+
+	err = json.Unmarshal(data, &cfg)
+	if err != nil {
+		log.Println("Failed to unmarshal namespace config:", err)
+		return NamespaceConfig{}, err
+	}
+
+	cm.namespaces.mu.Lock()
+	if cm.namespaces.configs == nil {
+		cm.namespaces.configs = make(map[string]NamespaceConfig)
+	}
+	cm.namespaces.configs[name] = cfg
+	cm.namespaces.mu.Unlock()
+
+	// Forget the cached config as soon as it changes, the next lookup reads it again
+	go func() {
+		<-ch
+		cm.namespaces.mu.Lock()
+		delete(cm.namespaces.configs, name)
+		cm.namespaces.mu.Unlock()
+	}()
+
+	return cfg, nil
+}
+
+// PutNamespace creates a namespace or replaces its config in Zookeeper
+func (cm *ClusterManager) PutNamespace(cfg NamespaceConfig) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+
+	_, err = cm.ZkClient.Create(namespacesPath, []byte(""), 0, zk.WorldACL(zk.PermAll))
+	if err != nil && !errors.Is(err, zk.ErrNodeExists) {
+		log.Println("Failed to create namespaces node:", err)
+		return err
+	}
+
+	path := namespacesPath + "/" + cfg.Name
+	_, err = cm.ZkClient.Create(path, data, 0, zk.WorldACL(zk.PermAll))
+	if errors.Is(err, zk.ErrNodeExists) {
+		// -1 overwrites whatever version is currently stored
+		_, err = cm.ZkClient.Set(path, data, -1)
+	}
+	if err != nil {
+		log.Println("Failed to store namespace config:", err)
+		return err
+	}
+	return nil
+}
@@ -134,7 +134,8 @@ func (em *ElectionManager) RegisterMaster(createPath string) {
 		panic(err)
 	}
 	if !exists {
-		_, err := em.ZkClient.Create(masterPath, []byte(""), zk.FlagEphemeral, zk.WorldACL(zk.PermAll))
+		// The address lets followers ask the leader about entries they are in doubt about
+		_, err := em.ZkClient.Create(masterPath, []byte(fmt.Sprintf("localhost:%d", em.KvPort)), zk.FlagEphemeral, zk.WorldACL(zk.PermAll))
 		if err != nil {
 			panic(err)
 		}
@@ -0,0 +1,109 @@
+package store
+
+import (
+	"kvstore/internal/wal"
+	"sync"
+)
+
+// Entries are applied out of version order: writes to different keys commit concurrently.
+// The applied low-water mark is the highest version such that every committed entry at or below it has been applied.
+// A prepared entry holds the mark below its version in the WAL until it is committed or aborted,
+// a committed entry is announced with BeginApply before its COMMIT record is logged and holds it until Apply is done.
+// Versions that are never prepared, like the ones lost to WAL conflicts, do not hold the mark back.
+
+// pendingApplies are the committed entries that are not applied yet
+type pendingApplies struct {
+	mu        sync.Mutex
+	versions  map[int]bool
+	undecided undecidedLog
+}
+
+// undecidedLog is the log of the prepared entries, *wal.WALManager implements it
+type undecidedLog interface {
+	// OldestUndecided returns the oldest version prepared and neither committed nor aborted yet
+	OldestUndecided() (int, bool)
+}
+
+// TrackUndecided makes the prepared entries of the log hold back the applied low-water mark
+func (sm *StoreManager) TrackUndecided(log undecidedLog) {
+	sm.pending.mu.Lock()
+	defer sm.pending.mu.Unlock()
+
+	sm.pending.undecided = log
+}
+
+// BeginApply announces that the entry of version is about to be committed, it must be called before the COMMIT record
+// is logged. Apply or CancelApply ends it.
+func (sm *StoreManager) BeginApply(version int) {
+	sm.pending.mu.Lock()
+	defer sm.pending.mu.Unlock()
+
+	if sm.pending.versions == nil {
+		sm.pending.versions = make(map[int]bool)
+	}
+	sm.pending.versions[version] = true
+}
+
+// CancelApply ends BeginApply for an entry whose COMMIT record could not be logged
+func (sm *StoreManager) CancelApply(version int) {
+	sm.pending.mu.Lock()
+	defer sm.pending.mu.Unlock()
+
+	delete(sm.pending.versions, version)
+}
+
+// finishApply ends BeginApply once Apply is done with the entry and hands the new low-water mark to the engine
+func (sm *StoreManager) finishApply(version int) {
+	sm.CancelApply(version)
+	if flushed, ok := sm.Store.(flushedEngine); ok {
+		flushed.SetAppliedVersion(sm.AppliedVersion())
+	}
+}
+
+// AppliedVersion returns the applied low-water mark, it trails LatestVersion while older entries are still being applied
+func (sm *StoreManager) AppliedVersion() int {
+	sm.pending.mu.Lock()
+	defer sm.pending.mu.Unlock()
+
+	applied := sm.LatestVersion()
+	for version := range sm.pending.versions {
+		applied = min(applied, version-1)
+	}
+	if sm.pending.undecided != nil {
+		if version, ok := sm.pending.undecided.OldestUndecided(); ok {
+			applied = min(applied, version-1)
+		}
+	}
+	return applied
+}
+
+// Replay applies a committed entry again after a restart.
+// The entries above the recovered low-water mark may already be in the store, those are only recorded as applied:
+// read-modify-write entries such as INCR would otherwise be applied twice.
+func (sm *StoreManager) Replay(entry wal.WAL) error {
+	held, err := sm.holds(entry)
+	if err != nil {
+		return err
+	}
+	if !held {
+		return sm.Apply(entry)
+	}
+	sm.observeVersion(entry.Version)
+	sm.finishApply(entry.Version)
+	return nil
+}
+
+// holds tells whether the store already holds the entry: writes to a key are applied in version order,
+// so a key holding the entry's version or a newer one has been through it
+func (sm *StoreManager) holds(entry wal.WAL) (bool, error) {
+	for _, key := range entryKeys(entry) {
+		current, exists, err := sm.Store.GetVersioned(key)
+		if err != nil {
+			return false, err
+		}
+		if exists && current.Version >= entry.Version {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,61 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Condition guards a write on the current state of the key.
+// Every field that is set has to hold for the write to go ahead.
+type Condition struct {
+	// Version requires the key to currently be at this WAL version
+	Version *int `json:"version,omitempty"`
+	// Absent requires the key to not exist
+	Absent bool `json:"absent,omitempty"`
+	// Exists requires the key to exist, whatever its version
+	Exists bool `json:"exists,omitempty"`
+	// Value requires the current value to be equal to this one
+	Value *string `json:"value,omitempty"`
+}
+
+// ConditionFailedError reports the state of the key that made a condition fail
+type ConditionFailedError struct {
+	Key            string `json:"key"`
+	Exists         bool   `json:"exists"`
+	CurrentVersion int    `json:"current_version"`
+}
+
+func (e *ConditionFailedError) Error() string {
+	if !e.Exists {
+		return fmt.Sprintf("condition failed on key %s: key does not exist", e.Key)
+	}
+	return fmt.Sprintf("condition failed on key %s: current version is %d", e.Key, e.CurrentVersion)
+}
+
+// CheckCondition evaluates cond against the current state of key.
+// The caller should hold the key's lock from LockKeys so that the state cannot change before the write.
+func (sm *StoreManager) CheckCondition(key string, cond Condition) error {
+	current, exists, err := sm.Store.GetVersioned(key)
+	if err != nil {
+		return err
+	}
+
+	failed := &ConditionFailedError{Key: key, Exists: exists, CurrentVersion: -1}
+	if exists {
+		failed.CurrentVersion = current.Version
+	}
+
+	if cond.Absent && exists {
+		return failed
+	}
+	if cond.Exists && !exists {
+		return failed
+	}
+	if cond.Version != nil && (!exists || current.Version != *cond.Version) {
+		return failed
+	}
+	if cond.Value != nil && (!exists || !bytes.Equal(current.Value, []byte(*cond.Value))) {
+		return failed
+	}
+	return nil
+}
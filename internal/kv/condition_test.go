@@ -0,0 +1,51 @@
+package store
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheckCondition(t *testing.T) {
+	sm, err := NewStoreManager(Config{Engine: EngineMemory})
+	if err != nil {
+		t.Fatalf("NewStoreManager failed: %v", err)
+	}
+	sm.Store.Put("a", []byte("1"), "", 4)
+
+	version := 4
+	staleVersion := 3
+	value := "1"
+	otherValue := "2"
+
+	cases := []struct {
+		name string
+		key  string
+		cond Condition
+		ok   bool
+	}{
+		{"version matches", "a", Condition{Version: &version}, true},
+		{"version is stale", "a", Condition{Version: &staleVersion}, false},
+		{"absent on existing key", "a", Condition{Absent: true}, false},
+		{"absent on missing key", "b", Condition{Absent: true}, true},
+		{"exists on missing key", "b", Condition{Exists: true}, false},
+		{"value matches", "a", Condition{Value: &value}, true},
+		{"value differs", "a", Condition{Value: &otherValue}, false},
+		{"version on missing key", "b", Condition{Version: &version}, false},
+	}
+	for _, c := range cases {
+		err := sm.CheckCondition(c.key, c.cond)
+		if c.ok && err != nil {
+			t.Errorf("%s: unexpected error %v", c.name, err)
+		}
+		var failed *ConditionFailedError
+		if !c.ok && !errors.As(err, &failed) {
+			t.Errorf("%s: expected ConditionFailedError, got %v", c.name, err)
+		}
+	}
+
+	err = sm.CheckCondition("a", Condition{Version: &staleVersion})
+	var failed *ConditionFailedError
+	if errors.As(err, &failed) && (!failed.Exists || failed.CurrentVersion != 4) {
+		t.Fatalf("failed condition reported %+v; want current version 4", failed)
+	}
+}
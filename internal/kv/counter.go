@@ -0,0 +1,72 @@
+package store
+
+import (
+	"errors"
+	"kvstore/internal/wal"
+	"math"
+	"strconv"
+)
+
+var (
+	ErrNotInteger      = errors.New("value is not an integer")
+	ErrCounterOverflow = errors.New("increment would overflow the counter")
+)
+
+// counterSize is the largest size a counter can take, an int64 is at most 20 characters
+const counterSize = 20
+
+// CounterDelta is what a counter entry adds to the current value
+func CounterDelta(entry wal.WAL) int64 {
+	switch entry.Type {
+	case "INCR":
+		return 1
+	case "DECR":
+		return -1
+	default:
+		return entry.Delta
+	}
+}
+
+// NextCounterValue returns the value the counter would have after adding delta.
+// A missing key counts as 0. The leader calls it before the prepare phase so that bad increments never reach the WAL.
+func (sm *StoreManager) NextCounterValue(key string, delta int64) (int64, error) {
+	current, exists, err := sm.Store.GetVersioned(key)
+	if err != nil {
+		return 0, err
+	}
+	return addToCounter(current, exists, delta)
+}
+
+func addToCounter(current Versioned, exists bool, delta int64) (int64, error) {
+	var value int64
+	if exists {
+		var err error
+		value, err = strconv.ParseInt(string(current.Value), 10, 64)
+		if err != nil {
+			return 0, ErrNotInteger
+		}
+	}
+	if (delta > 0 && value > math.MaxInt64-delta) || (delta < 0 && value < math.MinInt64-delta) {
+		return 0, ErrCounterOverflow
+	}
+	return value + delta, nil
+}
+
+// applyCounter adds the entry's delta to the counter and returns the new value.
+// An existing counter keeps its expiry, a new one gets the entry's TTL.
+func (sm *StoreManager) applyCounter(entry wal.WAL) ([]byte, error) {
+	current, exists, err := sm.Store.GetVersioned(entry.Key)
+	if err != nil {
+		return nil, err
+	}
+	next, err := addToCounter(current, exists, CounterDelta(entry))
+	if err != nil {
+		return nil, err
+	}
+
+	value := []byte(strconv.FormatInt(next, 10))
+	if err := sm.writeKeepingExpiry(entry, current, exists, value, "text/plain"); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
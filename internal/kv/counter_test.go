@@ -0,0 +1,72 @@
+package store
+
+import (
+	"errors"
+	"kvstore/internal/wal"
+	"math"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestCounterEntries(t *testing.T) {
+	sm, err := NewStoreManager(Config{Engine: EngineMemory})
+	if err != nil {
+		t.Fatalf("NewStoreManager failed: %v", err)
+	}
+
+	entries := []wal.WAL{
+		{Type: "INCR", Key: "hits", Version: 1},
+		{Type: "INCR", Key: "hits", Version: 2},
+		{Type: "INCRBY", Key: "hits", Delta: 10, Version: 3},
+		{Type: "DECR", Key: "hits", Version: 4},
+	}
+	for _, entry := range entries {
+		if err := sm.Apply(entry); err != nil {
+			t.Fatalf("Apply(%s) failed: %v", entry.Type, err)
+		}
+	}
+	expectValue(t, sm.Store, "hits", "11")
+
+	next, err := sm.NextCounterValue("hits", -20)
+	if err != nil || next != -9 {
+		t.Fatalf("NextCounterValue(hits, -20) = %d, %v; want -9", next, err)
+	}
+}
+
+func TestCounterKeepsExpiryOfExistingKey(t *testing.T) {
+	sm, err := NewStoreManager(Config{Engine: EngineMemory})
+	if err != nil {
+		t.Fatalf("NewStoreManager failed: %v", err)
+	}
+	now := time.Now()
+	sm.Apply(wal.WAL{Type: "INCR", Key: "quota", TTL: 60, Timestamp: now.UnixNano(), Version: 1})
+	// A later TTL on the entry does not move the deadline of the existing counter
+	sm.Apply(wal.WAL{Type: "INCR", Key: "quota", TTL: 3600, Timestamp: now.UnixNano(), Version: 2})
+
+	current, _, _ := sm.Store.GetVersioned("quota")
+	want := now.Add(60 * time.Second).UnixNano()
+	if string(current.Value) != "2" || current.ExpiresAt != want {
+		t.Fatalf("GetVersioned(quota) = %q expiring at %d; want %q expiring at %d", current.Value, current.ExpiresAt, "2", want)
+	}
+}
+
+func TestCounterRejectsBadValues(t *testing.T) {
+	sm, err := NewStoreManager(Config{Engine: EngineMemory})
+	if err != nil {
+		t.Fatalf("NewStoreManager failed: %v", err)
+	}
+	sm.Store.Put("name", []byte("bob"), "", 1)
+	sm.Store.Put("max", []byte(strconv.FormatInt(math.MaxInt64, 10)), "", 2)
+
+	if _, err := sm.NextCounterValue("name", 1); !errors.Is(err, ErrNotInteger) {
+		t.Fatalf("NextCounterValue(name) = %v; want ErrNotInteger", err)
+	}
+	if _, err := sm.NextCounterValue("max", 1); !errors.Is(err, ErrCounterOverflow) {
+		t.Fatalf("NextCounterValue(max) = %v; want ErrCounterOverflow", err)
+	}
+	if err := sm.Apply(wal.WAL{Type: "INCR", Key: "name", Version: 3}); !errors.Is(err, ErrNotInteger) {
+		t.Fatalf("Apply(INCR name) = %v; want ErrNotInteger", err)
+	}
+	expectValue(t, sm.Store, "name", "bob")
+}
@@ -0,0 +1,365 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kvstore/internal/wal"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// ContentTypeJSON marks a value stored through the document routes, it always holds valid JSON
+const ContentTypeJSON = "application/json"
+
+var (
+	ErrInvalidDocument  = errors.New("document is not valid JSON")
+	ErrDocumentNotFound = errors.New("document does not exist")
+	ErrPathNotFound     = errors.New("path does not exist in the document")
+	ErrInvalidPatch     = errors.New("invalid patch")
+	ErrPatchTestFailed  = errors.New("patch test operation failed")
+)
+
+// PatchOp is a JSON Patch (RFC 6902) operation. Paths are JSON Pointers (RFC 6901).
+// Besides the standard operations, "set" writes a value and creates the missing parent objects on the way.
+type PatchOp struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// decodeJSON keeps numbers as json.Number so that documents do not lose precision on the way through
+func decodeJSON(data []byte) (any, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var v any
+	if err := decoder.Decode(&v); err != nil {
+		return nil, err
+	}
+	if decoder.More() {
+		return nil, errors.New("trailing data after the JSON value")
+	}
+	return v, nil
+}
+
+// ValidateDocument checks that the value is a single JSON value
+func ValidateDocument(value []byte) error {
+	if _, err := decodeJSON(value); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidDocument, err)
+	}
+	return nil
+}
+
+func parsePointer(path string) ([]string, error) {
+	if path == "" {
+		return nil, nil
+	}
+	if path[0] != '/' {
+		return nil, fmt.Errorf("%w: path %q does not start with /", ErrInvalidPatch, path)
+	}
+	tokens := strings.Split(path[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// arrayIndex parses an array index token, "-" is accepted as len(array) only when allowEnd is set
+func arrayIndex(token string, length int, allowEnd bool) (int, error) {
+	if token == "-" && allowEnd {
+		return length, nil
+	}
+	index, err := strconv.Atoi(token)
+	if err != nil || index < 0 || (token != "0" && token[0] == '0') {
+		return 0, fmt.Errorf("%w: invalid array index %q", ErrInvalidPatch, token)
+	}
+	limit := length - 1
+	if allowEnd {
+		limit = length
+	}
+	if index > limit {
+		return 0, fmt.Errorf("%w: array index %d out of range", ErrPathNotFound, index)
+	}
+	return index, nil
+}
+
+func lookup(doc any, tokens []string) (any, error) {
+	for _, token := range tokens {
+		switch node := doc.(type) {
+		case map[string]any:
+			child, ok := node[token]
+			if !ok {
+				return nil, ErrPathNotFound
+			}
+			doc = child
+		case []any:
+			index, err := arrayIndex(token, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = node[index]
+		default:
+			return nil, ErrPathNotFound
+		}
+	}
+	return doc, nil
+}
+
+// mutate rebuilds the path down to the parent of the last token and lets fn change that parent
+func mutate(doc any, tokens []string, create bool, fn func(parent any, token string) (any, error)) (any, error) {
+	if len(tokens) == 1 {
+		return fn(doc, tokens[0])
+	}
+	switch node := doc.(type) {
+	case map[string]any:
+		child, ok := node[tokens[0]]
+		if !ok {
+			if !create {
+				return nil, ErrPathNotFound
+			}
+			child = map[string]any{}
+		}
+		updated, err := mutate(child, tokens[1:], create, fn)
+		if err != nil {
+			return nil, err
+		}
+		node[tokens[0]] = updated
+		return node, nil
+	case []any:
+		index, err := arrayIndex(tokens[0], len(node), false)
+		if err != nil {
+			return nil, err
+		}
+		updated, err := mutate(node[index], tokens[1:], create, fn)
+		if err != nil {
+			return nil, err
+		}
+		node[index] = updated
+		return node, nil
+	default:
+		return nil, ErrPathNotFound
+	}
+}
+
+func addValue(doc any, tokens []string, value any, create bool) (any, error) {
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	return mutate(doc, tokens, create, func(parent any, token string) (any, error) {
+		switch node := parent.(type) {
+		case map[string]any:
+			node[token] = value
+			return node, nil
+		case []any:
+			if create && token != "-" {
+				// set replaces an existing element instead of inserting before it
+				index, err := arrayIndex(token, len(node), false)
+				if err != nil {
+					return nil, err
+				}
+				node[index] = value
+				return node, nil
+			}
+			index, err := arrayIndex(token, len(node), true)
+			if err != nil {
+				return nil, err
+			}
+			node = append(node, nil)
+			copy(node[index+1:], node[index:])
+			node[index] = value
+			return node, nil
+		default:
+			return nil, ErrPathNotFound
+		}
+	})
+}
+
+func removeValue(doc any, tokens []string) (any, error) {
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("%w: the whole document cannot be removed", ErrInvalidPatch)
+	}
+	return mutate(doc, tokens, false, func(parent any, token string) (any, error) {
+		switch node := parent.(type) {
+		case map[string]any:
+			if _, ok := node[token]; !ok {
+				return nil, ErrPathNotFound
+			}
+			delete(node, token)
+			return node, nil
+		case []any:
+			index, err := arrayIndex(token, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			return append(node[:index], node[index+1:]...), nil
+		default:
+			return nil, ErrPathNotFound
+		}
+	})
+}
+
+// ApplyPatch applies the operations in order to the document and returns the patched document.
+// Either every operation applies or an error is returned.
+func ApplyPatch(document []byte, ops []PatchOp) ([]byte, error) {
+	doc, err := decodeJSON(document)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidDocument, err)
+	}
+
+	for i, op := range ops {
+		doc, err = applyPatchOp(doc, op)
+		if err != nil {
+			return nil, fmt.Errorf("patch operation %d (%s %s): %w", i, op.Op, op.Path, err)
+		}
+	}
+	return json.Marshal(doc)
+}
+
+func applyPatchOp(doc any, op PatchOp) (any, error) {
+	tokens, err := parsePointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	var value any
+	switch op.Op {
+	case "add", "replace", "test", "set":
+		if len(op.Value) == 0 {
+			return nil, fmt.Errorf("%w: missing value", ErrInvalidPatch)
+		}
+		if value, err = decodeJSON(op.Value); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+		}
+	case "move", "copy":
+		from, err := parsePointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+		if value, err = lookup(doc, from); err != nil {
+			return nil, err
+		}
+		if op.Op == "copy" {
+			// The copy must not share maps or slices with the original
+			encoded, _ := json.Marshal(value)
+			value, _ = decodeJSON(encoded)
+			break
+		}
+		if op.Path == op.From {
+			return doc, nil
+		}
+		if strings.HasPrefix(op.Path, op.From+"/") {
+			return nil, fmt.Errorf("%w: cannot move a value into itself", ErrInvalidPatch)
+		}
+		if doc, err = removeValue(doc, from); err != nil {
+			return nil, err
+		}
+	}
+
+	switch op.Op {
+	case "add", "move", "copy":
+		return addValue(doc, tokens, value, false)
+	case "set":
+		return addValue(doc, tokens, value, true)
+	case "remove":
+		return removeValue(doc, tokens)
+	case "replace":
+		if _, err := lookup(doc, tokens); err != nil {
+			return nil, err
+		}
+		if len(tokens) == 0 {
+			return value, nil
+		}
+		if doc, err = removeValue(doc, tokens); err != nil {
+			return nil, err
+		}
+		return addValue(doc, tokens, value, false)
+	case "test":
+		current, err := lookup(doc, tokens)
+		if err != nil {
+			return nil, ErrPatchTestFailed
+		}
+		if !jsonEqual(current, value) {
+			return nil, ErrPatchTestFailed
+		}
+		return doc, nil
+	default:
+		return nil, fmt.Errorf("%w: unknown operation %q", ErrInvalidPatch, op.Op)
+	}
+}
+
+// jsonEqual compares two decoded values, numbers are compared by value and not by how they were written
+func jsonEqual(a, b any) bool {
+	normalize := func(v any) any {
+		encoded, _ := json.Marshal(v)
+		var out any
+		json.Unmarshal(encoded, &out)
+		return out
+	}
+	return reflect.DeepEqual(normalize(a), normalize(b))
+}
+
+// Document returns the JSON stored at key, or the part of it at the JSON Pointer path
+func (sm *StoreManager) Document(key string, path string) (json.RawMessage, Versioned, error) {
+	current, exists, err := sm.Store.GetVersioned(key)
+	if err != nil {
+		return nil, current, err
+	}
+	if !exists {
+		return nil, current, ErrDocumentNotFound
+	}
+	if current.ContentType != ContentTypeJSON {
+		return nil, current, ErrWrongType
+	}
+	if path == "" {
+		return current.Value, current, nil
+	}
+
+	tokens, err := parsePointer(path)
+	if err != nil {
+		return nil, current, err
+	}
+	doc, err := decodeJSON(current.Value)
+	if err != nil {
+		return nil, current, fmt.Errorf("%w: %v", ErrInvalidDocument, err)
+	}
+	part, err := lookup(doc, tokens)
+	if err != nil {
+		return nil, current, ErrPathNotFound
+	}
+	encoded, err := json.Marshal(part)
+	return encoded, current, err
+}
+
+// nextPatchedValue returns the document the key will hold once the PATCH entry is applied.
+// The entry's value holds the patch operations.
+func (sm *StoreManager) nextPatchedValue(entry wal.WAL) ([]byte, Versioned, error) {
+	var ops []PatchOp
+	if err := json.Unmarshal(entry.Value, &ops); err != nil {
+		return nil, Versioned{}, fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+	}
+	document, current, err := sm.Document(entry.Key, "")
+	if err != nil {
+		return nil, current, err
+	}
+	patched, err := ApplyPatch(document, ops)
+	return patched, current, err
+}
+
+// CheckPatch fails when the PATCH entry cannot be applied to the current document.
+// The leader calls it before the prepare phase so that failing patches never reach the WAL.
+func (sm *StoreManager) CheckPatch(entry wal.WAL) error {
+	_, _, err := sm.nextPatchedValue(entry)
+	return err
+}
+
+// applyPatch replaces the document with its patched version, the key keeps its expiry
+func (sm *StoreManager) applyPatch(entry wal.WAL) error {
+	patched, current, err := sm.nextPatchedValue(entry)
+	if err != nil {
+		return err
+	}
+	return sm.writeKeepingExpiry(entry, current, true, patched, ContentTypeJSON)
+}
@@ -0,0 +1,124 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"kvstore/internal/wal"
+	"testing"
+)
+
+func patchOps(t *testing.T, raw string) []PatchOp {
+	t.Helper()
+	var ops []PatchOp
+	if err := json.Unmarshal([]byte(raw), &ops); err != nil {
+		t.Fatalf("bad patch in test: %v", err)
+	}
+	return ops
+}
+
+func expectJSON(t *testing.T, got []byte, want string) {
+	t.Helper()
+	if !jsonEqual(mustDecode(t, got), mustDecode(t, []byte(want))) {
+		t.Fatalf("got %s; want %s", got, want)
+	}
+}
+
+func mustDecode(t *testing.T, data []byte) any {
+	t.Helper()
+	v, err := decodeJSON(data)
+	if err != nil {
+		t.Fatalf("decodeJSON(%s) failed: %v", data, err)
+	}
+	return v
+}
+
+func TestApplyPatch(t *testing.T) {
+	cases := []struct {
+		name  string
+		doc   string
+		patch string
+		want  string
+	}{
+		{"add member", `{"a":1}`, `[{"op":"add","path":"/b","value":[1,2]}]`, `{"a":1,"b":[1,2]}`},
+		{"insert into array", `{"a":[1,3]}`, `[{"op":"add","path":"/a/1","value":2}]`, `{"a":[1,2,3]}`},
+		{"append to array", `{"a":[1]}`, `[{"op":"add","path":"/a/-","value":2}]`, `{"a":[1,2]}`},
+		{"remove", `{"a":1,"b":{"c":[1,2]}}`, `[{"op":"remove","path":"/b/c/0"},{"op":"remove","path":"/a"}]`, `{"b":{"c":[2]}}`},
+		{"replace", `{"a":{"b":1}}`, `[{"op":"replace","path":"/a/b","value":"x"}]`, `{"a":{"b":"x"}}`},
+		{"move", `{"a":{"b":1},"c":{}}`, `[{"op":"move","from":"/a/b","path":"/c/d"}]`, `{"a":{},"c":{"d":1}}`},
+		{"copy", `{"a":{"b":[1]}}`, `[{"op":"copy","from":"/a","path":"/c"},{"op":"add","path":"/c/b/-","value":2}]`, `{"a":{"b":[1]},"c":{"b":[1,2]}}`},
+		{"test then replace", `{"n":1.0}`, `[{"op":"test","path":"/n","value":1},{"op":"replace","path":"/n","value":2}]`, `{"n":2}`},
+		{"escaped pointer", `{"a/b":{"m~n":1}}`, `[{"op":"replace","path":"/a~1b/m~0n","value":2}]`, `{"a/b":{"m~n":2}}`},
+		{"set creates parents", `{}`, `[{"op":"set","path":"/profile/email","value":"a@b.c"}]`, `{"profile":{"email":"a@b.c"}}`},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := ApplyPatch([]byte(c.doc), patchOps(t, c.patch))
+			if err != nil {
+				t.Fatalf("ApplyPatch failed: %v", err)
+			}
+			expectJSON(t, got, c.want)
+		})
+	}
+}
+
+func TestApplyPatchKeepsNumberPrecision(t *testing.T) {
+	got, err := ApplyPatch([]byte(`{"id":12345678901234567890}`), patchOps(t, `[{"op":"add","path":"/x","value":1.50}]`))
+	if err != nil {
+		t.Fatalf("ApplyPatch failed: %v", err)
+	}
+	if string(got) != `{"id":12345678901234567890,"x":1.50}` {
+		t.Fatalf("ApplyPatch = %s; numbers were rewritten", got)
+	}
+}
+
+func TestApplyPatchErrors(t *testing.T) {
+	cases := []struct {
+		name  string
+		patch string
+		want  error
+	}{
+		{"test fails", `[{"op":"test","path":"/a","value":2}]`, ErrPatchTestFailed},
+		{"missing path", `[{"op":"replace","path":"/missing","value":2}]`, ErrPathNotFound},
+		{"missing parent", `[{"op":"add","path":"/x/y","value":2}]`, ErrPathNotFound},
+		{"bad pointer", `[{"op":"add","path":"a","value":2}]`, ErrInvalidPatch},
+		{"unknown op", `[{"op":"merge","path":"/a"}]`, ErrInvalidPatch},
+		{"move into itself", `[{"op":"move","from":"/b","path":"/b/c"}]`, ErrInvalidPatch},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := ApplyPatch([]byte(`{"a":1,"b":{}}`), patchOps(t, c.patch))
+			if !errors.Is(err, c.want) {
+				t.Fatalf("ApplyPatch = %v; want %v", err, c.want)
+			}
+		})
+	}
+}
+
+func TestPatchEntryAndSubPath(t *testing.T) {
+	sm, _ := NewStoreManager(Config{Engine: EngineMemory})
+	patch := []byte(`[{"op":"add","path":"/tags/-","value":"new"}]`)
+	applyAll(t, sm,
+		wal.WAL{Type: "PUT", Key: "doc", Value: []byte(`{"name":"bob","tags":["a"]}`), ContentType: ContentTypeJSON},
+		wal.WAL{Type: "PATCH", Key: "doc", Value: patch},
+	)
+
+	part, current, err := sm.Document("doc", "/tags")
+	if err != nil {
+		t.Fatalf("Document(doc, /tags) failed: %v", err)
+	}
+	expectJSON(t, part, `["a","new"]`)
+	if current.Version != 2 {
+		t.Fatalf("document version = %d; want 2", current.Version)
+	}
+	if _, _, err := sm.Document("doc", "/missing"); !errors.Is(err, ErrPathNotFound) {
+		t.Fatalf("Document(doc, /missing) = %v; want ErrPathNotFound", err)
+	}
+
+	applyAll(t, sm, wal.WAL{Type: "PUT", Key: "plain", Value: []byte(`{}`), ContentType: "text/plain"})
+	if err := sm.CheckPatch(wal.WAL{Type: "PATCH", Key: "plain", Value: patch}); !errors.Is(err, ErrWrongType) {
+		t.Fatalf("CheckPatch(plain) = %v; want ErrWrongType", err)
+	}
+	if err := sm.CheckPatch(wal.WAL{Type: "PATCH", Key: "missing", Value: patch}); !errors.Is(err, ErrDocumentNotFound) {
+		t.Fatalf("CheckPatch(missing) = %v; want ErrDocumentNotFound", err)
+	}
+}
@@ -0,0 +1,219 @@
+package store
+
+import (
+	"container/heap"
+	"container/list"
+	"fmt"
+	"math/rand"
+)
+
+const (
+	// EvictionNone rejects writes once the memory budget is used up
+	EvictionNone   = "noeviction"
+	EvictionLRU    = "lru"
+	EvictionLFU    = "lfu"
+	EvictionRandom = "random"
+)
+
+// EvictionPolicy decides which key goes first when the memory budget is hit.
+// Policies are not safe for concurrent use, the memory tracker serializes every call.
+type EvictionPolicy interface {
+	// Add starts tracking a key that was just written for the first time
+	Add(key string)
+	// Touch records an access to a tracked key, writes count as accesses too
+	Touch(key string)
+	Remove(key string)
+	// Victim returns the key to evict next, skipping the excluded ones
+	Victim(exclude map[string]bool) (string, bool)
+}
+
+func NewEvictionPolicy(name string) (EvictionPolicy, error) {
+	switch name {
+	case EvictionNone, "":
+		return nil, nil
+	case EvictionLRU:
+		return newLRUPolicy(), nil
+	case EvictionLFU:
+		return newLFUPolicy(), nil
+	case EvictionRandom:
+		return newRandomPolicy(), nil
+	default:
+		return nil, fmt.Errorf("unknown eviction policy: %s", name)
+	}
+}
+
+// lruPolicy keeps keys in access order, the front is the most recently used
+type lruPolicy struct {
+	order *list.List
+	keys  map[string]*list.Element
+}
+
+func newLRUPolicy() *lruPolicy {
+	return &lruPolicy{order: list.New(), keys: make(map[string]*list.Element)}
+}
+
+func (p *lruPolicy) Add(key string) {
+	if _, ok := p.keys[key]; ok {
+		p.Touch(key)
+		return
+	}
+	p.keys[key] = p.order.PushFront(key)
+}
+
+func (p *lruPolicy) Touch(key string) {
+	if elem, ok := p.keys[key]; ok {
+		p.order.MoveToFront(elem)
+	}
+}
+
+func (p *lruPolicy) Remove(key string) {
+	if elem, ok := p.keys[key]; ok {
+		p.order.Remove(elem)
+		delete(p.keys, key)
+	}
+}
+
+func (p *lruPolicy) Victim(exclude map[string]bool) (string, bool) {
+	for elem := p.order.Back(); elem != nil; elem = elem.Prev() {
+		key := elem.Value.(string)
+		if !exclude[key] {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// lfuItem is a key in the LFU heap, ties on the count go to the key that was added first
+type lfuItem struct {
+	key   string
+	count uint64
+	seq   uint64
+	index int
+}
+
+type lfuHeap []*lfuItem
+
+func (h lfuHeap) Len() int { return len(h) }
+func (h lfuHeap) Less(i, j int) bool {
+	if h[i].count != h[j].count {
+		return h[i].count < h[j].count
+	}
+	return h[i].seq < h[j].seq
+}
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *lfuHeap) Push(x any) {
+	item := x.(*lfuItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+func (h *lfuHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+// lfuPolicy evicts the key with the fewest accesses
+type lfuPolicy struct {
+	heap lfuHeap
+	keys map[string]*lfuItem
+	seq  uint64
+}
+
+func newLFUPolicy() *lfuPolicy {
+	return &lfuPolicy{keys: make(map[string]*lfuItem)}
+}
+
+func (p *lfuPolicy) Add(key string) {
+	if _, ok := p.keys[key]; ok {
+		p.Touch(key)
+		return
+	}
+	p.seq++
+	item := &lfuItem{key: key, count: 1, seq: p.seq}
+	heap.Push(&p.heap, item)
+	p.keys[key] = item
+}
+
+func (p *lfuPolicy) Touch(key string) {
+	if item, ok := p.keys[key]; ok {
+		item.count++
+		heap.Fix(&p.heap, item.index)
+	}
+}
+
+func (p *lfuPolicy) Remove(key string) {
+	if item, ok := p.keys[key]; ok {
+		heap.Remove(&p.heap, item.index)
+		delete(p.keys, key)
+	}
+}
+
+func (p *lfuPolicy) Victim(exclude map[string]bool) (string, bool) {
+	// Excluded keys are popped out of the way and pushed back afterwards
+	var skipped []*lfuItem
+	defer func() {
+		for _, item := range skipped {
+			heap.Push(&p.heap, item)
+		}
+	}()
+	for p.heap.Len() > 0 {
+		item := p.heap[0]
+		if !exclude[item.key] {
+			return item.key, true
+		}
+		skipped = append(skipped, heap.Pop(&p.heap).(*lfuItem))
+	}
+	return "", false
+}
+
+// randomPolicy evicts any key, keys sit in a slice so that picking one is O(1)
+type randomPolicy struct {
+	keys  []string
+	index map[string]int
+}
+
+func newRandomPolicy() *randomPolicy {
+	return &randomPolicy{index: make(map[string]int)}
+}
+
+func (p *randomPolicy) Add(key string) {
+	if _, ok := p.index[key]; ok {
+		return
+	}
+	p.index[key] = len(p.keys)
+	p.keys = append(p.keys, key)
+}
+
+func (p *randomPolicy) Touch(key string) {}
+
+func (p *randomPolicy) Remove(key string) {
+	i, ok := p.index[key]
+	if !ok {
+		return
+	}
+	last := len(p.keys) - 1
+	p.keys[i] = p.keys[last]
+	p.index[p.keys[i]] = i
+	p.keys = p.keys[:last]
+	delete(p.index, key)
+}
+
+func (p *randomPolicy) Victim(exclude map[string]bool) (string, bool) {
+	if len(p.keys) == 0 {
+		return "", false
+	}
+	// Start at a random position and walk until a key that is not excluded turns up
+	start := rand.Intn(len(p.keys))
+	for i := range p.keys {
+		key := p.keys[(start+i)%len(p.keys)]
+		if !exclude[key] {
+			return key, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,178 @@
+package store
+
+import (
+	"errors"
+	"kvstore/internal/wal"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLRUPolicyEvictsLeastRecentlyUsed(t *testing.T) {
+	p := newLRUPolicy()
+	p.Add("a")
+	p.Add("b")
+	p.Add("c")
+	p.Touch("a")
+
+	if key, _ := p.Victim(nil); key != "b" {
+		t.Fatalf("Victim = %q; want %q", key, "b")
+	}
+	if key, _ := p.Victim(map[string]bool{"b": true}); key != "c" {
+		t.Fatalf("Victim excluding b = %q; want %q", key, "c")
+	}
+	p.Remove("b")
+	p.Remove("c")
+	if key, _ := p.Victim(nil); key != "a" {
+		t.Fatalf("Victim = %q; want %q", key, "a")
+	}
+}
+
+func TestLFUPolicyEvictsLeastFrequentlyUsed(t *testing.T) {
+	p := newLFUPolicy()
+	p.Add("a")
+	p.Add("b")
+	p.Add("c")
+	p.Touch("a")
+	p.Touch("a")
+	p.Touch("b")
+
+	if key, _ := p.Victim(nil); key != "c" {
+		t.Fatalf("Victim = %q; want %q", key, "c")
+	}
+	if key, _ := p.Victim(map[string]bool{"c": true}); key != "b" {
+		t.Fatalf("Victim excluding c = %q; want %q", key, "b")
+	}
+	// Skipped keys must still be tracked afterwards
+	if key, _ := p.Victim(nil); key != "c" {
+		t.Fatalf("Victim after exclusion = %q; want %q", key, "c")
+	}
+}
+
+func TestRandomPolicyOnlyReturnsTrackedKeys(t *testing.T) {
+	p := newRandomPolicy()
+	p.Add("a")
+	p.Add("b")
+	p.Remove("a")
+
+	for i := 0; i < 10; i++ {
+		if key, ok := p.Victim(nil); !ok || key != "b" {
+			t.Fatalf("Victim = %q, %v; want %q", key, ok, "b")
+		}
+	}
+	if _, ok := p.Victim(map[string]bool{"b": true}); ok {
+		t.Fatalf("Victim found a key although every key is excluded")
+	}
+}
+
+func putEntry(key string, value string, version int) wal.WAL {
+	return wal.WAL{Type: "PUT", Key: key, Value: []byte(value), Version: version}
+}
+
+func TestNoEvictionRejectsWritesOverBudget(t *testing.T) {
+	sm, err := NewStoreManager(Config{Engine: EngineMemory, MaxMemory: 2 * (entryOverhead + 2), EvictionPolicy: EvictionNone})
+	if err != nil {
+		t.Fatalf("NewStoreManager failed: %v", err)
+	}
+	sm.Apply(putEntry("a", "1", 1))
+	sm.Apply(putEntry("b", "2", 2))
+
+	// Overwriting with a value of the same size still fits
+	if _, _, err := sm.EvictionVictims(putEntry("a", "3", 3)); err != nil {
+		t.Fatalf("EvictionVictims(overwrite) failed: %v", err)
+	}
+	if _, _, err := sm.EvictionVictims(putEntry("c", "3", 3)); !errors.Is(err, ErrMemoryBudgetExceeded) {
+		t.Fatalf("EvictionVictims(new key) = %v; want ErrMemoryBudgetExceeded", err)
+	}
+	if stats := sm.MemoryStats(); stats.Rejections != 1 || stats.Keys != 2 {
+		t.Fatalf("MemoryStats = %+v; want 1 rejection and 2 keys", stats)
+	}
+}
+
+func TestLRUEvictionIsAppliedAsWALEntry(t *testing.T) {
+	sm, err := NewStoreManager(Config{Engine: EngineMemory, MaxMemory: 3 * (entryOverhead + 2), EvictionPolicy: EvictionLRU})
+	if err != nil {
+		t.Fatalf("NewStoreManager failed: %v", err)
+	}
+	sm.Apply(putEntry("a", "1", 1))
+	sm.Apply(putEntry("b", "2", 2))
+	sm.Apply(putEntry("c", "3", 3))
+	sm.Touch("a")
+
+	incoming := putEntry("d", strings.Repeat("x", entryOverhead), 5)
+	victims, release, err := sm.EvictionVictims(incoming)
+	if err != nil {
+		t.Fatalf("EvictionVictims failed: %v", err)
+	}
+	release()
+	if !reflect.DeepEqual(victims, []string{"b", "c"}) {
+		t.Fatalf("EvictionVictims = %v; want [b c]", victims)
+	}
+
+	evict := wal.WAL{Type: "EVICT", Version: 4}
+	for _, key := range victims {
+		evict.Ops = append(evict.Ops, wal.Op{Type: "DELETE", Key: key})
+	}
+	if err := sm.Apply(evict); err != nil {
+		t.Fatalf("Apply(EVICT) failed: %v", err)
+	}
+	if err := sm.Apply(incoming); err != nil {
+		t.Fatalf("Apply(PUT) failed: %v", err)
+	}
+
+	expectValue(t, sm.Store, "a", "1")
+	expectValue(t, sm.Store, "b", "")
+	stats := sm.MemoryStats()
+	if stats.Evictions != 2 || stats.Keys != 2 || stats.UsedBytes > stats.BudgetBytes {
+		t.Fatalf("MemoryStats = %+v; want 2 evictions, 2 keys and usage within budget", stats)
+	}
+}
+
+func TestEvictionSkipsLockedKeys(t *testing.T) {
+	sm, err := NewStoreManager(Config{Engine: EngineMemory, MaxMemory: 2 * (entryOverhead + 2), EvictionPolicy: EvictionLRU})
+	if err != nil {
+		t.Fatalf("NewStoreManager failed: %v", err)
+	}
+	sm.Apply(putEntry("a", "1", 1))
+	sm.Apply(putEntry("b", "2", 2))
+
+	// a is the least recently used key, but a writer holds it
+	unlock := sm.LockKeys("a")
+	victims, release, err := sm.EvictionVictims(putEntry("c", "3", 3))
+	if err != nil || !reflect.DeepEqual(victims, []string{"b"}) {
+		t.Fatalf("EvictionVictims = %v, %v; want [b]", victims, err)
+	}
+	// b stays locked until the eviction is done
+	if sm.keyLocks.stripes[keyStripe("b")].TryLock() {
+		t.Fatalf("the victim b is not locked")
+	}
+	release()
+	unlock()
+}
+
+func TestEvictionReservesRoomUntilReleased(t *testing.T) {
+	sm, err := NewStoreManager(Config{Engine: EngineMemory, MaxMemory: 3 * (entryOverhead + 2), EvictionPolicy: EvictionLRU})
+	if err != nil {
+		t.Fatalf("NewStoreManager failed: %v", err)
+	}
+	sm.Apply(putEntry("a", "1", 1))
+	sm.Apply(putEntry("b", "2", 2))
+
+	// c takes the last room, d has to evict even though c is not applied yet
+	_, releaseC, err := sm.EvictionVictims(putEntry("c", "3", 3))
+	if err != nil {
+		t.Fatalf("EvictionVictims(c) failed: %v", err)
+	}
+	victims, releaseD, err := sm.EvictionVictims(putEntry("d", "4", 4))
+	if err != nil || !reflect.DeepEqual(victims, []string{"a"}) {
+		t.Fatalf("EvictionVictims(d) = %v, %v; want [a]", victims, err)
+	}
+	// a is already being evicted for d, e picks the next key
+	victims, releaseE, err := sm.EvictionVictims(putEntry("e", "5", 5))
+	if err != nil || !reflect.DeepEqual(victims, []string{"b"}) {
+		t.Fatalf("EvictionVictims(e) = %v, %v; want [b]", victims, err)
+	}
+	releaseC()
+	releaseD()
+	releaseE()
+}
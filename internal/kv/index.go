@@ -0,0 +1,306 @@
+package store
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kvstore/pkg/kvstore/engine"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	IndexString = "string"
+	IndexNumber = "number"
+)
+
+var (
+	ErrIndexNotFound     = errors.New("index not found")
+	ErrInvalidIndexQuery = errors.New("invalid index query")
+)
+
+// IndexSpec declares a secondary index on a JSON path of the values of a namespace
+type IndexSpec struct {
+	Name string `json:"name"`
+	// Path is a JSON Pointer into the value, values that are not JSON or lack the path are not indexed
+	Path string `json:"path"`
+	// Type is IndexString or IndexNumber, values of another JSON type are not indexed
+	Type string `json:"type"`
+}
+
+func (spec IndexSpec) Validate() error {
+	if spec.Name == "" {
+		return errors.New("index name cannot be empty")
+	}
+	if _, err := parsePointer(spec.Path); err != nil || spec.Path == "" {
+		return fmt.Errorf("index %s has an invalid path: %q", spec.Name, spec.Path)
+	}
+	if spec.Type != IndexString && spec.Type != IndexNumber {
+		return fmt.Errorf("index %s has an unknown type: %q", spec.Name, spec.Type)
+	}
+	return nil
+}
+
+// secondaryIndex maps encoded field values to stored keys.
+// Its entries are keyed by the encoded value followed by the stored key and hold the stored key.
+type secondaryIndex struct {
+	spec    IndexSpec
+	tokens  []string
+	entries *engine.OrderedMap
+	// byKey remembers the entry key of every indexed stored key, so that updates can drop the old one
+	byKey map[string]string
+}
+
+// indexSet holds the indexes of every namespace
+type indexSet struct {
+	mu         sync.RWMutex
+	namespaces map[string]map[string]*secondaryIndex
+}
+
+// encodeIndexValue turns a field value into a string whose byte order is the order of the values
+func encodeIndexValue(indexType string, v any) (string, bool) {
+	switch indexType {
+	case IndexNumber:
+		var f float64
+		switch n := v.(type) {
+		case json.Number:
+			parsed, err := n.Float64()
+			if err != nil {
+				return "", false
+			}
+			f = parsed
+		case float64:
+			f = n
+		default:
+			return "", false
+		}
+		// Flip the sign bit of positive numbers and every bit of negative ones so that bytes sort like numbers
+		bits := math.Float64bits(f)
+		if bits&(1<<63) == 0 {
+			bits ^= 1 << 63
+		} else {
+			bits = ^bits
+		}
+		var buf [8]byte
+		binary.BigEndian.PutUint64(buf[:], bits)
+		return string(buf[:]), true
+	case IndexString:
+		s, ok := v.(string)
+		if !ok {
+			return "", false
+		}
+		// 0x00 is escaped so that the 0x00 0x01 terminator sorts before any longer string
+		return strings.ReplaceAll(s, "\x00", "\x00\xff") + "\x00\x01", true
+	}
+	return "", false
+}
+
+// parseIndexValue reads a value given in a query, numbers are parsed for number indexes
+func parseIndexValue(indexType string, raw string) (string, error) {
+	var v any = raw
+	if indexType == IndexNumber {
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return "", fmt.Errorf("%w: %q is not a number", ErrInvalidIndexQuery, raw)
+		}
+		v = f
+	}
+	encoded, _ := encodeIndexValue(indexType, v)
+	return encoded, nil
+}
+
+func newSecondaryIndex(spec IndexSpec) *secondaryIndex {
+	tokens, _ := parsePointer(spec.Path)
+	return &secondaryIndex{
+		spec:    spec,
+		tokens:  tokens,
+		entries: engine.NewOrderedMap(),
+		byKey:   make(map[string]string),
+	}
+}
+
+// update indexes the current value of a stored key, a nil value only removes the key from the index
+func (idx *secondaryIndex) update(key string, value []byte) {
+	if old, ok := idx.byKey[key]; ok {
+		idx.entries.Remove(old)
+		delete(idx.byKey, key)
+	}
+	if value == nil {
+		return
+	}
+	doc, err := decodeJSON(value)
+	if err != nil {
+		return
+	}
+	field, err := lookup(doc, idx.tokens)
+	if err != nil {
+		return
+	}
+	encoded, ok := encodeIndexValue(idx.spec.Type, field)
+	if !ok {
+		return
+	}
+	indexKey := encoded + key
+	idx.entries.Set(indexKey, key)
+	idx.byKey[key] = indexKey
+}
+
+// keyNamespace returns the namespace part of a stored key
+func keyNamespace(key string) string {
+	namespace, _, _ := strings.Cut(key, "/")
+	return namespace
+}
+
+// EnsureIndexes brings the indexes of a namespace in line with specs.
+// New or changed indexes are built from the keys already in the store, indexes missing from specs are dropped.
+func (sm *StoreManager) EnsureIndexes(namespace string, specs []IndexSpec) error {
+	sm.indexes.mu.RLock()
+	current := sm.indexes.namespaces[namespace]
+	upToDate := len(current) == len(specs)
+	for _, spec := range specs {
+		if idx, ok := current[spec.Name]; !ok || !reflect.DeepEqual(idx.spec, spec) {
+			upToDate = false
+		}
+	}
+	sm.indexes.mu.RUnlock()
+	if upToDate {
+		return nil
+	}
+
+	// Writes wait while the indexes are rebuilt, their own reindex then runs on top of the backfill
+	sm.indexes.mu.Lock()
+	defer sm.indexes.mu.Unlock()
+
+	current = sm.indexes.namespaces[namespace]
+	updated := make(map[string]*secondaryIndex, len(specs))
+	var pairs []KVPair
+	for _, spec := range specs {
+		if idx, ok := current[spec.Name]; ok && reflect.DeepEqual(idx.spec, spec) {
+			updated[spec.Name] = idx
+			continue
+		}
+		if pairs == nil {
+			var err error
+			if pairs, err = sm.Store.ScanPrefix(NamespacedKey(namespace, "")); err != nil {
+				return err
+			}
+		}
+		idx := newSecondaryIndex(spec)
+		for _, pair := range pairs {
+			idx.update(pair.Key, pair.Value)
+		}
+		updated[spec.Name] = idx
+	}
+
+	if sm.indexes.namespaces == nil {
+		sm.indexes.namespaces = make(map[string]map[string]*secondaryIndex)
+	}
+	if len(updated) == 0 {
+		delete(sm.indexes.namespaces, namespace)
+	} else {
+		sm.indexes.namespaces[namespace] = updated
+	}
+	return nil
+}
+
+// reindex refreshes the indexes of the key's namespace from the value now in the store.
+// Reading the store instead of trusting the WAL entry keeps the index right whatever order writes land in.
+func (sm *StoreManager) reindex(keys ...string) {
+	// Most namespaces have no index, their writes should not queue on the exclusive lock
+	sm.indexes.mu.RLock()
+	indexed := false
+	for _, key := range keys {
+		indexed = indexed || len(sm.indexes.namespaces[keyNamespace(key)]) > 0
+	}
+	sm.indexes.mu.RUnlock()
+	if !indexed {
+		return
+	}
+
+	sm.indexes.mu.Lock()
+	defer sm.indexes.mu.Unlock()
+
+	for _, key := range keys {
+		indexes := sm.indexes.namespaces[keyNamespace(key)]
+		if len(indexes) == 0 {
+			continue
+		}
+		// A missing key leaves a nil value, which drops it from the indexes
+		value, err := sm.Store.Get(key)
+		if err != nil && !errors.Is(err, ErrKeyNotFound) {
+			continue
+		}
+		for _, idx := range indexes {
+			idx.update(key, value)
+		}
+	}
+}
+
+// IndexQuery selects the values of an index. Eq, when set, wins over the range.
+// Min and Max are inclusive, an empty bound is open.
+type IndexQuery struct {
+	Eq    string
+	Min   string
+	Max   string
+	Limit int
+}
+
+// QueryIndex returns the keys of the namespace whose indexed field matches the query, in index order.
+// Keys are returned as stored, with their namespace.
+func (sm *StoreManager) QueryIndex(namespace string, name string, query IndexQuery) ([]KVPair, error) {
+	sm.indexes.mu.RLock()
+	idx, ok := sm.indexes.namespaces[namespace][name]
+	if !ok {
+		sm.indexes.mu.RUnlock()
+		return nil, ErrIndexNotFound
+	}
+
+	start, end := "", ""
+	if query.Eq != "" {
+		query.Min, query.Max = query.Eq, query.Eq
+	}
+	if query.Min != "" {
+		encoded, err := parseIndexValue(idx.spec.Type, query.Min)
+		if err != nil {
+			sm.indexes.mu.RUnlock()
+			return nil, err
+		}
+		start = encoded
+	}
+	if query.Max != "" {
+		encoded, err := parseIndexValue(idx.spec.Type, query.Max)
+		if err != nil {
+			sm.indexes.mu.RUnlock()
+			return nil, err
+		}
+		// Every index key with the max value as prefix is still in range
+		end = PrefixEnd(encoded)
+	}
+
+	var keys []string
+	idx.entries.Range(start, end, func(_ string, key string) bool {
+		keys = append(keys, key)
+		return true
+	})
+	sm.indexes.mu.RUnlock()
+
+	// Values are read after the index, expired keys that the sweeper has not reached yet are skipped here
+	var pairs []KVPair
+	for _, key := range keys {
+		if query.Limit > 0 && len(pairs) >= query.Limit {
+			break
+		}
+		current, exists, err := sm.Store.GetVersioned(key)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			pairs = append(pairs, KVPair{Key: key, Value: current.Value, ContentType: current.ContentType})
+		}
+	}
+	return pairs, nil
+}
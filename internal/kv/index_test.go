@@ -0,0 +1,101 @@
+package store
+
+import (
+	"errors"
+	"kvstore/internal/wal"
+	"testing"
+	"time"
+)
+
+func indexedKeys(t *testing.T, sm *StoreManager, name string, query IndexQuery) []string {
+	t.Helper()
+	pairs, err := sm.QueryIndex("users", name, query)
+	if err != nil {
+		t.Fatalf("QueryIndex(%s) failed: %v", name, err)
+	}
+	keys := make([]string, len(pairs))
+	for i, pair := range pairs {
+		keys[i] = StripNamespace("users", pair.Key)
+	}
+	return keys
+}
+
+func expectKeys(t *testing.T, got []string, want ...string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("keys = %v; want %v", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("keys = %v; want %v", got, want)
+		}
+	}
+}
+
+func TestSecondaryIndexes(t *testing.T) {
+	sm, _ := NewStoreManager(Config{Engine: EngineMemory})
+	put := func(key string, value string) {
+		t.Helper()
+		applyAll(t, sm, wal.WAL{Type: "PUT", Key: NamespacedKey("users", key), Value: []byte(value)})
+	}
+
+	// Keys written before the index exists are backfilled
+	put("u1", `{"email":"bob@example.com","age":30}`)
+	put("u2", `{"email":"amy@example.com","age":-4.5}`)
+	err := sm.EnsureIndexes("users", []IndexSpec{
+		{Name: "email", Path: "/email", Type: IndexString},
+		{Name: "age", Path: "/age", Type: IndexNumber},
+	})
+	if err != nil {
+		t.Fatalf("EnsureIndexes failed: %v", err)
+	}
+	put("u3", `{"email":"cat@example.com","age":100}`)
+	put("u4", `not json`)
+	put("u5", `{"email":42}`)
+	applyAll(t, sm, wal.WAL{Type: "PUT", Key: NamespacedKey("other", "u6"), Value: []byte(`{"email":"bob@example.com"}`)})
+
+	expectKeys(t, indexedKeys(t, sm, "email", IndexQuery{Eq: "bob@example.com"}), "u1")
+	expectKeys(t, indexedKeys(t, sm, "email", IndexQuery{}), "u2", "u1", "u3")
+	expectKeys(t, indexedKeys(t, sm, "age", IndexQuery{Min: "-10", Max: "30"}), "u2", "u1")
+	expectKeys(t, indexedKeys(t, sm, "age", IndexQuery{Min: "31", Limit: 5}), "u3")
+
+	// Updates move the key in the index, deletes drop it, also through transactions and patches
+	put("u1", `{"email":"bobby@example.com","age":30}`)
+	applyAll(t, sm,
+		wal.WAL{Type: "TXN", Ops: []wal.Op{{Type: "DELETE", Key: NamespacedKey("users", "u2")}}},
+		wal.WAL{Type: "PUT", Key: NamespacedKey("users", "u7"), Value: []byte(`{"age":1}`), ContentType: ContentTypeJSON},
+		wal.WAL{Type: "PATCH", Key: NamespacedKey("users", "u7"), Value: []byte(`[{"op":"add","path":"/email","value":"bob@example.com"}]`)},
+	)
+	expectKeys(t, indexedKeys(t, sm, "email", IndexQuery{Eq: "bob@example.com"}), "u7")
+	expectKeys(t, indexedKeys(t, sm, "age", IndexQuery{Max: "30"}), "u7", "u1")
+
+	if _, err := sm.QueryIndex("users", "age", IndexQuery{Eq: "old"}); !errors.Is(err, ErrInvalidIndexQuery) {
+		t.Fatalf("QueryIndex with a bad number = %v; want ErrInvalidIndexQuery", err)
+	}
+
+	// Dropping an index from the namespace config removes it
+	sm.EnsureIndexes("users", []IndexSpec{{Name: "age", Path: "/age", Type: IndexNumber}})
+	if _, err := sm.QueryIndex("users", "email", IndexQuery{}); !errors.Is(err, ErrIndexNotFound) {
+		t.Fatalf("QueryIndex on a dropped index = %v; want ErrIndexNotFound", err)
+	}
+}
+
+func TestExpirySweepDropsIndexedKeys(t *testing.T) {
+	sm, _ := NewStoreManager(Config{Engine: EngineMemory})
+	if err := sm.EnsureIndexes("users", []IndexSpec{{Name: "age", Path: "/age", Type: IndexNumber}}); err != nil {
+		t.Fatalf("EnsureIndexes failed: %v", err)
+	}
+	now := time.Now()
+	applyAll(t, sm,
+		wal.WAL{Type: "PUT", Key: NamespacedKey("users", "u1"), Value: []byte(`{"age":30}`), TTL: 1, Timestamp: now.UnixNano()},
+		wal.WAL{Type: "PUT", Key: NamespacedKey("users", "u2"), Value: []byte(`{"age":40}`)},
+	)
+
+	if removed := sm.sweepExpired(now.Add(2 * time.Second)); removed != 1 {
+		t.Fatalf("sweepExpired removed %d keys; want 1", removed)
+	}
+	if indexed := len(sm.indexes.namespaces["users"]["age"].byKey); indexed != 1 {
+		t.Fatalf("index holds %d keys after the sweep; want 1", indexed)
+	}
+	expectKeys(t, indexedKeys(t, sm, "age", IndexQuery{}), "u2")
+}
@@ -0,0 +1,67 @@
+package store
+
+import (
+	"hash/fnv"
+	"sort"
+	"sync"
+)
+
+const keyLockStripes = 256
+
+// keyLocks is a fixed set of mutexes that keys are striped over.
+type keyLocks struct {
+	stripes [keyLockStripes]sync.Mutex
+}
+
+func keyStripe(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % keyLockStripes)
+}
+
+// LockKeys holds the write locks of every given key until the returned function is called.
+// Stripes are always taken in ascending order so that two callers cannot deadlock.
+func (sm *StoreManager) LockKeys(keys ...string) func() {
+	seen := make(map[int]bool)
+	var stripes []int
+	for _, key := range keys {
+		stripe := keyStripe(key)
+		if !seen[stripe] {
+			seen[stripe] = true
+			stripes = append(stripes, stripe)
+		}
+	}
+	sort.Ints(stripes)
+
+	for _, stripe := range stripes {
+		sm.keyLocks.stripes[stripe].Lock()
+	}
+	return func() {
+		for i := len(stripes) - 1; i >= 0; i-- {
+			sm.keyLocks.stripes[stripes[i]].Unlock()
+		}
+	}
+}
+
+// tryLockKeys returns a function that takes the lock of a key without waiting, it reports false when
+// another caller holds the lock. Everything it took is held until unlock is called.
+func (sm *StoreManager) tryLockKeys() (tryLock func(key string) bool, unlock func()) {
+	held := make(map[int]bool)
+	tryLock = func(key string) bool {
+		stripe := keyStripe(key)
+		if held[stripe] {
+			return true
+		}
+		if !sm.keyLocks.stripes[stripe].TryLock() {
+			return false
+		}
+		held[stripe] = true
+		return true
+	}
+	unlock = func() {
+		for stripe := range held {
+			sm.keyLocks.stripes[stripe].Unlock()
+		}
+	}
+	return tryLock, unlock
+}
@@ -0,0 +1,114 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kvstore/internal/wal"
+)
+
+// Locks are regular keys holding a Lock, their TTL is the lease.
+// LOCK, RENEW and UNLOCK are their own WAL entry types: the leader checks ownership before the prepare phase
+// and the followers apply the entries as they come, without consulting their own clocks.
+// Lock keys are not counted against the memory budget so that eviction can never release a lock.
+// Plain PUT, DELETE and TXN writes are refused on a held lock, so only its owner can release it.
+
+// ContentTypeLock marks a key holding a lock
+const ContentTypeLock = "application/vnd.kvstore.lock+json"
+
+var (
+	ErrLockHeld    = errors.New("lock is held by another owner")
+	ErrLockNotHeld = errors.New("lock is not held by this owner and token")
+	ErrLockKey     = errors.New("key holds a lock, only LOCK, RENEW and UNLOCK may change it")
+)
+
+// Lock is the value of a lock key.
+// Token is the fencing token: the WAL version of the LOCK entry that acquired the lock.
+// It grows with every acquisition, so a resource can refuse writes carrying an older token.
+type Lock struct {
+	Owner string `json:"owner"`
+	Token int    `json:"token"`
+}
+
+// GetLock returns the lock held on key, expired locks are not held
+func (sm *StoreManager) GetLock(key string) (Lock, Versioned, bool, error) {
+	var lock Lock
+	current, exists, err := sm.readTyped(key, ContentTypeLock, &lock)
+	return lock, current, exists, err
+}
+
+// CheckLockEntry tells whether a LOCK, RENEW or UNLOCK entry may be committed.
+// The entry's value is the Lock the caller claims, the token is ignored for LOCK.
+func (sm *StoreManager) CheckLockEntry(entry wal.WAL) error {
+	var claim Lock
+	if err := json.Unmarshal(entry.Value, &claim); err != nil {
+		return fmt.Errorf("invalid lock entry: %w", err)
+	}
+	held, _, exists, err := sm.GetLock(entry.Key)
+	if err != nil {
+		return err
+	}
+
+	switch entry.Type {
+	case "LOCK":
+		// The owner may acquire again, for example when retrying after a timeout, and gets a new token
+		if exists && held.Owner != claim.Owner {
+			return ErrLockHeld
+		}
+	case "RENEW", "UNLOCK":
+		if !exists || held != claim {
+			return ErrLockNotHeld
+		}
+	default:
+		return fmt.Errorf("unknown lock entry: %s", entry.Type)
+	}
+	return nil
+}
+
+// CheckPlainWrite tells whether a plain PUT, DELETE or TXN may write the keys.
+// It fails with ErrLockKey when one of them holds a lock that has not expired.
+func (sm *StoreManager) CheckPlainWrite(keys ...string) error {
+	for _, key := range keys {
+		current, exists, err := sm.Store.GetVersioned(key)
+		if err != nil {
+			return err
+		}
+		if exists && current.ContentType == ContentTypeLock {
+			return fmt.Errorf("%w: %s", ErrLockKey, key)
+		}
+	}
+	return nil
+}
+
+// applyLock writes or removes the lock. LOCK takes the entry's version as the fencing token.
+func (sm *StoreManager) applyLock(entry wal.WAL) error {
+	if entry.Type == "UNLOCK" {
+		return sm.Store.Delete(entry.Key, entry.Version)
+	}
+
+	var lock Lock
+	if err := json.Unmarshal(entry.Value, &lock); err != nil {
+		return fmt.Errorf("invalid lock entry: %w", err)
+	}
+	if entry.Type == "LOCK" {
+		lock.Token = entry.Version
+	}
+	value, err := json.Marshal(lock)
+	if err != nil {
+		return err
+	}
+
+	if entry.TTL > 0 {
+		err = sm.Store.PutWithTTL(entry.Key, value, ContentTypeLock, entry.Version, entry.ExpiresAt())
+	} else {
+		err = sm.Store.Put(entry.Key, value, ContentTypeLock, entry.Version)
+	}
+	if err != nil {
+		return err
+	}
+	// The key may have held an expired value that was still counted
+	if sm.memory != nil {
+		sm.memory.remove(entry.Key)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"kvstore/internal/wal"
+	"testing"
+	"time"
+)
+
+func lockEntry(entryType string, owner string, token int) wal.WAL {
+	value, _ := json.Marshal(Lock{Owner: owner, Token: token})
+	return wal.WAL{Type: entryType, Key: "lock", Value: value, ContentType: ContentTypeLock, TTL: 10, Timestamp: time.Now().UnixNano()}
+}
+
+func TestLockEntries(t *testing.T) {
+	sm, _ := NewStoreManager(Config{Engine: EngineMemory})
+
+	if err := sm.CheckLockEntry(lockEntry("LOCK", "a", 0)); err != nil {
+		t.Fatalf("CheckLockEntry(LOCK) on a free lock = %v", err)
+	}
+	applyAll(t, sm, lockEntry("LOCK", "a", 0))
+	lock, current, held, err := sm.GetLock("lock")
+	if err != nil || !held || lock.Owner != "a" || lock.Token != sm.LatestVersion() || current.ExpiresAt == 0 {
+		t.Fatalf("GetLock = %+v, %+v, %v, %v; want held by a with the LOCK version as token", lock, current, held, err)
+	}
+	token := lock.Token
+
+	if err := sm.CheckLockEntry(lockEntry("LOCK", "b", 0)); !errors.Is(err, ErrLockHeld) {
+		t.Fatalf("CheckLockEntry(LOCK) by another owner = %v; want ErrLockHeld", err)
+	}
+	if err := sm.CheckLockEntry(lockEntry("RENEW", "a", token-1)); !errors.Is(err, ErrLockNotHeld) {
+		t.Fatalf("CheckLockEntry(RENEW) with a stale token = %v; want ErrLockNotHeld", err)
+	}
+
+	// Renewing keeps the token
+	applyAll(t, sm, lockEntry("RENEW", "a", token))
+	if lock, _, _, _ := sm.GetLock("lock"); lock.Token != token {
+		t.Fatalf("token after RENEW = %d; want %d", lock.Token, token)
+	}
+
+	if err := sm.CheckLockEntry(lockEntry("UNLOCK", "a", token)); err != nil {
+		t.Fatalf("CheckLockEntry(UNLOCK) by the holder = %v", err)
+	}
+	applyAll(t, sm, lockEntry("UNLOCK", "a", token))
+	if _, _, held, _ := sm.GetLock("lock"); held {
+		t.Fatalf("lock still held after UNLOCK")
+	}
+
+	// The next holder gets a larger fencing token
+	applyAll(t, sm, lockEntry("LOCK", "b", 0))
+	if lock, _, _, _ := sm.GetLock("lock"); lock.Token <= token {
+		t.Fatalf("token of the next holder = %d; want more than %d", lock.Token, token)
+	}
+}
+
+func TestExpiredLockCanBeTaken(t *testing.T) {
+	sm, _ := NewStoreManager(Config{Engine: EngineMemory})
+	expired := lockEntry("LOCK", "a", 0)
+	expired.Timestamp = time.Now().Add(-time.Minute).UnixNano()
+	applyAll(t, sm, expired)
+
+	if err := sm.CheckLockEntry(lockEntry("LOCK", "b", 0)); err != nil {
+		t.Fatalf("CheckLockEntry(LOCK) on an expired lock = %v", err)
+	}
+	if err := sm.CheckLockEntry(lockEntry("RENEW", "a", sm.LatestVersion())); !errors.Is(err, ErrLockNotHeld) {
+		t.Fatalf("CheckLockEntry(RENEW) of an expired lock = %v; want ErrLockNotHeld", err)
+	}
+}
+
+func TestPlainWritesCannotChangeHeldLocks(t *testing.T) {
+	sm, _ := NewStoreManager(Config{Engine: EngineMemory})
+	applyAll(t, sm, lockEntry("LOCK", "a", 0), wal.WAL{Type: "PUT", Key: "plain", Value: []byte("v")})
+
+	if err := sm.CheckPlainWrite("plain", "missing"); err != nil {
+		t.Fatalf("CheckPlainWrite(plain, missing) = %v", err)
+	}
+	if err := sm.CheckPlainWrite("plain", "lock"); !errors.Is(err, ErrLockKey) {
+		t.Fatalf("CheckPlainWrite on a held lock = %v; want ErrLockKey", err)
+	}
+	if err := ValidateOps([]wal.Op{{Type: "PUT", Key: "other", Value: []byte(`{"owner":"b"}`), ContentType: ContentTypeLock}}); err == nil {
+		t.Fatalf("ValidateOps accepted a transaction writing a lock")
+	}
+
+	// Once released the key is an ordinary key again
+	lock, _, _, _ := sm.GetLock("lock")
+	applyAll(t, sm, lockEntry("UNLOCK", "a", lock.Token))
+	if err := sm.CheckPlainWrite("lock"); err != nil {
+		t.Fatalf("CheckPlainWrite on a released lock = %v", err)
+	}
+}
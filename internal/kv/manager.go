@@ -1,17 +1,193 @@
 package store
 
-type IStoreManager interface {
-	Get(key string) (string, error)
-	Put(key string, value string) error
-	Delete(key string)
+import (
+	"fmt"
+	"kvstore/pkg/kvstore/engine"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultShardCount is the number of shards of the in-memory engine when no shard count is configured
+const DefaultShardCount = engine.DefaultShardCount
+
+const (
+	EngineMemory = "memory"
+	EngineLSM    = "lsm"
+)
+
+type Config struct {
+	// Engine is either EngineMemory or EngineLSM
+	Engine string `json:"engine"`
+	// ShardCount is only used by the in-memory engine
+	ShardCount int `json:"shard_count"`
+	// DataDir is only used by the LSM engine
+	DataDir string `json:"data_dir"`
+	// VersionRetention is how many WAL versions of history are kept for reads as of a past version
+	VersionRetention int `json:"version_retention"`
+	// MaxMemory is the approximate memory budget in bytes, 0 means unbounded
+	MaxMemory int64 `json:"max_memory"`
+	// EvictionPolicy is one of EvictionNone, EvictionLRU, EvictionLFU or EvictionRandom
+	EvictionPolicy string `json:"eviction_policy"`
 }
 
 type StoreManager struct {
-	Store IStoreManager `json:"store"`
+	Store            engine.IKVStore `json:"store"`
+	VersionRetention int             `json:"version_retention"`
+	// latestVersion is the highest WAL version applied to the store
+	latestVersion atomic.Int64
+	// pending hold the applied low-water mark below the committed entries that are not applied yet
+	pending pendingApplies
+	// keyLocks serialize the leader's read-check-write cycles on the same key
+	keyLocks keyLocks
+	// indexes are the secondary indexes of every namespace, kept up to date by Apply
+	indexes indexSet
+	// memory is nil when the store has no memory budget
+	memory *memoryTracker
+	// snapshots are the open snapshots, they hold back the version GC and the expiry sweeper
+	snapshots snapshotSet
+}
+
+func NewStoreManager(config Config) (*StoreManager, error) {
+	var kvEngine engine.IKVStore
+	switch config.Engine {
+	case EngineMemory, "":
+		kvEngine = engine.NewShardedInMemStore(config.ShardCount)
+	case EngineLSM:
+		lsm, err := engine.OpenLSMStore(config.DataDir, engine.DefaultLSMOptions())
+		if err != nil {
+			return nil, err
+		}
+		kvEngine = lsm
+	default:
+		return nil, fmt.Errorf("unknown storage engine: %s", config.Engine)
+	}
+
+	sm := &StoreManager{
+		Store:            kvEngine,
+		VersionRetention: config.VersionRetention,
+	}
+	if config.MaxMemory <= 0 {
+		if _, err := NewEvictionPolicy(config.EvictionPolicy); err != nil {
+			return nil, err
+		}
+		return sm, nil
+	}
+
+	memory, err := newMemoryTracker(config.MaxMemory, config.EvictionPolicy)
+	if err != nil {
+		return nil, err
+	}
+	// A persistent engine may already hold keys, they count against the budget from the start
+	pairs, err := kvEngine.ScanPrefix("")
+	if err != nil {
+		return nil, err
+	}
+	for _, pair := range pairs {
+		memory.set(pair.Key, entrySize(pair.Key, pair.Value, pair.ContentType), time.Time{})
+	}
+	sm.memory = memory
+	return sm, nil
+}
+
+// LatestVersion returns the highest WAL version applied to the store
+func (sm *StoreManager) LatestVersion() int {
+	return int(sm.latestVersion.Load())
+}
+
+// RecoverVersion returns the applied low-water mark the store kept across the restart and records it as applied.
+// Every committed entry up to it is held, the replay starts right above it. It is -1 for the memory engine.
+// Entries above it may be held as well, the highest version in the store is no guide since entries apply out of order.
+func (sm *StoreManager) RecoverVersion() (int, error) {
+	recovered := sm.PersistedVersion()
+	if recovered >= 0 {
+		sm.observeVersion(recovered)
+	}
+	return recovered, nil
 }
 
-func NewStoreManager() *StoreManager {
-	return &StoreManager{
-		Store: NewInMemStore(),
+// flushedEngine is an engine that writes its data to files, *engine.LSMStore implements it.
+// It is told the applied low-water mark, the flushed version never passes it.
+type flushedEngine interface {
+	FlushedVersion() int
+	SetAppliedVersion(version int)
+}
+
+// PersistedVersion is the highest WAL version the engine keeps across a crash on its own, along with every older one.
+// Older WAL entries are no longer needed to rebuild the store. It is -1 for the memory engine.
+func (sm *StoreManager) PersistedVersion() int {
+	flushed, ok := sm.Store.(flushedEngine)
+	if !ok {
+		return -1
+	}
+	return flushed.FlushedVersion()
+}
+
+// observeVersion records that a WAL version has been applied
+func (sm *StoreManager) observeVersion(version int) {
+	for {
+		latest := sm.latestVersion.Load()
+		if int64(version) <= latest || sm.latestVersion.CompareAndSwap(latest, int64(version)) {
+			return
+		}
+	}
+}
+
+// retentionHorizon is the oldest version that can still be read as of, open snapshots keep it from moving past them
+func (sm *StoreManager) retentionHorizon() int {
+	horizon := sm.LatestVersion() - sm.VersionRetention
+	if version, _, ok := sm.oldestSnapshot(); ok {
+		horizon = min(horizon, version)
+	}
+	return horizon
+}
+
+// sweepDeadline is the instant keys must have expired by to be swept.
+// Keys still visible to an open snapshot are kept until it is released.
+func (sm *StoreManager) sweepDeadline(now time.Time) time.Time {
+	if _, createdAt, ok := sm.oldestSnapshot(); ok && createdAt.Before(now) {
+		return createdAt
 	}
+	return now
+}
+
+// StartExpirySweeper periodically removes expired keys from the store.
+// Expired keys are already hidden from Get, the sweeper only reclaims their memory.
+func (sm *StoreManager) StartExpirySweeper(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			if removed := sm.sweepExpired(now); removed > 0 {
+				log.Println("Expiry sweeper removed keys:", removed)
+			}
+		}
+	}()
+}
+
+// sweepExpired removes the keys that expired by now from the store, the memory accounting and the secondary indexes
+func (sm *StoreManager) sweepExpired(now time.Time) int {
+	removed := sm.Store.DeleteExpired(sm.sweepDeadline(now))
+	if sm.memory != nil {
+		sm.memory.sweep(now)
+	}
+	sm.reindex(removed...)
+	return len(removed)
+}
+
+// StartVersionGC periodically drops versions that fell out of the retention window.
+func (sm *StoreManager) StartVersionGC(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			if released := sm.releaseExpiredSnapshots(now); released > 0 {
+				log.Println("Version GC released expired snapshots:", released)
+			}
+			dropped := sm.Store.PruneVersions(sm.retentionHorizon())
+			if dropped > 0 {
+				log.Println("Version GC dropped versions:", dropped)
+			}
+		}
+	}()
 }
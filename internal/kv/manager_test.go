@@ -0,0 +1,153 @@
+package store
+
+import (
+	"errors"
+	"kvstore/internal/wal"
+	"kvstore/pkg/kvstore/engine"
+	"testing"
+)
+
+// expectValue checks the value of key, an empty want means the key must be missing
+func expectValue(t *testing.T, s engine.IKVStore, key string, want string) {
+	t.Helper()
+	value, err := s.Get(key)
+	if want == "" {
+		if !errors.Is(err, ErrKeyNotFound) {
+			t.Fatalf("Get(%s) = %q, %v; want ErrKeyNotFound", key, value, err)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatalf("Get(%s) failed: %v", key, err)
+	}
+	if string(value) != want {
+		t.Fatalf("Get(%s) = %q; want %q", key, value, want)
+	}
+}
+
+func TestDeleteEntryLeavesTombstone(t *testing.T) {
+	sm, err := NewStoreManager(Config{Engine: EngineMemory, MaxMemory: 1 << 20, EvictionPolicy: EvictionLRU, VersionRetention: 10})
+	if err != nil {
+		t.Fatalf("NewStoreManager failed: %v", err)
+	}
+	sm.Apply(putEntry("a", "1", 1))
+	if err := sm.Apply(wal.WAL{Type: "DELETE", Key: "a", Version: 2}); err != nil {
+		t.Fatalf("Apply(DELETE) failed: %v", err)
+	}
+
+	expectValue(t, sm.Store, "a", "")
+	if current, err := sm.GetAt("a", 1); err != nil || string(current.Value) != "1" {
+		t.Fatalf("GetAt(a, 1) = %q, %v; want %q", current.Value, err, "1")
+	}
+	if sm.LatestVersion() != 2 {
+		t.Fatalf("LatestVersion = %d; want 2", sm.LatestVersion())
+	}
+	if stats := sm.MemoryStats(); stats.Keys != 0 || stats.UsedBytes != 0 {
+		t.Fatalf("MemoryStats = %+v; want no tracked keys", stats)
+	}
+}
+
+func TestRecoverVersion(t *testing.T) {
+	sm, _ := NewStoreManager(Config{Engine: EngineMemory})
+	if version, err := sm.RecoverVersion(); err != nil || version != -1 {
+		t.Fatalf("RecoverVersion on an empty store = %d, %v; want -1", version, err)
+	}
+
+	dir := t.TempDir()
+	sm, err := NewStoreManager(Config{Engine: EngineLSM, DataDir: dir})
+	if err != nil {
+		t.Fatalf("NewStoreManager failed: %v", err)
+	}
+	sm.Apply(putEntry("a", "1", 3))
+	sm.Apply(putEntry("b", "2", 7))
+	if err := sm.Store.(*engine.LSMStore).Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	sm.Apply(putEntry("c", "3", 8))
+	sm.Store.Close()
+
+	// The write of 8 was not flushed, the replay starts right after the flushed versions
+	reopened, err := NewStoreManager(Config{Engine: EngineLSM, DataDir: dir})
+	if err != nil {
+		t.Fatalf("NewStoreManager failed: %v", err)
+	}
+	defer reopened.Store.Close()
+	version, err := reopened.RecoverVersion()
+	if err != nil || version != 7 {
+		t.Fatalf("RecoverVersion = %d, %v; want 7", version, err)
+	}
+	if reopened.AppliedVersion() != 7 {
+		t.Fatalf("AppliedVersion = %d; want 7", reopened.AppliedVersion())
+	}
+}
+
+// undecidedVersions is a log with the given versions prepared and undecided
+type undecidedVersions map[int]bool
+
+func (u undecidedVersions) OldestUndecided() (int, bool) {
+	oldest, ok := 0, false
+	for version := range u {
+		if !ok || version < oldest {
+			oldest, ok = version, true
+		}
+	}
+	return oldest, ok
+}
+
+func TestAppliedVersionWaitsForOlderEntries(t *testing.T) {
+	sm, _ := NewStoreManager(Config{Engine: EngineMemory})
+	prepared := undecidedVersions{}
+	sm.TrackUndecided(prepared)
+	sm.Apply(putEntry("a", "1", 1))
+
+	// 2 is prepared when 3 is applied
+	prepared[2] = true
+	sm.Apply(putEntry("c", "3", 3))
+	if sm.AppliedVersion() != 1 || sm.LatestVersion() != 3 {
+		t.Fatalf("AppliedVersion, LatestVersion = %d, %d; want 1, 3", sm.AppliedVersion(), sm.LatestVersion())
+	}
+
+	// Committed, not applied yet
+	sm.BeginApply(2)
+	delete(prepared, 2)
+	if sm.AppliedVersion() != 1 {
+		t.Fatalf("AppliedVersion = %d; want 1 until 2 is applied", sm.AppliedVersion())
+	}
+	sm.Apply(putEntry("b", "2", 2))
+	if sm.AppliedVersion() != 3 {
+		t.Fatalf("AppliedVersion = %d; want 3", sm.AppliedVersion())
+	}
+}
+
+func TestReplaySkipsHeldEntries(t *testing.T) {
+	sm, _ := NewStoreManager(Config{Engine: EngineMemory})
+	incr := wal.WAL{Type: "INCR", Key: "hits", Version: 1}
+	for i := 0; i < 2; i++ {
+		if err := sm.Replay(incr); err != nil {
+			t.Fatalf("Replay failed: %v", err)
+		}
+	}
+	expectValue(t, sm.Store, "hits", "1")
+
+	incr.Version = 2
+	sm.Replay(incr)
+	expectValue(t, sm.Store, "hits", "2")
+}
+
+func TestPersistedVersionStopsAtAppliedVersion(t *testing.T) {
+	sm, err := NewStoreManager(Config{Engine: EngineLSM, DataDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("NewStoreManager failed: %v", err)
+	}
+	defer sm.Store.Close()
+	sm.TrackUndecided(undecidedVersions{2: true})
+	sm.Apply(putEntry("a", "1", 1))
+	sm.Apply(putEntry("c", "3", 3))
+
+	if err := sm.Store.(*engine.LSMStore).Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if persisted := sm.PersistedVersion(); persisted != 1 {
+		t.Fatalf("PersistedVersion = %d; want 1 while 2 is undecided", persisted)
+	}
+}
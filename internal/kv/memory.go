@@ -0,0 +1,333 @@
+package store
+
+import (
+	"errors"
+	"kvstore/internal/wal"
+	"sync"
+	"time"
+)
+
+var ErrMemoryBudgetExceeded = errors.New("memory budget exceeded")
+
+// errRoomInFlight means a write only fits once the writes in flight are applied and their keys can be evicted
+var errRoomInFlight = errors.New("memory budget reserved by writes in flight")
+
+// entryOverhead approximates what an entry costs besides its key, value and content type
+const entryOverhead = 64
+
+func entrySize(key string, value []byte, contentType string) int64 {
+	return int64(len(key)+len(value)+len(contentType)) + entryOverhead
+}
+
+type MemoryStats struct {
+	BudgetBytes int64  `json:"budget_bytes"`
+	UsedBytes   int64  `json:"used_bytes"`
+	Keys        int    `json:"keys"`
+	Policy      string `json:"policy"`
+	// Evictions counts the keys removed by applied EVICT entries, it is the same on every replica
+	Evictions uint64 `json:"evictions"`
+	// Rejections counts the writes refused because nothing could be evicted, only the leader refuses writes
+	Rejections uint64 `json:"rejections"`
+}
+
+type trackedKey struct {
+	size      int64
+	expiresAt int64
+}
+
+// memoryTracker keeps the approximate size of every live key against the memory budget.
+// Only current values are counted, older versions are bounded by the version retention instead.
+type memoryTracker struct {
+	mu         sync.Mutex
+	budget     int64
+	policyName string
+	// policy is nil with noeviction
+	policy     EvictionPolicy
+	used       int64
+	keys       map[string]trackedKey
+	evictions  uint64
+	rejections uint64
+	// reserved is the room the leader's writes in flight were promised, it counts as used until they are applied
+	reserved int64
+	// evicting holds the size of every victim of an eviction in flight, freeing is their total.
+	// It counts as free already, so that writers in flight do not evict more than they need together.
+	evicting map[string]int64
+	freeing  int64
+	// releases counts the reservations given back, writers waiting for room are woken by released
+	releases uint64
+	released *sync.Cond
+}
+
+func newMemoryTracker(budget int64, policyName string) (*memoryTracker, error) {
+	policy, err := NewEvictionPolicy(policyName)
+	if err != nil {
+		return nil, err
+	}
+	if policyName == "" {
+		policyName = EvictionNone
+	}
+	mt := &memoryTracker{
+		budget:     budget,
+		policyName: policyName,
+		policy:     policy,
+		keys:       make(map[string]trackedKey),
+		evicting:   make(map[string]int64),
+	}
+	mt.released = sync.NewCond(&mt.mu)
+	return mt, nil
+}
+
+func (mt *memoryTracker) set(key string, size int64, expiresAt time.Time) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	tracked := trackedKey{size: size}
+	if !expiresAt.IsZero() {
+		tracked.expiresAt = expiresAt.UnixNano()
+	}
+	mt.used += size - mt.keys[key].size
+	mt.keys[key] = tracked
+	if mt.policy != nil {
+		mt.policy.Add(key)
+	}
+}
+
+func (mt *memoryTracker) remove(key string) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	mt.removeLocked(key)
+}
+
+func (mt *memoryTracker) removeLocked(key string) {
+	tracked, ok := mt.keys[key]
+	if !ok {
+		return
+	}
+	mt.used -= tracked.size
+	delete(mt.keys, key)
+	if mt.policy != nil {
+		mt.policy.Remove(key)
+	}
+}
+
+func (mt *memoryTracker) touch(key string) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	if mt.policy != nil {
+		mt.policy.Touch(key)
+	}
+}
+
+// sweep stops counting the keys that expired by now
+func (mt *memoryTracker) sweep(now time.Time) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	deadline := now.UnixNano()
+	for key, tracked := range mt.keys {
+		if tracked.expiresAt != 0 && tracked.expiresAt <= deadline {
+			mt.removeLocked(key)
+		}
+	}
+}
+
+// reserve picks the keys to evict so that the writes in sizes fit in the budget and reserves the room they need.
+// sizes maps every key of the write to its new size, 0 for deletes. Keys of the write are never picked,
+// nor the victims of other writes, nor keys lock cannot take: those are being written,
+// maybe after a condition was checked on them. The reservation holds until release is called with what it returned.
+// It fails with errRoomInFlight, along with the count of releases to wait for, when the room left is reserved
+// by writes in flight whose keys are not evictable yet.
+func (mt *memoryTracker) reserve(sizes map[string]int64, lock func(key string) bool) ([]string, int64, uint64, error) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	growth := int64(0)
+	exclude := make(map[string]bool, len(sizes)+len(mt.evicting))
+	for key, size := range sizes {
+		growth += size - mt.keys[key].size
+		exclude[key] = true
+	}
+	need := mt.used + mt.reserved - mt.freeing + growth - mt.budget
+	if need > 0 && mt.policy == nil {
+		mt.rejections++
+		return nil, 0, 0, ErrMemoryBudgetExceeded
+	}
+	for key := range mt.evicting {
+		exclude[key] = true
+	}
+
+	var victims []string
+	for need > 0 {
+		key, ok := mt.policy.Victim(exclude)
+		if !ok && mt.reserved > 0 {
+			return nil, 0, mt.releases, errRoomInFlight
+		}
+		if !ok {
+			// Even evicting everything else would not make room for this write
+			mt.rejections++
+			return nil, 0, 0, ErrMemoryBudgetExceeded
+		}
+		exclude[key] = true
+		if !lock(key) {
+			continue
+		}
+		victims = append(victims, key)
+		need -= mt.keys[key].size
+	}
+
+	for _, key := range victims {
+		mt.evicting[key] = mt.keys[key].size
+		mt.freeing += mt.keys[key].size
+	}
+	reserved := max(growth, 0)
+	mt.reserved += reserved
+	return victims, reserved, 0, nil
+}
+
+// waitRelease blocks until a reservation is given back after the given count of releases
+func (mt *memoryTracker) waitRelease(releases uint64) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	for mt.releases == releases {
+		mt.released.Wait()
+	}
+}
+
+// release gives back the room reserve took, the victims that were not evicted count as used again
+func (mt *memoryTracker) release(victims []string, reserved int64) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	mt.reserved -= reserved
+	for _, key := range victims {
+		mt.evicted(key)
+	}
+	mt.releases++
+	mt.released.Broadcast()
+}
+
+// evicted stops counting key as being evicted, the caller must hold mu
+func (mt *memoryTracker) evicted(key string) {
+	if size, ok := mt.evicting[key]; ok {
+		mt.freeing -= size
+		delete(mt.evicting, key)
+	}
+}
+
+func (mt *memoryTracker) stats() MemoryStats {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	return MemoryStats{
+		BudgetBytes: mt.budget,
+		UsedBytes:   mt.used,
+		Keys:        len(mt.keys),
+		Policy:      mt.policyName,
+		Evictions:   mt.evictions,
+		Rejections:  mt.rejections,
+	}
+}
+
+// track updates the memory accounting once a WAL entry has been applied to the store
+func (sm *StoreManager) track(entry wal.WAL) {
+	if sm.memory == nil {
+		return
+	}
+	switch entry.Type {
+	case "PUT":
+		sm.memory.set(entry.Key, entrySize(entry.Key, entry.Value, entry.ContentType), entry.ExpiresAt())
+	case "DELETE":
+		sm.memory.remove(entry.Key)
+	case "TXN":
+		for _, op := range entry.Ops {
+			if op.Type == "DELETE" {
+				sm.memory.remove(op.Key)
+				continue
+			}
+			sm.memory.set(op.Key, entrySize(op.Key, op.Value, op.ContentType), entry.OpExpiresAt(op))
+		}
+	case "EVICT":
+		sm.memory.mu.Lock()
+		for _, op := range entry.Ops {
+			sm.memory.removeLocked(op.Key)
+			sm.memory.evicted(op.Key)
+		}
+		sm.memory.evictions += uint64(len(entry.Ops))
+		sm.memory.mu.Unlock()
+	}
+}
+
+// EvictionVictims returns the keys the leader has to evict before entry fits in the memory budget
+// and reserves the room entry needs, so that writers in flight together never count on the same room.
+// It fails with ErrMemoryBudgetExceeded when the policy is noeviction or nothing else is left to evict.
+// The reservation and the locks of the victims are held until release is called, which the caller does
+// once entry is applied or failed. No writer checks a condition on a key while it is evicted,
+// and keys whose lock is held by a writer are not picked.
+func (sm *StoreManager) EvictionVictims(entry wal.WAL) (victims []string, release func(), err error) {
+	release = func() {}
+	if sm.memory == nil || entry.Type == "EVICT" {
+		return nil, release, nil
+	}
+	sizes := make(map[string]int64)
+	switch entry.Type {
+	case "PUT":
+		sizes[entry.Key] = entrySize(entry.Key, entry.Value, entry.ContentType)
+	case "INCR", "DECR", "INCRBY":
+		sizes[entry.Key] = entrySize(entry.Key, make([]byte, counterSize), "text/plain")
+	case "HSET", "HDEL", "LPUSH", "RPUSH", "LPOP", "RPOP", "SADD", "SREM", "ZADD", "ZREM":
+		value, _, _, err := sm.nextTypedValue(entry)
+		if err != nil {
+			return nil, release, err
+		}
+		contentType, _ := typedEntryContentType(entry.Type)
+		sizes[entry.Key] = 0
+		if value != nil {
+			sizes[entry.Key] = entrySize(entry.Key, value, contentType)
+		}
+	case "PATCH":
+		value, _, err := sm.nextPatchedValue(entry)
+		if err != nil {
+			return nil, release, err
+		}
+		sizes[entry.Key] = entrySize(entry.Key, value, ContentTypeJSON)
+	case "TXN":
+		for _, op := range entry.Ops {
+			if op.Type == "DELETE" {
+				sizes[op.Key] = 0
+			} else {
+				sizes[op.Key] = entrySize(op.Key, op.Value, op.ContentType)
+			}
+		}
+	}
+	for {
+		tryLock, unlock := sm.tryLockKeys()
+		victims, reserved, releases, err := sm.memory.reserve(sizes, tryLock)
+		if errors.Is(err, errRoomInFlight) {
+			// The victims picked so far are unlocked while waiting, the writes in flight may need them to finish
+			unlock()
+			sm.memory.waitRelease(releases)
+			continue
+		}
+		if err != nil {
+			unlock()
+			return nil, release, err
+		}
+		release = func() {
+			sm.memory.release(victims, reserved)
+			unlock()
+		}
+		return victims, release, nil
+	}
+}
+
+// Touch records a read of the key for the eviction policy
+func (sm *StoreManager) Touch(key string) {
+	if sm.memory != nil {
+		sm.memory.touch(key)
+	}
+}
+
+func (sm *StoreManager) MemoryStats() MemoryStats {
+	if sm.memory == nil {
+		return MemoryStats{Policy: EvictionNone}
+	}
+	return sm.memory.stats()
+}
@@ -0,0 +1,23 @@
+package store
+
+import "strings"
+
+// NamespacedKey is the key under which a namespace's key is stored.
+// Namespace names cannot contain "/", so the first "/" always ends the namespace.
+func NamespacedKey(namespace string, key string) string {
+	return namespace + "/" + key
+}
+
+// StripNamespace turns a stored key back into the key its namespace knows it by
+func StripNamespace(namespace string, key string) string {
+	return strings.TrimPrefix(key, namespace+"/")
+}
+
+// NamespaceRange maps a [start, end) range inside a namespace onto the stored keys.
+// An empty end stays inside the namespace instead of running to the end of the keyspace.
+func NamespaceRange(namespace string, start string, end string) (string, string) {
+	if end == "" {
+		return NamespacedKey(namespace, start), PrefixEnd(NamespacedKey(namespace, ""))
+	}
+	return NamespacedKey(namespace, start), NamespacedKey(namespace, end)
+}
@@ -1 +1,31 @@
 package store
+
+import (
+	"errors"
+	"kvstore/pkg/kvstore/engine"
+)
+
+var ErrVersionNotRetained = errors.New("version is older than the retention window")
+
+var ErrKeyNotFound = engine.ErrKeyNotFound
+
+// The storage types are defined next to the public engine interface
+type (
+	Versioned = engine.Versioned
+	KVPair    = engine.KVPair
+)
+
+// PrefixEnd returns the smallest key that is greater than every key starting with prefix.
+// An empty result means there is no upper bound.
+func PrefixEnd(prefix string) string {
+	return engine.PrefixEnd(prefix)
+}
+
+// GetAt serves a read as of a past WAL version.
+// Versions older than the retention window may already be garbage collected and are refused.
+func (sm *StoreManager) GetAt(key string, version int) (Versioned, error) {
+	if version < sm.retentionHorizon() {
+		return Versioned{}, ErrVersionNotRetained
+	}
+	return sm.Store.GetAt(key, version)
+}
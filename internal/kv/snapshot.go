@@ -0,0 +1,210 @@
+package store
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Snapshots are MVCC based: a snapshot is a WAL version and an instant, reads through it walk the version chains.
+// While a snapshot is open the version GC keeps its versions and the expiry sweeper keeps the keys it can still see.
+
+// DefaultSnapshotTTL is how long a snapshot stays open when it is not released
+const DefaultSnapshotTTL = 10 * time.Minute
+
+// snapshotPageSize is how many keys an iterator reads from the store at a time
+const snapshotPageSize = 256
+
+var ErrSnapshotNotFound = errors.New("snapshot not found or already released")
+
+type Snapshot struct {
+	ID string `json:"id"`
+	// Version is the WAL version the snapshot was taken at, it sees every write up to it
+	Version int `json:"version"`
+	// CreatedAt is the instant expiry is judged at, keys that expire later are still visible
+	CreatedAt time.Time `json:"created_at"`
+	// ExpiresAt is when the snapshot is released if the client has not done it already
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type snapshotSet struct {
+	mu        sync.Mutex
+	nextID    int
+	snapshots map[string]Snapshot
+}
+
+// CreateSnapshot opens a snapshot at the applied low-water mark, a ttl <= 0 means DefaultSnapshotTTL.
+// Entries above the mark may still be applied, a snapshot at LatestVersion would see them appear.
+func (sm *StoreManager) CreateSnapshot(ttl time.Duration) Snapshot {
+	if ttl <= 0 {
+		ttl = DefaultSnapshotTTL
+	}
+	sm.snapshots.mu.Lock()
+	defer sm.snapshots.mu.Unlock()
+
+	if sm.snapshots.snapshots == nil {
+		sm.snapshots.snapshots = make(map[string]Snapshot)
+	}
+	sm.snapshots.nextID++
+	now := time.Now()
+	snapshot := Snapshot{
+		ID:        strconv.Itoa(sm.snapshots.nextID),
+		Version:   sm.AppliedVersion(),
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+	sm.snapshots.snapshots[snapshot.ID] = snapshot
+	return snapshot
+}
+
+// GetSnapshot returns an open snapshot
+func (sm *StoreManager) GetSnapshot(id string) (Snapshot, error) {
+	sm.snapshots.mu.Lock()
+	defer sm.snapshots.mu.Unlock()
+
+	snapshot, ok := sm.snapshots.snapshots[id]
+	if !ok {
+		return Snapshot{}, ErrSnapshotNotFound
+	}
+	return snapshot, nil
+}
+
+// Snapshots returns the open snapshots, oldest first
+func (sm *StoreManager) Snapshots() []Snapshot {
+	sm.snapshots.mu.Lock()
+	defer sm.snapshots.mu.Unlock()
+
+	snapshots := make([]Snapshot, 0, len(sm.snapshots.snapshots))
+	for _, snapshot := range sm.snapshots.snapshots {
+		snapshots = append(snapshots, snapshot)
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].CreatedAt.Before(snapshots[j].CreatedAt)
+	})
+	return snapshots
+}
+
+// ReleaseSnapshot closes a snapshot, the versions it pinned can be garbage collected again
+func (sm *StoreManager) ReleaseSnapshot(id string) error {
+	sm.snapshots.mu.Lock()
+	defer sm.snapshots.mu.Unlock()
+
+	if _, ok := sm.snapshots.snapshots[id]; !ok {
+		return ErrSnapshotNotFound
+	}
+	delete(sm.snapshots.snapshots, id)
+	return nil
+}
+
+// releaseExpiredSnapshots closes the snapshots whose ttl ran out and returns how many were closed
+func (sm *StoreManager) releaseExpiredSnapshots(now time.Time) int {
+	sm.snapshots.mu.Lock()
+	defer sm.snapshots.mu.Unlock()
+
+	released := 0
+	for id, snapshot := range sm.snapshots.snapshots {
+		if !now.Before(snapshot.ExpiresAt) {
+			delete(sm.snapshots.snapshots, id)
+			released++
+		}
+	}
+	return released
+}
+
+// oldestSnapshot returns the lowest version and the earliest instant an open snapshot still reads at
+func (sm *StoreManager) oldestSnapshot() (int, time.Time, bool) {
+	sm.snapshots.mu.Lock()
+	defer sm.snapshots.mu.Unlock()
+
+	var version int
+	var createdAt time.Time
+	found := false
+	for _, snapshot := range sm.snapshots.snapshots {
+		if !found || snapshot.Version < version {
+			version = snapshot.Version
+		}
+		if !found || snapshot.CreatedAt.Before(createdAt) {
+			createdAt = snapshot.CreatedAt
+		}
+		found = true
+	}
+	return version, createdAt, found
+}
+
+// SnapshotIterator walks the keys of a snapshot in ascending order.
+// It reads the store a page at a time, so writes are never blocked for the whole iteration.
+//
+//	it, err := sm.NewSnapshotIterator(id, start, end)
+//	for it.Next() {
+//		pair := it.Pair()
+//	}
+//	err = it.Err()
+type SnapshotIterator struct {
+	sm       *StoreManager
+	snapshot Snapshot
+	end      string
+	// next is where the following page starts, done is set once the range is exhausted
+	next string
+	done bool
+	page []KVPair
+	pos  int
+	err  error
+}
+
+// NewSnapshotIterator iterates the keys of the snapshot in [start, end), an empty end runs to the end of the keyspace
+func (sm *StoreManager) NewSnapshotIterator(id string, start string, end string) (*SnapshotIterator, error) {
+	snapshot, err := sm.GetSnapshot(id)
+	if err != nil {
+		return nil, err
+	}
+	return &SnapshotIterator{sm: sm, snapshot: snapshot, end: end, next: start}, nil
+}
+
+// Snapshot returns the snapshot the iterator reads
+func (it *SnapshotIterator) Snapshot() Snapshot {
+	return it.snapshot
+}
+
+// Next moves to the next key and reports whether there is one
+func (it *SnapshotIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	it.pos++
+	if it.pos < len(it.page) {
+		return true
+	}
+	if it.done {
+		return false
+	}
+
+	// A released snapshot no longer pins its versions, reading on could return newer data
+	if _, err := it.sm.GetSnapshot(it.snapshot.ID); err != nil {
+		it.err = err
+		return false
+	}
+	page, err := it.sm.Store.ScanAt(it.next, it.end, it.snapshot.Version, it.snapshot.CreatedAt, snapshotPageSize)
+	if err != nil {
+		it.err = err
+		return false
+	}
+	it.page, it.pos = page, 0
+	if len(page) < snapshotPageSize {
+		it.done = true
+	} else {
+		it.next = page[len(page)-1].Key + "\x00"
+	}
+	return len(page) > 0
+}
+
+// Pair returns the current key, its value is shared with the store and must not be modified
+func (it *SnapshotIterator) Pair() KVPair {
+	return it.page[it.pos]
+}
+
+// Err returns the error that stopped the iteration, if any
+func (it *SnapshotIterator) Err() error {
+	return it.err
+}
@@ -0,0 +1,118 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"kvstore/internal/wal"
+	"testing"
+	"time"
+)
+
+func snapshotKeys(t *testing.T, sm *StoreManager, id string) map[string]string {
+	t.Helper()
+	it, err := sm.NewSnapshotIterator(id, "", "")
+	if err != nil {
+		t.Fatalf("NewSnapshotIterator failed: %v", err)
+	}
+	values := make(map[string]string)
+	last := ""
+	for it.Next() {
+		pair := it.Pair()
+		if pair.Key <= last {
+			t.Fatalf("snapshot iterator returned %q after %q", pair.Key, last)
+		}
+		last = pair.Key
+		values[pair.Key] = string(pair.Value)
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("snapshot iteration failed: %v", err)
+	}
+	return values
+}
+
+func testSnapshotIsolation(t *testing.T, sm *StoreManager) {
+	// More keys than a page so that the iterator has to go back to the store
+	for i := 0; i < snapshotPageSize+10; i++ {
+		applyAll(t, sm, wal.WAL{Type: "PUT", Key: fmt.Sprintf("key%04d", i), Value: []byte("old")})
+	}
+	applyAll(t, sm, wal.WAL{Type: "PUT", Key: "short-lived", Value: []byte("v"), TTL: 1, Timestamp: time.Now().UnixNano()})
+
+	snapshot := sm.CreateSnapshot(0)
+	if snapshot.Version != sm.LatestVersion() {
+		t.Fatalf("snapshot version = %d; want %d", snapshot.Version, sm.LatestVersion())
+	}
+
+	applyAll(t, sm,
+		wal.WAL{Type: "PUT", Key: "key0000", Value: []byte("new")},
+		wal.WAL{Type: "PUT", Key: "added", Value: []byte("new")},
+		wal.WAL{Type: "TXN", Ops: []wal.Op{{Type: "DELETE", Key: "key0001"}}},
+	)
+	// Neither the version GC nor the expiry sweeper may take what the snapshot sees
+	sm.Store.PruneVersions(sm.retentionHorizon())
+	sm.Store.DeleteExpired(sm.sweepDeadline(time.Now().Add(time.Hour)))
+
+	values := snapshotKeys(t, sm, snapshot.ID)
+	if len(values) != snapshotPageSize+11 {
+		t.Fatalf("snapshot has %d keys; want %d", len(values), snapshotPageSize+11)
+	}
+	if values["key0000"] != "old" || values["key0001"] != "old" || values["short-lived"] != "v" {
+		t.Fatalf("snapshot sees later writes: key0000=%q key0001=%q short-lived=%q", values["key0000"], values["key0001"], values["short-lived"])
+	}
+	if _, ok := values["added"]; ok {
+		t.Fatalf("snapshot sees a key added after it was taken")
+	}
+
+	if err := sm.ReleaseSnapshot(snapshot.ID); err != nil {
+		t.Fatalf("ReleaseSnapshot failed: %v", err)
+	}
+	if _, err := sm.NewSnapshotIterator(snapshot.ID, "", ""); !errors.Is(err, ErrSnapshotNotFound) {
+		t.Fatalf("NewSnapshotIterator on a released snapshot = %v; want ErrSnapshotNotFound", err)
+	}
+}
+
+func TestSnapshotIsolationInMemStore(t *testing.T) {
+	sm, _ := NewStoreManager(Config{Engine: EngineMemory})
+	testSnapshotIsolation(t, sm)
+}
+
+func TestSnapshotIsolationLSMStore(t *testing.T) {
+	sm, err := NewStoreManager(Config{Engine: EngineLSM, DataDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("NewStoreManager failed: %v", err)
+	}
+	defer sm.Store.Close()
+	testSnapshotIsolation(t, sm)
+}
+
+func TestSnapshotsExpire(t *testing.T) {
+	sm, _ := NewStoreManager(Config{Engine: EngineMemory})
+	expiring := sm.CreateSnapshot(time.Minute)
+	kept := sm.CreateSnapshot(time.Hour)
+
+	if released := sm.releaseExpiredSnapshots(time.Now().Add(2 * time.Minute)); released != 1 {
+		t.Fatalf("releaseExpiredSnapshots released %d snapshots; want 1", released)
+	}
+	if _, err := sm.GetSnapshot(expiring.ID); !errors.Is(err, ErrSnapshotNotFound) {
+		t.Fatalf("GetSnapshot on an expired snapshot = %v; want ErrSnapshotNotFound", err)
+	}
+	if snapshots := sm.Snapshots(); len(snapshots) != 1 || snapshots[0].ID != kept.ID {
+		t.Fatalf("Snapshots() = %v; want only %s", snapshots, kept.ID)
+	}
+}
+
+func TestSnapshotWaitsForOlderEntries(t *testing.T) {
+	sm, _ := NewStoreManager(Config{Engine: EngineMemory})
+	sm.Apply(putEntry("a", "1", 1))
+	sm.Apply(putEntry("c", "3", 3))
+
+	// 2 is committed but not applied yet, a snapshot at 3 would see it appear later
+	sm.BeginApply(2)
+	snapshot := sm.CreateSnapshot(0)
+	if snapshot.Version != 1 {
+		t.Fatalf("snapshot version = %d; want the applied low-water mark 1", snapshot.Version)
+	}
+	sm.Apply(putEntry("b", "2", 2))
+	if values := snapshotKeys(t, sm, snapshot.ID); len(values) != 1 || values["a"] != "1" {
+		t.Fatalf("snapshot = %v; want only a=1", values)
+	}
+}
@@ -0,0 +1,272 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kvstore/internal/wal"
+	"sort"
+	"time"
+)
+
+// Hashes, lists, sets and sorted sets are stored as JSON in a regular value.
+// The content type tells them apart from plain values and from each other.
+const (
+	ContentTypeHash      = "application/vnd.kvstore.hash+json"
+	ContentTypeList      = "application/vnd.kvstore.list+json"
+	ContentTypeSet       = "application/vnd.kvstore.set+json"
+	ContentTypeSortedSet = "application/vnd.kvstore.zset+json"
+)
+
+var ErrWrongType = errors.New("operation against a key holding the wrong kind of value")
+
+// ZMember is a member of a sorted set
+type ZMember struct {
+	Member string  `json:"member"`
+	Score  float64 `json:"score"`
+}
+
+// typedEntryContentType returns the content type a data type entry works on
+func typedEntryContentType(entryType string) (string, bool) {
+	switch entryType {
+	case "HSET", "HDEL":
+		return ContentTypeHash, true
+	case "LPUSH", "RPUSH", "LPOP", "RPOP":
+		return ContentTypeList, true
+	case "SADD", "SREM":
+		return ContentTypeSet, true
+	case "ZADD", "ZREM":
+		return ContentTypeSortedSet, true
+	}
+	return "", false
+}
+
+// readTyped loads the key and decodes it into v when it holds contentType.
+// A missing key leaves v untouched, a key of another type fails with ErrWrongType.
+func (sm *StoreManager) readTyped(key string, contentType string, v any) (Versioned, bool, error) {
+	current, exists, err := sm.Store.GetVersioned(key)
+	if err != nil || !exists {
+		return current, exists, err
+	}
+	if current.ContentType != contentType {
+		return current, exists, ErrWrongType
+	}
+	if err := json.Unmarshal(current.Value, v); err != nil {
+		return current, exists, fmt.Errorf("corrupt %s value for key %s: %w", contentType, key, err)
+	}
+	return current, exists, nil
+}
+
+// Hash returns the fields of the hash, it fails with ErrKeyNotFound when the key does not exist
+func (sm *StoreManager) Hash(key string) (map[string]string, error) {
+	hash := map[string]string{}
+	_, exists, err := sm.readTyped(key, ContentTypeHash, &hash)
+	if err == nil && !exists {
+		err = ErrKeyNotFound
+	}
+	return hash, err
+}
+
+func (sm *StoreManager) List(key string) ([]string, error) {
+	list := []string{}
+	_, exists, err := sm.readTyped(key, ContentTypeList, &list)
+	if err == nil && !exists {
+		err = ErrKeyNotFound
+	}
+	return list, err
+}
+
+// Set returns the members of the set in sorted order
+func (sm *StoreManager) Set(key string) ([]string, error) {
+	set := []string{}
+	_, exists, err := sm.readTyped(key, ContentTypeSet, &set)
+	if err == nil && !exists {
+		err = ErrKeyNotFound
+	}
+	return set, err
+}
+
+// SortedSet returns the members ordered by score, members with the same score by name
+func (sm *StoreManager) SortedSet(key string) ([]ZMember, error) {
+	zset := []ZMember{}
+	_, exists, err := sm.readTyped(key, ContentTypeSortedSet, &zset)
+	if err == nil && !exists {
+		err = ErrKeyNotFound
+	}
+	return zset, err
+}
+
+// nextTypedValue computes the value the key will hold once the data type entry is applied.
+// A nil value means the collection became empty and the key is removed.
+func (sm *StoreManager) nextTypedValue(entry wal.WAL) ([]byte, Versioned, bool, error) {
+	contentType, ok := typedEntryContentType(entry.Type)
+	if !ok {
+		return nil, Versioned{}, false, fmt.Errorf("unknown data type entry: %s", entry.Type)
+	}
+
+	var next any
+	var empty bool
+	var current Versioned
+	var exists bool
+	var err error
+	switch contentType {
+	case ContentTypeHash:
+		hash := map[string]string{}
+		if current, exists, err = sm.readTyped(entry.Key, contentType, &hash); err != nil {
+			return nil, current, exists, err
+		}
+		for _, item := range entry.Items {
+			if entry.Type == "HSET" {
+				hash[item.Member] = item.Value
+			} else {
+				delete(hash, item.Member)
+			}
+		}
+		next, empty = hash, len(hash) == 0
+	case ContentTypeList:
+		list := []string{}
+		if current, exists, err = sm.readTyped(entry.Key, contentType, &list); err != nil {
+			return nil, current, exists, err
+		}
+		list = applyListEntry(list, entry)
+		next, empty = list, len(list) == 0
+	case ContentTypeSet:
+		set := []string{}
+		if current, exists, err = sm.readTyped(entry.Key, contentType, &set); err != nil {
+			return nil, current, exists, err
+		}
+		set = applySetEntry(set, entry)
+		next, empty = set, len(set) == 0
+	case ContentTypeSortedSet:
+		zset := []ZMember{}
+		if current, exists, err = sm.readTyped(entry.Key, contentType, &zset); err != nil {
+			return nil, current, exists, err
+		}
+		zset = applySortedSetEntry(zset, entry)
+		next, empty = zset, len(zset) == 0
+	}
+
+	if empty {
+		return nil, current, exists, nil
+	}
+	value, err := json.Marshal(next)
+	return value, current, exists, err
+}
+
+func applyListEntry(list []string, entry wal.WAL) []string {
+	switch entry.Type {
+	case "LPUSH":
+		// Every item is pushed on the head in turn, so the last one ends up first
+		for _, item := range entry.Items {
+			list = append([]string{item.Member}, list...)
+		}
+	case "RPUSH":
+		for _, item := range entry.Items {
+			list = append(list, item.Member)
+		}
+	case "LPOP":
+		list = list[min(entry.Count, len(list)):]
+	case "RPOP":
+		list = list[:len(list)-min(entry.Count, len(list))]
+	}
+	return list
+}
+
+// applySetEntry keeps the members sorted so that every replica encodes the set the same way
+func applySetEntry(set []string, entry wal.WAL) []string {
+	members := make(map[string]bool, len(set))
+	for _, member := range set {
+		members[member] = true
+	}
+	for _, item := range entry.Items {
+		members[item.Member] = entry.Type == "SADD"
+	}
+	set = set[:0]
+	for member, present := range members {
+		if present {
+			set = append(set, member)
+		}
+	}
+	sort.Strings(set)
+	return set
+}
+
+func applySortedSetEntry(zset []ZMember, entry wal.WAL) []ZMember {
+	scores := make(map[string]float64, len(zset))
+	for _, m := range zset {
+		scores[m.Member] = m.Score
+	}
+	for _, item := range entry.Items {
+		if entry.Type == "ZADD" {
+			scores[item.Member] = item.Score
+		} else {
+			delete(scores, item.Member)
+		}
+	}
+	zset = zset[:0]
+	for member, score := range scores {
+		zset = append(zset, ZMember{Member: member, Score: score})
+	}
+	sort.Slice(zset, func(i, j int) bool {
+		if zset[i].Score != zset[j].Score {
+			return zset[i].Score < zset[j].Score
+		}
+		return zset[i].Member < zset[j].Member
+	})
+	return zset
+}
+
+// CheckTypedEntry fails with ErrWrongType when the entry does not match the type of the key.
+// The leader calls it before the prepare phase so that such entries never reach the WAL.
+func (sm *StoreManager) CheckTypedEntry(entry wal.WAL) error {
+	_, _, _, err := sm.nextTypedValue(entry)
+	return err
+}
+
+// applyTyped applies a hash, list, set or sorted set entry as a read-modify-write of the key
+func (sm *StoreManager) applyTyped(entry wal.WAL) error {
+	value, current, exists, err := sm.nextTypedValue(entry)
+	if err != nil {
+		return err
+	}
+	if value == nil {
+		// Empty collections do not exist, like in Redis
+		if exists {
+			if err := sm.Store.Delete(entry.Key, entry.Version); err != nil {
+				return err
+			}
+			if sm.memory != nil {
+				sm.memory.remove(entry.Key)
+			}
+		}
+		return nil
+	}
+	contentType, _ := typedEntryContentType(entry.Type)
+	return sm.writeKeepingExpiry(entry, current, exists, value, contentType)
+}
+
+// writeKeepingExpiry stores the result of a read-modify-write entry.
+// An existing key keeps its expiry, a new one gets the entry's TTL.
+func (sm *StoreManager) writeKeepingExpiry(entry wal.WAL, current Versioned, exists bool, value []byte, contentType string) error {
+	expiresAt := entry.ExpiresAt()
+	if exists {
+		expiresAt = time.Time{}
+		if current.ExpiresAt != 0 {
+			expiresAt = time.Unix(0, current.ExpiresAt)
+		}
+	}
+
+	var err error
+	if expiresAt.IsZero() {
+		err = sm.Store.Put(entry.Key, value, contentType, entry.Version)
+	} else {
+		err = sm.Store.PutWithTTL(entry.Key, value, contentType, entry.Version, expiresAt)
+	}
+	if err != nil {
+		return err
+	}
+	if sm.memory != nil {
+		sm.memory.set(entry.Key, entrySize(entry.Key, value, contentType), expiresAt)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package store
+
+import (
+	"errors"
+	"kvstore/internal/wal"
+	"reflect"
+	"testing"
+)
+
+func applyAll(t *testing.T, sm *StoreManager, entries ...wal.WAL) {
+	t.Helper()
+	for i, entry := range entries {
+		entry.Version = sm.LatestVersion() + 1
+		if err := sm.Apply(entry); err != nil {
+			t.Fatalf("Apply(%s) #%d failed: %v", entry.Type, i, err)
+		}
+	}
+}
+
+func items(members ...string) []wal.Item {
+	out := make([]wal.Item, len(members))
+	for i, member := range members {
+		out[i] = wal.Item{Member: member}
+	}
+	return out
+}
+
+func TestHashEntries(t *testing.T) {
+	sm, _ := NewStoreManager(Config{Engine: EngineMemory})
+	applyAll(t, sm,
+		wal.WAL{Type: "HSET", Key: "user", Items: []wal.Item{{Member: "name", Value: "bob"}, {Member: "email", Value: "bob@example.com"}}},
+		wal.WAL{Type: "HSET", Key: "user", Items: []wal.Item{{Member: "name", Value: "alice"}}},
+		wal.WAL{Type: "HDEL", Key: "user", Items: items("email", "missing")},
+	)
+	hash, err := sm.Hash("user")
+	if err != nil || !reflect.DeepEqual(hash, map[string]string{"name": "alice"}) {
+		t.Fatalf("Hash(user) = %v, %v; want only name=alice", hash, err)
+	}
+
+	// Removing the last field removes the key
+	applyAll(t, sm, wal.WAL{Type: "HDEL", Key: "user", Items: items("name")})
+	if _, exists, _ := sm.Store.GetVersioned("user"); exists {
+		t.Fatalf("empty hash still exists")
+	}
+}
+
+func TestListEntries(t *testing.T) {
+	sm, _ := NewStoreManager(Config{Engine: EngineMemory})
+	applyAll(t, sm,
+		wal.WAL{Type: "RPUSH", Key: "queue", Items: items("b", "c")},
+		wal.WAL{Type: "LPUSH", Key: "queue", Items: items("a", "z")},
+		wal.WAL{Type: "LPOP", Key: "queue", Count: 1},
+		wal.WAL{Type: "RPOP", Key: "queue", Count: 1},
+	)
+	list, err := sm.List("queue")
+	if err != nil || !reflect.DeepEqual(list, []string{"a", "b"}) {
+		t.Fatalf("List(queue) = %v, %v; want [a b]", list, err)
+	}
+
+	applyAll(t, sm, wal.WAL{Type: "LPOP", Key: "queue", Count: 10})
+	if list, err := sm.List("queue"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("List(queue) after popping everything = %v, %v; want ErrKeyNotFound", list, err)
+	}
+}
+
+func TestSetAndSortedSetEntries(t *testing.T) {
+	sm, _ := NewStoreManager(Config{Engine: EngineMemory})
+	applyAll(t, sm,
+		wal.WAL{Type: "SADD", Key: "tags", Items: items("go", "db", "go")},
+		wal.WAL{Type: "SREM", Key: "tags", Items: items("db")},
+		wal.WAL{Type: "ZADD", Key: "scores", Items: []wal.Item{{Member: "bob", Score: 3}, {Member: "amy", Score: 1}, {Member: "cat", Score: 3}}},
+		wal.WAL{Type: "ZADD", Key: "scores", Items: []wal.Item{{Member: "amy", Score: 5}}},
+		wal.WAL{Type: "ZREM", Key: "scores", Items: items("cat")},
+	)
+	set, err := sm.Set("tags")
+	if err != nil || !reflect.DeepEqual(set, []string{"go"}) {
+		t.Fatalf("Set(tags) = %v, %v; want [go]", set, err)
+	}
+	zset, err := sm.SortedSet("scores")
+	want := []ZMember{{Member: "bob", Score: 3}, {Member: "amy", Score: 5}}
+	if err != nil || !reflect.DeepEqual(zset, want) {
+		t.Fatalf("SortedSet(scores) = %v, %v; want %v", zset, err, want)
+	}
+}
+
+func TestDataTypeEntriesRejectWrongType(t *testing.T) {
+	sm, _ := NewStoreManager(Config{Engine: EngineMemory})
+	applyAll(t, sm,
+		wal.WAL{Type: "PUT", Key: "plain", Value: []byte("x")},
+		wal.WAL{Type: "SADD", Key: "tags", Items: items("go")},
+	)
+
+	if err := sm.CheckTypedEntry(wal.WAL{Type: "HSET", Key: "plain", Items: items("f")}); !errors.Is(err, ErrWrongType) {
+		t.Fatalf("CheckTypedEntry(HSET plain) = %v; want ErrWrongType", err)
+	}
+	if err := sm.Apply(wal.WAL{Type: "LPUSH", Key: "tags", Items: items("a"), Version: 10}); !errors.Is(err, ErrWrongType) {
+		t.Fatalf("Apply(LPUSH tags) = %v; want ErrWrongType", err)
+	}
+	if _, err := sm.Hash("tags"); !errors.Is(err, ErrWrongType) {
+		t.Fatalf("Hash(tags) = %v; want ErrWrongType", err)
+	}
+}
@@ -1 +1,112 @@
 package store
+
+import (
+	"fmt"
+	"kvstore/internal/wal"
+	"kvstore/pkg/kvstore/engine"
+)
+
+type BatchOp = engine.BatchOp
+
+// ValidateOps checks the mutations of a TXN entry before anything is applied
+func ValidateOps(ops []wal.Op) error {
+	if len(ops) == 0 {
+		return fmt.Errorf("transaction has no operations")
+	}
+	for _, op := range ops {
+		if op.Key == "" {
+			return fmt.Errorf("transaction operation has an empty key")
+		}
+		if op.TTL < 0 {
+			return fmt.Errorf("transaction operation on key %s has a negative TTL", op.Key)
+		}
+		if op.Type != "PUT" && op.Type != "DELETE" {
+			return fmt.Errorf("unknown transaction operation type: %s", op.Type)
+		}
+		// Locks are only written by LOCK entries, which give them their fencing token
+		if op.ContentType == ContentTypeLock {
+			return fmt.Errorf("transaction operation on key %s cannot write a lock", op.Key)
+		}
+	}
+	return nil
+}
+
+// Apply writes a committed WAL entry into the store.
+// Both the leader and the followers go through here so that they end up in the same state.
+func (sm *StoreManager) Apply(entry wal.WAL) error {
+	// An entry that fails to apply fails the same way on every replica, it no longer holds the low-water mark
+	defer sm.finishApply(entry.Version)
+	switch entry.Type {
+	case "PUT":
+		var err error
+		if entry.TTL > 0 {
+			err = sm.Store.PutWithTTL(entry.Key, entry.Value, entry.ContentType, entry.Version, entry.ExpiresAt())
+		} else {
+			err = sm.Store.Put(entry.Key, entry.Value, entry.ContentType, entry.Version)
+		}
+		if err != nil {
+			return err
+		}
+	case "DELETE":
+		// A tombstone at the entry's version, older versions stay readable for snapshots and as_of reads
+		if err := sm.Store.Delete(entry.Key, entry.Version); err != nil {
+			return err
+		}
+	// EVICT entries are batches of deletes picked by the leader's eviction policy
+	case "TXN", "EVICT":
+		// The batch is validated up front so that it is applied entirely or not at all
+		if err := ValidateOps(entry.Ops); err != nil {
+			return err
+		}
+		batch := make([]BatchOp, len(entry.Ops))
+		for i, op := range entry.Ops {
+			batch[i] = BatchOp{
+				Key:         op.Key,
+				Value:       op.Value,
+				ContentType: op.ContentType,
+				Version:     entry.Version,
+				ExpiresAt:   entry.OpExpiresAt(op),
+				Delete:      op.Type == "DELETE",
+			}
+		}
+		if err := sm.Store.WriteBatch(batch); err != nil {
+			return err
+		}
+	case "INCR", "DECR", "INCRBY":
+		// Followers add the same delta to the same previous value, so every replica ends up with the same counter
+		if _, err := sm.applyCounter(entry); err != nil {
+			return err
+		}
+	case "HSET", "HDEL", "LPUSH", "RPUSH", "LPOP", "RPOP", "SADD", "SREM", "ZADD", "ZREM":
+		if err := sm.applyTyped(entry); err != nil {
+			return err
+		}
+	case "PATCH":
+		// The patch is replicated instead of the whole document, every replica patches its own copy
+		if err := sm.applyPatch(entry); err != nil {
+			return err
+		}
+	case "LOCK", "RENEW", "UNLOCK":
+		if err := sm.applyLock(entry); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown WAL entry type: %s", entry.Type)
+	}
+	sm.track(entry)
+	sm.reindex(entryKeys(entry)...)
+	sm.observeVersion(entry.Version)
+	return nil
+}
+
+// entryKeys returns every key a WAL entry writes
+func entryKeys(entry wal.WAL) []string {
+	keys := make([]string, 0, len(entry.Ops)+1)
+	if entry.Key != "" {
+		keys = append(keys, entry.Key)
+	}
+	for _, op := range entry.Ops {
+		keys = append(keys, op.Key)
+	}
+	return keys
+}
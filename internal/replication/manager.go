@@ -3,40 +3,124 @@ package replication
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"kvstore/internal/cluster"
 	"kvstore/internal/wal"
 	"log"
+	"math"
 	"net/http"
 	"sync"
+	"time"
 
 	"github.com/go-zookeeper/zk"
 )
 
+// zkClient is the part of the Zookeeper client replication uses, *zk.Conn implements it
+type zkClient interface {
+	Children(path string) ([]string, *zk.Stat, error)
+	Get(path string) ([]byte, *zk.Stat, error)
+}
+
 type ReplicationManager struct {
 	KvPort         int                     `json:"kv_port"`
-	ZkClient       *zk.Conn                `json:"zk_client"`
+	ZkClient       zkClient                `json:"zk_client"`
 	WALManager     *(wal.WALManager)       `json:"wal_manager"`
 	ClusterManager *cluster.ClusterManager `json:"cluster_manager"`
+	// acked is the highest version each worker has committed, by worker name
+	acked map[string]int
+	// unacked are the versions sent to each worker that it has not committed yet, by worker name.
+	// Commits are confirmed out of version order, they hold the worker's acknowledged version back.
+	unacked    map[string]map[int]bool
+	ackedMutex sync.Mutex
+	// asyncQueues hold the entries of async namespaces each worker has yet to be sent, by worker name
+	asyncQueues map[string]chan asyncEntry
+	asyncMutex  sync.Mutex
 }
 
-func NewReplicationManager(kvPort int, zkClient *zk.Conn) *ReplicationManager {
+func NewReplicationManager(kvPort int, zkClient zkClient, walManager *wal.WALManager, clusterManager *cluster.ClusterManager) *ReplicationManager {
 	return &ReplicationManager{
+		KvPort:         kvPort,
 		ZkClient:       zkClient,
-		WALManager:     wal.NewWALManager(int(kvPort), zkClient),
-		ClusterManager: cluster.NewClusterManager(int(kvPort), zkClient),
+		WALManager:     walManager,
+		ClusterManager: clusterManager,
+		acked:          make(map[string]int),
+		unacked:        make(map[string]map[int]bool),
+		asyncQueues:    make(map[string]chan asyncEntry),
+	}
+}
+
+// expectAcks records that the commit of an entry is being sent to the workers
+func (rm *ReplicationManager) expectAcks(workers []string, version int) {
+	rm.ackedMutex.Lock()
+	defer rm.ackedMutex.Unlock()
+	for _, worker := range workers {
+		if rm.unacked[worker] == nil {
+			rm.unacked[worker] = make(map[int]bool)
+		}
+		rm.unacked[worker][version] = true
+	}
+}
+
+// ack records that a worker has committed an entry
+func (rm *ReplicationManager) ack(worker string, version int) {
+	rm.ackedMutex.Lock()
+	defer rm.ackedMutex.Unlock()
+	rm.acked[worker] = max(rm.acked[worker], version)
+	delete(rm.unacked[worker], version)
+}
+
+// forgetAck stops waiting for a worker that left the cluster to commit an entry
+func (rm *ReplicationManager) forgetAck(worker string, version int) {
+	rm.ackedMutex.Lock()
+	defer rm.ackedMutex.Unlock()
+	delete(rm.unacked[worker], version)
+}
+
+// AckedVersion returns the highest version such that every worker has committed every entry sent to it up to it,
+// -1 while a worker has not committed anything yet. A commit a worker missed holds it back for good.
+// Entries still in their prepare phase are not sent yet, the leader's own applied version holds those back.
+// Without workers every version counts as acknowledged.
+func (rm *ReplicationManager) AckedVersion() (int, error) {
+	workers, _, err := rm.ZkClient.Children("/workers")
+	if err != nil {
+		log.Println("Failed to get workers:", err)
+		return -1, err
+	}
+
+	rm.ackedMutex.Lock()
+	defer rm.ackedMutex.Unlock()
+	acked := math.MaxInt
+	for _, worker := range workers {
+		version, ok := rm.acked[worker]
+		if !ok {
+			return -1, nil
+		}
+		for unacked := range rm.unacked[worker] {
+			version = min(version, unacked-1)
+		}
+		acked = min(acked, version)
+	}
+	return acked, nil
+}
+
+// namespaceConfig returns the replication settings of the namespace the entry belongs to
+func (rm *ReplicationManager) namespaceConfig(entry wal.WAL) (cluster.NamespaceConfig, error) {
+	namespace := entry.Namespace
+	if namespace == "" {
+		namespace = cluster.DefaultNamespace
 	}
+	return rm.ClusterManager.GetNamespace(namespace)
 }
 
-func (rm *ReplicationManager) WALReplicationToWorkers(opType string, key string, value string, version int) error {
-	body := wal.WAL{
-		Version: version,
-		Type:    opType,
-		Key:     key,
-		Value:   value,
+func (rm *ReplicationManager) WALReplicationToWorkers(entry wal.WAL) error {
+	cfg, err := rm.namespaceConfig(entry)
+	if err != nil {
+		log.Println("Failed to get namespace config:", err)
+		return err
 	}
 
-	bodyJson, err := json.Marshal(body)
+	bodyJson, err := json.Marshal(entry)
 	if err != nil {
 		log.Println("Failed to marshal body:", err)
 		return err
@@ -48,6 +132,12 @@ func (rm *ReplicationManager) WALReplicationToWorkers(opType string, key string,
 		return err
 	}
 
+	if cfg.ReplicationMode == cluster.ReplicationAsync {
+		// The leader does not wait for the followers, each one gets the prepare and the commit in the background
+		rm.replicateAsync(workers, entry.Version, bodyJson)
+		return nil
+	}
+
 	wg := sync.WaitGroup{}
 	successCount := int32(0)
 	mu := sync.Mutex{}
@@ -56,7 +146,7 @@ func (rm *ReplicationManager) WALReplicationToWorkers(opType string, key string,
 	for _, worker := range workers {
 		go func(worker string) {
 			defer wg.Done()
-			workerData, _, err := rm.ZkClient.Get("/workers" + worker)
+			workerData, _, err := rm.ZkClient.Get("/workers/" + worker)
 			if err != nil {
 				log.Println("Failed to get worker data:", err)
 				return
@@ -79,24 +169,121 @@ func (rm *ReplicationManager) WALReplicationToWorkers(opType string, key string,
 
 	wg.Wait()
 
-	if successCount < rm.ClusterManager.WriteQuorum {
-		return fmt.Errorf("failed to replicate to enough workers: %d/%d", successCount, rm.ClusterManager.WriteQuorum)
+	writeQuorum := rm.ClusterManager.EffectiveWriteQuorum(cfg)
+	if successCount < writeQuorum {
+		return fmt.Errorf("failed to replicate to enough workers: %d/%d", successCount, writeQuorum)
 	}
 
 	return nil
 }
 
-func (rm *ReplicationManager) CommitTxnToWorkers(opType string, key string, value string, version int) error {
-	// Create a new WriteRecordBody struct
-	body := wal.WAL{
-		Type:    opType,
-		Version: version,
-		Key:     key,
-		Value:   value,
+// asyncQueueSize is how many async entries may wait for a worker before writers block on it
+const asyncQueueSize = 4096
+
+// asyncRetryDelay is the pause before an entry a worker did not take is sent to it again
+const asyncRetryDelay = 500 * time.Millisecond
+
+// asyncEntry is an entry waiting to be sent to a worker in the background
+type asyncEntry struct {
+	version  int
+	bodyJson []byte
+	// prepared is set once the worker has logged the entry, a retry only sends the commit
+	prepared bool
+}
+
+// replicateAsync queues the entry for every worker without waiting for it to be sent.
+// Every worker has a single sender that goes through its queue in order, and writers hold their keys
+// while they queue, so a follower never gets an older write of a key after a newer one.
+// An entry a worker does not take stays at the front of its queue and is sent again until it does.
+func (rm *ReplicationManager) replicateAsync(workers []string, version int, bodyJson []byte) {
+	rm.expectAcks(workers, version)
+	for _, worker := range workers {
+		rm.asyncQueue(worker) <- asyncEntry{version: version, bodyJson: bodyJson}
+	}
+}
+
+// asyncQueue returns the queue of a worker, its sender is started the first time
+func (rm *ReplicationManager) asyncQueue(worker string) chan asyncEntry {
+	rm.asyncMutex.Lock()
+	defer rm.asyncMutex.Unlock()
+	queue, ok := rm.asyncQueues[worker]
+	if !ok {
+		queue = make(chan asyncEntry, asyncQueueSize)
+		rm.asyncQueues[worker] = queue
+		go func() {
+			for entry := range queue {
+				for !rm.sendAsync(worker, &entry) {
+					time.Sleep(asyncRetryDelay)
+				}
+			}
+		}()
 	}
+	return queue
+}
 
-	// Marshal the body into JSON
-	bodyJson, err := json.Marshal(body)
+// sendAsync sends the prepare and then the commit of an async entry to a worker and reports whether it is done with it.
+// A worker that left the cluster is done with every entry, it catches up from the leader when it joins again.
+func (rm *ReplicationManager) sendAsync(worker string, entry *asyncEntry) bool {
+	workerData, _, err := rm.ZkClient.Get("/workers/" + worker)
+	if errors.Is(err, zk.ErrNoNode) {
+		log.Println("Dropping async entry of a worker that left:", worker, entry.version)
+		rm.forgetAck(worker, entry.version)
+		return true
+	}
+	if err != nil {
+		log.Println("Failed to get worker data:", err)
+		return false
+	}
+	workerAddress := string(workerData)
+	if !entry.prepared {
+		resp, err := http.Post("http://"+workerAddress+"/api/v1/replicate/", "application/json", bytes.NewBuffer(entry.bodyJson))
+		if err != nil {
+			log.Println("Failed to send async replication request:", err)
+			return false
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			log.Println("Worker rejected async replication request:", workerAddress, resp.StatusCode)
+			return false
+		}
+		entry.prepared = true
+	}
+	resp, err := http.Post("http://"+workerAddress+"/commit/", "application/json", bytes.NewBuffer(entry.bodyJson))
+	if err != nil {
+		log.Println("Failed to send async commit request:", err)
+		return false
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Println("Worker rejected async commit request:", workerAddress, resp.StatusCode)
+		return false
+	}
+	rm.ack(worker, entry.version)
+	return true
+}
+
+// commitAttempts is how many times the commit phase is sent to the workers that have not confirmed it
+const commitAttempts = 3
+
+// commitRetryDelay is the pause between two attempts of the commit phase
+const commitRetryDelay = 100 * time.Millisecond
+
+// CommitTxnToWorkers sends the commit phase of an entry and fails when fewer workers than the write quorum confirm it.
+// The decision is already logged on the leader, the workers that did not confirm are retried in the background
+// so that the caller does not wait on them with its keys locked.
+func (rm *ReplicationManager) CommitTxnToWorkers(entry wal.WAL) error {
+	cfg, err := rm.namespaceConfig(entry)
+	if err != nil {
+		log.Println("Failed to get namespace config:", err)
+		return err
+	}
+	if cfg.ReplicationMode == cluster.ReplicationAsync {
+		// Already committed in the background by WALReplicationToWorkers
+		return nil
+	}
+
+	// Marshal the entry into JSON
+	bodyJson, err := json.Marshal(entry)
 	if err != nil {
 		log.Println("Failed to marshal body:", err)
 		return err
@@ -109,22 +296,65 @@ func (rm *ReplicationManager) CommitTxnToWorkers(opType string, key string, valu
 	}
 
 	// Send the Commit on the version to all followers
-
+	rm.expectAcks(workers, entry.Version)
+	successCount := int32(0)
+	var failed []string
 	for _, worker := range workers {
-		workerData, _, err := rm.ZkClient.Get("/workers" + worker)
-		if err != nil {
-			log.Println("Failed to get worker data:", err)
-			return err
+		if !rm.sendCommit(worker, bodyJson) {
+			failed = append(failed, worker)
+			continue
 		}
-		workerAddress := string(workerData)
-		resp, err := http.Post("http://"+workerAddress+"/commit/", "application/json", bytes.NewBuffer(bodyJson))
-		if err != nil {
-			log.Println("Failed to send replication request:", err)
-			return err
-		}
-		resp.Body.Close()
+		rm.ack(worker, entry.Version)
+		successCount++
+	}
+	if len(failed) > 0 {
+		go rm.retryCommit(failed, entry.Version, bodyJson)
 	}
 
+	writeQuorum := rm.ClusterManager.EffectiveWriteQuorum(cfg)
+	if successCount < writeQuorum {
+		return fmt.Errorf("failed to commit on enough workers: %d/%d", successCount, writeQuorum)
+	}
 	return nil
+}
 
+// retryCommit sends the commit phase again to the workers that did not confirm it.
+// A worker that still misses it holds AckedVersion back, it asks the leader for the entry when it restarts.
+func (rm *ReplicationManager) retryCommit(workers []string, version int, bodyJson []byte) {
+	for attempt := 1; attempt < commitAttempts && len(workers) > 0; attempt++ {
+		time.Sleep(commitRetryDelay)
+		var failed []string
+		for _, worker := range workers {
+			if !rm.sendCommit(worker, bodyJson) {
+				failed = append(failed, worker)
+				continue
+			}
+			rm.ack(worker, version)
+		}
+		workers = failed
+	}
+	if len(workers) > 0 {
+		log.Println("Workers did not commit WAL entry:", version, workers)
+	}
+}
+
+// sendCommit sends the commit phase to a worker and reports whether it confirmed it
+func (rm *ReplicationManager) sendCommit(worker string, bodyJson []byte) bool {
+	workerData, _, err := rm.ZkClient.Get("/workers/" + worker)
+	if err != nil {
+		log.Println("Failed to get worker data:", err)
+		return false
+	}
+	workerAddress := string(workerData)
+	resp, err := http.Post("http://"+workerAddress+"/commit/", "application/json", bytes.NewBuffer(bodyJson))
+	if err != nil {
+		log.Println("Failed to send commit request:", err)
+		return false
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Println("Worker rejected commit request:", workerAddress, resp.StatusCode)
+		return false
+	}
+	return true
 }
@@ -0,0 +1,128 @@
+package replication
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-zookeeper/zk"
+)
+
+// fakeZk registers a single worker
+type fakeZk struct {
+	address string
+}
+
+func (z *fakeZk) Children(path string) ([]string, *zk.Stat, error) {
+	return []string{"w1"}, &zk.Stat{}, nil
+}
+
+func (z *fakeZk) Get(path string) ([]byte, *zk.Stat, error) {
+	if path != "/workers/w1" {
+		return nil, nil, zk.ErrNoNode
+	}
+	return []byte(z.address), &zk.Stat{}, nil
+}
+
+func TestAsyncEntriesAreRetriedInOrder(t *testing.T) {
+	var mu sync.Mutex
+	var committed []string
+	prepares := 0
+	failures := 2
+	worker := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		body, _ := io.ReadAll(r.Body)
+		switch {
+		case r.URL.Path == "/commit/" && failures > 0:
+			// The worker is down for a while, the first entry has to wait for it
+			failures--
+			http.Error(rw, "unavailable", http.StatusServiceUnavailable)
+		case r.URL.Path == "/commit/":
+			committed = append(committed, string(body))
+			rw.WriteHeader(http.StatusOK)
+		default:
+			prepares++
+			rw.WriteHeader(http.StatusOK)
+		}
+	}))
+	defer worker.Close()
+
+	rm := NewReplicationManager(0, &fakeZk{address: strings.TrimPrefix(worker.URL, "http://")}, nil, nil)
+	rm.replicateAsync([]string{"w1"}, 0, []byte("first"))
+	rm.replicateAsync([]string{"w1"}, 1, []byte("second"))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if acked, _ := rm.AckedVersion(); acked == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("worker did not acknowledge both entries")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(committed) != 2 || committed[0] != "first" || committed[1] != "second" {
+		t.Fatalf("committed = %q; want first then second", committed)
+	}
+	// A retry only sends the commit again, the entry is already logged on the worker
+	if prepares != 2 {
+		t.Fatalf("worker got %d prepares; want 2", prepares)
+	}
+}
+
+func TestAckedVersionIsAContiguousPrefix(t *testing.T) {
+	rm := NewReplicationManager(0, &fakeZk{}, nil, nil)
+	expectAcked := func(want int) {
+		t.Helper()
+		if acked, err := rm.AckedVersion(); err != nil || acked != want {
+			t.Fatalf("AckedVersion = %d, %v; want %d", acked, err, want)
+		}
+	}
+
+	rm.expectAcks([]string{"w1"}, 1)
+	rm.ack("w1", 1)
+	expectAcked(1)
+
+	// 3 is confirmed before 2, 2 still holds the version back
+	rm.expectAcks([]string{"w1"}, 2)
+	rm.expectAcks([]string{"w1"}, 3)
+	rm.ack("w1", 3)
+	expectAcked(1)
+	rm.ack("w1", 2)
+	expectAcked(3)
+}
+
+func TestCommitIsRetriedForWorkersThatMissedIt(t *testing.T) {
+	var mu sync.Mutex
+	commits := 0
+	worker := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		commits++
+		if commits == 1 {
+			http.Error(rw, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer worker.Close()
+
+	rm := NewReplicationManager(0, &fakeZk{address: strings.TrimPrefix(worker.URL, "http://")}, nil, nil)
+	rm.expectAcks([]string{"w1"}, 0)
+	if rm.sendCommit("w1", []byte("entry")) {
+		t.Fatalf("first commit confirmed; want the worker to miss it")
+	}
+	rm.retryCommit([]string{"w1"}, 0, []byte("entry"))
+
+	if acked, _ := rm.AckedVersion(); acked != 0 {
+		t.Fatalf("AckedVersion = %d; want 0 once the retry is confirmed", acked)
+	}
+}
@@ -0,0 +1,125 @@
+package replication
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"kvstore/internal/cluster"
+	"kvstore/internal/wal"
+	"log"
+	"net/http"
+)
+
+var ErrNoLeader = errors.New("no leader registered")
+
+// OutcomeResponse is what a replica's WAL says about the entry of a version
+type OutcomeResponse struct {
+	Version int    `json:"version"`
+	Outcome string `json:"outcome"`
+}
+
+// AbortTxnToWorkers sends the abort phase of an entry that did not reach its write quorum.
+// It is best effort: a worker that misses it resolves the entry with the leader when it restarts.
+func (rm *ReplicationManager) AbortTxnToWorkers(entry wal.WAL) error {
+	cfg, err := rm.namespaceConfig(entry)
+	if err != nil {
+		log.Println("Failed to get namespace config:", err)
+		return err
+	}
+	if cfg.ReplicationMode == cluster.ReplicationAsync {
+		// Async entries are prepared and committed in one go, there is nothing to abort
+		return nil
+	}
+
+	bodyJson, err := json.Marshal(entry)
+	if err != nil {
+		log.Println("Failed to marshal body:", err)
+		return err
+	}
+
+	workers, _, err := rm.ZkClient.Children("/workers")
+	if err != nil {
+		log.Println("Failed to get workers:", err)
+		return err
+	}
+
+	var failed error
+	for _, worker := range workers {
+		workerData, _, err := rm.ZkClient.Get("/workers/" + worker)
+		if err != nil {
+			log.Println("Failed to get worker data:", err)
+			failed = err
+			continue
+		}
+		resp, err := http.Post("http://"+string(workerData)+"/abort/", "application/json", bytes.NewBuffer(bodyJson))
+		if err != nil {
+			log.Println("Failed to send abort request:", err)
+			failed = err
+			continue
+		}
+		resp.Body.Close()
+	}
+	return failed
+}
+
+// LeaderAddress returns the address the leader registered under /master
+func (rm *ReplicationManager) LeaderAddress() (string, error) {
+	masters, _, err := rm.ZkClient.Children("/master")
+	if err != nil {
+		log.Println("Failed to get master:", err)
+		return "", err
+	}
+	for _, master := range masters {
+		data, _, err := rm.ZkClient.Get("/master/" + master)
+		if err != nil {
+			log.Println("Failed to get master data:", err)
+			return "", err
+		}
+		if len(data) > 0 {
+			return string(data), nil
+		}
+	}
+	return "", ErrNoLeader
+}
+
+// WorkerAddresses returns the addresses of the workers other than this node
+func (rm *ReplicationManager) WorkerAddresses() ([]string, error) {
+	workers, _, err := rm.ZkClient.Children("/workers")
+	if err != nil {
+		log.Println("Failed to get workers:", err)
+		return nil, err
+	}
+	self := fmt.Sprintf("localhost:%d", rm.KvPort)
+	var addresses []string
+	for _, worker := range workers {
+		workerData, _, err := rm.ZkClient.Get("/workers/" + worker)
+		if err != nil {
+			log.Println("Failed to get worker data:", err)
+			return nil, err
+		}
+		if address := string(workerData); address != self {
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses, nil
+}
+
+// QueryOutcome asks the replica at address what happened to the entry of a version
+func (rm *ReplicationManager) QueryOutcome(address string, version int) (string, error) {
+	resp, err := http.Get(fmt.Sprintf("http://%s/outcome/%d", address, version))
+	if err != nil {
+		log.Println("Failed to send outcome request:", err)
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var body OutcomeResponse
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("outcome request to %s failed with status %d", address, resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	return body.Outcome, nil
+}
@@ -0,0 +1,88 @@
+package replication
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// ReadResult is a key as seen by a single replica
+type ReadResult struct {
+	Key         string `json:"key"`
+	Found       bool   `json:"found"`
+	Value       []byte `json:"value"`
+	ContentType string `json:"content_type,omitempty"`
+	Version     int    `json:"version"`
+}
+
+type PeerReadBody struct {
+	Keys []string `json:"keys"`
+}
+
+// ReadFromWorkers asks the other workers for their copy of the keys.
+// It returns as soon as needed workers have answered, or an error if not enough of them could.
+func (rm *ReplicationManager) ReadFromWorkers(keys []string, needed int32) ([][]ReadResult, error) {
+	if needed <= 0 {
+		return nil, nil
+	}
+
+	bodyJson, err := json.Marshal(PeerReadBody{Keys: keys})
+	if err != nil {
+		log.Println("Failed to marshal body:", err)
+		return nil, err
+	}
+
+	workers, _, err := rm.ZkClient.Children("/workers")
+	if err != nil {
+		log.Println("Failed to get workers:", err)
+		return nil, err
+	}
+
+	self := fmt.Sprintf("localhost:%d", rm.KvPort)
+	responses := make(chan []ReadResult, len(workers))
+	for _, worker := range workers {
+		go func(worker string) {
+			workerData, _, err := rm.ZkClient.Get("/workers/" + worker)
+			if err != nil {
+				log.Println("Failed to get worker data:", err)
+				responses <- nil
+				return
+			}
+			workerAddress := string(workerData)
+			if workerAddress == self {
+				responses <- nil
+				return
+			}
+			resp, err := http.Post("http://"+workerAddress+"/api/v1/internal/read", "application/json", bytes.NewBuffer(bodyJson))
+			if err != nil {
+				log.Println("Failed to send read request:", err)
+				responses <- nil
+				return
+			}
+			defer resp.Body.Close()
+
+			var results []ReadResult
+			if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&results) != nil || len(results) != len(keys) {
+				log.Println("Invalid read response from worker:", workerAddress)
+				responses <- nil
+				return
+			}
+			responses <- results
+		}(worker)
+	}
+
+	var collected [][]ReadResult
+	for range workers {
+		results := <-responses
+		if results == nil {
+			continue
+		}
+		collected = append(collected, results)
+		if int32(len(collected)) >= needed {
+			return collected, nil
+		}
+	}
+	return nil, fmt.Errorf("failed to read from enough workers: %d/%d", len(collected), needed)
+}
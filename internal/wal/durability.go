@@ -0,0 +1,139 @@
+package wal
+
+import (
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Durability decides when an appended entry is fsynced, and so whether an acknowledged write survives a crash
+const (
+	// Every write is fsynced before it is acknowledged
+	DurabilityFsync = "fsync"
+	// Concurrent writes wait for a shared fsync, one fsync covers every write that came in while the previous one ran
+	DurabilityGroup = "group"
+	// Writes are acknowledged right away and fsynced by a background ticker, a crash loses the last interval
+	DurabilityInterval = "interval"
+)
+
+func ValidDurability(durability string) bool {
+	return durability == DurabilityFsync || durability == DurabilityGroup || durability == DurabilityInterval
+}
+
+// groupCommit tracks which writes are durable, writes are numbered in the order they were appended
+type groupCommit struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	// synced is the number of the last write known to be on disk
+	synced uint64
+	// syncing is set while a writer runs the fsync for the group
+	syncing bool
+	// syncs counts the fsyncs, it shows how well writes are batched
+	syncs uint64
+}
+
+func newGroupCommit() *groupCommit {
+	g := &groupCommit{}
+	g.cond = sync.NewCond(&g.mu)
+	return g
+}
+
+func (g *groupCommit) markSynced(seq uint64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.synced = max(g.synced, seq)
+	g.syncs++
+	g.cond.Broadcast()
+}
+
+// durability returns the durability of the namespace an entry belongs to
+func (wm *WALManager) durability(namespace string) string {
+	if wm.NamespaceDurability != nil {
+		if durability := wm.NamespaceDurability(namespace); durability != "" {
+			return durability
+		}
+	}
+	return wm.Durability
+}
+
+// syncActive fsyncs the active segment, every frame written before the call is durable once it returns
+func (wm *WALManager) syncActive() error {
+	wm.AppendMutex.Lock()
+	seq, file := wm.written, wm.active
+	wm.AppendMutex.Unlock()
+
+	wm.group.mu.Lock()
+	synced := wm.group.synced
+	wm.group.mu.Unlock()
+	if file == nil || seq <= synced {
+		return nil
+	}
+
+	err := file.Sync()
+	if errors.Is(err, os.ErrClosed) {
+		// The segment was rotated in the meantime, rotation fsyncs it before closing it
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	wm.group.markSynced(seq)
+	return nil
+}
+
+// waitSynced returns once write seq is on disk. The first writer to get here runs the fsync,
+// the ones arriving while it runs are covered by the next one.
+func (wm *WALManager) waitSynced(seq uint64) error {
+	g := wm.group
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for g.synced < seq {
+		if g.syncing {
+			g.cond.Wait()
+			continue
+		}
+		g.syncing = true
+		g.mu.Unlock()
+		err := wm.syncActive()
+		g.mu.Lock()
+		g.syncing = false
+		g.cond.Broadcast()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StartIntervalSync periodically fsyncs the writes of the interval durability
+func (wm *WALManager) StartIntervalSync(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := wm.syncActive(); err != nil {
+				log.Println("Failed to sync WAL file:", err)
+			}
+		}
+	}()
+}
+
+// Close fsyncs and closes the active segment
+func (wm *WALManager) Close() error {
+	wm.AppendMutex.Lock()
+	defer wm.AppendMutex.Unlock()
+	if wm.active == nil {
+		return nil
+	}
+	err := wm.active.Sync()
+	if closeErr := wm.active.Close(); err == nil {
+		err = closeErr
+	}
+	wm.active = nil
+	if err == nil {
+		wm.group.markSynced(wm.written)
+	}
+	return err
+}
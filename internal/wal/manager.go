@@ -5,49 +5,188 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/go-zookeeper/zk"
 )
 
+// zkClient is the part of the Zookeeper client the WAL uses, *zk.Conn implements it
+type zkClient interface {
+	Get(path string) ([]byte, *zk.Stat, error)
+}
+
 type WALManager struct {
-	KvPort            int        `json:"kv_port"`
-	ZkClient          *zk.Conn   `json:"zk_client"`
+	KvPort   int      `json:"kv_port"`
+	ZkClient zkClient `json:"zk_client"`
+	// Dir holds the segments, each one is named by the version of its first entry
+	Dir               string     `json:"dir"`
+	SegmentSize       int64      `json:"segment_size"`
 	WriteVersion      int        `json:"write_version"`
 	WriteVersionMutex sync.Mutex `json:"write_version_mutex"`
+	// Durability is the node's durability, NamespaceDurability may override it for a namespace
+	Durability          string                        `json:"durability"`
+	NamespaceDurability func(namespace string) string `json:"-"`
+	// AppendMutex guards the segment index and the active segment and keeps frames from interleaving
+	AppendMutex sync.Mutex `json:"append_mutex"`
+	segments    []segment
+	// active is the open file of the last segment
+	active *os.File
+	// written is the number of frames appended since the start
+	written uint64
+	group   *groupCommit
+	// compactedBefore is the oldest version the retention may not have deleted
+	compactedBefore int
+	// outcomeMutex guards undecided and decided
+	outcomeMutex sync.Mutex
+	// undecided are the versions prepared and neither committed nor aborted yet, they hold back the applied low-water mark
+	undecided map[int]bool
+	// decided is the outcome of every version in the log, so that Outcome does not have to read the segments
+	decided map[int]string
+	// versionLocks are striped over the versions, see LockVersion
+	versionLocks [versionLockStripes]sync.Mutex
 }
 
-func NewWALManager(kv_port int, zkClient *zk.Conn) *WALManager {
-	return &WALManager{
-		KvPort:       kv_port,
-		ZkClient:     zkClient,
-		WriteVersion: readLatestSuccessfulWriteVersionFromWAL(kv_port),
+const versionLockStripes = 64
+
+func NewWALManager(kv_port int, zkClient zkClient, dir string, segmentSize int64, durability string) *WALManager {
+	if dir == "" {
+		dir = fmt.Sprintf("wal_%d", kv_port)
+	}
+	if segmentSize <= 0 {
+		segmentSize = DefaultSegmentSize
+	}
+	if durability == "" {
+		durability = DurabilityGroup
+	}
+	// Move an older single file log into the directory and cut a torn tail before the latest version is read
+	segments, err := openSegments(dir, legacyLogPath(kv_port))
+	if err != nil {
+		log.Println("Failed to recover WAL segments:", err)
 	}
+	wm := &WALManager{
+		KvPort:      kv_port,
+		ZkClient:    zkClient,
+		Dir:         dir,
+		SegmentSize: segmentSize,
+		Durability:  durability,
+		// The next entry follows the last logged one, an empty log starts at 0
+		WriteVersion: latestSegmentVersion(segments) + 1,
+		segments:     segments,
+		group:        newGroupCommit(),
+		undecided:    make(map[int]bool),
+		decided:      make(map[int]string),
+	}
+	if len(segments) > 0 {
+		wm.compactedBefore = segments[0].Start
+	}
+	// The entries left in doubt by a crash stay undecided until they are resolved
+	_, outcomes, err := wm.outcomes(wm.compactedBefore)
+	if err != nil {
+		log.Println("Failed to read WAL outcomes:", err)
+	}
+	for version, outcome := range outcomes {
+		wm.decided[version] = outcome
+		if outcome == OutcomePending {
+			wm.undecided[version] = true
+		}
+	}
+	return wm
 }
 
 type WAL struct {
-	Version       int    `json:"version"`
-	Type          string `json:"type"`
-	Key           string `json:"key"`
-	Value         string `json:"value"`
-	SuccessMarker bool   `json:"success_marker"`
+	Version int    `json:"version"`
+	Type    string `json:"type"`
+	// Namespace decides the quorum and replication mode the entry is replicated with
+	Namespace string `json:"namespace,omitempty"`
+	Key       string `json:"key"`
+	// Value is raw bytes, it is base64 encoded in the record payload and on the wire
+	Value       []byte `json:"value"`
+	ContentType string `json:"content_type,omitempty"`
+	// TTL is in seconds, 0 means the key never expires
+	TTL int64 `json:"ttl,omitempty"`
+	// Delta is what an INCRBY entry adds to the counter, INCR and DECR always add 1 and -1
+	Delta int64 `json:"delta,omitempty"`
+	// Items are the arguments of the hash, list, set and sorted set entries
+	Items []Item `json:"items,omitempty"`
+	// Count is how many elements LPOP and RPOP remove
+	Count int `json:"count,omitempty"`
+	// Timestamp is the leader's clock (unix nanoseconds) when the entry was created.
+	// Expiry is computed from it so that followers do not depend on their local clocks.
+	Timestamp int64 `json:"timestamp"`
+	// Ops holds the mutations of a TXN entry, they all share the entry's version
+	Ops []Op `json:"ops,omitempty"`
 }
 
-func (wm *WALManager) WALWriter(wal WAL) (int, error) {
-	// Open the WAL file for appending
-	file, err := os.OpenFile(fmt.Sprintf("wal_%d.log", wm.KvPort), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		log.Println("Failed to open WAL file:", err)
-		return -1, err
+// Op is a single PUT or DELETE inside a TXN entry
+type Op struct {
+	Type        string `json:"type"`
+	Key         string `json:"key"`
+	Value       []byte `json:"value,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	// TTL in seconds, 0 means the key never expires
+	TTL int64 `json:"ttl,omitempty"`
+}
+
+// Item is a hash field, list element, set member or sorted set member of a data type entry
+type Item struct {
+	Member string `json:"member"`
+	// Value is the value of a hash field
+	Value string `json:"value,omitempty"`
+	// Score is the score of a sorted set member
+	Score float64 `json:"score,omitempty"`
+}
+
+// ExpiresAt returns the absolute expiry deadline of the entry,
+// or the zero time if the entry has no TTL.
+func (w WAL) ExpiresAt() time.Time {
+	return w.expiresAfter(w.TTL)
+}
+
+// OpExpiresAt returns the expiry deadline of an op of a TXN entry
+func (w WAL) OpExpiresAt(op Op) time.Time {
+	return w.expiresAfter(op.TTL)
+}
+
+func (w WAL) expiresAfter(ttl int64) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
 	}
-	defer file.Close()
+	return time.Unix(0, w.Timestamp).Add(time.Duration(ttl) * time.Second)
+}
 
-	// Increment the write version
+func (wm *WALManager) WALWriter(wal WAL) (int, error) {
+	// Increment the write version. The version is undecided from the moment it is handed out,
+	// so that no later version can be applied with this one unaccounted for.
 	wm.WriteVersionMutex.Lock()
 	wal.Version = wm.WriteVersion
 	wm.WriteVersion++
+	wm.setUndecided(wal.Version, true)
+	wm.WriteVersionMutex.Unlock()
+
+	return wm.appendEntry(wal)
+}
+
+// ReplicaWALWriter appends an entry prepared by the leader.
+// It keeps the leader's version so that the log of every replica numbers entries the same way.
+func (wm *WALManager) ReplicaWALWriter(wal WAL) (int, error) {
+	wm.WriteVersionMutex.Lock()
+	wm.WriteVersion = max(wm.WriteVersion, wal.Version+1)
+	wm.setUndecided(wal.Version, true)
 	wm.WriteVersionMutex.Unlock()
 
+	return wm.appendEntry(wal)
+}
+
+func (wm *WALManager) appendEntry(wal WAL) (version int, err error) {
+	defer func() {
+		if err != nil {
+			// The entry is not in the log, nothing will ever commit it
+			wm.setUndecided(wal.Version, false)
+		}
+	}()
+
 	// Check for conflicts
 	conflictDetected, err := wm.isConflictDetected()
 	if err != nil {
@@ -60,55 +199,216 @@ func (wm *WALManager) WALWriter(wal WAL) (int, error) {
 		return -1, fmt.Errorf("conflict detected: WAL entry not written")
 	}
 
-	// Write the WAL entry to the file
-	err = json.NewEncoder(file).Encode(wal)
-	if err != nil {
+	// Write the WAL entry to the active segment as a single frame
+	if err := wm.writeEntry(wal); err != nil {
 		log.Println("Failed to write to WAL file:", err)
 		return -1, err
 	}
 	return wal.Version, nil
 }
 
-func (wm *WALManager) isConflictDetected() (bool, error) {
-	latestVersion := readLatestSuccessfulWriteVersionFromWAL(wm.KvPort)
-	latestSuccessfulVersion, err := readLastestSuccessfulWriteVersionFromZK(wm.ZkClient)
+// Outcomes of a prepared entry
+const (
+	OutcomeCommitted = "committed"
+	OutcomeAborted   = "aborted"
+	// The entry is prepared and neither committed nor aborted yet
+	OutcomePending = "pending"
+	// The entry is not in the log
+	OutcomeUnknown = "unknown"
+)
+
+// MarkCommitted logs that an entry was committed, only committed entries are replayed after a restart
+func (wm *WALManager) MarkCommitted(entry WAL) error {
+	return wm.mark(recordCommit, entry)
+}
+
+// MarkAborted logs that an entry was aborted, it is never applied
+func (wm *WALManager) MarkAborted(entry WAL) error {
+	return wm.mark(recordAbort, entry)
+}
+
+// mark logs a commit or abort record, it is as durable as the entry's namespace asks for
+func (wm *WALManager) mark(recordType byte, entry WAL) error {
+	frame := appendFrame(nil, record{Type: recordType, Version: entry.Version})
+	if err := wm.writeFrame(frame, entry.Version, entry.Namespace); err != nil {
+		log.Println("Failed to write commit or abort to WAL file:", err)
+		return err
+	}
+	outcome := OutcomeCommitted
+	if recordType == recordAbort {
+		outcome = OutcomeAborted
+	}
+	wm.outcomeMutex.Lock()
+	defer wm.outcomeMutex.Unlock()
+
+	wm.decided[entry.Version] = outcome
+	delete(wm.undecided, entry.Version)
+	return nil
+}
+
+func (wm *WALManager) setUndecided(version int, undecided bool) {
+	wm.outcomeMutex.Lock()
+	defer wm.outcomeMutex.Unlock()
+
+	if undecided {
+		wm.undecided[version] = true
+	} else {
+		delete(wm.undecided, version)
+	}
+}
+
+// prepared records that the entry of version is in the log.
+// A prepare received again after the entry was committed or aborted does not reopen it.
+func (wm *WALManager) prepared(version int) {
+	wm.outcomeMutex.Lock()
+	defer wm.outcomeMutex.Unlock()
+
+	if outcome, ok := wm.decided[version]; ok && outcome != OutcomePending {
+		delete(wm.undecided, version)
+		return
+	}
+	wm.decided[version] = OutcomePending
+}
+
+// LockVersion holds the lock of a version until the returned function is called.
+// Deciding an entry and applying it happen under it, so a retried commit sees the entry applied and not only committed.
+func (wm *WALManager) LockVersion(version int) func() {
+	stripe := &wm.versionLocks[uint(version)%versionLockStripes]
+	stripe.Lock()
+	return stripe.Unlock
+}
+
+// OldestUndecided returns the oldest version that was prepared and is neither committed nor aborted yet
+func (wm *WALManager) OldestUndecided() (int, bool) {
+	wm.outcomeMutex.Lock()
+	defer wm.outcomeMutex.Unlock()
+
+	oldest, ok := 0, false
+	for version := range wm.undecided {
+		if !ok || version < oldest {
+			oldest, ok = version, true
+		}
+	}
+	return oldest, ok
+}
+
+// outcomes returns the prepared entries from a version on, in log order, with the outcome of every version
+func (wm *WALManager) outcomes(from int) ([]record, map[int]string, error) {
+	records, err := wm.recordsFrom(from)
 	if err != nil {
-		log.Println("Failed to get latest successful write version from Zookeeper:", err)
-		return false, err
+		return nil, nil, err
 	}
-	if latestSuccessfulVersion != latestVersion {
-		// Conflict detected
-		log.Println("Conflict detected: latest successful version from Zookeeper does not match WAL version")
-		return true, nil
+
+	var prepared []record
+	outcomes := make(map[int]string)
+	for _, r := range records {
+		if r.Version < from {
+			continue
+		}
+		switch r.Type {
+		case recordEntry:
+			prepared = append(prepared, r)
+			if _, ok := outcomes[r.Version]; !ok {
+				outcomes[r.Version] = OutcomePending
+			}
+		case recordCommit:
+			outcomes[r.Version] = OutcomeCommitted
+		case recordAbort:
+			outcomes[r.Version] = OutcomeAborted
+		}
 	}
-	return false, nil
+	return prepared, outcomes, nil
 }
 
-func readLatestSuccessfulWriteVersionFromWAL(KvPort int) int {
-	// Open the WAL file for reading
-	file, err := os.Open(fmt.Sprintf("wal_%d.log", KvPort))
+// Outcome returns what happened to the entry of a version according to this log.
+// It fails with ErrCompacted when the entry was deleted by the retention.
+func (wm *WALManager) Outcome(version int) (string, error) {
+	if oldest := wm.OldestVersion(); version < oldest {
+		return "", fmt.Errorf("%w: version %d is older than %d", ErrCompacted, version, oldest)
+	}
+	wm.outcomeMutex.Lock()
+	defer wm.outcomeMutex.Unlock()
+
+	if outcome, ok := wm.decided[version]; ok {
+		return outcome, nil
+	}
+	return OutcomeUnknown, nil
+}
+
+// ReadEntries returns the entries of the log with a version of at least from, in log order.
+// It fails with ErrCompacted when some of them were deleted by the retention.
+func (wm *WALManager) ReadEntries(from int) ([]WAL, error) {
+	records, err := wm.recordsFrom(from)
 	if err != nil {
-		log.Println("Failed to open WAL file:", err)
-		return 0
+		return nil, err
 	}
-	defer file.Close()
 
-	var latestVersion int
-	var wal WAL
+	var entries []WAL
+	for _, r := range records {
+		if r.Type != recordEntry || r.Version < from {
+			continue
+		}
+		entry, err := decodeEntry(r)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// CommittedEntries returns the committed entries with a version of at least from, in version order.
+// Entries that were aborted or are still in doubt are left out.
+func (wm *WALManager) CommittedEntries(from int) ([]WAL, error) {
+	return wm.entriesWithOutcome(from, OutcomeCommitted)
+}
 
-	// Read the WAL entries from the file
-	for {
-		err = json.NewDecoder(file).Decode(&wal)
+// InDoubtEntries returns the entries with a version of at least from that were prepared
+// but neither committed nor aborted, in version order
+func (wm *WALManager) InDoubtEntries(from int) ([]WAL, error) {
+	return wm.entriesWithOutcome(from, OutcomePending)
+}
+
+func (wm *WALManager) entriesWithOutcome(from int, outcome string) ([]WAL, error) {
+	prepared, outcomes, err := wm.outcomes(from)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []WAL
+	for _, r := range prepared {
+		if outcomes[r.Version] != outcome {
+			continue
+		}
+		entry, err := decodeEntry(r)
 		if err != nil {
-			break
+			return nil, err
 		}
-		//TODO: This should only happen if there is a success marker
-		latestVersion = wal.Version
+		entries = append(entries, entry)
 	}
-	return latestVersion
+	// Followers may log entries slightly out of order
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Version < entries[j].Version
+	})
+	return entries, nil
+}
+
+func (wm *WALManager) isConflictDetected() (bool, error) {
+	latestVersion := wm.latestVersion()
+	latestSuccessfulVersion, err := readLastestSuccessfulWriteVersionFromZK(wm.ZkClient)
+	if err != nil {
+		log.Println("Failed to get latest successful write version from Zookeeper:", err)
+		return false, err
+	}
+	if latestSuccessfulVersion != latestVersion {
+		// Conflict detected
+		log.Println("Conflict detected: latest successful version from Zookeeper does not match WAL version")
+		return true, nil
+	}
+	return false, nil
 }
 
-func readLastestSuccessfulWriteVersionFromZK(ZkClient *zk.Conn) (int, error) {
+func readLastestSuccessfulWriteVersionFromZK(ZkClient zkClient) (int, error) {
 	path := "/version"
 	var latestVersion int
 	// Get the latest successful write version from Zookeeper
@@ -0,0 +1,264 @@
+package wal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"os"
+)
+
+// A WAL file starts with walMagic, followed by records framed as
+// length (4 bytes), CRC32C (4 bytes), type (1 byte), version (8 bytes) and the payload.
+// length is the payload length, the checksum covers the type, the version and the payload.
+const (
+	recordHeaderSize = 4 + 4 + 1 + 8
+	// maxRecordSize bounds the payload so that a corrupt length is never trusted
+	maxRecordSize = 64 << 20
+)
+
+// Record types
+const (
+	// recordEntry holds a JSON encoded WAL entry
+	recordEntry byte = 1
+	// recordCommit marks the entry of its version as committed, it has no payload
+	recordCommit byte = 2
+	// recordAbort marks the entry of its version as aborted, it has no payload
+	recordAbort byte = 3
+)
+
+var walMagic = []byte("KVWAL\x00\x00\x01")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var ErrCorruptWAL = errors.New("corrupt WAL record")
+
+type record struct {
+	Type    byte
+	Version int
+	Payload []byte
+}
+
+// appendFrame encodes a single record to the end of buf
+func appendFrame(buf []byte, r record) []byte {
+	var header [recordHeaderSize]byte
+	binary.LittleEndian.PutUint32(header[0:], uint32(len(r.Payload)))
+	header[8] = r.Type
+	binary.LittleEndian.PutUint64(header[9:], uint64(r.Version))
+
+	checksum := crc32.Update(0, crcTable, header[8:])
+	checksum = crc32.Update(checksum, crcTable, r.Payload)
+	binary.LittleEndian.PutUint32(header[4:], checksum)
+
+	buf = append(buf, header[:]...)
+	return append(buf, r.Payload...)
+}
+
+// encodeEntry frames a WAL entry as a recordEntry
+func encodeEntry(entry WAL) ([]byte, error) {
+	payload, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+	return appendFrame(nil, record{Type: recordEntry, Version: entry.Version, Payload: payload}), nil
+}
+
+// decodeRecords decodes the records that follow the magic header.
+// It stops at a partial record at the tail, which is a write still in progress or torn by a crash,
+// and fails with ErrCorruptWAL when a record does not match its checksum.
+// valid is the length of data that holds complete and intact records.
+func decodeRecords(data []byte) (records []record, valid int, err error) {
+	if !bytes.HasPrefix(data, walMagic) {
+		if len(data) < len(walMagic) && bytes.HasPrefix(walMagic, data) {
+			return nil, 0, nil
+		}
+		return nil, 0, fmt.Errorf("%w: missing header", ErrCorruptWAL)
+	}
+
+	offset := len(walMagic)
+	for offset < len(data) {
+		if len(data)-offset < recordHeaderSize {
+			break
+		}
+		header := data[offset : offset+recordHeaderSize]
+		length := int(binary.LittleEndian.Uint32(header[0:]))
+		if length > maxRecordSize {
+			return records, offset, fmt.Errorf("%w: record at offset %d is too large", ErrCorruptWAL, offset)
+		}
+		if len(data)-offset-recordHeaderSize < length {
+			break
+		}
+		payload := data[offset+recordHeaderSize : offset+recordHeaderSize+length]
+
+		checksum := crc32.Update(0, crcTable, header[8:])
+		checksum = crc32.Update(checksum, crcTable, payload)
+		if checksum != binary.LittleEndian.Uint32(header[4:]) {
+			return records, offset, fmt.Errorf("%w: checksum mismatch at offset %d", ErrCorruptWAL, offset)
+		}
+
+		records = append(records, record{
+			Type:    header[8],
+			Version: int(binary.LittleEndian.Uint64(header[9:])),
+			Payload: payload,
+		})
+		offset += recordHeaderSize + length
+	}
+	return records, offset, nil
+}
+
+// decodeEntry decodes the WAL entry of a recordEntry
+func decodeEntry(r record) (WAL, error) {
+	var entry WAL
+	if err := json.Unmarshal(r.Payload, &entry); err != nil {
+		return entry, fmt.Errorf("%w: %v", ErrCorruptWAL, err)
+	}
+	entry.Version = r.Version
+	return entry, nil
+}
+
+// readLog reads every record of the WAL file at path, a missing file has no records
+func readLog(path string) ([]record, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	records, _, err := decodeRecords(data)
+	return records, err
+}
+
+// recoverLog prepares the WAL file at path for appending.
+// JSON logs written by older versions are migrated first, then the log is truncated
+// after the last intact record: a torn or corrupt record is the result of a crash mid-write.
+func recoverLog(path string) error {
+	if err := migrateJSONLog(path); err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return os.WriteFile(path, walMagic, 0644)
+	}
+	if err != nil {
+		return err
+	}
+	if len(data) < len(walMagic) {
+		// Only a part of the header made it to disk, nothing was ever logged
+		return os.WriteFile(path, walMagic, 0644)
+	}
+
+	_, valid, err := decodeRecords(data)
+	if err != nil {
+		log.Println("Corrupt WAL record:", err)
+	}
+	if valid < len(walMagic) {
+		// Not a WAL file at all, it is kept aside instead of being truncated to nothing
+		log.Printf("WAL file %s does not start with a WAL header, moving it to %s.corrupt", path, path)
+		if err := os.Rename(path, path+".corrupt"); err != nil {
+			return err
+		}
+		return os.WriteFile(path, walMagic, 0644)
+	}
+	if valid < len(data) {
+		log.Printf("Truncating WAL file %s at offset %d of %d", path, valid, len(data))
+		return os.Truncate(path, int64(valid))
+	}
+	return nil
+}
+
+// legacyEntry is a line of the JSON log, its value is the plain string the client sent.
+// The Value field shadows the base64 encoded one of WAL.
+type legacyEntry struct {
+	WAL
+	Value string `json:"value"`
+}
+
+// migrateJSONLog rewrites a newline delimited JSON log in the binary format.
+// The JSON log is kept next to it with a .json suffix.
+func migrateJSONLog(path string) error {
+	legacyPath := path + ".json"
+	data, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		// A crash between the two renames below leaves only the JSON log
+		data, err = os.ReadFile(legacyPath)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	case !isJSONLog(data):
+		return nil
+	default:
+		if err := os.Rename(path, legacyPath); err != nil {
+			return err
+		}
+	}
+
+	buf := append([]byte(nil), walMagic...)
+	count := 0
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var legacy legacyEntry
+		if err := json.Unmarshal(line, &legacy); err != nil {
+			// Typically a torn line at the tail, the lines around it are still migrated
+			log.Printf("Skipping a corrupt entry of the JSON WAL %s: %v", legacyPath, err)
+			continue
+		}
+		entry := legacy.WAL
+		if legacy.Value != "" {
+			entry.Value = []byte(legacy.Value)
+		}
+		frame, err := encodeEntry(entry)
+		if err != nil {
+			return err
+		}
+		buf = append(buf, frame...)
+		count++
+	}
+
+	tmpPath := path + ".tmp"
+	if err := writeFileSync(tmpPath, buf); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	log.Printf("Migrated %d entries from the JSON WAL %s", count, legacyPath)
+	return nil
+}
+
+// isJSONLog reports whether data is a log written before the binary format, those start with a JSON object
+func isJSONLog(data []byte) bool {
+	if bytes.HasPrefix(data, walMagic) {
+		return false
+	}
+	trimmed := bytes.TrimLeft(data, " \t\r\n")
+	return len(trimmed) > 0 && trimmed[0] == '{'
+}
+
+func writeFileSync(path string, data []byte) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,133 @@
+package wal
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeLog(t *testing.T, path string, entries ...WAL) []byte {
+	t.Helper()
+	data := append([]byte(nil), walMagic...)
+	for _, entry := range entries {
+		frame, err := encodeEntry(entry)
+		if err != nil {
+			t.Fatalf("encodeEntry failed: %v", err)
+		}
+		data = append(data, frame...)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	return data
+}
+
+func readEntries(t *testing.T, path string) []WAL {
+	t.Helper()
+	records, err := readLog(path)
+	if err != nil {
+		t.Fatalf("readLog failed: %v", err)
+	}
+	entries := make([]WAL, len(records))
+	for i, r := range records {
+		if entries[i], err = decodeEntry(r); err != nil {
+			t.Fatalf("decodeEntry failed: %v", err)
+		}
+	}
+	return entries
+}
+
+func TestRecordRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.log")
+	entries := []WAL{
+		{Version: 0, Type: "PUT", Key: "a", Value: []byte{0, 1, 2}, ContentType: "application/octet-stream", Timestamp: 1},
+		{Version: 1, Type: "TXN", Ops: []Op{{Type: "DELETE", Key: "a"}, {Type: "PUT", Key: "b", Value: []byte("2")}}},
+	}
+	writeLog(t, path, entries...)
+
+	if got := readEntries(t, path); !reflect.DeepEqual(got, entries) {
+		t.Fatalf("entries = %+v; want %+v", got, entries)
+	}
+}
+
+func TestRecoverLogTruncatesTornTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.log")
+	data := writeLog(t, path, WAL{Version: 0, Type: "PUT", Key: "a"}, WAL{Version: 1, Type: "PUT", Key: "b"})
+	intact := len(data)
+
+	// Half of a third frame made it to disk before the crash
+	frame, _ := encodeEntry(WAL{Version: 2, Type: "PUT", Key: "c"})
+	os.WriteFile(path, append(data, frame[:len(frame)/2]...), 0644)
+
+	// Readers skip the partial frame, it may still be being written
+	if got := readEntries(t, path); len(got) != 2 {
+		t.Fatalf("read %d entries; want 2", len(got))
+	}
+	if err := recoverLog(path); err != nil {
+		t.Fatalf("recoverLog failed: %v", err)
+	}
+	if info, _ := os.Stat(path); info.Size() != int64(intact) {
+		t.Fatalf("log size after recovery = %d; want %d", info.Size(), intact)
+	}
+}
+
+func TestCorruptRecordIsDetected(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.log")
+	data := writeLog(t, path, WAL{Version: 0, Type: "PUT", Key: "a", Value: []byte("1")}, WAL{Version: 1, Type: "PUT", Key: "b"})
+
+	// Flip a bit in the payload of the first frame
+	data[len(walMagic)+recordHeaderSize+2] ^= 1
+	os.WriteFile(path, data, 0644)
+
+	if _, err := readLog(path); !errors.Is(err, ErrCorruptWAL) {
+		t.Fatalf("readLog = %v; want ErrCorruptWAL", err)
+	}
+
+	// Recovery keeps everything before the corrupt frame
+	if err := recoverLog(path); err != nil {
+		t.Fatalf("recoverLog failed: %v", err)
+	}
+	if got := readEntries(t, path); len(got) != 0 {
+		t.Fatalf("read %d entries after recovery; want 0", len(got))
+	}
+}
+
+func TestMigrateJSONLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.log")
+	// Lines as the JSON log wrote them, values are the plain strings the clients sent
+	lines := `{"version":0,"type":"PUT","key":"a","value":"hello","success_marker":false}
+{"version":1,"type":"PUT","key":"b","value":"aGVsbG8=","success_marker":false}
+{"version":2,"type":"DELETE","key":"a","value":"","success_marker":false}
+` +
+		// A torn line from a crash mid-write
+		`{"version":3,"type":"PU`
+	if err := os.WriteFile(path, []byte(lines), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	entries := []WAL{
+		{Version: 0, Type: "PUT", Key: "a", Value: []byte("hello")},
+		// A value that happens to be valid base64 is kept as it was sent
+		{Version: 1, Type: "PUT", Key: "b", Value: []byte("aGVsbG8=")},
+		{Version: 2, Type: "DELETE", Key: "a"},
+	}
+
+	if err := recoverLog(path); err != nil {
+		t.Fatalf("recoverLog failed: %v", err)
+	}
+	if got := readEntries(t, path); !reflect.DeepEqual(got, entries) {
+		t.Fatalf("migrated entries = %+v; want %+v", got, entries)
+	}
+	if _, err := os.Stat(path + ".json"); err != nil {
+		t.Fatalf("JSON log was not kept: %v", err)
+	}
+
+	// Migrating twice is a no-op
+	if err := recoverLog(path); err != nil {
+		t.Fatalf("second recoverLog failed: %v", err)
+	}
+	if got := readEntries(t, path); !reflect.DeepEqual(got, entries) {
+		t.Fatalf("entries after second recovery = %+v; want %+v", got, entries)
+	}
+}
@@ -0,0 +1,343 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultSegmentSize is the size a segment is rotated at
+const DefaultSegmentSize = 64 << 20
+
+const segmentSuffix = ".wal"
+
+// ErrCompacted is returned when the entries asked for were in segments deleted by the retention
+var ErrCompacted = errors.New("WAL entries were deleted by the retention")
+
+// segment is a WAL file holding the entries from its start version on.
+// Followers may log entries slightly out of order, so Last is the highest version in it rather than the last one.
+type segment struct {
+	Start int
+	// Last is -1 while the segment is empty
+	Last int
+	Size int64
+	Path string
+}
+
+func segmentName(start int) string {
+	return fmt.Sprintf("%020d%s", start, segmentSuffix)
+}
+
+// legacyLogPath is the single file WAL of older versions, it lives in the working directory
+func legacyLogPath(kvPort int) string {
+	return fmt.Sprintf("wal_%d.log", kvPort)
+}
+
+// openSegments builds the segment index of dir.
+// A single file WAL left by an older version becomes the first segment, and a torn tail
+// is cut from the last segment, the only one that was being written to.
+func openSegments(dir string, legacyPath string) ([]segment, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	segments, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(segments) == 0 {
+		if err := adoptLegacyLog(dir, legacyPath); err != nil {
+			return nil, err
+		}
+		if segments, err = listSegments(dir); err != nil {
+			return nil, err
+		}
+	}
+	if len(segments) > 0 {
+		if err := recoverLog(segments[len(segments)-1].Path); err != nil {
+			return nil, err
+		}
+	}
+
+	for i := range segments {
+		if err := scanSegment(&segments[i]); err != nil {
+			return nil, err
+		}
+	}
+	return segments, nil
+}
+
+// listSegments returns the segments of dir ordered by start version
+func listSegments(dir string) ([]segment, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	// Names are zero padded, so the directory order is the version order
+	var segments []segment
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		start, err := strconv.Atoi(strings.TrimSuffix(name, segmentSuffix))
+		if err != nil {
+			continue
+		}
+		segments = append(segments, segment{Start: start, Last: -1, Path: filepath.Join(dir, name)})
+	}
+	return segments, nil
+}
+
+// scanSegment fills in the size and the highest version of a segment
+func scanSegment(seg *segment) error {
+	data, err := os.ReadFile(seg.Path)
+	if err != nil {
+		return err
+	}
+	records, _, err := decodeRecords(data)
+	if err != nil {
+		// The intact records are still indexed, readers report the corruption
+		log.Println("Corrupt WAL segment:", seg.Path, err)
+	}
+	seg.Size = int64(len(data))
+	seg.Last = -1
+	for _, r := range records {
+		seg.Last = max(seg.Last, r.Version)
+	}
+	return nil
+}
+
+// adoptLegacyLog moves the single file WAL into dir, named by the version of its first entry
+func adoptLegacyLog(dir string, legacyPath string) error {
+	_, err := os.Stat(legacyPath)
+	if errors.Is(err, os.ErrNotExist) {
+		// The JSON log is all that is left when a migration was interrupted
+		if _, err := os.Stat(legacyPath + ".json"); errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+	} else if err != nil {
+		return err
+	}
+
+	if err := recoverLog(legacyPath); err != nil {
+		return err
+	}
+	records, err := readLog(legacyPath)
+	if err != nil {
+		return err
+	}
+	start := 0
+	if len(records) > 0 {
+		start = records[0].Version
+	}
+	path := filepath.Join(dir, segmentName(start))
+	if err := os.Rename(legacyPath, path); err != nil {
+		return err
+	}
+	log.Printf("Moved the WAL file %s to the segment %s", legacyPath, path)
+	return nil
+}
+
+// activeSegment returns the segment a frame of the given version and size is appended to, with its open file.
+// A new segment is started once the frame would not fit in the current one.
+// The caller must hold AppendMutex.
+func (wm *WALManager) activeSegment(version int, size int64) (*segment, *os.File, error) {
+	if n := len(wm.segments); n > 0 {
+		active := &wm.segments[n-1]
+		// A frame larger than a whole segment still goes into an empty one.
+		// An entry logged out of order stays in the active segment, so segment names never repeat.
+		if active.Last < 0 || active.Size+size <= wm.SegmentSize || version <= active.Start {
+			if wm.active == nil {
+				file, err := os.OpenFile(active.Path, os.O_APPEND|os.O_WRONLY, 0644)
+				if err != nil {
+					return nil, nil, err
+				}
+				wm.active = file
+			}
+			return active, wm.active, nil
+		}
+	}
+
+	// The full segment is synced before it is closed, whatever the durability, so that it never changes again
+	if wm.active != nil {
+		if err := wm.active.Sync(); err != nil {
+			return nil, nil, err
+		}
+		wm.active.Close()
+		wm.active = nil
+	}
+
+	seg := segment{Start: version, Last: -1, Size: int64(len(walMagic)), Path: filepath.Join(wm.Dir, segmentName(version))}
+	if err := writeFileSync(seg.Path, walMagic); err != nil {
+		return nil, nil, err
+	}
+	file, err := os.OpenFile(seg.Path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	wm.active = file
+	wm.segments = append(wm.segments, seg)
+	return &wm.segments[len(wm.segments)-1], file, nil
+}
+
+// writeEntry appends an entry to the active segment
+func (wm *WALManager) writeEntry(wal WAL) error {
+	frame, err := encodeEntry(wal)
+	if err != nil {
+		return err
+	}
+	if err := wm.writeFrame(frame, wal.Version, wal.Namespace); err != nil {
+		return err
+	}
+	wm.prepared(wal.Version)
+	return nil
+}
+
+// writeFrame appends a frame to the active segment and returns once it is as durable as the namespace asks for
+func (wm *WALManager) writeFrame(frame []byte, version int, namespace string) error {
+	durability := wm.durability(namespace)
+
+	wm.AppendMutex.Lock()
+	seg, file, err := wm.activeSegment(version, int64(len(frame)))
+	if err != nil {
+		wm.AppendMutex.Unlock()
+		return err
+	}
+	if _, err := file.Write(frame); err != nil {
+		wm.AppendMutex.Unlock()
+		return err
+	}
+	seg.Size += int64(len(frame))
+	seg.Last = max(seg.Last, version)
+	wm.written++
+	seq := wm.written
+
+	if durability == DurabilityFsync {
+		err := file.Sync()
+		if err == nil {
+			wm.group.markSynced(seq)
+		}
+		wm.AppendMutex.Unlock()
+		return err
+	}
+	wm.AppendMutex.Unlock()
+
+	if durability == DurabilityGroup {
+		return wm.waitSynced(seq)
+	}
+	return nil
+}
+
+// segmentsFrom returns the segments that may hold entries with a version of at least from
+func (wm *WALManager) segmentsFrom(from int) ([]segment, error) {
+	wm.AppendMutex.Lock()
+	defer wm.AppendMutex.Unlock()
+	if from < wm.compactedBefore {
+		return nil, fmt.Errorf("%w: version %d is older than %d", ErrCompacted, from, wm.compactedBefore)
+	}
+	var segments []segment
+	for _, seg := range wm.segments {
+		if seg.Last >= from {
+			segments = append(segments, seg)
+		}
+	}
+	return segments, nil
+}
+
+// recordsFrom returns the records of the segments that may hold versions of at least from, in log order
+func (wm *WALManager) recordsFrom(from int) ([]record, error) {
+	segments, err := wm.segmentsFrom(from)
+	if err != nil {
+		return nil, err
+	}
+	var records []record
+	for _, seg := range segments {
+		segmentRecords, err := readLog(seg.Path)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, segmentRecords...)
+	}
+	return records, nil
+}
+
+// latestVersion returns the highest version in the log, 0 for an empty log
+func (wm *WALManager) latestVersion() int {
+	wm.AppendMutex.Lock()
+	defer wm.AppendMutex.Unlock()
+	return max(latestSegmentVersion(wm.segments), 0)
+}
+
+// OldestVersion returns the oldest version the retention has kept, older entries are gone
+func (wm *WALManager) OldestVersion() int {
+	wm.AppendMutex.Lock()
+	defer wm.AppendMutex.Unlock()
+	return wm.compactedBefore
+}
+
+// latestSegmentVersion returns the highest version in the segments, -1 when they are empty
+func latestSegmentVersion(segments []segment) int {
+	for i := len(segments) - 1; i >= 0; i-- {
+		if segments[i].Last >= 0 {
+			return segments[i].Last
+		}
+	}
+	return -1
+}
+
+// Retain deletes the segments that only hold entries older than horizon and returns how many it deleted.
+// The active segment is always kept.
+func (wm *WALManager) Retain(horizon int) (int, error) {
+	wm.AppendMutex.Lock()
+	defer wm.AppendMutex.Unlock()
+
+	removed := 0
+	for len(wm.segments) > 1 && wm.segments[0].Last < horizon {
+		oldest := wm.segments[0]
+		if err := os.Remove(oldest.Path); err != nil {
+			return removed, err
+		}
+		wm.compactedBefore = max(wm.compactedBefore, oldest.Last+1)
+		wm.segments = wm.segments[1:]
+		removed++
+	}
+	if removed > 0 {
+		wm.forgetOutcomes(wm.compactedBefore)
+	}
+	return removed, nil
+}
+
+// forgetOutcomes drops the outcomes of the versions older than before, their entries are gone from the log
+func (wm *WALManager) forgetOutcomes(before int) {
+	wm.outcomeMutex.Lock()
+	defer wm.outcomeMutex.Unlock()
+
+	for version := range wm.decided {
+		if version < before {
+			delete(wm.decided, version)
+		}
+	}
+}
+
+// StartRetention periodically deletes the segments below the version horizon returns.
+// horizon returns -1 while nothing may be deleted.
+func (wm *WALManager) StartRetention(interval time.Duration, horizon func() int) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			removed, err := wm.Retain(horizon())
+			if err != nil {
+				log.Println("Failed to delete WAL segments:", err)
+			}
+			if removed > 0 {
+				log.Println("WAL retention deleted segments:", removed)
+			}
+		}
+	}()
+}
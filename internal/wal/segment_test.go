@@ -0,0 +1,222 @@
+package wal
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func versionsOf(entries []WAL) []int {
+	versions := make([]int, len(entries))
+	for i, entry := range entries {
+		versions[i] = entry.Version
+	}
+	return versions
+}
+
+func writeEntries(t *testing.T, wm *WALManager, from int, to int) {
+	t.Helper()
+	for version := from; version < to; version++ {
+		if err := wm.writeEntry(WAL{Version: version, Type: "PUT", Key: "key", Value: make([]byte, 100)}); err != nil {
+			t.Fatalf("writeFrame(%d) failed: %v", version, err)
+		}
+	}
+}
+
+func TestSegmentRotation(t *testing.T) {
+	dir := t.TempDir()
+	wm := NewWALManager(0, nil, dir, 1024, DurabilityGroup)
+	defer wm.Close()
+	writeEntries(t, wm, 0, 30)
+
+	if len(wm.segments) < 3 {
+		t.Fatalf("%d segments; want the log to be rotated", len(wm.segments))
+	}
+	for i, seg := range wm.segments {
+		if i > 0 && seg.Start != wm.segments[i-1].Last+1 {
+			t.Fatalf("segment %d starts at %d; want %d", i, seg.Start, wm.segments[i-1].Last+1)
+		}
+		if filepath.Base(seg.Path) != segmentName(seg.Start) {
+			t.Fatalf("segment %s is not named by its start version %d", seg.Path, seg.Start)
+		}
+	}
+
+	entries, err := wm.ReadEntries(17)
+	if err != nil || len(entries) != 13 || entries[0].Version != 17 {
+		t.Fatalf("ReadEntries(17) = %v, %v; want versions 17 to 29", versionsOf(entries), err)
+	}
+
+	// Reopening rebuilds the same index
+	reopened := NewWALManager(0, nil, dir, 1024, DurabilityGroup)
+	defer reopened.Close()
+	if len(reopened.segments) != len(wm.segments) || reopened.WriteVersion != 30 {
+		t.Fatalf("reopened %d segments at version %d; want %d segments at version 30", len(reopened.segments), reopened.WriteVersion, len(wm.segments))
+	}
+	for i := range wm.segments {
+		if reopened.segments[i] != wm.segments[i] {
+			t.Fatalf("reopened segment %d = %+v; want %+v", i, reopened.segments[i], wm.segments[i])
+		}
+	}
+}
+
+func TestSegmentRetention(t *testing.T) {
+	dir := t.TempDir()
+	wm := NewWALManager(0, nil, dir, 1024, DurabilityGroup)
+	defer wm.Close()
+	writeEntries(t, wm, 0, 30)
+	segments := len(wm.segments)
+
+	if removed, err := wm.Retain(-1); err != nil || removed != 0 {
+		t.Fatalf("Retain(-1) = %d, %v; want nothing deleted", removed, err)
+	}
+
+	// Only segments entirely below the horizon go
+	second := wm.segments[1]
+	removed, err := wm.Retain(second.Last)
+	if err != nil || removed != 1 {
+		t.Fatalf("Retain(%d) = %d, %v; want 1", second.Last, removed, err)
+	}
+	if _, err := wm.ReadEntries(0); !errors.Is(err, ErrCompacted) {
+		t.Fatalf("ReadEntries(0) = %v; want ErrCompacted", err)
+	}
+	if entries, err := wm.ReadEntries(second.Start); err != nil || entries[0].Version != second.Start {
+		t.Fatalf("ReadEntries(%d) = %v, %v", second.Start, versionsOf(entries), err)
+	}
+
+	// The active segment is kept whatever the horizon
+	removed, _ = wm.Retain(100)
+	if removed != segments-2 || len(wm.segments) != 1 {
+		t.Fatalf("Retain(100) deleted %d segments and kept %d; want only the active one kept", removed, len(wm.segments))
+	}
+	files, _ := os.ReadDir(dir)
+	if len(files) != 1 {
+		t.Fatalf("%d files left in the WAL directory; want 1", len(files))
+	}
+}
+
+func TestLegacyLogBecomesFirstSegment(t *testing.T) {
+	dir := t.TempDir()
+	legacyPath := filepath.Join(dir, "wal_0.log")
+	writeLog(t, legacyPath, WAL{Version: 0, Type: "PUT", Key: "a"}, WAL{Version: 1, Type: "PUT", Key: "b"})
+
+	segmentsDir := filepath.Join(dir, "wal")
+	segments, err := openSegments(segmentsDir, legacyPath)
+	if err != nil {
+		t.Fatalf("openSegments failed: %v", err)
+	}
+	if len(segments) != 1 || segments[0].Start != 0 || segments[0].Last != 1 {
+		t.Fatalf("segments = %+v; want a single segment with versions 0 to 1", segments)
+	}
+	if _, err := os.Stat(legacyPath); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("legacy log was not moved: %v", err)
+	}
+}
+
+func TestCommittedEntriesSkipPreparedEntries(t *testing.T) {
+	wm := NewWALManager(0, nil, t.TempDir(), 1024, DurabilityGroup)
+	defer wm.Close()
+
+	// 2 was prepared but never committed, 4 was logged before 3 by a follower
+	for _, version := range []int{0, 1, 2, 4, 3} {
+		if err := wm.writeEntry(WAL{Version: version, Type: "PUT", Key: "key"}); err != nil {
+			t.Fatalf("writeEntry(%d) failed: %v", version, err)
+		}
+		if version == 2 {
+			continue
+		}
+		if err := wm.MarkCommitted(WAL{Version: version}); err != nil {
+			t.Fatalf("MarkCommitted(%d) failed: %v", version, err)
+		}
+	}
+
+	entries, err := wm.CommittedEntries(1)
+	if err != nil || !reflect.DeepEqual(versionsOf(entries), []int{1, 3, 4}) {
+		t.Fatalf("CommittedEntries(1) = %v, %v; want [1 3 4]", versionsOf(entries), err)
+	}
+	if entries, _ := wm.ReadEntries(0); len(entries) != 5 {
+		t.Fatalf("ReadEntries(0) = %v; want every prepared entry", versionsOf(entries))
+	}
+}
+
+func TestAbortedEntriesAreNotReplayed(t *testing.T) {
+	wm := NewWALManager(0, nil, t.TempDir(), 1024, DurabilityGroup)
+	defer wm.Close()
+
+	// 0 is committed, 1 aborted and 2 in doubt
+	writeEntries(t, wm, 0, 3)
+	if err := wm.MarkCommitted(WAL{Version: 0}); err != nil {
+		t.Fatalf("MarkCommitted failed: %v", err)
+	}
+	if err := wm.MarkAborted(WAL{Version: 1}); err != nil {
+		t.Fatalf("MarkAborted failed: %v", err)
+	}
+
+	want := map[int]string{0: OutcomeCommitted, 1: OutcomeAborted, 2: OutcomePending, 3: OutcomeUnknown}
+	for version, outcome := range want {
+		if got, err := wm.Outcome(version); err != nil || got != outcome {
+			t.Fatalf("Outcome(%d) = %q, %v; want %q", version, got, err, outcome)
+		}
+	}
+	if entries, err := wm.CommittedEntries(0); err != nil || !reflect.DeepEqual(versionsOf(entries), []int{0}) {
+		t.Fatalf("CommittedEntries(0) = %v, %v; want [0]", versionsOf(entries), err)
+	}
+	if entries, err := wm.InDoubtEntries(0); err != nil || !reflect.DeepEqual(versionsOf(entries), []int{2}) {
+		t.Fatalf("InDoubtEntries(0) = %v, %v; want [2]", versionsOf(entries), err)
+	}
+}
+
+func TestInDoubtEntriesStayUndecidedAcrossRestarts(t *testing.T) {
+	dir := t.TempDir()
+	wm := NewWALManager(0, nil, dir, 1024, DurabilityGroup)
+	writeEntries(t, wm, 0, 3)
+	wm.MarkCommitted(WAL{Version: 0})
+	wm.MarkAborted(WAL{Version: 1})
+	wm.Close()
+
+	reopened := NewWALManager(0, nil, dir, 1024, DurabilityGroup)
+	defer reopened.Close()
+	if version, ok := reopened.OldestUndecided(); !ok || version != 2 {
+		t.Fatalf("OldestUndecided = %d, %v; want 2", version, ok)
+	}
+	if err := reopened.MarkCommitted(WAL{Version: 2}); err != nil {
+		t.Fatalf("MarkCommitted failed: %v", err)
+	}
+	if version, ok := reopened.OldestUndecided(); ok {
+		t.Fatalf("OldestUndecided = %d; want none once 2 is committed", version)
+	}
+}
+
+func TestOutcomesFollowTheLog(t *testing.T) {
+	dir := t.TempDir()
+	wm := NewWALManager(0, nil, dir, 1024, DurabilityGroup)
+	writeEntries(t, wm, 0, 30)
+	wm.MarkCommitted(WAL{Version: 0})
+	wm.MarkCommitted(WAL{Version: 29})
+	// A prepare the leader sent again after the commit leaves the entry committed,
+	// ReplicaWALWriter marks it undecided before it is written
+	wm.setUndecided(29, true)
+	writeEntries(t, wm, 29, 30)
+	if outcome, _ := wm.Outcome(29); outcome != OutcomeCommitted {
+		t.Fatalf("Outcome(29) = %q; want %q", outcome, OutcomeCommitted)
+	}
+	if version, _ := wm.OldestUndecided(); version == 29 {
+		t.Fatalf("OldestUndecided = 29; want the committed entry decided")
+	}
+
+	// Outcomes of the entries deleted by the retention are gone with them
+	if _, err := wm.Retain(wm.segments[1].Start); err != nil {
+		t.Fatalf("Retain failed: %v", err)
+	}
+	if _, err := wm.Outcome(0); !errors.Is(err, ErrCompacted) {
+		t.Fatalf("Outcome(0) = %v; want ErrCompacted", err)
+	}
+	wm.Close()
+
+	reopened := NewWALManager(0, nil, dir, 1024, DurabilityGroup)
+	defer reopened.Close()
+	if outcome, _ := reopened.Outcome(29); outcome != OutcomeCommitted {
+		t.Fatalf("Outcome(29) after a restart = %q; want %q", outcome, OutcomeCommitted)
+	}
+}
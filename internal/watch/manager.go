@@ -0,0 +1,179 @@
+package watch
+
+import (
+	"context"
+	"errors"
+	"kvstore/internal/wal"
+	"strings"
+	"sync"
+)
+
+// FromNow starts a watch at the next committed mutation, without replaying the WAL
+const FromNow = -1
+
+// subscriberBuffer is how many events a watcher can fall behind before it is dropped
+const subscriberBuffer = 256
+
+// ErrWatcherTooSlow ends a watch whose consumer did not keep up with the change feed.
+// The client reconnects from the last version it saw and catches up from the WAL.
+var ErrWatcherTooSlow = errors.New("watcher fell behind the change feed")
+
+// Event is a committed mutation of a single key. Every event of a TXN entry shares its version.
+type Event struct {
+	Key     string `json:"key"`
+	Op      string `json:"op"`
+	Version int    `json:"version"`
+}
+
+// Filter selects the stored keys a watcher is interested in
+type Filter struct {
+	Key string `json:"key"`
+	// Prefix makes Key a key prefix instead of a single key
+	Prefix bool `json:"prefix"`
+}
+
+func (f Filter) Matches(key string) bool {
+	if f.Prefix {
+		return strings.HasPrefix(key, f.Key)
+	}
+	return key == f.Key
+}
+
+type subscriber struct {
+	filter Filter
+	// events is closed when the subscriber is dropped for being too slow
+	events chan Event
+}
+
+type WatchManager struct {
+	// readEntries returns the committed WAL entries from a version on, it is the WAL manager's CommittedEntries
+	readEntries func(from int) ([]wal.WAL, error)
+	// latestVersion is the highest version applied to the store
+	latestVersion func() int
+
+	mu          sync.Mutex
+	subscribers map[*subscriber]struct{}
+}
+
+func NewWatchManager(walManager *wal.WALManager, latestVersion func() int) *WatchManager {
+	return &WatchManager{
+		readEntries:   walManager.CommittedEntries,
+		latestVersion: latestVersion,
+		subscribers:   make(map[*subscriber]struct{}),
+	}
+}
+
+// EventsFromWAL returns the per key events of a WAL entry
+func EventsFromWAL(entry wal.WAL) []Event {
+	switch entry.Type {
+	case "TXN", "EVICT":
+		events := make([]Event, len(entry.Ops))
+		for i, op := range entry.Ops {
+			events[i] = Event{Key: op.Key, Op: op.Type, Version: entry.Version}
+			if entry.Type == "EVICT" {
+				events[i].Op = "EVICT"
+			}
+		}
+		return events
+	default:
+		return []Event{{Key: entry.Key, Op: entry.Type, Version: entry.Version}}
+	}
+}
+
+// Publish hands the events of an applied entry to the watchers, it never blocks on a slow watcher
+func (wm *WatchManager) Publish(entry wal.WAL) {
+	events := EventsFromWAL(entry)
+
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	for sub := range wm.subscribers {
+		for _, event := range events {
+			if sub.filter.Matches(event.Key) && !wm.deliver(sub, event) {
+				break
+			}
+		}
+	}
+}
+
+// deliver queues the event for the subscriber, or drops the subscriber when its queue is full.
+// It is called with mu held.
+func (wm *WatchManager) deliver(sub *subscriber, event Event) bool {
+	select {
+	case sub.events <- event:
+		return true
+	default:
+		delete(wm.subscribers, sub)
+		close(sub.events)
+		return false
+	}
+}
+
+func (wm *WatchManager) subscribe(filter Filter) *subscriber {
+	sub := &subscriber{filter: filter, events: make(chan Event, subscriberBuffer)}
+	wm.mu.Lock()
+	wm.subscribers[sub] = struct{}{}
+	wm.mu.Unlock()
+	return sub
+}
+
+func (wm *WatchManager) unsubscribe(sub *subscriber) {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	if _, ok := wm.subscribers[sub]; ok {
+		delete(wm.subscribers, sub)
+		close(sub.events)
+	}
+}
+
+// Watch calls send with every event matching the filter until ctx is done, send fails or the watcher falls behind.
+// A from version other than FromNow first replays the WAL from that version, then switches to the live feed.
+// Events of the from version itself are replayed, so a client resuming from the last version it saw may get those again.
+func (wm *WatchManager) Watch(ctx context.Context, filter Filter, from int, send func(Event) error) error {
+	// Subscribing before reading the WAL leaves no gap between the replay and the live feed,
+	// the live events are buffered in the meantime
+	sub := wm.subscribe(filter)
+	defer wm.unsubscribe(sub)
+
+	// Entries apply out of version order, so the live feed skips exactly the versions the replay sent.
+	// An older version that is applied after the WAL was read only comes through the live feed.
+	replayed := make(map[int]bool)
+	if from != FromNow {
+		// Entries above the applied version are committed but not applied yet, the live feed delivers them
+		latest := wm.latestVersion()
+		entries, err := wm.readEntries(from)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if entry.Version > latest {
+				continue
+			}
+			replayed[entry.Version] = true
+			for _, event := range EventsFromWAL(entry) {
+				if !filter.Matches(event.Key) {
+					continue
+				}
+				if err := send(event); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case event, ok := <-sub.events:
+			if !ok {
+				return ErrWatcherTooSlow
+			}
+			if replayed[event.Version] {
+				continue
+			}
+			if err := send(event); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package watch
+
+import (
+	"context"
+	"errors"
+	"kvstore/internal/wal"
+	"testing"
+	"time"
+)
+
+func newTestWatchManager(log []wal.WAL, latest int) *WatchManager {
+	return &WatchManager{
+		readEntries: func(from int) ([]wal.WAL, error) {
+			var entries []wal.WAL
+			for _, entry := range log {
+				if entry.Version >= from {
+					entries = append(entries, entry)
+				}
+			}
+			return entries, nil
+		},
+		latestVersion: func() int { return latest },
+		subscribers:   make(map[*subscriber]struct{}),
+	}
+}
+
+// collect runs a watch in the background and returns its events on a channel
+func collect(wm *WatchManager, ctx context.Context, filter Filter, from int) (<-chan Event, <-chan error) {
+	events := make(chan Event, 100)
+	done := make(chan error, 1)
+	go func() {
+		done <- wm.Watch(ctx, filter, from, func(event Event) error {
+			events <- event
+			return nil
+		})
+	}()
+	return events, done
+}
+
+func expectEvent(t *testing.T, events <-chan Event, want Event) {
+	t.Helper()
+	select {
+	case got := <-events:
+		if got != want {
+			t.Fatalf("event = %+v; want %+v", got, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no event; want %+v", want)
+	}
+}
+
+// waitForSubscribers waits until n watches are registered
+func waitForSubscribers(t *testing.T, wm *WatchManager, n int) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		wm.mu.Lock()
+		count := len(wm.subscribers)
+		wm.mu.Unlock()
+		if count == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("watchers did not subscribe")
+}
+
+func TestWatchReplaysThenFollowsLiveFeed(t *testing.T) {
+	log := []wal.WAL{
+		{Version: 1, Type: "PUT", Key: "default/user:1"},
+		{Version: 2, Type: "PUT", Key: "default/order:1"},
+		{Version: 3, Type: "TXN", Ops: []wal.Op{{Type: "DELETE", Key: "default/user:1"}, {Type: "PUT", Key: "default/user:2"}}},
+		// Prepared but not applied yet
+		{Version: 4, Type: "PUT", Key: "default/user:3"},
+	}
+	wm := newTestWatchManager(log, 3)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events, done := collect(wm, ctx, Filter{Key: "default/user:", Prefix: true}, 1)
+	expectEvent(t, events, Event{Key: "default/user:1", Op: "PUT", Version: 1})
+	expectEvent(t, events, Event{Key: "default/user:1", Op: "DELETE", Version: 3})
+	expectEvent(t, events, Event{Key: "default/user:2", Op: "PUT", Version: 3})
+
+	waitForSubscribers(t, wm, 1)
+	// Already replayed, the live copy is skipped
+	wm.Publish(log[2])
+	wm.Publish(log[3])
+	wm.Publish(wal.WAL{Version: 5, Type: "EVICT", Ops: []wal.Op{{Type: "DELETE", Key: "default/order:1"}, {Type: "DELETE", Key: "default/user:2"}}})
+	expectEvent(t, events, Event{Key: "default/user:3", Op: "PUT", Version: 4})
+	expectEvent(t, events, Event{Key: "default/user:2", Op: "EVICT", Version: 5})
+
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("Watch returned %v; want context.Canceled", err)
+	}
+	waitForSubscribers(t, wm, 0)
+}
+
+func TestWatchDeliversOlderVersionsAppliedAfterReplay(t *testing.T) {
+	// Version 2 is applied after version 3, it is missing from the WAL the replay reads
+	log := []wal.WAL{
+		{Version: 1, Type: "PUT", Key: "default/a"},
+		{Version: 3, Type: "PUT", Key: "default/c"},
+	}
+	wm := newTestWatchManager(log, 3)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events, _ := collect(wm, ctx, Filter{Prefix: true}, 1)
+	expectEvent(t, events, Event{Key: "default/a", Op: "PUT", Version: 1})
+	expectEvent(t, events, Event{Key: "default/c", Op: "PUT", Version: 3})
+
+	waitForSubscribers(t, wm, 1)
+	wm.Publish(log[1])
+	wm.Publish(wal.WAL{Version: 2, Type: "PUT", Key: "default/b"})
+	expectEvent(t, events, Event{Key: "default/b", Op: "PUT", Version: 2})
+}
+
+func TestWatchSingleKeyFromNow(t *testing.T) {
+	wm := newTestWatchManager([]wal.WAL{{Version: 1, Type: "PUT", Key: "default/a"}}, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events, _ := collect(wm, ctx, Filter{Key: "default/a"}, FromNow)
+	waitForSubscribers(t, wm, 1)
+	wm.Publish(wal.WAL{Version: 2, Type: "PUT", Key: "default/ab"})
+	wm.Publish(wal.WAL{Version: 3, Type: "INCR", Key: "default/a"})
+	expectEvent(t, events, Event{Key: "default/a", Op: "INCR", Version: 3})
+}
+
+func TestSlowWatcherIsDropped(t *testing.T) {
+	wm := newTestWatchManager(nil, 0)
+	release := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- wm.Watch(context.Background(), Filter{Prefix: true}, FromNow, func(Event) error {
+			<-release
+			return nil
+		})
+	}()
+	waitForSubscribers(t, wm, 1)
+
+	// The first event blocks the consumer, the queue fills up behind it
+	for version := 1; version <= subscriberBuffer+2; version++ {
+		wm.Publish(wal.WAL{Version: version, Type: "PUT", Key: "default/k"})
+	}
+	waitForSubscribers(t, wm, 0)
+	close(release)
+	if err := <-done; !errors.Is(err, ErrWatcherTooSlow) {
+		t.Fatalf("Watch returned %v; want ErrWatcherTooSlow", err)
+	}
+}
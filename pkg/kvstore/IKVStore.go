@@ -1,7 +1,17 @@
 package kvstore
 
-type IKVStore interface {
-	Get(key string) (string, error)
-	Put(key string, value string) error
-	Delete(key string)
-}
+import "kvstore/pkg/kvstore/engine"
+
+// ErrKeyNotFound is returned by reads of a key that does not exist, or did not at the version asked for.
+// An empty value is a value: it is returned as found, with a zero length.
+var ErrKeyNotFound = engine.ErrKeyNotFound
+
+// IKVStore is the storage engine interface, every engine of the store implements it.
+// A new engine proves it behaves like the others by passing kvstoretest.Run.
+// The interface and its types are defined in the engine package, see engine.IKVStore for the contract.
+type (
+	IKVStore  = engine.IKVStore
+	Versioned = engine.Versioned
+	KVPair    = engine.KVPair
+	BatchOp   = engine.BatchOp
+)
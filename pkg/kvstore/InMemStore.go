@@ -1,28 +1,18 @@
 package kvstore
 
-type InMemStore struct {
-	store map[string]string
-}
+import "kvstore/pkg/kvstore/engine"
 
-func NewInMemStore() *InMemStore {
-	return &InMemStore{
-		store: make(map[string]string),
-	}
-}
+// DefaultShardCount is the number of shards used when no shard count is configured.
+const DefaultShardCount = engine.DefaultShardCount
 
-func (s *InMemStore) Get(key string) (string, error) {
-	value, exists := s.store[key]
-	if !exists {
-		return "", nil
-	}
-	return value, nil
-}
+// InMemStore is the sharded in-memory engine the server runs with -engine memory.
+// Keys are split over lock-striped shards, each one kept ordered for range scans.
+type InMemStore = engine.InMemStore
 
-func (s *InMemStore) Put(key string, value string) error {
-	s.store[key] = value
-	return nil
+func NewInMemStore() *InMemStore {
+	return engine.NewInMemStore()
 }
 
-func (s *InMemStore) Delete(key string) {
-	delete(s.store, key)
+func NewShardedInMemStore(shardCount int) *InMemStore {
+	return engine.NewShardedInMemStore(shardCount)
 }
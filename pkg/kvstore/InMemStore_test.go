@@ -0,0 +1,21 @@
+package kvstore_test
+
+import (
+	"kvstore/pkg/kvstore"
+	"kvstore/pkg/kvstore/kvstoretest"
+	"testing"
+)
+
+// The public constructors return the engine the server runs, it has to pass the same suite as the others
+func TestInMemStoreConformance(t *testing.T) {
+	kvstoretest.Run(t, func(t *testing.T) kvstore.IKVStore {
+		return kvstore.NewInMemStore()
+	})
+}
+
+func TestShardedInMemStoreConformance(t *testing.T) {
+	kvstoretest.Run(t, func(t *testing.T) kvstore.IKVStore {
+		// A single shard holds every key, scans have nothing to merge
+		return kvstore.NewShardedInMemStore(1)
+	})
+}
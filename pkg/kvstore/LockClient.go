@@ -0,0 +1,113 @@
+package kvstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+var (
+	ErrLockHeld = errors.New("lock is held by another owner")
+	// ErrLockLost is returned by Renew and Release once the lease ran out or another owner took the lock
+	ErrLockLost = errors.New("lock is no longer held")
+)
+
+// Lease is a held lock. Token is the fencing token, pass it along with every write the lock protects.
+type Lease struct {
+	Key       string    `json:"key"`
+	Owner     string    `json:"owner"`
+	Token     int       `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// LockClient takes locks through the HTTP API of the cluster leader.
+//
+//	locks := kvstore.NewLockClient("http://localhost:8081")
+//	lease, err := locks.Acquire(ctx, "nightly-report", "worker-1", 30*time.Second)
+//	...
+//	defer locks.Release(ctx, lease)
+type LockClient struct {
+	// BaseURL is the leader's address, for example http://localhost:8081
+	BaseURL string
+	// Namespace is empty for the default namespace
+	Namespace  string
+	HTTPClient *http.Client
+}
+
+func NewLockClient(baseURL string) *LockClient {
+	return &LockClient{
+		BaseURL:    baseURL,
+		HTTPClient: http.DefaultClient,
+	}
+}
+
+type lockRequest struct {
+	Owner string `json:"owner"`
+	Token int    `json:"token,omitempty"`
+	TTL   int64  `json:"ttl,omitempty"`
+}
+
+// ttlSeconds rounds the lease up to whole seconds, the resolution of the store's TTLs
+func ttlSeconds(ttl time.Duration) int64 {
+	return max(int64((ttl+time.Second-1)/time.Second), 1)
+}
+
+// Acquire takes the lock for owner, it fails with ErrLockHeld without waiting when another owner holds it
+func (c *LockClient) Acquire(ctx context.Context, key string, owner string, ttl time.Duration) (Lease, error) {
+	var lease Lease
+	err := c.do(ctx, key, "acquire", lockRequest{Owner: owner, TTL: ttlSeconds(ttl)}, &lease, ErrLockHeld)
+	return lease, err
+}
+
+// Renew extends the lease by ttl from now, the token stays the same
+func (c *LockClient) Renew(ctx context.Context, lease Lease, ttl time.Duration) (Lease, error) {
+	var renewed Lease
+	err := c.do(ctx, lease.Key, "renew", lockRequest{Owner: lease.Owner, Token: lease.Token, TTL: ttlSeconds(ttl)}, &renewed, ErrLockLost)
+	return renewed, err
+}
+
+func (c *LockClient) Release(ctx context.Context, lease Lease) error {
+	return c.do(ctx, lease.Key, "release", lockRequest{Owner: lease.Owner, Token: lease.Token}, nil, ErrLockLost)
+}
+
+// do posts a lock operation, a 409 answer is returned as conflictErr
+func (c *LockClient) do(ctx context.Context, key string, op string, body lockRequest, out any, conflictErr error) error {
+	path := "/api/v1"
+	if c.Namespace != "" {
+		path += "/ns/" + url.PathEscape(c.Namespace)
+	}
+	path += "/locks/" + url.PathEscape(key) + "/" + op
+
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.BaseURL+path, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusConflict:
+		return conflictErr
+	case resp.StatusCode >= 300:
+		message, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("lock %s of %s failed: %s: %s", op, key, resp.Status, bytes.TrimSpace(message))
+	case out == nil:
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
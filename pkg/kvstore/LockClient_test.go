@@ -0,0 +1,59 @@
+package kvstore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLockClient(t *testing.T) {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		var body lockRequest
+		json.NewDecoder(r.Body).Decode(&body)
+		requests = append(requests, r.URL.Path)
+
+		switch r.URL.Path {
+		case "/api/v1/ns/jobs/locks/report/acquire":
+			if body.Owner != "w1" || body.TTL != 2 {
+				t.Errorf("acquire body = %+v; want owner w1 and a 2s ttl", body)
+			}
+			json.NewEncoder(rw).Encode(Lease{Key: "report", Owner: body.Owner, Token: 7})
+		case "/api/v1/ns/jobs/locks/report/renew":
+			if body.Token != 7 {
+				t.Errorf("renew token = %d; want 7", body.Token)
+			}
+			http.Error(rw, "lock is not held by this owner and token", http.StatusConflict)
+		case "/api/v1/ns/jobs/locks/report/release":
+			rw.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(rw, "not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	locks := NewLockClient(server.URL)
+	locks.Namespace = "jobs"
+	ctx := context.Background()
+
+	lease, err := locks.Acquire(ctx, "report", "w1", 1500*time.Millisecond)
+	if err != nil || lease.Token != 7 {
+		t.Fatalf("Acquire = %+v, %v; want token 7", lease, err)
+	}
+	if _, err := locks.Renew(ctx, lease, time.Second); !errors.Is(err, ErrLockLost) {
+		t.Fatalf("Renew = %v; want ErrLockLost", err)
+	}
+	if err := locks.Release(ctx, lease); err != nil {
+		t.Fatalf("Release = %v", err)
+	}
+	if _, err := locks.Acquire(ctx, "other", "w1", time.Second); err == nil {
+		t.Fatalf("Acquire on a failing route succeeded")
+	}
+	if len(requests) != 4 {
+		t.Fatalf("client sent %d requests; want 4", len(requests))
+	}
+}
@@ -0,0 +1,291 @@
+package engine
+
+import (
+	"bytes"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultShardCount is the number of shards used when no shard count is configured.
+const DefaultShardCount = 32
+
+// shard is a single lock-striped partition of the keyspace.
+// Keys are kept ordered inside a shard so that range scans can merge the shards.
+type shard struct {
+	mu    sync.RWMutex
+	store *skiplist
+}
+
+type InMemStore struct {
+	shards []*shard
+}
+
+func NewInMemStore() *InMemStore {
+	return NewShardedInMemStore(DefaultShardCount)
+}
+
+func NewShardedInMemStore(shardCount int) *InMemStore {
+	if shardCount <= 0 {
+		shardCount = DefaultShardCount
+	}
+	shards := make([]*shard, shardCount)
+	for i := range shards {
+		shards[i] = &shard{
+			store: newSkiplist(),
+		}
+	}
+	return &InMemStore{
+		shards: shards,
+	}
+}
+
+// shardIndex maps a key to the index of the shard that owns it
+func (s *InMemStore) shardIndex(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(s.shards)))
+}
+
+func (s *InMemStore) getShard(key string) *shard {
+	return s.shards[s.shardIndex(key)]
+}
+
+func (s *InMemStore) Get(key string) ([]byte, error) {
+	sh := s.getShard(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	e, exists := sh.store.get(key)
+	// Expired keys stay invisible until the sweeper removes them
+	if !exists || !e.visible(time.Now().UnixNano()) {
+		return nil, ErrKeyNotFound
+	}
+	return e.value, nil
+}
+
+// GetVersioned returns the current value of the key with the version that wrote it.
+func (s *InMemStore) GetVersioned(key string) (Versioned, bool, error) {
+	sh := s.getShard(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	e, exists := sh.store.get(key)
+	if !exists || !e.visible(time.Now().UnixNano()) {
+		return Versioned{}, false, nil
+	}
+	return e.versioned(), true, nil
+}
+
+// GetAt returns the value the key had right after the write with the given version.
+func (s *InMemStore) GetAt(key string, version int) (Versioned, error) {
+	sh := s.getShard(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	e, exists := sh.store.get(key)
+	if !exists {
+		return Versioned{}, ErrKeyNotFound
+	}
+	e, exists = e.at(version)
+	if !exists || !e.visible(time.Now().UnixNano()) {
+		return Versioned{}, ErrKeyNotFound
+	}
+	return e.versioned(), nil
+}
+
+// write stores a new version of key, keeping the current one in the history
+func (s *InMemStore) write(key string, e entry) {
+	sh := s.getShard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	sh.write(key, e)
+}
+
+// write is the lock-free part of InMemStore.write, the caller must hold the shard's write lock
+func (sh *shard) write(key string, e entry) {
+	old, exists := sh.store.get(key)
+	if !exists {
+		// A tombstone for a key without history does not need to be kept in memory
+		if !e.deleted {
+			sh.store.set(key, e)
+		}
+		return
+	}
+	sh.store.set(key, e.withPrevious(old))
+}
+
+func (s *InMemStore) Put(key string, value []byte, contentType string, version int) error {
+	s.write(key, entry{value: bytes.Clone(value), contentType: contentType, version: version})
+	return nil
+}
+
+// PutWithTTL stores a value that stops being visible at expiresAt.
+// The deadline is absolute so that every replica expires the key at the same instant.
+func (s *InMemStore) PutWithTTL(key string, value []byte, contentType string, version int, expiresAt time.Time) error {
+	s.write(key, entry{value: bytes.Clone(value), contentType: contentType, version: version, expiresAt: expiresAt.UnixNano()})
+	return nil
+}
+
+// Delete writes a tombstone version so that reads as of older versions still see the old value.
+func (s *InMemStore) Delete(key string, version int) error {
+	s.write(key, entry{deleted: true, version: version})
+	return nil
+}
+
+// WriteBatch applies every operation of the batch or none of them.
+// All the shards the batch touches are locked up front, in index order, so readers never see half of it.
+func (s *InMemStore) WriteBatch(ops []BatchOp) error {
+	locked := make(map[int]bool)
+	var indexes []int
+	for _, op := range ops {
+		index := s.shardIndex(op.Key)
+		if !locked[index] {
+			locked[index] = true
+			indexes = append(indexes, index)
+		}
+	}
+	sort.Ints(indexes)
+
+	for _, index := range indexes {
+		s.shards[index].mu.Lock()
+	}
+	defer func() {
+		for _, index := range indexes {
+			s.shards[index].mu.Unlock()
+		}
+	}()
+
+	for _, op := range ops {
+		s.shards[s.shardIndex(op.Key)].write(op.Key, batchEntry(op))
+	}
+	return nil
+}
+
+// PruneVersions drops the versions older than horizon that are no longer visible at the horizon
+// and returns how many versions were dropped.
+func (s *InMemStore) PruneVersions(horizon int) int {
+	dropped := 0
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+		var removable []string
+		for node := sh.store.first(); node != nil; node = node.next() {
+			pruned, n := node.value.prune(horizon)
+			node.value = pruned
+			dropped += n
+			if pruned.removable() {
+				removable = append(removable, node.key)
+			}
+		}
+		for _, key := range removable {
+			sh.store.remove(key)
+		}
+		dropped += len(removable)
+		sh.mu.Unlock()
+	}
+	return dropped
+}
+
+// DeleteExpired removes every key whose deadline is at or before now, history included,
+// and returns the removed keys.
+func (s *InMemStore) DeleteExpired(now time.Time) []string {
+	deadline := now.UnixNano()
+	var removed []string
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+		var expiredKeys []string
+		for node := sh.store.first(); node != nil; node = node.next() {
+			if !node.value.deleted && node.value.expired(deadline) {
+				expiredKeys = append(expiredKeys, node.key)
+			}
+		}
+		for _, key := range expiredKeys {
+			sh.store.remove(key)
+		}
+		removed = append(removed, expiredKeys...)
+		sh.mu.Unlock()
+	}
+	return removed
+}
+
+// Scan returns the live keys in [start, end) in ascending order.
+// An empty end means the scan runs to the end of the keyspace, a limit <= 0 means no limit.
+func (s *InMemStore) Scan(start string, end string, limit int) ([]KVPair, error) {
+	now := time.Now().UnixNano()
+	var pairs []KVPair
+
+	// Every shard contributes at most limit keys, the merged result is trimmed afterwards
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		count := 0
+		for node := sh.store.seek(start); node != nil; node = node.next() {
+			if end != "" && node.key >= end {
+				break
+			}
+			if limit > 0 && count >= limit {
+				break
+			}
+			if !node.value.visible(now) {
+				continue
+			}
+			pairs = append(pairs, KVPair{Key: node.key, Value: node.value.value, ContentType: node.value.contentType})
+			count++
+		}
+		sh.mu.RUnlock()
+	}
+
+	sort.Slice(pairs, func(i, j int) bool {
+		return pairs[i].Key < pairs[j].Key
+	})
+	if limit > 0 && len(pairs) > limit {
+		pairs = pairs[:limit]
+	}
+	return pairs, nil
+}
+
+// ScanAt returns the keys in [start, end) as they were right after the write with the given version,
+// with expiry judged at the given time. It reads the version chains, so it only reaches back to the retention horizon.
+func (s *InMemStore) ScanAt(start string, end string, version int, at time.Time, limit int) ([]KVPair, error) {
+	now := at.UnixNano()
+	var pairs []KVPair
+
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		count := 0
+		for node := sh.store.seek(start); node != nil; node = node.next() {
+			if end != "" && node.key >= end {
+				break
+			}
+			if limit > 0 && count >= limit {
+				break
+			}
+			e, ok := node.value.at(version)
+			if !ok || !e.visible(now) {
+				continue
+			}
+			pairs = append(pairs, KVPair{Key: node.key, Value: e.value, ContentType: e.contentType})
+			count++
+		}
+		sh.mu.RUnlock()
+	}
+
+	sort.Slice(pairs, func(i, j int) bool {
+		return pairs[i].Key < pairs[j].Key
+	})
+	if limit > 0 && len(pairs) > limit {
+		pairs = pairs[:limit]
+	}
+	return pairs, nil
+}
+
+// ScanPrefix returns every live key starting with prefix in ascending order.
+func (s *InMemStore) ScanPrefix(prefix string) ([]KVPair, error) {
+	return s.Scan(prefix, PrefixEnd(prefix), 0)
+}
+
+// Close is a no-op, the in-memory store holds no external resources
+func (s *InMemStore) Close() error {
+	return nil
+}
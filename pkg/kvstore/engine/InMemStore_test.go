@@ -0,0 +1,199 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestInMemStoreGetPutDelete(t *testing.T) {
+	s := NewShardedInMemStore(4)
+
+	if err := s.Put("a", []byte("1"), "", 0); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	value, err := s.Get("a")
+	if err != nil || string(value) != "1" {
+		t.Fatalf("Get(a) = %q, %v; want %q", value, err, "1")
+	}
+
+	s.Delete("a", 0)
+	value, err = s.Get("a")
+	if !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("Get(a) after delete = %q, %v; want ErrKeyNotFound", value, err)
+	}
+}
+
+func TestInMemStoreInvalidShardCount(t *testing.T) {
+	s := NewShardedInMemStore(0)
+	if len(s.shards) != DefaultShardCount {
+		t.Fatalf("shard count = %d; want %d", len(s.shards), DefaultShardCount)
+	}
+}
+
+func TestInMemStoreConcurrentAccess(t *testing.T) {
+	s := NewShardedInMemStore(8)
+
+	const goroutines = 32
+	const keysPerGoroutine = 500
+
+	var wg sync.WaitGroup
+	wg.Add(goroutines)
+	for g := 0; g < goroutines; g++ {
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < keysPerGoroutine; i++ {
+				// Every goroutine hits a shared key as well as its own keys
+				own := fmt.Sprintf("key-%d-%d", g, i)
+				shared := fmt.Sprintf("shared-%d", i%16)
+
+				if err := s.Put(own, []byte(own), "", 0); err != nil {
+					t.Errorf("Put(%s) failed: %v", own, err)
+					return
+				}
+				if err := s.Put(shared, []byte(own), "", 0); err != nil {
+					t.Errorf("Put(%s) failed: %v", shared, err)
+					return
+				}
+				if value, _ := s.Get(own); string(value) != own {
+					t.Errorf("Get(%s) = %q; want %q", own, value, own)
+					return
+				}
+				s.Get(shared)
+				if i%2 == 0 {
+					s.Delete(own, 0)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	for g := 0; g < goroutines; g++ {
+		for i := 0; i < keysPerGoroutine; i++ {
+			key := fmt.Sprintf("key-%d-%d", g, i)
+			value, _ := s.Get(key)
+			if i%2 == 0 && string(value) != "" {
+				t.Fatalf("Get(%s) = %q; want deleted", key, value)
+			}
+			if i%2 == 1 && string(value) != key {
+				t.Fatalf("Get(%s) = %q; want %q", key, value, key)
+			}
+		}
+	}
+}
+
+func TestInMemStoreTTL(t *testing.T) {
+	s := NewShardedInMemStore(4)
+
+	now := time.Now()
+	s.PutWithTTL("expired", []byte("1"), "", 0, now.Add(-time.Second))
+	s.PutWithTTL("live", []byte("2"), "", 0, now.Add(time.Hour))
+	s.Put("forever", []byte("3"), "", 0)
+
+	if value, _ := s.Get("expired"); string(value) != "" {
+		t.Fatalf("Get(expired) = %q; want empty", value)
+	}
+	if value, _ := s.Get("live"); string(value) != "2" {
+		t.Fatalf("Get(live) = %q; want %q", value, "2")
+	}
+
+	if removed := s.DeleteExpired(now); !reflect.DeepEqual(removed, []string{"expired"}) {
+		t.Fatalf("DeleteExpired removed %q; want [expired]", removed)
+	}
+	if removed := s.DeleteExpired(now.Add(2 * time.Hour)); !reflect.DeepEqual(removed, []string{"live"}) {
+		t.Fatalf("DeleteExpired removed %q; want [live]", removed)
+	}
+	if value, _ := s.Get("forever"); string(value) != "3" {
+		t.Fatalf("Get(forever) = %q; want %q", value, "3")
+	}
+}
+
+func TestInMemStoreScan(t *testing.T) {
+	s := NewShardedInMemStore(4)
+	for _, key := range []string{"user/3", "user/1", "order/1", "user/2", "users"} {
+		s.Put(key, []byte(key), "", 0)
+	}
+	s.PutWithTTL("user/0", []byte("expired"), "", 0, time.Now().Add(-time.Second))
+
+	pairs, _ := s.ScanPrefix("user/")
+	if got := keysOf(pairs); !reflect.DeepEqual(got, []string{"user/1", "user/2", "user/3"}) {
+		t.Fatalf("ScanPrefix(user/) = %v", got)
+	}
+
+	pairs, _ = s.Scan("order/1", "user/3", 2)
+	if got := keysOf(pairs); !reflect.DeepEqual(got, []string{"order/1", "user/1"}) {
+		t.Fatalf("Scan(order/1, user/3, 2) = %v", got)
+	}
+
+	pairs, _ = s.Scan("user/2", "", 0)
+	if got := keysOf(pairs); !reflect.DeepEqual(got, []string{"user/2", "user/3", "users"}) {
+		t.Fatalf("Scan(user/2, \"\", 0) = %v", got)
+	}
+}
+
+func keysOf(pairs []KVPair) []string {
+	keys := make([]string, len(pairs))
+	for i, pair := range pairs {
+		keys[i] = pair.Key
+	}
+	return keys
+}
+
+func TestInMemStoreGetAt(t *testing.T) {
+	s := NewShardedInMemStore(4)
+	s.Put("a", []byte("1"), "", 1)
+	s.Put("a", []byte("2"), "", 3)
+	s.Delete("a", 5)
+	s.Put("a", []byte("3"), "", 7)
+
+	cases := map[int]string{0: "", 1: "1", 2: "1", 3: "2", 5: "", 6: "", 7: "3", 100: "3"}
+	for version, want := range cases {
+		current, err := s.GetAt("a", version)
+		if want == "" && !errors.Is(err, ErrKeyNotFound) || want != "" && (err != nil || string(current.Value) != want) {
+			t.Fatalf("GetAt(a, %d) = %q, %v; want %q", version, current.Value, err, want)
+		}
+	}
+
+	// Version 3 is the newest version at the horizon, everything before it goes away
+	if dropped := s.PruneVersions(4); dropped != 1 {
+		t.Fatalf("PruneVersions dropped %d versions; want 1", dropped)
+	}
+	if current, _ := s.GetAt("a", 4); string(current.Value) != "2" {
+		t.Fatalf("GetAt(a, 4) after prune = %q; want %q", current.Value, "2")
+	}
+
+	// A deleted key without history is forgotten entirely
+	s.Put("b", []byte("1"), "", 8)
+	s.Delete("b", 9)
+	s.PruneVersions(10)
+	sh := s.getShard("b")
+	if _, exists := sh.store.get("b"); exists {
+		t.Fatalf("tombstone for b was not removed")
+	}
+}
+
+func TestInMemStoreWriteBatch(t *testing.T) {
+	s := NewShardedInMemStore(4)
+	s.Put("a", []byte("1"), "", 1)
+
+	err := s.WriteBatch([]BatchOp{
+		{Key: "a", Delete: true, Version: 2},
+		{Key: "b", Value: []byte("2"), Version: 2},
+		{Key: "b", Value: []byte("3"), Version: 2},
+	})
+	if err != nil {
+		t.Fatalf("WriteBatch failed: %v", err)
+	}
+	if value, _ := s.Get("a"); string(value) != "" {
+		t.Fatalf("Get(a) = %q; want deleted", value)
+	}
+	if value, _ := s.Get("b"); string(value) != "3" {
+		t.Fatalf("Get(b) = %q; want %q", value, "3")
+	}
+	if current, _ := s.GetAt("a", 1); string(current.Value) != "1" {
+		t.Fatalf("GetAt(a, 1) = %q; want %q", current.Value, "1")
+	}
+}
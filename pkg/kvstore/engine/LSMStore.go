@@ -0,0 +1,774 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	lsmMaxLevels    = 7
+	lsmManifestFile = "MANIFEST"
+	lsmMemtableLog  = "memtable.log"
+	logRecordHeader = 8
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var errStoreClosed = errors.New("store is closed")
+
+type LSMOptions struct {
+	// MemtableSize is the approximate size in bytes at which the memtable is flushed to level 0
+	MemtableSize int
+	// L0CompactionTrigger is the number of level 0 tables that triggers a compaction into level 1
+	L0CompactionTrigger int
+	// TableFileSize is the target size of the SSTables written by compactions
+	TableFileSize int64
+	// BaseLevelSize is the size limit of level 1, every following level is ten times larger
+	BaseLevelSize int64
+	// SyncWrites fsyncs the memtable log after every write
+	SyncWrites bool
+}
+
+func DefaultLSMOptions() LSMOptions {
+	return LSMOptions{
+		MemtableSize:        4 << 20,
+		L0CompactionTrigger: 4,
+		TableFileSize:       2 << 20,
+		BaseLevelSize:       10 << 20,
+		SyncWrites:          false,
+	}
+}
+
+type lsmManifest struct {
+	NextID int     `json:"next_id"`
+	Levels [][]int `json:"levels"`
+	// FlushedVersion is the highest WAL version that is in the tables along with every older one
+	FlushedVersion int `json:"flushed_version"`
+}
+
+// LSMStore is an on-disk log-structured merge tree.
+//
+// Writes go to a memtable backed by an append-only log, full memtables are flushed to level 0 SSTables
+// and leveled compaction merges them down. The MANIFEST file records which tables belong to which level,
+// so a crash at any point leaves either the old or the new set of tables.
+type LSMStore struct {
+	mu       sync.RWMutex
+	dir      string
+	options  LSMOptions
+	memtable *skiplist
+	memSize  int
+	log      *os.File
+	// levels[0] is ordered newest first, the other levels are sorted by key and never overlap
+	levels          [][]*sstable
+	compactPointers []string
+	// horizon is the oldest version that reads as of a past version may still ask for
+	horizon int
+	// expiryDeadline is the latest instant, in unix nanoseconds, DeleteExpired was given.
+	// Compaction only rewrites entries expired by then: open snapshots may still read the ones that expired later.
+	expiryDeadline int64
+	nextID         int
+	closed         bool
+	// flushedVersion is the highest WAL version that is in the SSTables along with every older one, -1 when unknown
+	flushedVersion int
+	// appliedVersion is the highest WAL version written along with every older one, as told by SetAppliedVersion
+	appliedVersion int
+	// unflushedMin is the oldest version written to the memtable since the last flush, -1 when there is none
+	unflushedMin int
+}
+
+func OpenLSMStore(dir string, options LSMOptions) (*LSMStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	s := &LSMStore{
+		dir:             dir,
+		options:         options,
+		memtable:        newSkiplist(),
+		levels:          make([][]*sstable, lsmMaxLevels),
+		compactPointers: make([]string, lsmMaxLevels),
+		horizon:         -1,
+		nextID:          1,
+		flushedVersion:  -1,
+		appliedVersion:  -1,
+		unflushedMin:    -1,
+	}
+
+	if err := s.loadManifest(); err != nil {
+		s.closeTables()
+		return nil, err
+	}
+	if err := s.removeOrphanTables(); err != nil {
+		s.closeTables()
+		return nil, err
+	}
+	if err := s.replayLog(); err != nil {
+		s.closeTables()
+		return nil, err
+	}
+
+	file, err := os.OpenFile(filepath.Join(dir, lsmMemtableLog), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		s.closeTables()
+		return nil, err
+	}
+	s.log = file
+	return s, nil
+}
+
+func (s *LSMStore) loadManifest() error {
+	data, err := os.ReadFile(filepath.Join(s.dir, lsmManifestFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// Manifests written before the flushed version was recorded leave it unknown until the next flush
+	manifest := lsmManifest{FlushedVersion: -1}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return fmt.Errorf("failed to read manifest: %w", err)
+	}
+	s.nextID = manifest.NextID
+	s.flushedVersion = manifest.FlushedVersion
+	s.appliedVersion = manifest.FlushedVersion
+	for level, ids := range manifest.Levels {
+		if level >= lsmMaxLevels {
+			return fmt.Errorf("manifest has too many levels: %d", len(manifest.Levels))
+		}
+		for _, id := range ids {
+			t, err := openSSTable(s.dir, id)
+			if err != nil {
+				return err
+			}
+			s.levels[level] = append(s.levels[level], t)
+		}
+	}
+	return nil
+}
+
+// saveManifest atomically replaces the MANIFEST with the current set of tables
+func (s *LSMStore) saveManifest() error {
+	manifest := lsmManifest{
+		NextID:         s.nextID,
+		Levels:         make([][]int, lsmMaxLevels),
+		FlushedVersion: s.flushedVersion,
+	}
+	for level, tables := range s.levels {
+		manifest.Levels[level] = []int{}
+		for _, t := range tables {
+			manifest.Levels[level] = append(manifest.Levels[level], t.id)
+		}
+	}
+
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := filepath.Join(s.dir, lsmManifestFile+".tmp")
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, filepath.Join(s.dir, lsmManifestFile)); err != nil {
+		return err
+	}
+	return syncDir(s.dir)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// removeOrphanTables deletes SSTables left behind by a flush or compaction that crashed
+// before the MANIFEST was updated.
+func (s *LSMStore) removeOrphanTables() error {
+	live := make(map[string]bool)
+	for _, tables := range s.levels {
+		for _, t := range tables {
+			live[filepath.Base(t.path)] = true
+		}
+	}
+
+	files, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		name := f.Name()
+		if strings.HasSuffix(name, ".sst") && !live[name] {
+			log.Println("Removing orphan SSTable:", name)
+			if err := os.Remove(filepath.Join(s.dir, name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// replayLog rebuilds the memtable from the memtable log.
+// A torn or corrupt record at the tail is the result of a crash mid-write, the log is truncated there.
+func (s *LSMStore) replayLog() error {
+	path := filepath.Join(s.dir, lsmMemtableLog)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	offset := 0
+	for offset < len(data) {
+		if len(data)-offset < logRecordHeader {
+			break
+		}
+		length := int(binary.LittleEndian.Uint32(data[offset:]))
+		checksum := binary.LittleEndian.Uint32(data[offset+4:])
+		if len(data)-offset-logRecordHeader < length {
+			break
+		}
+		payload := data[offset+logRecordHeader : offset+logRecordHeader+length]
+		if crc32.Checksum(payload, crcTable) != checksum {
+			break
+		}
+		records, err := decodeLogPayload(payload)
+		if err != nil {
+			break
+		}
+		for _, record := range records {
+			s.memtable.set(record.key, record.e)
+			s.memSize += recordSize(record.key, record.e)
+			// The log does not tell which version of the record was written last, every one counts as unflushed
+			s.noteUnflushed(record.e.version)
+			for _, h := range record.e.history {
+				s.noteUnflushed(h.version)
+			}
+		}
+		offset += logRecordHeader + length
+	}
+
+	if offset < len(data) {
+		log.Printf("Truncating memtable log at offset %d of %d", offset, len(data))
+		if err := os.Truncate(path, int64(offset)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// logRecord is a key and the entry written for it
+type logRecord struct {
+	key string
+	e   entry
+}
+
+// decodeLogPayload decodes the records logged together by one appendLog call
+func decodeLogPayload(payload []byte) ([]logRecord, error) {
+	count, n := binary.Uvarint(payload)
+	if n <= 0 || count > uint64(len(payload)) {
+		return nil, errCorruptRecord
+	}
+	payload = payload[n:]
+
+	records := make([]logRecord, 0, count)
+	for i := uint64(0); i < count; i++ {
+		key, e, n, err := decodeRecord(payload)
+		if err != nil {
+			return nil, err
+		}
+		payload = payload[n:]
+		records = append(records, logRecord{key: key, e: e})
+	}
+	return records, nil
+}
+
+// appendLog writes the records as a single checksummed log entry,
+// so that a batch is either replayed entirely or not at all.
+func (s *LSMStore) appendLog(records []logRecord) error {
+	payload := binary.AppendUvarint(nil, uint64(len(records)))
+	for _, record := range records {
+		payload = appendRecord(payload, record.key, record.e)
+	}
+
+	frame := make([]byte, logRecordHeader, logRecordHeader+len(payload))
+	binary.LittleEndian.PutUint32(frame, uint32(len(payload)))
+	binary.LittleEndian.PutUint32(frame[4:], crc32.Checksum(payload, crcTable))
+	frame = append(frame, payload...)
+
+	if _, err := s.log.Write(frame); err != nil {
+		return err
+	}
+	if s.options.SyncWrites {
+		return s.log.Sync()
+	}
+	return nil
+}
+
+// write logs and applies a single entry, the caller must hold the write lock
+func (s *LSMStore) write(key string, e entry) error {
+	return s.writeRecords([]logRecord{{key: key, e: e}})
+}
+
+// writeRecords logs and applies a group of entries, the caller must hold the write lock
+func (s *LSMStore) writeRecords(records []logRecord) error {
+	if s.closed {
+		return errStoreClosed
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	if err := s.appendLog(records); err != nil {
+		return err
+	}
+	for _, record := range records {
+		s.memtable.set(record.key, record.e)
+		s.memSize += recordSize(record.key, record.e)
+	}
+
+	if s.memSize >= s.options.MemtableSize {
+		return s.flush()
+	}
+	return nil
+}
+
+// flush writes the memtable to a new level 0 table and starts a fresh memtable log
+func (s *LSMStore) flush() error {
+	if s.memtable.len() == 0 {
+		return nil
+	}
+
+	id := s.nextID
+	s.nextID++
+	tw, err := newTableWriter(sstablePath(s.dir, id))
+	if err != nil {
+		return err
+	}
+	for node := s.memtable.first(); node != nil; node = node.next() {
+		if err := tw.add(node.key, node.value); err != nil {
+			tw.abort()
+			return err
+		}
+	}
+	if err := tw.finish(); err != nil {
+		return err
+	}
+	t, err := openSSTable(s.dir, id)
+	if err != nil {
+		return err
+	}
+
+	// Every write applied so far is in the tables once the manifest lists the new one.
+	// Writes arrive out of version order, only the versions every older one of which was written count as flushed.
+	s.levels[0] = append([]*sstable{t}, s.levels[0]...)
+	flushedVersion := s.flushedVersion
+	s.flushedVersion = max(s.flushedVersion, s.appliedVersion)
+	if err := s.saveManifest(); err != nil {
+		s.flushedVersion = flushedVersion
+		return err
+	}
+
+	// The memtable is now durable in the table, the log can start over
+	if err := s.log.Truncate(0); err != nil {
+		return err
+	}
+	if err := s.log.Sync(); err != nil {
+		return err
+	}
+	s.memtable = newSkiplist()
+	s.memSize = 0
+	s.unflushedMin = -1
+
+	return s.maybeCompact()
+}
+
+// noteUnflushed records that a write of version went to the memtable, the caller must hold the write lock
+func (s *LSMStore) noteUnflushed(version int) {
+	if s.unflushedMin < 0 || version < s.unflushedMin {
+		s.unflushedMin = version
+	}
+}
+
+// SetAppliedVersion tells the store that every WAL version up to version has been written to it,
+// apart from the ones that never will be. The next flush records it as flushed.
+// The store cannot tell a version still to come from one that will never be written, so nothing counts as flushed without it.
+func (s *LSMStore) SetAppliedVersion(version int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.appliedVersion = max(s.appliedVersion, version)
+}
+
+// FlushedVersion returns the highest WAL version that is in the SSTables along with every older one, -1 when none is.
+// The memtable log is not necessarily synced, so only flushed writes survive a crash for sure.
+// A write older than the last flush that is still in the memtable holds the version back.
+func (s *LSMStore) FlushedVersion() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.unflushedMin >= 0 && s.unflushedMin <= s.flushedVersion {
+		return s.unflushedMin - 1
+	}
+	return s.flushedVersion
+}
+
+// Flush forces the memtable to disk
+func (s *LSMStore) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return errStoreClosed
+	}
+	return s.flush()
+}
+
+// lookup finds the newest entry for key, including tombstones
+func (s *LSMStore) lookup(key string) (entry, bool, error) {
+	if e, ok := s.memtable.get(key); ok {
+		return e, true, nil
+	}
+
+	for _, t := range s.levels[0] {
+		e, ok, err := t.get(key)
+		if err != nil || ok {
+			return e, ok, err
+		}
+	}
+
+	for level := 1; level < lsmMaxLevels; level++ {
+		tables := s.levels[level]
+		i := sort.Search(len(tables), func(i int) bool {
+			return tables[i].largest >= key
+		})
+		if i == len(tables) {
+			continue
+		}
+		e, ok, err := tables[i].get(key)
+		if err != nil || ok {
+			return e, ok, err
+		}
+	}
+	return entry{}, false, nil
+}
+
+func (s *LSMStore) Get(key string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return nil, errStoreClosed
+	}
+	e, ok, err := s.lookup(key)
+	if err != nil {
+		return nil, err
+	}
+	if !ok || !e.visible(time.Now().UnixNano()) {
+		return nil, ErrKeyNotFound
+	}
+	return e.value, nil
+}
+
+func (s *LSMStore) GetVersioned(key string) (Versioned, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return Versioned{}, false, errStoreClosed
+	}
+	e, ok, err := s.lookup(key)
+	if err != nil {
+		return Versioned{}, false, err
+	}
+	if !ok || !e.visible(time.Now().UnixNano()) {
+		return Versioned{}, false, nil
+	}
+	return e.versioned(), true, nil
+}
+
+func (s *LSMStore) GetAt(key string, version int) (Versioned, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return Versioned{}, errStoreClosed
+	}
+	e, ok, err := s.lookup(key)
+	if err != nil {
+		return Versioned{}, err
+	}
+	if !ok {
+		return Versioned{}, ErrKeyNotFound
+	}
+	e, ok = e.at(version)
+	if !ok || !e.visible(time.Now().UnixNano()) {
+		return Versioned{}, ErrKeyNotFound
+	}
+	return e.versioned(), nil
+}
+
+// writeVersion stores a new version of key on top of its current chain,
+// the caller must hold the write lock
+func (s *LSMStore) writeVersion(key string, e entry) error {
+	if s.closed {
+		return errStoreClosed
+	}
+	old, ok, err := s.lookup(key)
+	if err != nil {
+		return err
+	}
+	s.noteUnflushed(e.version)
+	if !ok {
+		// Nothing to shadow, a tombstone would only waste space
+		if e.deleted {
+			return nil
+		}
+		return s.write(key, e)
+	}
+	e, _ = e.withPrevious(old).prune(s.horizon)
+	return s.write(key, e)
+}
+
+func (s *LSMStore) Put(key string, value []byte, contentType string, version int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.writeVersion(key, entry{value: bytes.Clone(value), contentType: contentType, version: version})
+}
+
+func (s *LSMStore) PutWithTTL(key string, value []byte, contentType string, version int, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.writeVersion(key, entry{value: bytes.Clone(value), contentType: contentType, version: version, expiresAt: expiresAt.UnixNano()})
+}
+
+func (s *LSMStore) Delete(key string, version int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.writeVersion(key, entry{deleted: true, version: version})
+}
+
+// WriteBatch logs the whole batch as one memtable log entry and then applies it,
+// a crash in between replays either all of the batch or none of it.
+func (s *LSMStore) WriteBatch(ops []BatchOp) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return errStoreClosed
+	}
+
+	// Later operations on the same key build on the earlier ones in the batch
+	pending := make(map[string]entry)
+	var records []logRecord
+	for _, op := range ops {
+		e := batchEntry(op)
+		old, ok := pending[op.Key]
+		if !ok {
+			var err error
+			old, ok, err = s.lookup(op.Key)
+			if err != nil {
+				return err
+			}
+		}
+		if ok {
+			e, _ = e.withPrevious(old).prune(s.horizon)
+		} else if e.deleted {
+			continue
+		}
+		pending[op.Key] = e
+		records = append(records, logRecord{key: op.Key, e: e})
+		s.noteUnflushed(op.Version)
+	}
+	return s.writeRecords(records)
+}
+
+// PruneVersions moves the retention horizon forward and trims the memtable.
+// Versions already on disk are trimmed when compaction rewrites their tables.
+func (s *LSMStore) PruneVersions(horizon int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed || horizon <= s.horizon {
+		return 0
+	}
+	s.horizon = horizon
+
+	dropped := 0
+	for node := s.memtable.first(); node != nil; node = node.next() {
+		pruned, n := node.value.prune(horizon)
+		node.value = pruned
+		dropped += n
+	}
+	return dropped
+}
+
+// DeleteExpired replaces expired memtable entries with tombstones.
+// Expired entries that already reached an SSTable are hidden from reads and dropped by compaction
+// once DeleteExpired has been called with an instant past their deadline.
+func (s *LSMStore) DeleteExpired(now time.Time) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+
+	deadline := now.UnixNano()
+	s.expiryDeadline = max(s.expiryDeadline, deadline)
+	var expiredKeys []string
+	for node := s.memtable.first(); node != nil; node = node.next() {
+		if !node.value.deleted && node.value.expired(deadline) {
+			expiredKeys = append(expiredKeys, node.key)
+		}
+	}
+	for i, key := range expiredKeys {
+		expired, _ := s.memtable.get(key)
+		// The tombstone keeps the expired value's version so that reads as of older versions still work
+		tombstone := expired
+		tombstone.deleted = true
+		tombstone.value = nil
+		if err := s.write(key, tombstone); err != nil {
+			log.Println("Failed to delete expired key from LSM store:", err)
+			return expiredKeys[:i]
+		}
+	}
+	return expiredKeys
+}
+
+// newIterator merges the memtable and every table that may hold keys in [start, end)
+func (s *LSMStore) newIterator(start string, end string) *mergeIterator {
+	sources := []iterator{s.memtable.iterator()}
+	for _, tables := range s.levels {
+		for _, t := range tables {
+			if t.overlaps(start, end) {
+				sources = append(sources, t.iterator())
+			}
+		}
+	}
+	return newMergeIterator(sources)
+}
+
+func (s *LSMStore) Scan(start string, end string, limit int) ([]KVPair, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return nil, errStoreClosed
+	}
+
+	now := time.Now().UnixNano()
+	var pairs []KVPair
+	it := s.newIterator(start, end)
+	for it.seek(start); it.valid(); it.next() {
+		if end != "" && it.key() >= end {
+			break
+		}
+		if limit > 0 && len(pairs) >= limit {
+			break
+		}
+		e := it.value()
+		if !e.visible(now) {
+			continue
+		}
+		pairs = append(pairs, KVPair{Key: it.key(), Value: e.value, ContentType: e.contentType})
+	}
+	if err := it.err(); err != nil {
+		return nil, err
+	}
+	return pairs, nil
+}
+
+// ScanAt returns the keys in [start, end) as they were right after the write with the given version,
+// with expiry judged at the given time
+func (s *LSMStore) ScanAt(start string, end string, version int, at time.Time, limit int) ([]KVPair, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return nil, errStoreClosed
+	}
+
+	now := at.UnixNano()
+	var pairs []KVPair
+	it := s.newIterator(start, end)
+	for it.seek(start); it.valid(); it.next() {
+		if end != "" && it.key() >= end {
+			break
+		}
+		if limit > 0 && len(pairs) >= limit {
+			break
+		}
+		e, ok := it.value().at(version)
+		if !ok || !e.visible(now) {
+			continue
+		}
+		pairs = append(pairs, KVPair{Key: it.key(), Value: e.value, ContentType: e.contentType})
+	}
+	if err := it.err(); err != nil {
+		return nil, err
+	}
+	return pairs, nil
+}
+
+func (s *LSMStore) ScanPrefix(prefix string) ([]KVPair, error) {
+	return s.Scan(prefix, PrefixEnd(prefix), 0)
+}
+
+func (s *LSMStore) closeTables() {
+	for _, tables := range s.levels {
+		for _, t := range tables {
+			t.close()
+		}
+	}
+}
+
+// Close syncs the memtable log and releases every open file.
+// The memtable is not flushed, it is rebuilt from the log on the next open.
+func (s *LSMStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	err := s.log.Sync()
+	if closeErr := s.log.Close(); err == nil {
+		err = closeErr
+	}
+	s.closeTables()
+	return err
+}
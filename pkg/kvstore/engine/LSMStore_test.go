@@ -0,0 +1,444 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// smallLSMOptions forces frequent flushes and compactions
+func smallLSMOptions() LSMOptions {
+	return LSMOptions{
+		MemtableSize:        1 << 10,
+		L0CompactionTrigger: 2,
+		TableFileSize:       2 << 10,
+		BaseLevelSize:       4 << 10,
+	}
+}
+
+func openTestLSM(t *testing.T, dir string, options LSMOptions) *LSMStore {
+	t.Helper()
+	s, err := OpenLSMStore(dir, options)
+	if err != nil {
+		t.Fatalf("OpenLSMStore failed: %v", err)
+	}
+	return s
+}
+
+// expectValue checks the value of key, an empty want means the key must be missing
+func expectValue(t *testing.T, s IKVStore, key string, want string) {
+	t.Helper()
+	value, err := s.Get(key)
+	if want == "" {
+		if !errors.Is(err, ErrKeyNotFound) {
+			t.Fatalf("Get(%s) = %q, %v; want ErrKeyNotFound", key, value, err)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatalf("Get(%s) failed: %v", key, err)
+	}
+	if string(value) != want {
+		t.Fatalf("Get(%s) = %q; want %q", key, value, want)
+	}
+}
+
+func TestLSMStoreGetPutDelete(t *testing.T) {
+	s := openTestLSM(t, t.TempDir(), DefaultLSMOptions())
+	defer s.Close()
+
+	s.Put("a", []byte("1"), "", 1)
+	s.Put("b", []byte("2"), "", 2)
+	s.Put("a", []byte("3"), "", 3)
+	if err := s.Delete("b", 4); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+
+	expectValue(t, s, "a", "3")
+	expectValue(t, s, "b", "")
+	expectValue(t, s, "missing", "")
+}
+
+func TestLSMStoreDeleteReportsWriteFailures(t *testing.T) {
+	s := openTestLSM(t, t.TempDir(), DefaultLSMOptions())
+	s.Put("a", []byte("1"), "", 1)
+	s.Close()
+
+	if err := s.Delete("a", 2); !errors.Is(err, errStoreClosed) {
+		t.Fatalf("Delete on a closed store = %v; want errStoreClosed", err)
+	}
+}
+
+func TestLSMStoreRecoversMemtableAfterCrash(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestLSM(t, dir, DefaultLSMOptions())
+	s.Put("a", []byte("1"), "", 1)
+	s.Put("b", []byte("2"), "", 2)
+	s.Delete("a", 3)
+	s.PutWithTTL("c", []byte("3"), "", 4, time.Now().Add(time.Hour))
+	// Simulate a crash: the store is abandoned without Close or Flush
+
+	recovered := openTestLSM(t, dir, DefaultLSMOptions())
+	defer recovered.Close()
+
+	expectValue(t, recovered, "a", "")
+	expectValue(t, recovered, "b", "2")
+	expectValue(t, recovered, "c", "3")
+}
+
+func TestLSMStoreTruncatesTornLogTail(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestLSM(t, dir, DefaultLSMOptions())
+	s.Put("a", []byte("1"), "", 0)
+	s.Put("b", []byte("2"), "", 0)
+	s.Close()
+
+	logPath := filepath.Join(dir, lsmMemtableLog)
+	info, err := os.Stat(logPath)
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	// Cut the last record in half as if the process died mid-write
+	if err := os.Truncate(logPath, info.Size()-3); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+
+	recovered := openTestLSM(t, dir, DefaultLSMOptions())
+	expectValue(t, recovered, "a", "1")
+	expectValue(t, recovered, "b", "")
+
+	// New writes after recovery must land after the last good record
+	recovered.Put("c", []byte("3"), "", 0)
+	recovered.Close()
+
+	reopened := openTestLSM(t, dir, DefaultLSMOptions())
+	defer reopened.Close()
+	expectValue(t, reopened, "a", "1")
+	expectValue(t, reopened, "c", "3")
+}
+
+func TestLSMStoreIgnoresCorruptLogRecord(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestLSM(t, dir, DefaultLSMOptions())
+	s.Put("a", []byte("1"), "", 0)
+	s.Put("b", []byte("2"), "", 0)
+	s.Close()
+
+	logPath := filepath.Join(dir, lsmMemtableLog)
+	data, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	// Flip a byte in the payload of the last record
+	data[len(data)-1] ^= 0xff
+	if err := os.WriteFile(logPath, data, 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	recovered := openTestLSM(t, dir, DefaultLSMOptions())
+	defer recovered.Close()
+	expectValue(t, recovered, "a", "1")
+	expectValue(t, recovered, "b", "")
+}
+
+func TestLSMStoreRecoversAfterFlushAndCompaction(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestLSM(t, dir, smallLSMOptions())
+
+	const keys = 500
+	version := 0
+	for round := 0; round < 3; round++ {
+		for i := 0; i < keys; i++ {
+			version++
+			if err := s.Put(fmt.Sprintf("key-%04d", i), []byte(fmt.Sprintf("value-%d-%d", round, i)), "", version); err != nil {
+				t.Fatalf("Put failed: %v", err)
+			}
+		}
+		// Keep only the versions written in the current round
+		s.PruneVersions(version - keys)
+	}
+	for i := 0; i < keys; i += 3 {
+		version++
+		s.Delete(fmt.Sprintf("key-%04d", i), version)
+	}
+
+	deeper := 0
+	for level := 1; level < lsmMaxLevels; level++ {
+		deeper += len(s.levels[level])
+	}
+	if deeper == 0 {
+		t.Fatalf("expected compaction to move tables below level 0")
+	}
+	// Crash without closing, part of the data is still only in the memtable log
+
+	recovered := openTestLSM(t, dir, smallLSMOptions())
+	defer recovered.Close()
+	for i := 0; i < keys; i++ {
+		want := fmt.Sprintf("value-2-%d", i)
+		if i%3 == 0 {
+			want = ""
+		}
+		expectValue(t, recovered, fmt.Sprintf("key-%04d", i), want)
+	}
+
+	pairs, err := recovered.ScanPrefix("key-00")
+	if err != nil {
+		t.Fatalf("ScanPrefix failed: %v", err)
+	}
+	var got []string
+	for _, pair := range pairs {
+		got = append(got, pair.Key)
+	}
+	var want []string
+	for i := 0; i < 100; i++ {
+		if i%3 != 0 {
+			want = append(want, fmt.Sprintf("key-%04d", i))
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("ScanPrefix(key-00) = %v; want %v", got, want)
+	}
+}
+
+func TestLSMStoreRemovesOrphanTables(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestLSM(t, dir, DefaultLSMOptions())
+	s.Put("a", []byte("1"), "", 0)
+	if err := s.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	s.Close()
+
+	// A table written by a flush that crashed before the MANIFEST was updated
+	orphan := sstablePath(dir, 99)
+	if err := os.WriteFile(orphan, []byte("partial table"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	recovered := openTestLSM(t, dir, DefaultLSMOptions())
+	defer recovered.Close()
+	expectValue(t, recovered, "a", "1")
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Fatalf("orphan table was not removed")
+	}
+}
+
+func TestLSMStoreFlushedVersion(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestLSM(t, dir, DefaultLSMOptions())
+	s.Put("a", []byte("1"), "", 1)
+	s.Put("b", []byte("2"), "", 3)
+	s.SetAppliedVersion(1)
+
+	// The memtable log is not synced, nothing is durable before a flush
+	if version := s.FlushedVersion(); version != -1 {
+		t.Fatalf("FlushedVersion before a flush = %d; want -1", version)
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	// 2 has not been written yet, 3 does not count as flushed
+	if version := s.FlushedVersion(); version != 1 {
+		t.Fatalf("FlushedVersion = %d; want 1", version)
+	}
+
+	s.Put("c", []byte("3"), "", 2)
+	s.SetAppliedVersion(3)
+	if version := s.FlushedVersion(); version != 1 {
+		t.Fatalf("FlushedVersion before flushing 2 = %d; want 1", version)
+	}
+	s.Flush()
+	if version := s.FlushedVersion(); version != 3 {
+		t.Fatalf("FlushedVersion = %d; want 3", version)
+	}
+
+	// A write older than the flush holds the version back until it is flushed too
+	s.Put("d", []byte("4"), "", 2)
+	if version := s.FlushedVersion(); version != 1 {
+		t.Fatalf("FlushedVersion with a late write = %d; want 1", version)
+	}
+	s.Put("e", []byte("5"), "", 5)
+	s.SetAppliedVersion(5)
+	s.Flush()
+	s.Close()
+
+	s = openTestLSM(t, dir, DefaultLSMOptions())
+	defer s.Close()
+	if version := s.FlushedVersion(); version != 5 {
+		t.Fatalf("FlushedVersion after reopening = %d; want 5", version)
+	}
+}
+
+func TestLSMStoreTTL(t *testing.T) {
+	s := openTestLSM(t, t.TempDir(), smallLSMOptions())
+	defer s.Close()
+
+	now := time.Now()
+	s.Put("expired", []byte("old"), "", 1)
+	s.Flush()
+	s.PutWithTTL("expired", []byte("1"), "", 2, now.Add(-time.Second))
+	s.PutWithTTL("live", []byte("2"), "", 3, now.Add(time.Hour))
+
+	expectValue(t, s, "expired", "")
+	expectValue(t, s, "live", "2")
+	if removed := s.DeleteExpired(now); !reflect.DeepEqual(removed, []string{"expired"}) {
+		t.Fatalf("DeleteExpired removed %q; want [expired]", removed)
+	}
+	// The tombstone must keep shadowing the older flushed value
+	s.Flush()
+	expectValue(t, s, "expired", "")
+}
+
+func TestLSMStoreCompactionKeepsEntriesExpiredAfterTheDeadline(t *testing.T) {
+	s := openTestLSM(t, t.TempDir(), smallLSMOptions())
+	defer s.Close()
+
+	// An open snapshot taken a minute ago still sees the key, the sweeper holds its deadline back to it
+	now := time.Now()
+	snapshotAt := now.Add(-time.Minute)
+	s.PutWithTTL("a", []byte("1"), "", 1, now.Add(-time.Second))
+	s.DeleteExpired(snapshotAt)
+	s.Flush()
+	s.mu.Lock()
+	err := s.compact(0)
+	s.mu.Unlock()
+	if err != nil {
+		t.Fatalf("compact failed: %v", err)
+	}
+
+	pairs, err := s.ScanAt("", "", 1, snapshotAt, 0)
+	if err != nil || len(pairs) != 1 || string(pairs[0].Value) != "1" {
+		t.Fatalf("ScanAt as of the snapshot = %v, %v; want a=1", pairs, err)
+	}
+	expectValue(t, s, "a", "")
+
+	// Once the snapshot is gone the deadline moves past the expiry and compaction drops the key
+	s.DeleteExpired(now)
+	s.mu.Lock()
+	err = s.compact(1)
+	s.mu.Unlock()
+	if err != nil {
+		t.Fatalf("compact failed: %v", err)
+	}
+	for level, tables := range s.levels {
+		if len(tables) > 0 {
+			t.Fatalf("level %d still holds %d tables; want the expired key dropped", level, len(tables))
+		}
+	}
+}
+
+func TestBloomFilter(t *testing.T) {
+	bloom := newBloomFilter(1000, bloomBitsPerKey)
+	for i := 0; i < 1000; i++ {
+		bloom.add(fmt.Sprintf("key-%d", i))
+	}
+	for i := 0; i < 1000; i++ {
+		if !bloom.mayContain(fmt.Sprintf("key-%d", i)) {
+			t.Fatalf("bloom filter lost key-%d", i)
+		}
+	}
+
+	falsePositives := 0
+	for i := 0; i < 1000; i++ {
+		if bloom.mayContain(fmt.Sprintf("other-%d", i)) {
+			falsePositives++
+		}
+	}
+	if falsePositives > 50 {
+		t.Fatalf("too many false positives: %d/1000", falsePositives)
+	}
+}
+
+func TestLSMStoreGetAt(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestLSM(t, dir, DefaultLSMOptions())
+	s.Put("a", []byte("1"), "", 1)
+	s.Put("a", []byte("2"), "", 3)
+	s.Flush()
+	s.Delete("a", 5)
+	s.Put("a", []byte("3"), "", 7)
+	s.Close()
+
+	// History has to survive both the flush and the memtable log replay
+	reopened := openTestLSM(t, dir, DefaultLSMOptions())
+	defer reopened.Close()
+
+	cases := map[int]string{0: "", 1: "1", 2: "1", 3: "2", 5: "", 6: "", 7: "3", 100: "3"}
+	for version, want := range cases {
+		current, err := reopened.GetAt("a", version)
+		if want == "" && !errors.Is(err, ErrKeyNotFound) || want != "" && (err != nil || string(current.Value) != want) {
+			t.Fatalf("GetAt(a, %d) = %q, %v; want %q", version, current.Value, err, want)
+		}
+	}
+
+	reopened.PruneVersions(4)
+	reopened.Put("a", []byte("4"), "", 9)
+	if current, _ := reopened.GetAt("a", 4); string(current.Value) != "2" {
+		t.Fatalf("GetAt(a, 4) after prune = %q; want %q", current.Value, "2")
+	}
+	if _, err := reopened.GetAt("a", 1); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("GetAt(a, 1) after prune = %v; want it to be dropped", err)
+	}
+}
+
+func TestLSMStoreBatchIsReplayedAtomically(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestLSM(t, dir, DefaultLSMOptions())
+	s.Put("a", []byte("1"), "", 1)
+	s.WriteBatch([]BatchOp{
+		{Key: "a", Value: []byte("2"), Version: 2},
+		{Key: "b", Value: []byte("2"), Version: 2},
+	})
+	s.WriteBatch([]BatchOp{
+		{Key: "a", Delete: true, Version: 3},
+		{Key: "c", Value: []byte("3"), Version: 3},
+	})
+	s.Close()
+
+	// Tear the last batch, none of it may come back
+	logPath := filepath.Join(dir, lsmMemtableLog)
+	info, _ := os.Stat(logPath)
+	os.Truncate(logPath, info.Size()-1)
+
+	recovered := openTestLSM(t, dir, DefaultLSMOptions())
+	defer recovered.Close()
+	expectValue(t, recovered, "a", "2")
+	expectValue(t, recovered, "b", "2")
+	expectValue(t, recovered, "c", "")
+}
+
+func TestLSMStoreKeepsBinaryValuesAndContentType(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestLSM(t, dir, DefaultLSMOptions())
+	value := []byte{0x00, 0xff, '\n', 0x80, 0x00}
+	s.Put("blob", value, "application/x-protobuf", 1)
+	// Writing into the caller's buffer must not change the stored value
+	value[0] = 0x01
+
+	check := func(s *LSMStore) {
+		t.Helper()
+		current, exists, err := s.GetVersioned("blob")
+		if err != nil || !exists {
+			t.Fatalf("GetVersioned(blob) = %v, %v; want the value", exists, err)
+		}
+		if !reflect.DeepEqual(current.Value, []byte{0x00, 0xff, '\n', 0x80, 0x00}) {
+			t.Fatalf("GetVersioned(blob) value = %v", current.Value)
+		}
+		if current.ContentType != "application/x-protobuf" {
+			t.Fatalf("GetVersioned(blob) content type = %q; want %q", current.ContentType, "application/x-protobuf")
+		}
+	}
+	check(s)
+	if err := s.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	s.Close()
+
+	recovered := openTestLSM(t, dir, DefaultLSMOptions())
+	defer recovered.Close()
+	check(recovered)
+}
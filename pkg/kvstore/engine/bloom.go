@@ -0,0 +1,75 @@
+package engine
+
+import (
+	"errors"
+	"hash/fnv"
+)
+
+// bloomFilter answers "definitely not present" for keys that were never added to an SSTable,
+// which lets point lookups skip tables without touching the disk.
+type bloomFilter struct {
+	bits []byte
+	k    uint8
+}
+
+func newBloomFilter(keyCount int, bitsPerKey int) *bloomFilter {
+	nbits := keyCount * bitsPerKey
+	if nbits < 64 {
+		nbits = 64
+	}
+	// k = bitsPerKey * ln(2) gives the lowest false positive rate
+	k := uint8(float64(bitsPerKey) * 0.69)
+	if k < 1 {
+		k = 1
+	}
+	if k > 30 {
+		k = 30
+	}
+	return &bloomFilter{
+		bits: make([]byte, (nbits+7)/8),
+		k:    k,
+	}
+}
+
+// bloomHash splits a 64 bit hash into the two halves used for double hashing
+func bloomHash(key string) (uint32, uint32) {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	return uint32(sum), uint32(sum >> 32)
+}
+
+func (b *bloomFilter) add(key string) {
+	nbits := uint32(len(b.bits) * 8)
+	h1, h2 := bloomHash(key)
+	for i := uint32(0); i < uint32(b.k); i++ {
+		bit := (h1 + i*h2) % nbits
+		b.bits[bit/8] |= 1 << (bit % 8)
+	}
+}
+
+func (b *bloomFilter) mayContain(key string) bool {
+	nbits := uint32(len(b.bits) * 8)
+	h1, h2 := bloomHash(key)
+	for i := uint32(0); i < uint32(b.k); i++ {
+		bit := (h1 + i*h2) % nbits
+		if b.bits[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *bloomFilter) encode() []byte {
+	return append([]byte{b.k}, b.bits...)
+}
+
+func decodeBloomFilter(data []byte) (*bloomFilter, error) {
+	if len(data) < 2 {
+		return nil, errors.New("bloom filter too short")
+	}
+	return &bloomFilter{
+		bits: data[1:],
+		k:    data[0],
+	}, nil
+}
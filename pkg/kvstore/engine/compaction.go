@@ -0,0 +1,220 @@
+package engine
+
+import (
+	"log"
+	"os"
+	"sort"
+)
+
+// maxLevelSize is the size budget of a level, every level is ten times larger than the previous one
+func (s *LSMStore) maxLevelSize(level int) int64 {
+	size := s.options.BaseLevelSize
+	for i := 1; i < level; i++ {
+		size *= 10
+	}
+	return size
+}
+
+func levelSize(tables []*sstable) int64 {
+	var size int64
+	for _, t := range tables {
+		size += t.size
+	}
+	return size
+}
+
+// pickCompactionLevel returns the level that needs to be compacted, or -1 if none
+func (s *LSMStore) pickCompactionLevel() int {
+	if len(s.levels[0]) >= s.options.L0CompactionTrigger {
+		return 0
+	}
+	for level := 1; level < lsmMaxLevels-1; level++ {
+		if levelSize(s.levels[level]) > s.maxLevelSize(level) {
+			return level
+		}
+	}
+	return -1
+}
+
+func (s *LSMStore) maybeCompact() error {
+	for {
+		level := s.pickCompactionLevel()
+		if level < 0 {
+			return nil
+		}
+		if err := s.compact(level); err != nil {
+			return err
+		}
+	}
+}
+
+// isBottomLevel reports whether no level below holds any data,
+// in which case tombstones and expired entries can be dropped for good.
+func (s *LSMStore) isBottomLevel(level int) bool {
+	for l := level + 1; l < lsmMaxLevels; l++ {
+		if len(s.levels[l]) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// compact merges tables from level into level+1.
+// Level 0 tables overlap each other so all of them are merged at once,
+// on deeper levels a single table is picked in round-robin key order.
+func (s *LSMStore) compact(level int) error {
+	var inputs []*sstable
+	if level == 0 {
+		inputs = append(inputs, s.levels[0]...)
+	} else {
+		tables := s.levels[level]
+		pick := 0
+		for i, t := range tables {
+			if t.smallest > s.compactPointers[level] {
+				pick = i
+				break
+			}
+		}
+		inputs = append(inputs, tables[pick])
+		s.compactPointers[level] = tables[pick].largest
+	}
+
+	smallest, largest := inputs[0].smallest, inputs[0].largest
+	for _, t := range inputs[1:] {
+		smallest = min(smallest, t.smallest)
+		largest = max(largest, t.largest)
+	}
+
+	// Tables of the next level that overlap the inputs take part in the merge
+	var overlapping, untouched []*sstable
+	for _, t := range s.levels[level+1] {
+		if t.overlaps(smallest, largest) {
+			overlapping = append(overlapping, t)
+		} else {
+			untouched = append(untouched, t)
+		}
+	}
+
+	// Inputs are newer than the next level, so they come first in the merge
+	var sources []iterator
+	for _, t := range inputs {
+		sources = append(sources, t.iterator())
+	}
+	for _, t := range overlapping {
+		sources = append(sources, t.iterator())
+	}
+
+	outputs, err := s.writeCompactionOutputs(newMergeIterator(sources), s.isBottomLevel(level+1))
+	if err != nil {
+		return err
+	}
+
+	// Swap the tables in and persist the new layout before removing the inputs
+	next := append(untouched, outputs...)
+	sort.Slice(next, func(i, j int) bool {
+		return next[i].smallest < next[j].smallest
+	})
+	s.levels[level+1] = next
+	s.levels[level] = removeTables(s.levels[level], inputs)
+	if err := s.saveManifest(); err != nil {
+		return err
+	}
+
+	log.Printf("Compacted %d tables from level %d into %d tables on level %d", len(inputs)+len(overlapping), level, len(outputs), level+1)
+	for _, t := range append(inputs, overlapping...) {
+		t.close()
+		if err := os.Remove(t.path); err != nil {
+			log.Println("Failed to remove compacted SSTable:", err)
+		}
+	}
+	return nil
+}
+
+// writeCompactionOutputs writes the merged stream into tables of roughly TableFileSize bytes
+func (s *LSMStore) writeCompactionOutputs(it *mergeIterator, bottom bool) ([]*sstable, error) {
+	var outputs []*sstable
+	var tw *tableWriter
+	var id int
+
+	finishTable := func() error {
+		if err := tw.finish(); err != nil {
+			return err
+		}
+		t, err := openSSTable(s.dir, id)
+		if err != nil {
+			return err
+		}
+		outputs = append(outputs, t)
+		tw = nil
+		return nil
+	}
+
+	abortAll := func() {
+		if tw != nil {
+			tw.abort()
+		}
+		for _, t := range outputs {
+			t.close()
+			os.Remove(t.path)
+		}
+	}
+
+	for it.seek(""); it.valid(); it.next() {
+		e := it.value()
+		if !e.deleted && e.expired(s.expiryDeadline) {
+			// An expired value still has to shadow older versions further down
+			e.deleted = true
+			e.value = nil
+		}
+		e, _ = e.prune(s.horizon)
+		if bottom && e.removable() {
+			continue
+		}
+
+		if tw == nil {
+			id = s.nextID
+			s.nextID++
+			var err error
+			tw, err = newTableWriter(sstablePath(s.dir, id))
+			if err != nil {
+				abortAll()
+				return nil, err
+			}
+		}
+		if err := tw.add(it.key(), e); err != nil {
+			abortAll()
+			return nil, err
+		}
+		if tw.offset >= s.options.TableFileSize {
+			if err := finishTable(); err != nil {
+				abortAll()
+				return nil, err
+			}
+		}
+	}
+	if err := it.err(); err != nil {
+		abortAll()
+		return nil, err
+	}
+	if tw != nil {
+		if err := finishTable(); err != nil {
+			abortAll()
+			return nil, err
+		}
+	}
+	return outputs, nil
+}
+
+func removeTables(tables []*sstable, removed []*sstable) []*sstable {
+	drop := make(map[int]bool)
+	for _, t := range removed {
+		drop[t.id] = true
+	}
+	var kept []*sstable
+	for _, t := range tables {
+		if !drop[t.id] {
+			kept = append(kept, t)
+		}
+	}
+	return kept
+}
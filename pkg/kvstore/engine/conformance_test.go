@@ -0,0 +1,28 @@
+package engine_test
+
+import (
+	"kvstore/pkg/kvstore/engine"
+	"kvstore/pkg/kvstore/kvstoretest"
+	"testing"
+)
+
+func TestInMemStoreConformance(t *testing.T) {
+	kvstoretest.Run(t, func(t *testing.T) engine.IKVStore {
+		return engine.NewShardedInMemStore(4)
+	})
+}
+
+func TestLSMStoreConformance(t *testing.T) {
+	kvstoretest.Run(t, func(t *testing.T) engine.IKVStore {
+		// Small enough that the suite goes through flushes and compactions, large enough to run quickly
+		options := engine.DefaultLSMOptions()
+		options.MemtableSize = 256 << 10
+		options.TableFileSize = 128 << 10
+		options.BaseLevelSize = 1 << 20
+		s, err := engine.OpenLSMStore(t.TempDir(), options)
+		if err != nil {
+			t.Fatalf("OpenLSMStore failed: %v", err)
+		}
+		return s
+	})
+}
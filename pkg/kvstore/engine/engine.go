@@ -0,0 +1,85 @@
+// Package engine holds the storage engines of the store: the sharded in-memory engine and the LSM engine,
+// along with the interface they implement. It knows nothing about the WAL or the cluster,
+// the server wraps the engines in internal/kv and applications can use them directly.
+package engine
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrKeyNotFound is returned by reads of a key that does not exist, or did not at the version asked for.
+// An empty value is a value: it is returned as found, with a zero length.
+var ErrKeyNotFound = errors.New("key not found")
+
+// IKVStore is the storage engine interface, every engine of the store implements it.
+// A new engine proves it behaves like the others by passing kvstoretest.Run.
+//
+// Versions are WAL versions: every write carries the version of the entry that produced it,
+// and the older versions of a key stay readable through GetAt until PruneVersions drops them.
+// Get and GetAt fail with ErrKeyNotFound for a missing key, GetVersioned reports it with its found flag.
+// Values passed to the store are copied, values returned by it are shared and must not be modified.
+type IKVStore interface {
+	Get(key string) ([]byte, error)
+	GetVersioned(key string) (Versioned, bool, error)
+	// GetAt returns the value the key had right after the write with the given version
+	GetAt(key string, version int) (Versioned, error)
+	Put(key string, value []byte, contentType string, version int) error
+	// PutWithTTL stores a value that stops being visible at expiresAt
+	PutWithTTL(key string, value []byte, contentType string, version int, expiresAt time.Time) error
+	// Delete writes a tombstone version, reads as of older versions still see the old value
+	Delete(key string, version int) error
+	// WriteBatch applies every operation of the batch or none of them
+	WriteBatch(ops []BatchOp) error
+	// DeleteExpired reclaims the keys whose deadline is at or before now and returns the removed keys.
+	// Keys that expire after now must stay readable to scans at instants before their deadline.
+	DeleteExpired(now time.Time) []string
+	// PruneVersions drops the versions that are no longer visible at horizon and returns how many were dropped
+	PruneVersions(horizon int) int
+	// Scan returns the live keys in [start, end) in ascending order.
+	// An empty end means the scan runs to the end of the keyspace, a limit <= 0 means no limit.
+	Scan(start string, end string, limit int) ([]KVPair, error)
+	// ScanAt is Scan as of a version, with expiry judged at the given time
+	ScanAt(start string, end string, version int, at time.Time, limit int) ([]KVPair, error)
+	ScanPrefix(prefix string) ([]KVPair, error)
+	Close() error
+}
+
+// Versioned is a value together with its content type and the WAL version of the write that produced it
+type Versioned struct {
+	Value       []byte `json:"value"`
+	ContentType string `json:"content_type,omitempty"`
+	Version     int    `json:"version"`
+	// ExpiresAt is the expiry deadline in unix nanoseconds, 0 means the value never expires
+	ExpiresAt int64 `json:"expires_at,omitempty"`
+}
+
+type KVPair struct {
+	Key         string `json:"key"`
+	Value       []byte `json:"value"`
+	ContentType string `json:"content_type,omitempty"`
+}
+
+// BatchOp is a single write of a batch that is applied atomically
+type BatchOp struct {
+	Key         string
+	Value       []byte
+	ContentType string
+	Version     int
+	// ExpiresAt is zero for keys that never expire
+	ExpiresAt time.Time
+	Delete    bool
+}
+
+// PrefixEnd returns the smallest key that is greater than every key starting with prefix.
+// An empty result means there is no upper bound.
+func PrefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
@@ -0,0 +1,122 @@
+package engine
+
+import "bytes"
+
+// entry is the newest version of a key along with the older versions still within the retention window.
+// An expiresAt of 0 means the value never expires.
+// Deleted entries are tombstones, they are kept around while older versions or older SSTables need shadowing.
+type entry struct {
+	value       []byte
+	contentType string
+	expiresAt   int64
+	deleted     bool
+	// version is the WAL version of the write that produced this value
+	version int
+	// history holds the older versions, newest first, without their own history
+	history []entry
+}
+
+// batchEntry turns a batch operation into the entry the engines store
+func batchEntry(op BatchOp) entry {
+	e := entry{value: bytes.Clone(op.Value), contentType: op.ContentType, version: op.Version, deleted: op.Delete}
+	if !op.ExpiresAt.IsZero() {
+		e.expiresAt = op.ExpiresAt.UnixNano()
+	}
+	return e
+}
+
+func (e entry) expired(now int64) bool {
+	return e.expiresAt != 0 && e.expiresAt <= now
+}
+
+// visible reports whether a read at now should see the value
+func (e entry) visible(now int64) bool {
+	return !e.deleted && !e.expired(now)
+}
+
+// versioned returns the value of the entry as readers see it
+func (e entry) versioned() Versioned {
+	return Versioned{Value: e.value, ContentType: e.contentType, Version: e.version, ExpiresAt: e.expiresAt}
+}
+
+// withPrevious returns the entry of a key once e is written over old, its current entry.
+// e normally becomes the current version with old pushed onto its history. A replica may receive
+// writes out of order though, an e older than old then goes into the history at its place.
+func (e entry) withPrevious(old entry) entry {
+	if e.version < old.version {
+		return old.withOlder(e)
+	}
+	history := make([]entry, 0, len(old.history)+1)
+	previous := old
+	previous.history = nil
+	history = append(history, previous)
+	history = append(history, old.history...)
+	e.history = history
+	return e
+}
+
+// withOlder inserts e, which is older than the current version, into the history in version order.
+// A version that is already there is replaced.
+func (cur entry) withOlder(e entry) entry {
+	e.history = nil
+	history := make([]entry, 0, len(cur.history)+1)
+	inserted := false
+	for _, h := range cur.history {
+		if !inserted && e.version >= h.version {
+			history = append(history, e)
+			inserted = true
+			if e.version == h.version {
+				continue
+			}
+		}
+		history = append(history, h)
+	}
+	if !inserted {
+		history = append(history, e)
+	}
+	cur.history = history
+	return cur
+}
+
+// at returns the newest version written at or before version
+func (e entry) at(version int) (entry, bool) {
+	if e.version <= version {
+		e.history = nil
+		return e, true
+	}
+	for _, h := range e.history {
+		if h.version <= version {
+			return h, true
+		}
+	}
+	return entry{}, false
+}
+
+// prune drops the versions that can no longer be read once nothing older than horizon is served.
+// The newest version at or below the horizon is still visible at the horizon, so it is kept
+// unless it is a tombstone, which reads the same as having no version at all.
+func (e entry) prune(horizon int) (entry, int) {
+	if e.version <= horizon {
+		dropped := len(e.history)
+		e.history = nil
+		return e, dropped
+	}
+	for i, h := range e.history {
+		if h.version <= horizon {
+			keep := i + 1
+			if h.deleted {
+				keep = i
+			}
+			dropped := len(e.history) - keep
+			e.history = append([]entry(nil), e.history[:keep]...)
+			return e, dropped
+		}
+	}
+	return e, 0
+}
+
+// removable reports whether an entry carries no information at all and can be forgotten,
+// a tombstone without history reads as missing at every version.
+func (e entry) removable() bool {
+	return e.deleted && len(e.history) == 0
+}
@@ -0,0 +1,89 @@
+package engine
+
+// iterator walks keys in ascending order.
+// A new iterator is not positioned, call seek before reading from it.
+type iterator interface {
+	valid() bool
+	key() string
+	value() entry
+	next()
+	seek(key string)
+	err() error
+}
+
+type skiplistIterator struct {
+	sl   *skiplist
+	node *skiplistNode
+}
+
+func (sl *skiplist) iterator() *skiplistIterator {
+	return &skiplistIterator{sl: sl}
+}
+
+func (it *skiplistIterator) valid() bool     { return it.node != nil }
+func (it *skiplistIterator) key() string     { return it.node.key }
+func (it *skiplistIterator) value() entry    { return it.node.value }
+func (it *skiplistIterator) next()           { it.node = it.node.next() }
+func (it *skiplistIterator) seek(key string) { it.node = it.sl.seek(key) }
+func (it *skiplistIterator) err() error      { return nil }
+
+// mergeIterator merges several iterators into one ordered stream.
+// Sources are ordered from newest to oldest, when a key shows up in several sources the newest one wins.
+type mergeIterator struct {
+	sources []iterator
+	k       string
+	v       entry
+	ok      bool
+}
+
+func newMergeIterator(sources []iterator) *mergeIterator {
+	return &mergeIterator{sources: sources}
+}
+
+func (it *mergeIterator) advance() {
+	winner := -1
+	for i, source := range it.sources {
+		if !source.valid() {
+			continue
+		}
+		if winner == -1 || source.key() < it.sources[winner].key() {
+			winner = i
+		}
+	}
+	if winner == -1 {
+		it.ok = false
+		return
+	}
+
+	it.k = it.sources[winner].key()
+	it.v = it.sources[winner].value()
+	it.ok = true
+
+	// Skip the older copies of the same key
+	for _, source := range it.sources {
+		if source.valid() && source.key() == it.k {
+			source.next()
+		}
+	}
+}
+
+func (it *mergeIterator) seek(key string) {
+	for _, source := range it.sources {
+		source.seek(key)
+	}
+	it.advance()
+}
+
+func (it *mergeIterator) next()        { it.advance() }
+func (it *mergeIterator) valid() bool  { return it.ok }
+func (it *mergeIterator) key() string  { return it.k }
+func (it *mergeIterator) value() entry { return it.v }
+
+func (it *mergeIterator) err() error {
+	for _, source := range it.sources {
+		if err := source.err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package engine
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const recordDeleted byte = 1 << 0
+
+var errCorruptRecord = errors.New("corrupt record")
+
+// appendRecord encodes a key and its entry the way it is laid out in SSTables and the memtable log:
+// key length, key, the newest version, the history length and the older versions.
+func appendRecord(buf []byte, key string, e entry) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(key)))
+	buf = append(buf, key...)
+
+	buf = appendVersion(buf, e)
+	buf = binary.AppendUvarint(buf, uint64(len(e.history)))
+	for _, h := range e.history {
+		buf = appendVersion(buf, h)
+	}
+	return buf
+}
+
+// appendVersion encodes a single version: flags, expiry, version, content type, value.
+func appendVersion(buf []byte, e entry) []byte {
+	var flags byte
+	if e.deleted {
+		flags |= recordDeleted
+	}
+	buf = append(buf, flags)
+
+	buf = binary.AppendVarint(buf, e.expiresAt)
+	buf = binary.AppendVarint(buf, int64(e.version))
+	buf = binary.AppendUvarint(buf, uint64(len(e.contentType)))
+	buf = append(buf, e.contentType...)
+	buf = binary.AppendUvarint(buf, uint64(len(e.value)))
+	buf = append(buf, e.value...)
+	return buf
+}
+
+// decodeRecord decodes a single record from the front of buf and returns its encoded length.
+func decodeRecord(buf []byte) (string, entry, int, error) {
+	keyLen, n := binary.Uvarint(buf)
+	if n <= 0 || uint64(len(buf)-n) < keyLen {
+		return "", entry{}, 0, errCorruptRecord
+	}
+	pos := n
+	key := string(buf[pos : pos+int(keyLen)])
+	pos += int(keyLen)
+
+	e, n, err := decodeVersion(buf[pos:])
+	if err != nil {
+		return "", entry{}, 0, err
+	}
+	pos += n
+
+	historyLen, n := binary.Uvarint(buf[pos:])
+	if n <= 0 || historyLen > uint64(len(buf)) {
+		return "", entry{}, 0, errCorruptRecord
+	}
+	pos += n
+	if historyLen > 0 {
+		e.history = make([]entry, 0, historyLen)
+	}
+	for i := uint64(0); i < historyLen; i++ {
+		h, n, err := decodeVersion(buf[pos:])
+		if err != nil {
+			return "", entry{}, 0, err
+		}
+		pos += n
+		e.history = append(e.history, h)
+	}
+
+	return key, e, pos, nil
+}
+
+func decodeVersion(buf []byte) (entry, int, error) {
+	var e entry
+	if len(buf) == 0 {
+		return e, 0, errCorruptRecord
+	}
+	e.deleted = buf[0]&recordDeleted != 0
+	pos := 1
+
+	expiresAt, n := binary.Varint(buf[pos:])
+	if n <= 0 {
+		return e, 0, errCorruptRecord
+	}
+	pos += n
+	e.expiresAt = expiresAt
+
+	version, n := binary.Varint(buf[pos:])
+	if n <= 0 {
+		return e, 0, errCorruptRecord
+	}
+	pos += n
+	e.version = int(version)
+
+	contentTypeLen, n := binary.Uvarint(buf[pos:])
+	if n <= 0 || uint64(len(buf)-pos-n) < contentTypeLen {
+		return e, 0, errCorruptRecord
+	}
+	pos += n
+	e.contentType = string(buf[pos : pos+int(contentTypeLen)])
+	pos += int(contentTypeLen)
+
+	valueLen, n := binary.Uvarint(buf[pos:])
+	if n <= 0 || uint64(len(buf)-pos-n) < valueLen {
+		return e, 0, errCorruptRecord
+	}
+	pos += n
+	// Copy the value out, buf is usually a block that is about to be reused or dropped
+	e.value = append([]byte(nil), buf[pos:pos+int(valueLen)]...)
+	pos += int(valueLen)
+
+	return e, pos, nil
+}
+
+// recordSize is the approximate memory footprint of an entry, used to decide when to flush the memtable
+func recordSize(key string, e entry) int {
+	size := len(key) + len(e.value) + len(e.contentType) + 24
+	for _, h := range e.history {
+		size += len(h.value) + len(h.contentType) + 24
+	}
+	return size
+}
@@ -0,0 +1,154 @@
+package engine
+
+import "math/rand"
+
+const (
+	skiplistMaxLevel = 16
+	skiplistP        = 0.25
+)
+
+type skiplistNode struct {
+	key     string
+	value   entry
+	forward []*skiplistNode
+}
+
+// next returns the following node in key order, or nil at the end of the list
+func (n *skiplistNode) next() *skiplistNode {
+	return n.forward[0]
+}
+
+// skiplist is an ordered map from keys to entries.
+// It is not safe for concurrent use, callers must hold the owning shard's lock.
+type skiplist struct {
+	head   *skiplistNode
+	level  int
+	length int
+}
+
+func newSkiplist() *skiplist {
+	return &skiplist{
+		head:  &skiplistNode{forward: make([]*skiplistNode, skiplistMaxLevel)},
+		level: 1,
+	}
+}
+
+func randomLevel() int {
+	level := 1
+	for level < skiplistMaxLevel && rand.Float64() < skiplistP {
+		level++
+	}
+	return level
+}
+
+// findPredecessors fills update with the rightmost node before key on every level
+func (sl *skiplist) findPredecessors(key string, update []*skiplistNode) *skiplistNode {
+	x := sl.head
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.forward[i] != nil && x.forward[i].key < key {
+			x = x.forward[i]
+		}
+		if update != nil {
+			update[i] = x
+		}
+	}
+	return x.forward[0]
+}
+
+func (sl *skiplist) get(key string) (entry, bool) {
+	x := sl.findPredecessors(key, nil)
+	if x != nil && x.key == key {
+		return x.value, true
+	}
+	return entry{}, false
+}
+
+func (sl *skiplist) set(key string, value entry) {
+	update := make([]*skiplistNode, skiplistMaxLevel)
+	x := sl.findPredecessors(key, update)
+	if x != nil && x.key == key {
+		x.value = value
+		return
+	}
+
+	level := randomLevel()
+	if level > sl.level {
+		for i := sl.level; i < level; i++ {
+			update[i] = sl.head
+		}
+		sl.level = level
+	}
+
+	node := &skiplistNode{key: key, value: value, forward: make([]*skiplistNode, level)}
+	for i := 0; i < level; i++ {
+		node.forward[i] = update[i].forward[i]
+		update[i].forward[i] = node
+	}
+	sl.length++
+}
+
+func (sl *skiplist) remove(key string) bool {
+	update := make([]*skiplistNode, skiplistMaxLevel)
+	x := sl.findPredecessors(key, update)
+	if x == nil || x.key != key {
+		return false
+	}
+
+	for i := 0; i < sl.level; i++ {
+		if update[i].forward[i] != x {
+			break
+		}
+		update[i].forward[i] = x.forward[i]
+	}
+	for sl.level > 1 && sl.head.forward[sl.level-1] == nil {
+		sl.level--
+	}
+	sl.length--
+	return true
+}
+
+// seek returns the first node whose key is >= key
+func (sl *skiplist) seek(key string) *skiplistNode {
+	return sl.findPredecessors(key, nil)
+}
+
+// first returns the smallest node, or nil if the list is empty
+func (sl *skiplist) first() *skiplistNode {
+	return sl.head.forward[0]
+}
+
+func (sl *skiplist) len() int {
+	return sl.length
+}
+
+// OrderedMap is an ordered map from strings to strings on top of the engines' skiplist,
+// the store's secondary indexes keep their entries in one.
+// It is not safe for concurrent use.
+type OrderedMap struct {
+	sl *skiplist
+}
+
+func NewOrderedMap() *OrderedMap {
+	return &OrderedMap{sl: newSkiplist()}
+}
+
+func (m *OrderedMap) Set(key string, value string) {
+	m.sl.set(key, entry{value: []byte(value)})
+}
+
+func (m *OrderedMap) Remove(key string) {
+	m.sl.remove(key)
+}
+
+// Range calls fn on the keys in [start, end) in ascending order until it returns false.
+// An empty end means the range runs to the last key.
+func (m *OrderedMap) Range(start string, end string, fn func(key string, value string) bool) {
+	for node := m.sl.seek(start); node != nil; node = node.next() {
+		if end != "" && node.key >= end {
+			return
+		}
+		if !fn(node.key, string(node.value.value)) {
+			return
+		}
+	}
+}
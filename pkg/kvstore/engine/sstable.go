@@ -0,0 +1,356 @@
+package engine
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	sstableMagic = uint64(0x6b7673746f726531)
+	// A sparse index entry is kept for every indexInterval records
+	indexInterval   = 16
+	bloomBitsPerKey = 10
+	footerSize      = 32
+)
+
+var errCorruptTable = errors.New("corrupt sstable")
+
+type indexEntry struct {
+	key    string
+	offset int64
+}
+
+// sstable is an immutable, sorted file of records.
+//
+// Layout: data records | sparse index | bloom filter | footer
+// The footer holds the index offset, the bloom filter offset, the record count and a magic number.
+type sstable struct {
+	id       int
+	path     string
+	file     *os.File
+	index    []indexEntry
+	bloom    *bloomFilter
+	dataEnd  int64
+	smallest string
+	largest  string
+	size     int64
+	count    int
+}
+
+func sstablePath(dir string, id int) string {
+	return filepath.Join(dir, fmt.Sprintf("%06d.sst", id))
+}
+
+// tableWriter streams sorted records into a new SSTable file
+type tableWriter struct {
+	file    *os.File
+	w       *bufio.Writer
+	offset  int64
+	index   []indexEntry
+	keys    []string
+	largest string
+	buf     []byte
+}
+
+func newTableWriter(path string) (*tableWriter, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &tableWriter{
+		file: file,
+		w:    bufio.NewWriter(file),
+	}, nil
+}
+
+// add appends a record, keys must be added in ascending order
+func (tw *tableWriter) add(key string, e entry) error {
+	if len(tw.keys)%indexInterval == 0 {
+		tw.index = append(tw.index, indexEntry{key: key, offset: tw.offset})
+	}
+	tw.keys = append(tw.keys, key)
+	tw.largest = key
+
+	tw.buf = appendRecord(tw.buf[:0], key, e)
+	n, err := tw.w.Write(tw.buf)
+	tw.offset += int64(n)
+	return err
+}
+
+func (tw *tableWriter) finish() error {
+	indexOffset := tw.offset
+
+	// Sparse index followed by the largest key in the table
+	var buf []byte
+	buf = binary.AppendUvarint(buf, uint64(len(tw.index)))
+	for _, ie := range tw.index {
+		buf = binary.AppendUvarint(buf, uint64(len(ie.key)))
+		buf = append(buf, ie.key...)
+		buf = binary.AppendUvarint(buf, uint64(ie.offset))
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(tw.largest)))
+	buf = append(buf, tw.largest...)
+	bloomOffset := indexOffset + int64(len(buf))
+
+	bloom := newBloomFilter(len(tw.keys), bloomBitsPerKey)
+	for _, key := range tw.keys {
+		bloom.add(key)
+	}
+	buf = append(buf, bloom.encode()...)
+
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(indexOffset))
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(bloomOffset))
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(len(tw.keys)))
+	buf = binary.LittleEndian.AppendUint64(buf, sstableMagic)
+
+	if _, err := tw.w.Write(buf); err != nil {
+		tw.file.Close()
+		return err
+	}
+	if err := tw.w.Flush(); err != nil {
+		tw.file.Close()
+		return err
+	}
+	if err := tw.file.Sync(); err != nil {
+		tw.file.Close()
+		return err
+	}
+	return tw.file.Close()
+}
+
+// abort discards a partially written table
+func (tw *tableWriter) abort() {
+	tw.file.Close()
+	os.Remove(tw.file.Name())
+}
+
+func openSSTable(dir string, id int) (*sstable, error) {
+	path := sstablePath(dir, id)
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := loadSSTable(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	t.id = id
+	t.path = path
+	return t, nil
+}
+
+func loadSSTable(file *os.File) (*sstable, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+	if size < footerSize {
+		return nil, errCorruptTable
+	}
+
+	footer := make([]byte, footerSize)
+	if _, err := file.ReadAt(footer, size-footerSize); err != nil {
+		return nil, err
+	}
+	indexOffset := int64(binary.LittleEndian.Uint64(footer[0:]))
+	bloomOffset := int64(binary.LittleEndian.Uint64(footer[8:]))
+	count := int(binary.LittleEndian.Uint64(footer[16:]))
+	if binary.LittleEndian.Uint64(footer[24:]) != sstableMagic ||
+		indexOffset > bloomOffset || bloomOffset > size-footerSize {
+		return nil, errCorruptTable
+	}
+
+	meta := make([]byte, size-footerSize-indexOffset)
+	if _, err := file.ReadAt(meta, indexOffset); err != nil {
+		return nil, err
+	}
+	indexData := meta[:bloomOffset-indexOffset]
+	bloomData := meta[bloomOffset-indexOffset:]
+
+	t := &sstable{
+		file:    file,
+		dataEnd: indexOffset,
+		size:    size,
+		count:   count,
+	}
+
+	readString := func() (string, bool) {
+		length, n := binary.Uvarint(indexData)
+		if n <= 0 || uint64(len(indexData)-n) < length {
+			return "", false
+		}
+		s := string(indexData[n : n+int(length)])
+		indexData = indexData[n+int(length):]
+		return s, true
+	}
+
+	entries, n := binary.Uvarint(indexData)
+	if n <= 0 {
+		return nil, errCorruptTable
+	}
+	indexData = indexData[n:]
+	t.index = make([]indexEntry, 0, entries)
+	for i := uint64(0); i < entries; i++ {
+		key, ok := readString()
+		if !ok {
+			return nil, errCorruptTable
+		}
+		offset, n := binary.Uvarint(indexData)
+		if n <= 0 {
+			return nil, errCorruptTable
+		}
+		indexData = indexData[n:]
+		t.index = append(t.index, indexEntry{key: key, offset: int64(offset)})
+	}
+	largest, ok := readString()
+	if !ok {
+		return nil, errCorruptTable
+	}
+	t.largest = largest
+	if len(t.index) > 0 {
+		t.smallest = t.index[0].key
+	}
+
+	t.bloom, err = decodeBloomFilter(bloomData)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *sstable) close() error {
+	return t.file.Close()
+}
+
+// overlaps reports whether the table may hold keys in [start, end]
+func (t *sstable) overlaps(start string, end string) bool {
+	if t.count == 0 {
+		return false
+	}
+	return t.largest >= start && (end == "" || t.smallest <= end)
+}
+
+// blockFor returns the index of the block that may contain key
+func (t *sstable) blockFor(key string) int {
+	i := sort.Search(len(t.index), func(i int) bool {
+		return t.index[i].key > key
+	})
+	if i == 0 {
+		return 0
+	}
+	return i - 1
+}
+
+func (t *sstable) readBlock(block int) ([]byte, error) {
+	start := t.index[block].offset
+	end := t.dataEnd
+	if block+1 < len(t.index) {
+		end = t.index[block+1].offset
+	}
+	buf := make([]byte, end-start)
+	if _, err := t.file.ReadAt(buf, start); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (t *sstable) get(key string) (entry, bool, error) {
+	if t.count == 0 || key < t.smallest || key > t.largest || !t.bloom.mayContain(key) {
+		return entry{}, false, nil
+	}
+
+	buf, err := t.readBlock(t.blockFor(key))
+	if err != nil {
+		return entry{}, false, err
+	}
+	for len(buf) > 0 {
+		k, e, n, err := decodeRecord(buf)
+		if err != nil {
+			return entry{}, false, err
+		}
+		if k == key {
+			return e, true, nil
+		}
+		if k > key {
+			break
+		}
+		buf = buf[n:]
+	}
+	return entry{}, false, nil
+}
+
+// tableIterator walks the records of an SSTable in key order, one block at a time
+type tableIterator struct {
+	t       *sstable
+	block   int
+	buf     []byte
+	k       string
+	v       entry
+	ok      bool
+	failure error
+}
+
+func (t *sstable) iterator() *tableIterator {
+	return &tableIterator{t: t, block: -1}
+}
+
+func (it *tableIterator) loadBlock(block int) bool {
+	if block >= len(it.t.index) {
+		it.ok = false
+		return false
+	}
+	buf, err := it.t.readBlock(block)
+	if err != nil {
+		it.failure = err
+		it.ok = false
+		return false
+	}
+	it.block = block
+	it.buf = buf
+	return true
+}
+
+func (it *tableIterator) next() {
+	for len(it.buf) == 0 {
+		if !it.loadBlock(it.block + 1) {
+			return
+		}
+	}
+	key, value, n, err := decodeRecord(it.buf)
+	if err != nil {
+		it.failure = err
+		it.ok = false
+		return
+	}
+	it.buf = it.buf[n:]
+	it.k = key
+	it.v = value
+	it.ok = true
+}
+
+func (it *tableIterator) seek(key string) {
+	if len(it.t.index) == 0 {
+		it.ok = false
+		return
+	}
+	if !it.loadBlock(it.t.blockFor(key)) {
+		return
+	}
+	it.next()
+	for it.ok && it.k < key {
+		it.next()
+	}
+}
+
+func (it *tableIterator) valid() bool  { return it.ok }
+func (it *tableIterator) key() string  { return it.k }
+func (it *tableIterator) value() entry { return it.v }
+func (it *tableIterator) err() error   { return it.failure }
@@ -0,0 +1,393 @@
+// Package kvstoretest is the conformance suite of engine.IKVStore.
+// An engine runs it from one of its own tests:
+//
+//	func TestConformance(t *testing.T) {
+//		kvstoretest.Run(t, func(t *testing.T) engine.IKVStore {
+//			return NewMyStore(t.TempDir())
+//		})
+//	}
+package kvstoretest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"kvstore/pkg/kvstore/engine"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Run checks that the engines returned by newStore behave like an IKVStore.
+// Every subtest opens a fresh, empty store and closes it when done.
+func Run(t *testing.T, newStore func(t *testing.T) engine.IKVStore) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, s engine.IKVStore)
+	}{
+		{"MissingKey", testMissingKey},
+		{"PutGet", testPutGet},
+		{"Overwrite", testOverwrite},
+		{"LateWrite", testLateWrite},
+		{"Delete", testDelete},
+		{"ValuesAreCopied", testValuesAreCopied},
+		{"TTL", testTTL},
+		{"WriteBatch", testWriteBatch},
+		{"Scan", testScan},
+		{"PruneVersions", testPruneVersions},
+		{"LargeValues", testLargeValues},
+		{"Concurrency", testConcurrency},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newStore(t)
+			tt.fn(t, s)
+			if err := s.Close(); err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+		})
+	}
+}
+
+func expectMissing(t *testing.T, s engine.IKVStore, key string) {
+	t.Helper()
+	if value, err := s.Get(key); !errors.Is(err, engine.ErrKeyNotFound) {
+		t.Fatalf("Get(%s) = %q, %v; want ErrKeyNotFound", key, value, err)
+	}
+	if current, found, err := s.GetVersioned(key); err != nil || found {
+		t.Fatalf("GetVersioned(%s) = %+v, %v, %v; want not found", key, current, found, err)
+	}
+}
+
+func expectValue(t *testing.T, s engine.IKVStore, key string, want string, wantVersion int) {
+	t.Helper()
+	value, err := s.Get(key)
+	if err != nil || string(value) != want {
+		t.Fatalf("Get(%s) = %q, %v; want %q", key, value, err, want)
+	}
+	current, found, err := s.GetVersioned(key)
+	if err != nil || !found || string(current.Value) != want || current.Version != wantVersion {
+		t.Fatalf("GetVersioned(%s) = %+v, %v, %v; want %q at version %d", key, current, found, err, want, wantVersion)
+	}
+}
+
+// expectValueAt checks a read as of version, an empty want means the key did not exist then
+func expectValueAt(t *testing.T, s engine.IKVStore, key string, version int, want string) {
+	t.Helper()
+	current, err := s.GetAt(key, version)
+	if want == "" {
+		if !errors.Is(err, engine.ErrKeyNotFound) {
+			t.Fatalf("GetAt(%s, %d) = %q, %v; want ErrKeyNotFound", key, version, current.Value, err)
+		}
+		return
+	}
+	if err != nil || string(current.Value) != want || current.Version > version {
+		t.Fatalf("GetAt(%s, %d) = %+v, %v; want %q", key, version, current, err, want)
+	}
+}
+
+func expectKeys(t *testing.T, pairs []engine.KVPair, err error, want ...string) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("scan failed: %v", err)
+	}
+	keys := make([]string, len(pairs))
+	for i, pair := range pairs {
+		keys[i] = pair.Key
+	}
+	if fmt.Sprint(keys) != fmt.Sprint(want) {
+		t.Fatalf("scan returned %v; want %v", keys, want)
+	}
+}
+
+func testMissingKey(t *testing.T, s engine.IKVStore) {
+	expectMissing(t, s, "missing")
+	expectValueAt(t, s, "missing", 10, "")
+	pairs, err := s.ScanPrefix("")
+	expectKeys(t, pairs, err)
+	// Deleting a key that never existed is not an error and does not create it
+	if err := s.Delete("missing", 1); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	expectMissing(t, s, "missing")
+
+	// An empty value is a value, it is not the same as a missing key
+	if err := s.Put("empty", []byte{}, "", 2); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if current, found, err := s.GetVersioned("empty"); err != nil || !found || len(current.Value) != 0 {
+		t.Fatalf("GetVersioned(empty) = %+v, %v, %v; want an empty value", current, found, err)
+	}
+	if value, err := s.Get("empty"); err != nil || len(value) != 0 {
+		t.Fatalf("Get(empty) = %q, %v; want an empty value", value, err)
+	}
+}
+
+func testPutGet(t *testing.T, s engine.IKVStore) {
+	if err := s.Put("a", []byte("1"), "text/plain", 1); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	expectValue(t, s, "a", "1", 1)
+	current, _, _ := s.GetVersioned("a")
+	if current.ContentType != "text/plain" || current.ExpiresAt != 0 {
+		t.Fatalf("GetVersioned(a) = %+v; want content type text/plain and no expiry", current)
+	}
+	expectMissing(t, s, "b")
+}
+
+func testOverwrite(t *testing.T, s engine.IKVStore) {
+	for version, value := range []string{"v0", "v1", "v2"} {
+		if err := s.Put("k", []byte(value), "", version+1); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	expectValue(t, s, "k", "v2", 3)
+	// Older versions stay readable until they are pruned
+	expectValueAt(t, s, "k", 1, "v0")
+	expectValueAt(t, s, "k", 2, "v1")
+	expectValueAt(t, s, "k", 100, "v2")
+	expectValueAt(t, s, "k", 0, "")
+
+	// The content type belongs to the version
+	if err := s.Put("k", []byte("bin"), "application/octet-stream", 4); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if current, _, _ := s.GetVersioned("k"); current.ContentType != "application/octet-stream" {
+		t.Fatalf("content type after overwrite = %q; want application/octet-stream", current.ContentType)
+	}
+}
+
+// testLateWrite writes versions out of order, as a follower may receive them, the newest version has to win
+func testLateWrite(t *testing.T, s engine.IKVStore) {
+	s.Put("k", []byte("v1"), "", 1)
+	s.Put("k", []byte("v3"), "", 3)
+	s.Put("k", []byte("v2"), "", 2)
+	expectValue(t, s, "k", "v3", 3)
+	expectValueAt(t, s, "k", 2, "v2")
+	expectValueAt(t, s, "k", 1, "v1")
+
+	// A late tombstone does not delete the newer value
+	s.Delete("k", 2)
+	expectValue(t, s, "k", "v3", 3)
+	expectValueAt(t, s, "k", 2, "")
+
+	s.Put("gone", []byte("v1"), "", 1)
+	s.Delete("gone", 3)
+	s.Put("gone", []byte("v2"), "", 2)
+	expectMissing(t, s, "gone")
+	expectValueAt(t, s, "gone", 2, "v2")
+
+	if err := s.WriteBatch([]engine.BatchOp{{Key: "k", Value: []byte("batch"), Version: 1}}); err != nil {
+		t.Fatalf("WriteBatch failed: %v", err)
+	}
+	expectValue(t, s, "k", "v3", 3)
+	expectValueAt(t, s, "k", 1, "batch")
+}
+
+func testDelete(t *testing.T, s engine.IKVStore) {
+	s.Put("a", []byte("1"), "", 1)
+	s.Put("b", []byte("2"), "", 2)
+	if err := s.Delete("a", 3); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+
+	expectMissing(t, s, "a")
+	expectValue(t, s, "b", "2", 2)
+	expectValueAt(t, s, "a", 2, "1")
+	expectValueAt(t, s, "a", 3, "")
+	pairs, err := s.ScanPrefix("")
+	expectKeys(t, pairs, err, "b")
+
+	// A deleted key can be written again
+	s.Put("a", []byte("3"), "", 4)
+	expectValue(t, s, "a", "3", 4)
+}
+
+func testValuesAreCopied(t *testing.T, s engine.IKVStore) {
+	value := []byte("original")
+	s.Put("k", value, "", 1)
+	copy(value, "modified")
+	expectValue(t, s, "k", "original", 1)
+
+	batch := []engine.BatchOp{{Key: "b", Value: []byte("original"), Version: 2}}
+	s.WriteBatch(batch)
+	copy(batch[0].Value, "modified")
+	expectValue(t, s, "b", "original", 2)
+}
+
+func testTTL(t *testing.T, s engine.IKVStore) {
+	now := time.Now()
+	s.PutWithTTL("expired", []byte("v"), "", 1, now.Add(-time.Second))
+	s.PutWithTTL("live", []byte("v"), "", 2, now.Add(time.Hour))
+
+	expectMissing(t, s, "expired")
+	expectValue(t, s, "live", "v", 2)
+	if current, _, _ := s.GetVersioned("live"); current.ExpiresAt != now.Add(time.Hour).UnixNano() {
+		t.Fatalf("ExpiresAt = %d; want %d", current.ExpiresAt, now.Add(time.Hour).UnixNano())
+	}
+	pairs, err := s.ScanPrefix("")
+	expectKeys(t, pairs, err, "live")
+
+	// Once the deadline passes the key is gone, the sweep only reclaims it
+	s.DeleteExpired(now.Add(2 * time.Hour))
+	expectMissing(t, s, "expired")
+	if removed := s.DeleteExpired(now); len(removed) != 0 {
+		t.Fatalf("DeleteExpired(now) removed %q again; want nothing", removed)
+	}
+}
+
+func testWriteBatch(t *testing.T, s engine.IKVStore) {
+	s.Put("gone", []byte("v"), "", 1)
+	err := s.WriteBatch([]engine.BatchOp{
+		{Key: "a", Value: []byte("1"), Version: 2},
+		{Key: "b", Value: []byte("2"), ContentType: "text/plain", Version: 2, ExpiresAt: time.Now().Add(time.Hour)},
+		{Key: "gone", Version: 2, Delete: true},
+	})
+	if err != nil {
+		t.Fatalf("WriteBatch failed: %v", err)
+	}
+	expectValue(t, s, "a", "1", 2)
+	expectValue(t, s, "b", "2", 2)
+	expectMissing(t, s, "gone")
+	expectValueAt(t, s, "gone", 1, "v")
+}
+
+func testScan(t *testing.T, s engine.IKVStore) {
+	for i, key := range []string{"b/2", "a/1", "b/1", "c", "b/3"} {
+		s.Put(key, []byte(key), "", i+1)
+	}
+	s.Delete("b/3", 6)
+
+	pairs, err := s.Scan("", "", 0)
+	expectKeys(t, pairs, err, "a/1", "b/1", "b/2", "c")
+	pairs, err = s.Scan("b/", "c", 0)
+	expectKeys(t, pairs, err, "b/1", "b/2")
+	pairs, err = s.Scan("a", "", 2)
+	expectKeys(t, pairs, err, "a/1", "b/1")
+	pairs, err = s.ScanPrefix("b/")
+	expectKeys(t, pairs, err, "b/1", "b/2")
+	if string(pairs[0].Value) != "b/1" {
+		t.Fatalf("scan value of b/1 = %q", pairs[0].Value)
+	}
+
+	// As of version 5 b/3 still exists and c, written at 4, is visible; as of 3 neither c nor b/3 is
+	pairs, err = s.ScanAt("b/", "", 5, time.Now(), 0)
+	expectKeys(t, pairs, err, "b/1", "b/2", "b/3", "c")
+	pairs, err = s.ScanAt("", "", 3, time.Now(), 0)
+	expectKeys(t, pairs, err, "a/1", "b/1", "b/2")
+}
+
+func testPruneVersions(t *testing.T, s engine.IKVStore) {
+	for version := 1; version <= 5; version++ {
+		s.Put("k", []byte(fmt.Sprint(version)), "", version)
+	}
+	s.Put("deleted", []byte("v"), "", 2)
+	s.Delete("deleted", 3)
+
+	s.PruneVersions(4)
+	// Everything at or after the horizon reads the same as before
+	expectValueAt(t, s, "k", 4, "4")
+	expectValueAt(t, s, "k", 5, "5")
+	expectValue(t, s, "k", "5", 5)
+	expectMissing(t, s, "deleted")
+	expectValueAt(t, s, "deleted", 4, "")
+}
+
+func testLargeValues(t *testing.T, s engine.IKVStore) {
+	sizes := []int{0, 1, 4 << 10, 1 << 20, 8 << 20}
+	values := make([][]byte, len(sizes))
+	for i, size := range sizes {
+		values[i] = bytes.Repeat([]byte{byte('a' + i)}, size)
+		// Every byte value has to survive, not only text
+		for j := 0; j < size && j < 256; j++ {
+			values[i][j] = byte(j)
+		}
+		if err := s.Put(fmt.Sprintf("large-%d", i), values[i], "application/octet-stream", i+1); err != nil {
+			t.Fatalf("Put of %d bytes failed: %v", size, err)
+		}
+	}
+	for i, want := range values {
+		key := fmt.Sprintf("large-%d", i)
+		current, found, err := s.GetVersioned(key)
+		if err != nil || !found || !bytes.Equal(current.Value, want) {
+			t.Fatalf("GetVersioned(%s) returned %d bytes, %v, %v; want %d bytes back", key, len(current.Value), found, err, len(want))
+		}
+	}
+
+	// Many keys, in and out of order
+	for i := 0; i < 5000; i++ {
+		s.Put(fmt.Sprintf("many-%05d", (i*7919)%5000), []byte("v"), "", 100+i)
+	}
+	pairs, err := s.ScanPrefix("many-")
+	if err != nil || len(pairs) != 5000 {
+		t.Fatalf("ScanPrefix(many-) returned %d keys, %v; want 5000", len(pairs), err)
+	}
+	for i := 1; i < len(pairs); i++ {
+		if pairs[i-1].Key >= pairs[i].Key {
+			t.Fatalf("scan is not ordered: %s before %s", pairs[i-1].Key, pairs[i].Key)
+		}
+	}
+}
+
+func testConcurrency(t *testing.T, s engine.IKVStore) {
+	const goroutines = 16
+	const keysPerGoroutine = 200
+
+	var version struct {
+		sync.Mutex
+		next int
+	}
+	nextVersion := func() int {
+		version.Lock()
+		defer version.Unlock()
+		version.next++
+		return version.next
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(goroutines)
+	for g := 0; g < goroutines; g++ {
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < keysPerGoroutine; i++ {
+				// Every goroutine hits a shared key as well as its own keys
+				own := fmt.Sprintf("key-%02d-%03d", g, i)
+				shared := fmt.Sprintf("shared-%d", i%16)
+
+				if err := s.Put(own, []byte(own), "", nextVersion()); err != nil {
+					t.Errorf("Put(%s) failed: %v", own, err)
+					return
+				}
+				if err := s.Put(shared, []byte(own), "", nextVersion()); err != nil {
+					t.Errorf("Put(%s) failed: %v", shared, err)
+					return
+				}
+				if value, _ := s.Get(own); string(value) != own {
+					t.Errorf("Get(%s) = %q; want %q", own, value, own)
+					return
+				}
+				s.Get(shared)
+				if i%10 == 0 {
+					s.ScanPrefix("shared-")
+				}
+				if i%2 == 0 {
+					s.Delete(own, nextVersion())
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	for g := 0; g < goroutines; g++ {
+		for i := 0; i < keysPerGoroutine; i++ {
+			key := fmt.Sprintf("key-%02d-%03d", g, i)
+			value, _ := s.Get(key)
+			if i%2 == 0 && value != nil {
+				t.Fatalf("Get(%s) = %q; want deleted", key, value)
+			}
+			if i%2 == 1 && string(value) != key {
+				t.Fatalf("Get(%s) = %q; want %q", key, value, key)
+			}
+		}
+	}
+}
@@ -21,8 +21,12 @@ func ExtractBody(r *http.Request, v interface{}) error {
 }
 
 func WriteJSON(rw http.ResponseWriter, v interface{}) error {
+	return WriteJSONWithStatus(rw, http.StatusOK, v)
+}
+
+func WriteJSONWithStatus(rw http.ResponseWriter, status int, v interface{}) error {
 	rw.Header().Set("Content-Type", "application/json")
-	rw.WriteHeader(http.StatusOK)
+	rw.WriteHeader(status)
 	body, err := json.Marshal(v)
 	if err != nil {
 		return err
@@ -0,0 +1,175 @@
+package utils
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Minimal server side of RFC 6455: the handshake, unfragmented text frames out, and control frames in.
+
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	wsOpText  = 0x1
+	wsOpClose = 0x8
+	wsOpPing  = 0x9
+	wsOpPong  = 0xA
+)
+
+// maxWebSocketFrame bounds the frames a client may send, the server only expects control frames
+const maxWebSocketFrame = 64 << 10
+
+// webSocketWriteTimeout is how long a frame may take to write, a client that stops reading is disconnected
+const webSocketWriteTimeout = 10 * time.Second
+
+var ErrBadWebSocketHandshake = errors.New("not a websocket handshake")
+
+type WebSocketConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	// writeMu keeps the frames written by the sender and the pong replies from interleaving
+	writeMu sync.Mutex
+}
+
+func headerContains(r *http.Request, name string, token string) bool {
+	for _, value := range strings.Split(r.Header.Get(name), ",") {
+		if strings.EqualFold(strings.TrimSpace(value), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// UpgradeWebSocket completes the opening handshake and takes over the connection.
+// Nothing is written to rw when ErrBadWebSocketHandshake is returned.
+func UpgradeWebSocket(rw http.ResponseWriter, r *http.Request) (*WebSocketConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || key == "" ||
+		!headerContains(r, "Connection", "upgrade") || !headerContains(r, "Upgrade", "websocket") ||
+		r.Header.Get("Sec-WebSocket-Version") != "13" {
+		return nil, ErrBadWebSocketHandshake
+	}
+	hijacker, ok := rw.(http.Hijacker)
+	if !ok {
+		return nil, errors.New("connection cannot be taken over")
+	}
+	conn, buffered, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	_, err = fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+		base64.StdEncoding.EncodeToString(sum[:]))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &WebSocketConn{conn: conn, reader: buffered.Reader}, nil
+}
+
+func (ws *WebSocketConn) writeFrame(opcode byte, payload []byte) error {
+	ws.writeMu.Lock()
+	defer ws.writeMu.Unlock()
+
+	// Server frames are never masked
+	header := []byte{0x80 | opcode}
+	switch {
+	case len(payload) < 126:
+		header = append(header, byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		header = append(header, 126)
+		header = binary.BigEndian.AppendUint16(header, uint16(len(payload)))
+	default:
+		header = append(header, 127)
+		header = binary.BigEndian.AppendUint64(header, uint64(len(payload)))
+	}
+	if err := ws.conn.SetWriteDeadline(time.Now().Add(webSocketWriteTimeout)); err != nil {
+		return err
+	}
+	if _, err := ws.conn.Write(append(header, payload...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// WriteText sends a text message
+func (ws *WebSocketConn) WriteText(payload []byte) error {
+	return ws.writeFrame(wsOpText, payload)
+}
+
+// ReadMessage returns the next data frame of the client. Pings are answered on the way.
+// io.EOF is returned once the client closed the connection.
+func (ws *WebSocketConn) ReadMessage() ([]byte, error) {
+	for {
+		var head [2]byte
+		if _, err := io.ReadFull(ws.reader, head[:]); err != nil {
+			return nil, err
+		}
+		opcode := head[0] & 0x0F
+		if head[1]&0x80 == 0 {
+			return nil, errors.New("client frame is not masked")
+		}
+
+		length := uint64(head[1] & 0x7F)
+		switch length {
+		case 126:
+			var ext [2]byte
+			if _, err := io.ReadFull(ws.reader, ext[:]); err != nil {
+				return nil, err
+			}
+			length = uint64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			if _, err := io.ReadFull(ws.reader, ext[:]); err != nil {
+				return nil, err
+			}
+			length = binary.BigEndian.Uint64(ext[:])
+		}
+		if length > maxWebSocketFrame {
+			return nil, fmt.Errorf("client frame of %d bytes is too large", length)
+		}
+
+		var mask [4]byte
+		if _, err := io.ReadFull(ws.reader, mask[:]); err != nil {
+			return nil, err
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(ws.reader, payload); err != nil {
+			return nil, err
+		}
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+
+		switch opcode {
+		case wsOpPing:
+			if err := ws.writeFrame(wsOpPong, payload); err != nil {
+				return nil, err
+			}
+		case wsOpPong:
+		case wsOpClose:
+			// Echo the close frame to finish the closing handshake
+			ws.writeFrame(wsOpClose, payload)
+			return nil, io.EOF
+		default:
+			return payload, nil
+		}
+	}
+}
+
+// Close sends a normal closure frame and closes the connection
+func (ws *WebSocketConn) Close() error {
+	ws.writeFrame(wsOpClose, []byte{0x03, 0xE8})
+	return ws.conn.Close()
+}